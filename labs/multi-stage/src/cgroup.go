@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupInfo locates the cgroup files that describe this container. With
+// cgroup v2 every controller lives in one directory; with v1 each
+// controller has its own hierarchy.
+type cgroupInfo struct {
+	Version int    `json:"version"`
+	CPUDir  string `json:"cpu_dir,omitempty"`
+	MemDir  string `json:"memory_dir,omitempty"`
+}
+
+const cgroupMount = "/sys/fs/cgroup"
+
+// detectCgroup finds the process's cgroup. CGROUP_ROOT overrides the
+// detection for hosts with unusual mounts.
+func detectCgroup() cgroupInfo {
+	if dir := os.Getenv("CGROUP_ROOT"); dir != "" {
+		return cgroupInfo{Version: 2, CPUDir: dir, MemDir: dir}
+	}
+	if _, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers")); err == nil {
+		dir := cgroupMount
+		if p, ok := procSelfCgroup()[""]; ok {
+			// Without a cgroup namespace the path is relative to the
+			// host root; with one it is "/" and the mount is ours.
+			if candidate := filepath.Join(cgroupMount, p); dirExists(candidate) {
+				dir = candidate
+			}
+		}
+		return cgroupInfo{Version: 2, CPUDir: dir, MemDir: dir}
+	}
+
+	info := cgroupInfo{Version: 1}
+	paths := procSelfCgroup()
+	for _, c := range []struct {
+		controller string
+		dirs       []string
+		dst        *string
+	}{
+		{"cpu", []string{"cpu,cpuacct", "cpu"}, &info.CPUDir},
+		{"memory", []string{"memory"}, &info.MemDir},
+	} {
+		for _, d := range c.dirs {
+			base := filepath.Join(cgroupMount, d)
+			if candidate := filepath.Join(base, paths[c.controller]); paths[c.controller] != "" && dirExists(candidate) {
+				*c.dst = candidate
+				break
+			}
+			if dirExists(base) {
+				*c.dst = base
+				break
+			}
+		}
+	}
+	if info.CPUDir == "" && info.MemDir == "" {
+		return cgroupInfo{}
+	}
+	return info
+}
+
+// procSelfCgroup maps controller names to cgroup paths from
+// /proc/self/cgroup. The v2 unified entry is stored under "".
+func procSelfCgroup() map[string]string {
+	out := make(map[string]string)
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return out
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(sc.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		for _, c := range strings.Split(parts[1], ",") {
+			out[c] = parts[2]
+		}
+	}
+	return out
+}
+
+func dirExists(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// cpuStat holds the cpu.stat counters, normalised to microseconds.
+type cpuStat struct {
+	UsageUsec     uint64 `json:"usage_usec"`
+	NrPeriods     uint64 `json:"nr_periods"`
+	NrThrottled   uint64 `json:"nr_throttled"`
+	ThrottledUsec uint64 `json:"throttled_usec"`
+}
+
+func (cg cgroupInfo) readCPUStat() (cpuStat, error) {
+	if cg.CPUDir == "" {
+		return cpuStat{}, errors.New("no cpu cgroup")
+	}
+	kv, err := readKeyValueFile(filepath.Join(cg.CPUDir, "cpu.stat"))
+	if err != nil {
+		return cpuStat{}, err
+	}
+	st := cpuStat{
+		UsageUsec:     kv["usage_usec"],
+		NrPeriods:     kv["nr_periods"],
+		NrThrottled:   kv["nr_throttled"],
+		ThrottledUsec: kv["throttled_usec"],
+	}
+	if cg.Version == 1 {
+		// v1 reports throttled_time in nanoseconds and keeps usage in
+		// cpuacct.usage, also in nanoseconds.
+		st.ThrottledUsec = kv["throttled_time"] / 1000
+		if usage, err := readUintFile(filepath.Join(cg.CPUDir, "cpuacct.usage")); err == nil {
+			st.UsageUsec = usage / 1000
+		}
+	}
+	return st, nil
+}
+
+// readMemoryCurrent returns the cgroup's charged memory: memory.current on
+// v2, memory.usage_in_bytes on v1.
+func (cg cgroupInfo) readMemoryCurrent() (uint64, error) {
+	if cg.MemDir == "" {
+		return 0, errors.New("no memory cgroup")
+	}
+	name := "memory.current"
+	if cg.Version == 1 {
+		name = "memory.usage_in_bytes"
+	}
+	return readUintFile(filepath.Join(cg.MemDir, name))
+}
+
+// readWorkingSet returns charged memory minus inactive page cache, the
+// figure the kubelet compares against the limit before evicting.
+func (cg cgroupInfo) readWorkingSet() (uint64, error) {
+	usage, err := cg.readMemoryCurrent()
+	if err != nil {
+		return 0, err
+	}
+	kv, err := readKeyValueFile(filepath.Join(cg.MemDir, "memory.stat"))
+	if err != nil {
+		return usage, nil
+	}
+	inactive := kv["inactive_file"]
+	if cg.Version == 1 {
+		inactive = kv["total_inactive_file"]
+	}
+	if inactive > usage {
+		return 0, nil
+	}
+	return usage - inactive, nil
+}
+
+// cgroupLimits are the configured CPU and memory ceilings. Zero means
+// unlimited.
+type cgroupLimits struct {
+	CPUCores    float64 `json:"cpu_cores,omitempty"`
+	MemoryBytes uint64  `json:"memory_bytes,omitempty"`
+}
+
+func (cg cgroupInfo) readLimits() cgroupLimits {
+	var l cgroupLimits
+	if cg.Version == 2 {
+		// cpu.max is "$MAX $PERIOD" with "max" meaning no quota.
+		if data, err := os.ReadFile(filepath.Join(cg.CPUDir, "cpu.max")); err == nil {
+			if f := strings.Fields(string(data)); len(f) == 2 && f[0] != "max" {
+				quota, _ := strconv.ParseFloat(f[0], 64)
+				period, _ := strconv.ParseFloat(f[1], 64)
+				if period > 0 {
+					l.CPUCores = quota / period
+				}
+			}
+		}
+		if v, err := readUintFile(filepath.Join(cg.MemDir, "memory.max")); err == nil {
+			l.MemoryBytes = v
+		}
+		return l
+	}
+	if cg.CPUDir != "" {
+		quota, err1 := os.ReadFile(filepath.Join(cg.CPUDir, "cpu.cfs_quota_us"))
+		period, err2 := readUintFile(filepath.Join(cg.CPUDir, "cpu.cfs_period_us"))
+		if q, err := strconv.ParseInt(strings.TrimSpace(string(quota)), 10, 64); err1 == nil && err2 == nil && err == nil && q > 0 && period > 0 {
+			l.CPUCores = float64(q) / float64(period)
+		}
+	}
+	if cg.MemDir != "" {
+		// v1 reports "unlimited" as a huge page-aligned number.
+		if v, err := readUintFile(filepath.Join(cg.MemDir, "memory.limit_in_bytes")); err == nil && v < 1<<62 {
+			l.MemoryBytes = v
+		}
+	}
+	return l
+}
+
+// memoryEvents holds the memory.events counters. On v1 only OOMKill is
+// available, from memory.oom_control.
+type memoryEvents struct {
+	Low     uint64 `json:"low"`
+	High    uint64 `json:"high"`
+	Max     uint64 `json:"max"`
+	OOM     uint64 `json:"oom"`
+	OOMKill uint64 `json:"oom_kill"`
+}
+
+func (cg cgroupInfo) readMemoryEvents() (memoryEvents, error) {
+	if cg.MemDir == "" {
+		return memoryEvents{}, errors.New("no memory cgroup")
+	}
+	if cg.Version == 1 {
+		kv, err := readKeyValueFile(filepath.Join(cg.MemDir, "memory.oom_control"))
+		if err != nil {
+			return memoryEvents{}, err
+		}
+		return memoryEvents{OOMKill: kv["oom_kill"]}, nil
+	}
+	kv, err := readKeyValueFile(filepath.Join(cg.MemDir, "memory.events"))
+	if err != nil {
+		return memoryEvents{}, err
+	}
+	return memoryEvents{
+		Low:     kv["low"],
+		High:    kv["high"],
+		Max:     kv["max"],
+		OOM:     kv["oom"],
+		OOMKill: kv["oom_kill"],
+	}, nil
+}
+
+// pressure is one line of a PSI file such as cpu.pressure.
+type pressure struct {
+	Avg10  float64 `json:"avg10"`
+	Avg60  float64 `json:"avg60"`
+	Avg300 float64 `json:"avg300"`
+	Total  uint64  `json:"total"`
+}
+
+// readPressure reads the "some" and "full" lines of <resource>.pressure.
+// The cgroup file is preferred; /proc/pressure is the host-wide fallback.
+func (cg cgroupInfo) readPressure(resource string) (some, full pressure, err error) {
+	path := filepath.Join(cg.CPUDir, resource+".pressure")
+	if cg.Version != 2 {
+		path = filepath.Join("/proc/pressure", resource)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return some, full, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var p pressure
+		for _, kv := range fields[1:] {
+			k, v, _ := strings.Cut(kv, "=")
+			switch k {
+			case "avg10":
+				p.Avg10, _ = strconv.ParseFloat(v, 64)
+			case "avg60":
+				p.Avg60, _ = strconv.ParseFloat(v, 64)
+			case "avg300":
+				p.Avg300, _ = strconv.ParseFloat(v, 64)
+			case "total":
+				p.Total, _ = strconv.ParseUint(v, 10, 64)
+			}
+		}
+		switch fields[0] {
+		case "some":
+			some = p
+		case "full":
+			full = p
+		}
+	}
+	return some, full, sc.Err()
+}
+
+// readKeyValueFile parses "key value" lines as found in cpu.stat and
+// memory.events.
+func readKeyValueFile(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	out := make(map[string]uint64)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, fields[0], err)
+		}
+		out[fields[0]] = v
+	}
+	return out, sc.Err()
+}
+
+func readUintFile(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
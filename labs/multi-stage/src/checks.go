@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// routeCheck is a request the server is expected to answer. The list is
+// the traffic used to exercise the binary from the inside, for example
+// while recording its syscalls.
+type routeCheck struct {
+	Method string
+	Path   string
+	// Status lists acceptable response codes. Optional features answer
+	// 404 when they are off, which still exercises the handler.
+	Status []int
+}
+
+// routeChecks is the traffic the service exists to serve. The load
+// generator cycles through it, so it stays free of diagnostics.
+var routeChecks = []routeCheck{
+	{http.MethodGet, "/", []int{http.StatusOK}},
+	{http.MethodGet, "/health", []int{http.StatusOK}},
+}
+
+// debugRouteChecks covers the remaining routes. What neither list can
+// reach is only recorded if it happens while the server runs: the GC
+// advisor, profiler, memory guard and StatsD exporter work on their own
+// schedule, so a profile that must cover them needs a -settle longer
+// than their interval.
+var debugRouteChecks = []routeCheck{
+	{http.MethodGet, "/metrics", []int{http.StatusOK}},
+	{http.MethodGet, "/debug/security", []int{http.StatusOK}},
+	{http.MethodGet, "/debug/resources/events", []int{http.StatusOK}},
+	{http.MethodGet, "/debug/resources/events?stream=1", []int{http.StatusOK}},
+	{http.MethodGet, "/debug/resources/history", []int{http.StatusOK, http.StatusNotFound}},
+	{http.MethodGet, "/debug/resources/history?stream=1", []int{http.StatusOK, http.StatusNotFound}},
+	{http.MethodGet, "/debug/recommendations", []int{http.StatusOK, http.StatusNotFound}},
+	{http.MethodGet, "/debug/gc-advice", []int{http.StatusOK, http.StatusNotFound}},
+}
+
+type routeCheckResult struct {
+	Check    routeCheck
+	Status   int
+	Duration time.Duration
+	Err      error
+}
+
+func (r routeCheckResult) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("%s %s: %v", r.Check.Method, r.Check.Path, r.Err)
+	}
+	return fmt.Sprintf("%s %s: %d in %s", r.Check.Method, r.Check.Path, r.Status, r.Duration.Round(time.Millisecond))
+}
+
+// runRouteChecks sends every route check, diagnostics included, to
+// baseURL once, in order.
+func runRouteChecks(client *http.Client, baseURL string) []routeCheckResult {
+	results := make([]routeCheckResult, 0, len(routeChecks)+len(debugRouteChecks))
+	for _, checks := range [][]routeCheck{routeChecks, debugRouteChecks} {
+		for _, check := range checks {
+			results = append(results, runRouteCheck(client, baseURL, check))
+		}
+	}
+	return results
+}
+
+func runRouteCheck(client *http.Client, baseURL string, check routeCheck) routeCheckResult {
+	res := routeCheckResult{Check: check}
+	req, err := http.NewRequest(check.Method, baseURL+check.Path, nil)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	// An event stream does not end, so its headers are all there is to
+	// wait for.
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		io.Copy(io.Discard, resp.Body)
+	}
+	resp.Body.Close()
+	res.Duration = time.Since(start)
+	res.Status = resp.StatusCode
+	for _, ok := range check.Status {
+		if resp.StatusCode == ok {
+			return res
+		}
+	}
+	res.Err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+	return res
+}
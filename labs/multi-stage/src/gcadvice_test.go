@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestAdviseGC(t *testing.T) {
+	const mib = 1 << 20
+	busy := gcObservation{Window: "5m0s", Cycles: 600, GCPerSecond: 2, GCCPUFraction: 0.20,
+		PeakLiveHeap: 40 * mib, NonHeapBytes: 20 * mib, GOMAXPROCS: 4}
+	defaults := gcSnapshot{GOGC: 100, MemoryLimit: math.MaxInt64}
+
+	for _, tc := range []struct {
+		name      string
+		obs       gcObservation
+		last      gcSnapshot
+		limits    cgroupLimits
+		want      gcSettings
+		wantKinds []string
+	}{
+		{
+			name:      "container limit without GOMEMLIMIT",
+			obs:       busy,
+			last:      defaults,
+			limits:    cgroupLimits{CPUCores: 2, MemoryBytes: 512 * mib},
+			want:      gcSettings{GOGC: "400", GOMEMLIMIT: "460MiB"},
+			wantKinds: []string{"no_gomemlimit", "gc_cpu_high", "gomaxprocs_above_cpu_limit"},
+		},
+		{
+			name:      "GOGC capped by the memory that is left",
+			obs:       busy,
+			last:      defaults,
+			limits:    cgroupLimits{MemoryBytes: 128 * mib},
+			want:      gcSettings{GOGC: "125", GOMEMLIMIT: "115MiB"},
+			wantKinds: []string{"no_gomemlimit", "gc_cpu_high"},
+		},
+		{
+			name:      "GOMEMLIMIT above the container",
+			obs:       gcObservation{Cycles: 10, GCCPUFraction: 0.02, GOMAXPROCS: 1},
+			last:      gcSnapshot{GOGC: 100, MemoryLimit: 1 << 30},
+			limits:    cgroupLimits{MemoryBytes: 256 * mib},
+			want:      gcSettings{GOGC: "100", GOMEMLIMIT: "230MiB"},
+			wantKinds: []string{"gomemlimit_above_container"},
+		},
+		{
+			name:      "thrashing against the memory limit",
+			obs:       busy,
+			last:      gcSnapshot{GOGC: 100, MemoryLimit: 60 * mib, LiveHeap: 40 * mib, HeapGoal: 44 * mib},
+			limits:    cgroupLimits{MemoryBytes: 64 * mib},
+			want:      gcSettings{GOGC: "100", GOMEMLIMIT: "60MiB"},
+			wantKinds: []string{"gc_thrashing"},
+		},
+		{
+			name:      "too few cycles",
+			obs:       gcObservation{Window: "10s", Cycles: 1, GCCPUFraction: 0.5, GOMAXPROCS: 1},
+			last:      defaults,
+			want:      gcSettings{GOGC: "100", GOMEMLIMIT: "off"},
+			wantKinds: []string{"low_confidence", "no_memory_limit"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rep := adviseGC(tc.obs, tc.last, tc.limits, 0.9)
+			if rep.Suggested != tc.want {
+				t.Errorf("suggested %+v; want %+v", rep.Suggested, tc.want)
+			}
+			var kinds []string
+			for _, f := range rep.Findings {
+				kinds = append(kinds, f.Kind)
+			}
+			if strings.Join(kinds, ",") != strings.Join(tc.wantKinds, ",") {
+				t.Errorf("findings %v; want %v", rep.Findings, tc.wantKinds)
+			}
+		})
+	}
+}
+
+func TestRuntimeMetricsExported(t *testing.T) {
+	var b strings.Builder
+	if err := registry.writePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE go_gc_heap_goal_bytes gauge",
+		"# TYPE go_gc_gomemlimit_bytes gauge",
+		"# TYPE go_sched_latencies_seconds histogram",
+		"# TYPE go_gc_heap_allocs_bytes_total counter",
+		"go_sched_latencies_seconds_bucket{le=\"+Inf\"}",
+		"go_gc_cpu_fraction ",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("/metrics output lacks %q", want)
+		}
+	}
+}
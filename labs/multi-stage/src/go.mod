@@ -1,6 +1,6 @@
 module github.com/olliefr/docker-gs-ping
 
-go 1.19
+go 1.21
 
 require github.com/labstack/echo/v4 v4.10.2
 
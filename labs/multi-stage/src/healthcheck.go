@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// healthcheck.go renders /health as application/health+json, following
+// draft-inadarei-api-health-check, for monitoring tools that parse that
+// format generically. The older {"Status":"OK"} stays the default; a
+// client opts in with "Accept: application/health+json", or
+// HEALTH_FORMAT=health+json makes it the default for everyone.
+
+const healthJSON = "application/health+json"
+
+var processStart = time.Now()
+
+// healthReport is the top-level health+json document.
+type healthReport struct {
+	Status    string                   `json:"status"`
+	Version   string                   `json:"version,omitempty"`
+	ReleaseID string                   `json:"releaseId,omitempty"`
+	ServiceID string                   `json:"serviceId,omitempty"`
+	Output    string                   `json:"output,omitempty"`
+	Checks    map[string][]healthCheck `json:"checks,omitempty"`
+}
+
+// healthCheck is one measurement, keyed "componentId:measurementName".
+type healthCheck struct {
+	ComponentID   string    `json:"componentId,omitempty"`
+	ComponentType string    `json:"componentType,omitempty"`
+	ObservedValue any       `json:"observedValue"`
+	ObservedUnit  string    `json:"observedUnit,omitempty"`
+	Status        string    `json:"status"`
+	Time          time.Time `json:"time"`
+	Output        string    `json:"output,omitempty"`
+}
+
+// Statuses in order of severity.
+var healthSeverity = map[string]int{"pass": 0, "warn": 1, "fail": 2}
+
+func wantsHealthJSON(r *http.Request) bool {
+	if strings.Contains(r.Header.Get("Accept"), healthJSON) {
+		return true
+	}
+	return envOr("HEALTH_FORMAT", "") == "health+json"
+}
+
+func newHealthReport(service string) *healthReport {
+	id, _ := os.Hostname()
+	return &healthReport{
+		Status:    "pass",
+		Version:   "1",
+		ReleaseID: buildVersion(),
+		ServiceID: envOr("HEALTH_SERVICE_ID", service+"@"+id),
+		Checks:    map[string][]healthCheck{},
+	}
+}
+
+// add records a check under key and raises the report's status to the
+// check's if it is worse.
+func (h *healthReport) add(key string, c healthCheck) {
+	h.Checks[key] = append(h.Checks[key], c)
+	if healthSeverity[c.Status] > healthSeverity[h.Status] {
+		h.Status = c.Status
+	}
+}
+
+// httpStatus follows the draft: pass and warn are 200, fail is 503.
+func (h *healthReport) httpStatus() int {
+	if h.Status == "fail" {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+// addProcessChecks adds the checks every service has: uptime, and memory
+// in use against the container limit or GOMEMLIMIT. Memory above
+// HEALTH_MEMORY_WARN (0.9) of the limit is a warning.
+func (h *healthReport) addProcessChecks(now time.Time) {
+	h.add("uptime", healthCheck{
+		ComponentType: "system",
+		ObservedValue: int64(now.Sub(processStart).Seconds()),
+		ObservedUnit:  "s",
+		Status:        "pass",
+		Time:          now,
+	})
+	g := memGuard{cg: detectCgroup()}
+	used, limit := g.usage()
+	if limit == 0 {
+		return
+	}
+	c := healthCheck{
+		ComponentType: "system",
+		ObservedValue: float64(used*1000/limit) / 10,
+		ObservedUnit:  "percent",
+		Status:        "pass",
+		Time:          now,
+	}
+	if float64(used) > envFloat("HEALTH_MEMORY_WARN", 0.9)*float64(limit) {
+		c.Status = "warn"
+		c.Output = "memory use is " + kubeMemory(used) + " of " + kubeMemory(limit)
+	}
+	h.add("memory:utilization", c)
+}
+
+func writeHealthReport(c echo.Context, h *healthReport) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	return c.Blob(h.httpStatus(), healthJSON, data)
+}
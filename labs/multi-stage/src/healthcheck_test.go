@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthFormats(t *testing.T) {
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	if got := rec.Body.String(); got != "{\"Status\":\"OK\"}\n" {
+		t.Errorf("legacy /health = %q", got)
+	}
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	req.Header.Set("Accept", "application/health+json")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d; want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != healthJSON {
+		t.Errorf("Content-Type = %q; want %q", ct, healthJSON)
+	}
+	var h healthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Status == "fail" || h.Version == "" || h.ReleaseID == "" || h.ServiceID == "" {
+		t.Errorf("report = %+v", h)
+	}
+	if c := h.Checks["uptime"]; len(c) != 1 || c[0].ObservedUnit != "s" || c[0].Time.IsZero() {
+		t.Errorf("uptime = %+v", c)
+	}
+}
+
+func TestHealthReportStatus(t *testing.T) {
+	h := newHealthReport("test")
+	h.add("a", healthCheck{Status: "warn"})
+	h.add("b", healthCheck{Status: "pass"})
+	if h.Status != "warn" || h.httpStatus() != http.StatusOK {
+		t.Errorf("status = %s/%d; want warn/200", h.Status, h.httpStatus())
+	}
+	h.add("c", healthCheck{Status: "fail"})
+	if h.Status != "fail" || h.httpStatus() != http.StatusServiceUnavailable {
+		t.Errorf("status = %s/%d; want fail/503", h.Status, h.httpStatus())
+	}
+}
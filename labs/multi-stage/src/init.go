@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Restart policies for supervised programs. The names follow the
+// docker run --restart values so they read the same in both places.
+const (
+	restartNo        = "no"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+)
+
+// program is a single child command declared in the init config.
+type program struct {
+	Name        string   `json:"name"`
+	Command     []string `json:"command"`
+	Dir         string   `json:"dir,omitempty"`
+	Env         []string `json:"env,omitempty"`
+	Restart     string   `json:"restart,omitempty"`
+	MaxRestarts int      `json:"max_restarts,omitempty"`
+	Priority    int      `json:"priority,omitempty"`
+}
+
+// initConfig is the JSON document read by `init -config`. It plays the
+// role supervisord.conf plays in the monolithic lab.
+type initConfig struct {
+	Programs    []program `json:"programs"`
+	StopTimeout string    `json:"stop_timeout,omitempty"`
+	BackoffMin  string    `json:"backoff_min,omitempty"`
+	BackoffMax  string    `json:"backoff_max,omitempty"`
+	StableAfter string    `json:"stable_after,omitempty"`
+
+	stopTimeout time.Duration
+	backoffMin  time.Duration
+	backoffMax  time.Duration
+	stableAfter time.Duration
+
+	// passthrough is set when a single command is run in front of
+	// the terminal, tini style: stdio is inherited, no log prefixes,
+	// and init exits with the child's status.
+	passthrough bool
+}
+
+func runInit(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("INIT_CONFIG"), "JSON file declaring the programs to supervise")
+	stopTimeout := fs.Duration("stop-timeout", 10*time.Second, "grace period between forwarding SIGTERM and sending SIGKILL")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s init [-config file] [-- command args...]\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintln(fs.Output(), "Runs as PID 1: forwards signals, reaps zombies and optionally supervises several programs.")
+		fmt.Fprintln(fs.Output(), "With no config and no command, the server itself is run as the only child.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg, err := loadInitConfig(*configPath, fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "init: %v\n", err)
+		return 2
+	}
+	if cfg.StopTimeout == "" {
+		cfg.stopTimeout = *stopTimeout
+	}
+	return supervise(cfg)
+}
+
+// loadInitConfig builds the supervision plan from either a config file or
+// a command line. With neither, the current executable is re-run without
+// the init argument so `server init` works as a drop-in ENTRYPOINT.
+func loadInitConfig(path string, command []string) (*initConfig, error) {
+	cfg := &initConfig{}
+	switch {
+	case path != "" && len(command) > 0:
+		return nil, errors.New("use either -config or a command, not both")
+	case path != "":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	case len(command) > 0:
+		cfg.Programs = []program{{Name: filepath.Base(command[0]), Command: command, Restart: restartNo}}
+		cfg.passthrough = true
+	default:
+		self, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		cfg.Programs = []program{{Name: filepath.Base(self), Command: []string{self}, Restart: restartNo}}
+		cfg.passthrough = true
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *initConfig) validate() error {
+	if len(cfg.Programs) == 0 {
+		return errors.New("no programs declared")
+	}
+	durations := []struct {
+		name string
+		raw  string
+		dst  *time.Duration
+		def  time.Duration
+	}{
+		{"stop_timeout", cfg.StopTimeout, &cfg.stopTimeout, 10 * time.Second},
+		{"backoff_min", cfg.BackoffMin, &cfg.backoffMin, time.Second},
+		{"backoff_max", cfg.BackoffMax, &cfg.backoffMax, 30 * time.Second},
+		{"stable_after", cfg.StableAfter, &cfg.stableAfter, 10 * time.Second},
+	}
+	for _, d := range durations {
+		*d.dst = d.def
+		if d.raw == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", d.name, err)
+		}
+		*d.dst = v
+	}
+	if cfg.backoffMax < cfg.backoffMin {
+		return errors.New("backoff_max must not be smaller than backoff_min")
+	}
+
+	seen := make(map[string]bool)
+	for i := range cfg.Programs {
+		p := &cfg.Programs[i]
+		if len(p.Command) == 0 {
+			return fmt.Errorf("program %d: empty command", i)
+		}
+		if p.Name == "" {
+			p.Name = filepath.Base(p.Command[0])
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("program %q declared twice", p.Name)
+		}
+		seen[p.Name] = true
+		switch p.Restart {
+		case "":
+			p.Restart = restartOnFailure
+		case restartNo, restartOnFailure, restartAlways:
+		default:
+			return fmt.Errorf("program %q: unknown restart policy %q", p.Name, p.Restart)
+		}
+	}
+	// Lower priority starts first, as in supervisord.
+	sort.SliceStable(cfg.Programs, func(i, j int) bool {
+		return cfg.Programs[i].Priority < cfg.Programs[j].Priority
+	})
+	return nil
+}
+
+// shouldRestart applies the program's restart policy to an exit. restarts
+// is the number of restarts already performed.
+func (p *program) shouldRestart(exitCode, restarts int) bool {
+	if p.MaxRestarts > 0 && restarts >= p.MaxRestarts {
+		return false
+	}
+	switch p.Restart {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		return exitCode != 0
+	}
+	return false
+}
+
+// backoff doubles the restart delay on every crash up to max.
+type backoff struct {
+	min, max time.Duration
+	cur      time.Duration
+}
+
+func (b *backoff) next() time.Duration {
+	if b.cur == 0 {
+		b.cur = b.min
+	} else {
+		b.cur *= 2
+	}
+	if b.cur > b.max {
+		b.cur = b.max
+	}
+	return b.cur
+}
+
+func (b *backoff) reset() { b.cur = 0 }
+
+// lockedWriter serialises whole lines from several children onto one
+// stream so their output does not interleave mid-line.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) writeLine(prefix string, line []byte) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	io.WriteString(lw.w, prefix)
+	lw.w.Write(line)
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		io.WriteString(lw.w, "\n")
+	}
+}
+
+// copyPrefixed copies r to w line by line, prefixing each line with the
+// program name. It returns when r reaches EOF.
+func copyPrefixed(w *lockedWriter, name string, r io.Reader) {
+	prefix := name + " | "
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			w.writeLine(prefix, line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func supervise(cfg *initConfig) int {
+	fmt.Fprintf(os.Stderr, "init: not supported on %s\n", runtime.GOOS)
+	return 1
+}
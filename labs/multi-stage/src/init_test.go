@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInitConfigValidate(t *testing.T) {
+	cfg := &initConfig{
+		BackoffMin: "250ms",
+		Programs: []program{
+			{Command: []string{"/usr/bin/python3", "/app/app.py"}, Priority: 2},
+			{Name: "redis", Command: []string{"redis-server"}, Restart: restartAlways, Priority: 1},
+		},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if cfg.Programs[0].Name != "redis" {
+		t.Errorf("first program = %q; want redis (lowest priority)", cfg.Programs[0].Name)
+	}
+	if got := cfg.Programs[1].Name; got != "python3" {
+		t.Errorf("default name = %q; want python3", got)
+	}
+	if got := cfg.Programs[1].Restart; got != restartOnFailure {
+		t.Errorf("default restart = %q; want %q", got, restartOnFailure)
+	}
+	if cfg.backoffMin != 250*time.Millisecond || cfg.backoffMax != 30*time.Second {
+		t.Errorf("backoff = %s..%s; want 250ms..30s", cfg.backoffMin, cfg.backoffMax)
+	}
+}
+
+func TestInitConfigValidateErrors(t *testing.T) {
+	var tests = []struct {
+		name string
+		cfg  initConfig
+	}{
+		{"no programs", initConfig{}},
+		{"empty command", initConfig{Programs: []program{{Name: "x"}}}},
+		{"duplicate", initConfig{Programs: []program{{Command: []string{"a"}}, {Command: []string{"a"}}}}},
+		{"bad policy", initConfig{Programs: []program{{Command: []string{"a"}, Restart: "sometimes"}}}},
+		{"bad duration", initConfig{StopTimeout: "soon", Programs: []program{{Command: []string{"a"}}}}},
+		{"inverted backoff", initConfig{BackoffMin: "1m", BackoffMax: "1s", Programs: []program{{Command: []string{"a"}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validate(); err == nil {
+				t.Errorf("validate succeeded; want error")
+			}
+		})
+	}
+}
+
+func TestShouldRestart(t *testing.T) {
+	var tests = []struct {
+		restart     string
+		maxRestarts int
+		code        int
+		restarts    int
+		want        bool
+	}{
+		{restartNo, 0, 1, 0, false},
+		{restartOnFailure, 0, 0, 0, false},
+		{restartOnFailure, 0, 1, 0, true},
+		{restartAlways, 0, 0, 0, true},
+		{restartAlways, 3, 0, 2, true},
+		{restartAlways, 3, 0, 3, false},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s,max=%d,code=%d,restarts=%d", tt.restart, tt.maxRestarts, tt.code, tt.restarts)
+		t.Run(testname, func(t *testing.T) {
+			p := program{Restart: tt.restart, MaxRestarts: tt.maxRestarts}
+			if got := p.shouldRestart(tt.code, tt.restarts); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := backoff{min: time.Second, max: 5 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := b.next(); got != w {
+			t.Errorf("step %d: got %s, want %s", i, got, w)
+		}
+	}
+	b.reset()
+	if got := b.next(); got != time.Second {
+		t.Errorf("after reset: got %s, want 1s", got)
+	}
+}
+
+func TestCopyPrefixed(t *testing.T) {
+	var buf bytes.Buffer
+	copyPrefixed(&lockedWriter{w: &buf}, "redis", strings.NewReader("ready\n\nno newline"))
+	want := "redis | ready\nredis | \nredis | no newline\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
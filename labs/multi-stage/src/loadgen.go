@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// loadResult summarises one load generator run.
+type loadResult struct {
+	Requests uint64
+	Errors   uint64
+	Elapsed  time.Duration
+	Latency  usageQuantiles // seconds
+}
+
+func (r loadResult) throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+func (r loadResult) String() string {
+	return fmt.Sprintf("%d requests in %s (%.0f req/s, %d errors), p50 %s p99 %s",
+		r.Requests, r.Elapsed.Round(time.Millisecond), r.throughput(), r.Errors,
+		secondsDuration(r.Latency.P50), secondsDuration(r.Latency.P99))
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Microsecond)
+}
+
+// generateLoad cycles through the route checks from concurrency workers
+// until duration has passed or ctx is done.
+func generateLoad(ctx context.Context, client *http.Client, baseURL string, concurrency int, duration time.Duration) loadResult {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		latency distribution
+		res     loadResult
+		wg      sync.WaitGroup
+	)
+	start := time.Now()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// Workers start at different routes so the mix is even
+			// from the first request.
+			for i := w; ctx.Err() == nil; i++ {
+				r := runRouteCheck(client, baseURL, routeChecks[i%len(routeChecks)])
+				if ctx.Err() != nil && r.Err != nil {
+					return // cut off by the deadline, not a server error
+				}
+				mu.Lock()
+				res.Requests++
+				if r.Err != nil {
+					res.Errors++
+				} else {
+					latency.add(r.Duration.Seconds())
+				}
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	res.Latency = latency.quantiles()
+	return res
+}
@@ -1,34 +1,88 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "init":
+			os.Exit(runInit(os.Args[2:]))
+		case "seccomp-profile":
+			os.Exit(runSeccompProfile(os.Args[2:]))
+		case "profiles":
+			os.Exit(runProfiles(os.Args[2:]))
+		case "pgo-capture":
+			os.Exit(runPGOCapture(os.Args[2:]))
+		case "size-report":
+			os.Exit(runSizeReport(os.Args[2:]))
+		case "sbom":
+			os.Exit(runSBOM(os.Args[2:]))
+		}
+	}
+
+	checkSecurityPosture()
+
+	e := newServer()
+
+	startResourceWatcher(context.Background())
+	startUsageHistory(context.Background())
+	startMemGuard(context.Background())
+	startGCAdvisor(context.Background())
+	startStatsD(context.Background(), "docker-gs-ping")
+	startProfiler(context.Background(), "docker-gs-ping")
+
+	httpPort := os.Getenv("PORT")
+	if httpPort == "" {
+		httpPort = "8080"
+	}
 
+	e.Logger.Fatal(e.Start(":" + httpPort))
+}
+
+// newServer sets up the routes. It is separate from main so pgo-capture
+// can serve the same handlers in-process.
+func newServer() *echo.Echo {
 	e := echo.New()
 
+	e.Use(addServerTiming)
 	e.Use(middleware.Logger())
+	e.Use(countRequests)
 	e.Use(middleware.Recover())
+	e.Use(labelRoutes)
+	e.Use(markHandlerStart)
 
 	e.GET("/", func(c echo.Context) error {
 		return c.HTML(http.StatusOK, "Hello, Docker! <3")
 	})
 
 	e.GET("/health", func(c echo.Context) error {
+		if wantsHealthJSON(c.Request()) {
+			h := newHealthReport("docker-gs-ping")
+			h.addProcessChecks(time.Now())
+			return writeHealthReport(c, h)
+		}
 		return c.JSON(http.StatusOK, struct{ Status string }{Status: "OK"})
 	})
 
-	httpPort := os.Getenv("PORT")
-	if httpPort == "" {
-		httpPort = "8080"
-	}
+	e.GET("/debug/security", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, collectSecurityReport())
+	})
 
-	e.Logger.Fatal(e.Start(":" + httpPort))
+	e.GET("/debug/resources/events", echo.WrapHandler(http.HandlerFunc(resourceEventsHandler)))
+	e.GET("/debug/resources/history", echo.WrapHandler(http.HandlerFunc(resourceHistoryHandler)))
+	e.GET("/debug/recommendations", echo.WrapHandler(http.HandlerFunc(recommendationsHandler)))
+	e.GET("/debug/gc-advice", echo.WrapHandler(http.HandlerFunc(gcAdviceHandler)))
+	e.GET("/metrics", echo.WrapHandler(http.HandlerFunc(metricsHandler)))
+
+	return e
 }
 
 // Simple implementation of an integer minimum
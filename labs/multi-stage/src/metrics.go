@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metrics.go is a deliberately small metric registry that speaks the
+// Prometheus text format. It keeps the binaries free of a client library
+// while still giving every feature one place to publish numbers.
+
+const (
+	counterKind   = "counter"
+	gaugeKind     = "gauge"
+	histogramKind = "histogram"
+)
+
+type metricFamily struct {
+	Name    string
+	Help    string
+	Kind    string
+	Labels  []string
+	Buckets []float64
+
+	// collect, when set, is read at scrape time instead of stored
+	// series. Used for gauges that mirror state owned elsewhere.
+	collect func() float64
+	// collectSample is the same for counters and histograms. Histogram
+	// counts must be cumulative and match Buckets.
+	collectSample func() metricSample
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	buckets     []float64
+
+	mu     sync.Mutex
+	value  float64
+	counts []uint64 // per bucket, not cumulative; last is +Inf
+	sum    float64
+	count  uint64
+}
+
+// metricSample is a point-in-time copy of one series.
+type metricSample struct {
+	LabelValues []string
+	Value       float64
+	// Histogram only: cumulative counts per bucket, then +Inf.
+	Counts []uint64
+	Sum    float64
+	Count  uint64
+}
+
+type metricRegistry struct {
+	mu       sync.Mutex
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+var registry = newMetricRegistry()
+
+func newMetricRegistry() *metricRegistry {
+	return &metricRegistry{byName: make(map[string]*metricFamily)}
+}
+
+// register adds f. Metric names are fixed at compile time, so a duplicate
+// is a programming error and panics, as prometheus.MustRegister does.
+func (r *metricRegistry) register(f *metricFamily) *metricFamily {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, dup := r.byName[f.Name]; dup {
+		panic("metric registered twice: " + f.Name)
+	}
+	f.series = make(map[string]*metricSeries)
+	r.families = append(r.families, f)
+	r.byName[f.Name] = f
+	return f
+}
+
+func (r *metricRegistry) counter(name, help string, labels ...string) *metricFamily {
+	return r.register(&metricFamily{Name: name, Help: help, Kind: counterKind, Labels: labels})
+}
+
+func (r *metricRegistry) gauge(name, help string, labels ...string) *metricFamily {
+	return r.register(&metricFamily{Name: name, Help: help, Kind: gaugeKind, Labels: labels})
+}
+
+func (r *metricRegistry) gaugeFunc(name, help string, fn func() float64) *metricFamily {
+	return r.register(&metricFamily{Name: name, Help: help, Kind: gaugeKind, collect: fn})
+}
+
+func (r *metricRegistry) counterFunc(name, help string, fn func() float64) *metricFamily {
+	return r.register(&metricFamily{Name: name, Help: help, Kind: counterKind,
+		collectSample: func() metricSample { return metricSample{Value: fn()} }})
+}
+
+func (r *metricRegistry) histogramFunc(name, help string, buckets []float64, fn func() metricSample) *metricFamily {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return r.register(&metricFamily{Name: name, Help: help, Kind: histogramKind, Buckets: b, collectSample: fn})
+}
+
+func (r *metricRegistry) histogram(name, help string, buckets []float64, labels ...string) *metricFamily {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return r.register(&metricFamily{Name: name, Help: help, Kind: histogramKind, Labels: labels, Buckets: b})
+}
+
+// snapshot returns the registered families in registration order.
+func (r *metricRegistry) snapshot() []*metricFamily {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*metricFamily(nil), r.families...)
+}
+
+// with returns the series for the given label values, creating it on
+// first use.
+func (f *metricFamily) with(values ...string) *metricSeries {
+	if len(values) != len(f.Labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", f.Name, len(values), len(f.Labels)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), values...), buckets: f.Buckets}
+		if f.Kind == histogramKind {
+			s.counts = make([]uint64, len(f.Buckets)+1)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (s *metricSeries) add(v float64) {
+	s.mu.Lock()
+	s.value += v
+	s.mu.Unlock()
+}
+
+func (s *metricSeries) inc() { s.add(1) }
+
+func (s *metricSeries) set(v float64) {
+	s.mu.Lock()
+	s.value = v
+	s.mu.Unlock()
+}
+
+func (s *metricSeries) observe(v float64) {
+	i := sort.SearchFloat64s(s.buckets, v)
+	s.mu.Lock()
+	s.counts[i]++
+	s.sum += v
+	s.count++
+	s.mu.Unlock()
+}
+
+// samples copies the family's series, sorted by label values.
+func (f *metricFamily) samples() []metricSample {
+	if f.collect != nil {
+		return []metricSample{{Value: f.collect()}}
+	}
+	if f.collectSample != nil {
+		return []metricSample{f.collectSample()}
+	}
+	f.mu.Lock()
+	series := make([]*metricSeries, 0, len(f.series))
+	for _, s := range f.series {
+		series = append(series, s)
+	}
+	f.mu.Unlock()
+	sort.Slice(series, func(i, j int) bool {
+		return strings.Join(series[i].labelValues, "\xff") < strings.Join(series[j].labelValues, "\xff")
+	})
+
+	out := make([]metricSample, 0, len(series))
+	for _, s := range series {
+		s.mu.Lock()
+		sample := metricSample{LabelValues: s.labelValues, Value: s.value, Sum: s.sum, Count: s.count}
+		if s.counts != nil {
+			sample.Counts = make([]uint64, len(s.counts))
+			var cum uint64
+			for i, c := range s.counts {
+				cum += c
+				sample.Counts[i] = cum
+			}
+		}
+		s.mu.Unlock()
+		out = append(out, sample)
+	}
+	return out
+}
+
+// writePrometheus renders every family in the text exposition format.
+func (r *metricRegistry) writePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range r.snapshot() {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.Name, escapeHelp(f.Help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.Name, f.Kind)
+		for _, s := range f.samples() {
+			if f.Kind != histogramKind {
+				fmt.Fprintf(bw, "%s%s %s\n", f.Name, formatLabels(f.Labels, s.LabelValues, ""), formatFloat(s.Value))
+				continue
+			}
+			for i, c := range s.Counts {
+				le := math.Inf(1)
+				if i < len(f.Buckets) {
+					le = f.Buckets[i]
+				}
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", f.Name, formatLabels(f.Labels, s.LabelValues, formatFloat(le)), c)
+			}
+			fmt.Fprintf(bw, "%s_sum%s %s\n", f.Name, formatLabels(f.Labels, s.LabelValues, ""), formatFloat(s.Sum))
+			fmt.Fprintf(bw, "%s_count%s %d\n", f.Name, formatLabels(f.Labels, s.LabelValues, ""), s.Count)
+		}
+	}
+	return bw.Flush()
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registry.writePrometheus(w)
+}
+
+func formatLabels(names, values []string, le string) string {
+	if len(names) == 0 && le == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	if le != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(`le="`)
+		b.WriteString(le)
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	r := newMetricRegistry()
+	requests := r.counter("http_requests_total", "Requests served.", "route", "code")
+	requests.with("/counter", "200").add(2)
+	requests.with("/health", "503").inc()
+	r.gaugeFunc("up", "Always one.", func() float64 { return 1 })
+	latency := r.histogram("http_request_duration_seconds", "Latency.", []float64{0.1, 0.01}, "route")
+	for _, v := range []float64{0.005, 0.01, 0.05, 3} {
+		latency.with(`/a"b`).observe(v)
+	}
+
+	var b strings.Builder
+	if err := r.writePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP http_requests_total Requests served.
+# TYPE http_requests_total counter
+http_requests_total{route="/counter",code="200"} 2
+http_requests_total{route="/health",code="503"} 1
+# HELP up Always one.
+# TYPE up gauge
+up 1
+# HELP http_request_duration_seconds Latency.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{route="/a\"b",le="0.01"} 2
+http_request_duration_seconds_bucket{route="/a\"b",le="0.1"} 3
+http_request_duration_seconds_bucket{route="/a\"b",le="+Inf"} 4
+http_request_duration_seconds_sum{route="/a\"b"} 3.065
+http_request_duration_seconds_count{route="/a\"b"} 4
+`
+	if got := b.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRegisterDuplicatePanics(t *testing.T) {
+	r := newMetricRegistry()
+	r.counter("dup_total", "first")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("second registration did not panic")
+		}
+	}()
+	r.gauge("dup_total", "second")
+}
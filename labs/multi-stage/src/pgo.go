@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// pgo.go collects a CPU profile for profile-guided optimisation by serving
+// the real handlers in-process under synthetic load. Committing the result
+// as default.pgo next to main.go makes `go build` use it automatically.
+
+func runPGOCapture(args []string) int {
+	fs := flag.NewFlagSet("pgo-capture", flag.ExitOnError)
+	duration := fs.Duration("duration", 30*time.Second, "how long to profile under load")
+	concurrency := fs.Int("concurrency", 8, "concurrent load generator workers")
+	out := fs.String("out", "default.pgo", "where to write the profile")
+	var merge stringList
+	fs.Var(&merge, "merge", "existing CPU profile to merge into the output (repeatable)")
+	compare := fs.String("compare", "", "PGO-built binary to benchmark against -baseline")
+	baseline := fs.String("baseline", "", "binary built without PGO (default: this executable)")
+	benchDuration := fs.Duration("bench-duration", 10*time.Second, "load duration per benchmark round")
+	rounds := fs.Int("rounds", 3, "benchmark rounds per binary, alternated to even out noise")
+	startTimeout := fs.Duration("start-timeout", 10*time.Second, "how long to wait for a benchmarked binary to listen")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s pgo-capture [flags]\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintln(fs.Output(), "Serves the application in-process, drives it with the built-in load generator")
+		fmt.Fprintln(fs.Output(), "while CPU profiling and writes the profile for `go build -pgo`. With -compare,")
+		fmt.Fprintln(fs.Output(), "also measures the throughput of a PGO build against the baseline.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	profile, res, err := captureInProcess(*duration, *concurrency)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pgo-capture: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "pgo-capture: profiled %s\n", res)
+
+	profiles := [][]byte{profile}
+	for _, path := range merge {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "pgo-capture: %v\n", err)
+			return 1
+		}
+		profiles = append(profiles, data)
+	}
+	merged, err := mergeCPUProfiles(profiles)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pgo-capture: merging: %v\n", err)
+		return 1
+	}
+	if err := os.WriteFile(*out, merged, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "pgo-capture: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "pgo-capture: wrote %s (%d profiles merged)\n", *out, len(profiles))
+
+	if *compare == "" {
+		return 0
+	}
+	if *baseline == "" {
+		if *baseline, err = os.Executable(); err != nil {
+			fmt.Fprintf(os.Stderr, "pgo-capture: %v\n", err)
+			return 1
+		}
+	}
+	var before, after []float64
+	for i := 0; i < *rounds; i++ {
+		for _, b := range []struct {
+			path string
+			dst  *[]float64
+		}{{*baseline, &before}, {*compare, &after}} {
+			r, err := benchBinary(b.path, *concurrency, *benchDuration, *startTimeout)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "pgo-capture: %s: %v\n", b.path, err)
+				return 1
+			}
+			fmt.Fprintf(os.Stderr, "pgo-capture: round %d %s: %s\n", i+1, filepath.Base(b.path), r)
+			*b.dst = append(*b.dst, r.throughput())
+		}
+	}
+	mb, ma := median(before), median(after)
+	fmt.Printf("baseline %.0f req/s, pgo %.0f req/s (%+.1f%%)\n", mb, ma, (ma-mb)/mb*100)
+	return 0
+}
+
+// captureInProcess profiles the server's handlers under load without
+// leaving the process, so the profile holds request handling rather than
+// process start-up.
+func captureInProcess(duration time.Duration, concurrency int) ([]byte, loadResult, error) {
+	e := newServer()
+	e.Logger.SetOutput(io.Discard)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, loadResult{}, err
+	}
+	srv := &http.Server{Handler: e}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		return nil, loadResult{}, err
+	}
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: concurrency},
+	}
+	res := generateLoad(context.Background(), client, "http://"+ln.Addr().String(), concurrency, duration)
+	pprof.StopCPUProfile()
+	if res.Requests == 0 || res.Errors == res.Requests {
+		return nil, res, fmt.Errorf("no successful requests: %s", res)
+	}
+	return buf.Bytes(), res, nil
+}
+
+// benchBinary starts path on a free port and measures its throughput.
+func benchBinary(path string, concurrency int, duration, startTimeout time.Duration) (loadResult, error) {
+	port, err := freePort()
+	if err != nil {
+		return loadResult{}, err
+	}
+	cmd := exec.Command(path)
+	cmd.Env = append(os.Environ(), "PORT="+strconv.Itoa(port))
+	if err := cmd.Start(); err != nil {
+		return loadResult{}, err
+	}
+	exited := make(chan struct{})
+	go func() { cmd.Wait(); close(exited) }()
+	defer func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+			<-exited
+		}
+	}()
+
+	baseURL := "http://127.0.0.1:" + strconv.Itoa(port)
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: concurrency},
+	}
+	deadline := time.Now().Add(startTimeout)
+	for {
+		resp, err := client.Get(baseURL + "/")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			return loadResult{}, fmt.Errorf("did not start listening on port %d: %w", port, err)
+		}
+		select {
+		case <-exited:
+			return loadResult{}, errors.New("exited before it was ready")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return generateLoad(context.Background(), client, baseURL, concurrency, duration), nil
+}
+
+func median(v []float64) float64 {
+	s := append([]float64(nil), v...)
+	sort.Float64s(s)
+	if len(s) == 0 {
+		return 0
+	}
+	return s[len(s)/2]
+}
+
+// mergeCPUProfiles concatenates pprof profiles into one. Protobuf merges
+// concatenated messages by appending repeated fields, so the work is in
+// shifting each later profile's mapping, location and function IDs and
+// string table indexes past those already written. Header fields are
+// taken from the first profile and durations are summed.
+func mergeCPUProfiles(profiles [][]byte) ([]byte, error) {
+	var first []valueType
+	var out []byte
+	var strOff, mapOff, locOff, fnOff, duration uint64
+	for i, data := range profiles {
+		data, err := gunzipIfNeeded(data)
+		if err != nil {
+			return nil, fmt.Errorf("profile %d: %w", i+1, err)
+		}
+		p, err := parseProfile(data)
+		if err != nil {
+			return nil, fmt.Errorf("profile %d: %w", i+1, err)
+		}
+		if i == 0 {
+			first = p.SampleTypes
+		} else if fmt.Sprint(p.SampleTypes) != fmt.Sprint(first) {
+			return nil, fmt.Errorf("profile %d has sample types %v, want %v", i+1, p.SampleTypes, first)
+		}
+
+		shiftStr := func(v uint64) uint64 {
+			if v == 0 {
+				return 0 // index 0 is "" in every table
+			}
+			return v + strOff
+		}
+		var strs, maxMap, maxLoc, maxFn uint64
+		err = walkFields(data, func(field, wire int, v uint64, b []byte) error {
+			var rewritten []byte
+			var err error
+			switch field {
+			case 1, 7, 8, 9, 11, 12, 13, 14: // header fields
+				if i > 0 {
+					return nil
+				}
+				out = appendField(out, field, wire, v, b)
+				return nil
+			case 10: // duration_nanos
+				duration += v
+				return nil
+			case 2: // sample
+				rewritten, err = rewriteFields(b, func(f, w int, v uint64, b []byte) (uint64, []byte, error) {
+					switch f {
+					case 1:
+						return shiftVarints(w, v, b, locOff)
+					case 3:
+						b, err := rewriteFields(b, func(f, _ int, v uint64, b []byte) (uint64, []byte, error) {
+							if f == 1 || f == 2 || f == 4 {
+								v = shiftStr(v)
+							}
+							return v, b, nil
+						})
+						return v, b, err
+					}
+					return v, b, nil
+				})
+			case 3: // mapping
+				rewritten, err = rewriteFields(b, func(f, _ int, v uint64, b []byte) (uint64, []byte, error) {
+					switch f {
+					case 1:
+						maxMap = max(maxMap, v+mapOff)
+						v += mapOff
+					case 5, 6:
+						v = shiftStr(v)
+					}
+					return v, b, nil
+				})
+			case 4: // location
+				rewritten, err = rewriteFields(b, func(f, _ int, v uint64, b []byte) (uint64, []byte, error) {
+					switch f {
+					case 1:
+						maxLoc = max(maxLoc, v+locOff)
+						v += locOff
+					case 2:
+						if v != 0 {
+							v += mapOff
+						}
+					case 4:
+						b, err := rewriteFields(b, func(f, _ int, v uint64, b []byte) (uint64, []byte, error) {
+							if f == 1 {
+								v += fnOff
+							}
+							return v, b, nil
+						})
+						return v, b, err
+					}
+					return v, b, nil
+				})
+			case 5: // function
+				rewritten, err = rewriteFields(b, func(f, _ int, v uint64, b []byte) (uint64, []byte, error) {
+					switch f {
+					case 1:
+						maxFn = max(maxFn, v+fnOff)
+						v += fnOff
+					case 2, 3, 4:
+						v = shiftStr(v)
+					}
+					return v, b, nil
+				})
+			case 6: // string_table
+				strs++
+				rewritten = b
+			default:
+				rewritten = b
+			}
+			if err != nil {
+				return err
+			}
+			out = appendField(out, field, wire, v, rewritten)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("profile %d: %w", i+1, err)
+		}
+		strOff += strs
+		mapOff, locOff, fnOff = max(mapOff, maxMap), max(locOff, maxLoc), max(fnOff, maxFn)
+	}
+	out = appendField(out, 10, 0, duration, nil)
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(out)
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return gz.Bytes(), nil
+}
+
+// rewriteFields re-encodes a message, letting fn replace each field's
+// value or payload. Wire types are preserved.
+func rewriteFields(data []byte, fn func(field, wire int, v uint64, b []byte) (uint64, []byte, error)) ([]byte, error) {
+	var out []byte
+	err := walkFields(data, func(field, wire int, v uint64, b []byte) error {
+		v, b, err := fn(field, wire, v, b)
+		if err != nil {
+			return err
+		}
+		out = appendField(out, field, wire, v, b)
+		return nil
+	})
+	return out, err
+}
+
+// shiftVarints adds off to a repeated integer field, packed or not.
+func shiftVarints(wire int, v uint64, b []byte, off uint64) (uint64, []byte, error) {
+	if wire != 2 {
+		return v + off, nil, nil
+	}
+	var ids []uint64
+	if err := appendVarints(&ids, wire, v, b); err != nil {
+		return 0, nil, err
+	}
+	var packed []byte
+	for _, id := range ids {
+		packed = binary.AppendUvarint(packed, id+off)
+	}
+	return 0, packed, nil
+}
+
+func appendField(out []byte, field, wire int, v uint64, b []byte) []byte {
+	out = binary.AppendUvarint(out, uint64(field)<<3|uint64(wire))
+	switch wire {
+	case 0:
+		out = binary.AppendUvarint(out, v)
+	case 1:
+		out = binary.LittleEndian.AppendUint64(out, v)
+	case 2:
+		out = binary.AppendUvarint(out, uint64(len(b)))
+		out = append(out, b...)
+	case 5:
+		out = binary.LittleEndian.AppendUint32(out, uint32(v))
+	}
+	return out
+}
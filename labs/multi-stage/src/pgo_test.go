@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"runtime/pprof"
+	"testing"
+	"time"
+)
+
+func TestMergeCPUProfiles(t *testing.T) {
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		t.Skip(err)
+	}
+	pprof.Do(context.Background(), pprof.Labels("route", "/"), func(context.Context) {
+		spin(200 * time.Millisecond)
+	})
+	pprof.StopCPUProfile()
+
+	merged, err := mergeCPUProfiles([][]byte{buf.Bytes(), buf.Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, err := parseProfile(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	two, err := parseProfile(merged)
+	if err != nil {
+		t.Fatalf("merged profile does not parse: %v", err)
+	}
+	if len(two.Samples) != 2*len(one.Samples) {
+		t.Fatalf("merged %d samples; want %d", len(two.Samples), 2*len(one.Samples))
+	}
+	idx, _ := one.sampleIndex("")
+	a, totalA := aggregateProfile(one, idx, "", false)
+	b, totalB := aggregateProfile(two, idx, "", false)
+	if totalB != 2*totalA {
+		t.Errorf("merged total %d; want %d", totalB, 2*totalA)
+	}
+	// Shifted IDs must still resolve to the same functions and labels.
+	for fn, v := range a {
+		if b[fn] != 2*v {
+			t.Errorf("%s: merged %d; want %d", fn, b[fn], 2*v)
+		}
+	}
+	if routes, _ := aggregateProfile(two, idx, "route", false); routes["/"] != totalB {
+		t.Errorf("route labels lost in merge: %v", routes)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// pprofparse.go decodes just enough of the pprof protobuf format
+// (github.com/google/pprof/proto/profile.proto) to aggregate samples by
+// function or label. Mappings, addresses and comments are skipped.
+
+type valueType struct {
+	Type string
+	Unit string
+}
+
+type profileSample struct {
+	Values []int64
+	Stack  []string // function names, leaf first
+	Labels map[string]string
+}
+
+type parsedProfile struct {
+	SampleTypes       []valueType
+	DefaultSampleType string
+	Samples           []profileSample
+}
+
+// sampleIndex returns the index of the named sample type, or the
+// profile's default ("" picks the default, as pprof does).
+func (p *parsedProfile) sampleIndex(name string) (int, error) {
+	if name == "" {
+		name = p.DefaultSampleType
+	}
+	if name == "" {
+		return len(p.SampleTypes) - 1, nil
+	}
+	for i, st := range p.SampleTypes {
+		if st.Type == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("profile has no sample type %q", name)
+}
+
+// Raw messages hold string table indexes until the table, which may come
+// last, has been read.
+type rawSample struct {
+	locations []uint64
+	values    []int64
+	labels    [][2]int64 // key, str
+}
+
+type rawLine struct{ function uint64 }
+
+func parseProfile(data []byte) (*parsedProfile, error) {
+	data, err := gunzipIfNeeded(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		strs        []string
+		sampleTypes [][2]int64
+		samples     []rawSample
+		locations   = map[uint64][]rawLine{}
+		functions   = map[uint64]int64{} // id -> name index
+		defaultType int64
+	)
+	err = walkFields(data, func(field int, wire int, v uint64, b []byte) error {
+		switch field {
+		case 1: // sample_type
+			var vt [2]int64
+			err := walkFields(b, func(f, _ int, v uint64, _ []byte) error {
+				if f == 1 || f == 2 {
+					vt[f-1] = int64(v)
+				}
+				return nil
+			})
+			sampleTypes = append(sampleTypes, vt)
+			return err
+		case 2: // sample
+			var s rawSample
+			err := walkFields(b, func(f, wire int, v uint64, b []byte) error {
+				switch f {
+				case 1:
+					return appendVarints(&s.locations, wire, v, b)
+				case 2:
+					var vals []uint64
+					if err := appendVarints(&vals, wire, v, b); err != nil {
+						return err
+					}
+					for _, x := range vals {
+						s.values = append(s.values, int64(x))
+					}
+				case 3:
+					var l [2]int64
+					err := walkFields(b, func(f, _ int, v uint64, _ []byte) error {
+						if f == 1 || f == 2 {
+							l[f-1] = int64(v)
+						}
+						return nil
+					})
+					if err != nil {
+						return err
+					}
+					if l[1] != 0 {
+						s.labels = append(s.labels, l)
+					}
+				}
+				return nil
+			})
+			samples = append(samples, s)
+			return err
+		case 4: // location
+			var id uint64
+			var lines []rawLine
+			err := walkFields(b, func(f, _ int, v uint64, b []byte) error {
+				switch f {
+				case 1:
+					id = v
+				case 4:
+					var ln rawLine
+					err := walkFields(b, func(f, _ int, v uint64, _ []byte) error {
+						if f == 1 {
+							ln.function = v
+						}
+						return nil
+					})
+					lines = append(lines, ln)
+					return err
+				}
+				return nil
+			})
+			locations[id] = lines
+			return err
+		case 5: // function
+			var id uint64
+			var name int64
+			err := walkFields(b, func(f, _ int, v uint64, _ []byte) error {
+				switch f {
+				case 1:
+					id = v
+				case 2:
+					name = int64(v)
+				}
+				return nil
+			})
+			functions[id] = name
+			return err
+		case 6: // string_table
+			strs = append(strs, string(b))
+		case 14: // default_sample_type
+			defaultType = int64(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decoding profile: %w", err)
+	}
+
+	str := func(i int64) string {
+		if i < 0 || int(i) >= len(strs) {
+			return ""
+		}
+		return strs[i]
+	}
+	p := &parsedProfile{DefaultSampleType: str(defaultType)}
+	for _, vt := range sampleTypes {
+		p.SampleTypes = append(p.SampleTypes, valueType{str(vt[0]), str(vt[1])})
+	}
+	for _, rs := range samples {
+		s := profileSample{Values: rs.values}
+		for _, loc := range rs.locations {
+			for _, ln := range locations[loc] {
+				s.Stack = append(s.Stack, str(functions[ln.function]))
+			}
+		}
+		for _, l := range rs.labels {
+			if s.Labels == nil {
+				s.Labels = make(map[string]string)
+			}
+			s.Labels[str(l[0])] = str(l[1])
+		}
+		p.Samples = append(p.Samples, s)
+	}
+	return p, nil
+}
+
+// gunzipIfNeeded inflates gzipped profiles, as written by runtime/pprof,
+// and returns raw ones unchanged.
+func gunzipIfNeeded(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+// walkFields calls fn for each field of a protobuf message. v holds
+// varint and fixed-width values; b holds length-delimited payloads.
+func walkFields(data []byte, fn func(field, wire int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("bad field key")
+		}
+		data = data[n:]
+		field, wire := int(key>>3), int(key&7)
+		var v uint64
+		var b []byte
+		switch wire {
+		case 0:
+			v, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("bad varint")
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return io.ErrUnexpectedEOF
+			}
+			v, data = binary.LittleEndian.Uint64(data), data[8:]
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return io.ErrUnexpectedEOF
+			}
+			b, data = data[n:n+int(l)], data[n+int(l):]
+		case 5:
+			if len(data) < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", wire)
+		}
+		if err := fn(field, wire, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendVarints handles a repeated integer field in either packed
+// (wire type 2) or unpacked form.
+func appendVarints(dst *[]uint64, wire int, v uint64, b []byte) error {
+	if wire != 2 {
+		*dst = append(*dst, v)
+		return nil
+	}
+	for len(b) > 0 {
+		x, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("bad packed varint")
+		}
+		*dst = append(*dst, x)
+		b = b[n:]
+	}
+	return nil
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// profiler.go captures CPU, heap, allocs, mutex and block profiles on a
+// schedule into a rotating directory, so a regression can be compared
+// against what the service looked like an hour ago.
+
+var profileCaptures = registry.counter("profile_captures_total",
+	"Continuous profiling captures, by outcome.", "result")
+
+var allProfileTypes = []string{"cpu", "heap", "allocs", "mutex", "block"}
+
+type profiler struct {
+	dir         string
+	interval    time.Duration
+	cpuDuration time.Duration
+	types       []string
+	retain      int
+	pushURL     string
+	app         string
+	labels      map[string]string
+	client      *http.Client
+}
+
+// profilingEnabled is set once continuous profiling starts; request
+// labelling is skipped when nobody is collecting the profiles.
+var profilingEnabled bool
+
+// startProfiler is enabled by PROFILE_DIR. Every PROFILE_INTERVAL (1m) it
+// records PROFILE_TYPES (all of cpu,heap,allocs,mutex,block), the CPU
+// profile over PROFILE_CPU_DURATION (10s), keeping PROFILE_RETAIN (60)
+// captures. PROFILE_PUSH_URL additionally sends each profile to a
+// Pyroscope-compatible /ingest endpoint.
+func startProfiler(ctx context.Context, app string) {
+	dir := os.Getenv("PROFILE_DIR")
+	if dir == "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Printf("Continuous profiling disabled: %v", err)
+		return
+	}
+	retain, err := strconv.Atoi(envOr("PROFILE_RETAIN", "60"))
+	if err != nil || retain <= 0 {
+		retain = 60
+	}
+	p := &profiler{
+		dir:         dir,
+		interval:    envDuration("PROFILE_INTERVAL", time.Minute),
+		cpuDuration: envDuration("PROFILE_CPU_DURATION", 10*time.Second),
+		retain:      retain,
+		pushURL:     strings.TrimRight(os.Getenv("PROFILE_PUSH_URL"), "/"),
+		app:         envOr("PROFILE_APP_NAME", app),
+		labels:      map[string]string{"version": buildVersion()},
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+	if host, err := os.Hostname(); err == nil {
+		p.labels["instance"] = host
+	}
+	for _, t := range strings.Split(envOr("PROFILE_TYPES", strings.Join(allProfileTypes, ",")), ",") {
+		t = strings.TrimSpace(t)
+		switch t {
+		case "cpu", "heap", "allocs":
+		case "mutex":
+			runtime.SetMutexProfileFraction(int(envFloat("PROFILE_MUTEX_FRACTION", 5)))
+		case "block":
+			runtime.SetBlockProfileRate(int(envDuration("PROFILE_BLOCK_RATE", 10*time.Microsecond)))
+		default:
+			log.Printf("Continuous profiling: ignoring unknown profile type %q", t)
+			continue
+		}
+		p.types = append(p.types, t)
+	}
+	if p.cpuDuration >= p.interval {
+		p.cpuDuration = p.interval / 2
+	}
+	profilingEnabled = true
+	log.Printf("Continuous profiling %v every %s into %s", p.types, p.interval, dir)
+	go p.run(ctx)
+}
+
+func (p *profiler) run(ctx context.Context) {
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := p.capture(ctx); err != nil {
+			profileCaptures.with("error").inc()
+			slog.Error("profile capture failed", "err", err)
+			continue
+		}
+		profileCaptures.with("ok").inc()
+		pruneCaptures(p.dir, p.retain)
+	}
+}
+
+// capture records one set of profiles. Profiles are buffered in memory
+// first because the CPU profile takes seconds and the directory should
+// only appear once everything is in it.
+func (p *profiler) capture(ctx context.Context) error {
+	start := time.Now()
+	data := make(map[string][]byte)
+	for _, t := range p.types {
+		var buf bytes.Buffer
+		if t == "cpu" {
+			if err := pprof.StartCPUProfile(&buf); err != nil {
+				// Someone else is profiling; skip rather than fail the set.
+				slog.Warn("skipping CPU profile", "err", err)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(p.cpuDuration):
+			}
+			pprof.StopCPUProfile()
+		} else if err := pprof.Lookup(t).WriteTo(&buf, 0); err != nil {
+			return fmt.Errorf("%s profile: %w", t, err)
+		}
+		data[t] = buf.Bytes()
+	}
+	end := time.Now()
+
+	files := []captureFile{{"labels.json", func(w io.Writer) error {
+		return writeJSON(w, map[string]any{"app": p.app, "labels": p.labels, "start": start, "end": end})
+	}}}
+	for _, t := range sortedKeys(data) {
+		b := data[t]
+		files = append(files, captureFile{t + ".pprof", func(w io.Writer) error {
+			_, err := w.Write(b)
+			return err
+		}})
+	}
+	if _, err := writeCaptureDir(p.dir, start.UTC().Format("20060102T150405Z"), files); err != nil {
+		return err
+	}
+
+	if p.pushURL != "" {
+		for t, b := range data {
+			if err := p.push(t, b, start, end); err != nil {
+				slog.Warn("profile push failed", "type", t, "err", err)
+			}
+		}
+	}
+	return nil
+}
+
+// push sends one profile to Pyroscope's ingest API. The application name
+// carries the labels in Pyroscope's app{key=value} syntax.
+func (p *profiler) push(kind string, data []byte, from, until time.Time) error {
+	var labels []string
+	for _, k := range sortedKeys(p.labels) {
+		labels = append(labels, k+"="+p.labels[k])
+	}
+	q := url.Values{}
+	q.Set("name", fmt.Sprintf("%s.%s{%s}", p.app, kind, strings.Join(labels, ",")))
+	q.Set("from", strconv.FormatInt(from.Unix(), 10))
+	q.Set("until", strconv.FormatInt(until.Unix(), 10))
+	q.Set("format", "pprof")
+	q.Set("spyName", "gospy")
+	req, err := http.NewRequest(http.MethodPost, p.pushURL+"/ingest?"+q.Encode(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if token := os.Getenv("PROFILE_PUSH_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", p.pushURL, resp.Status)
+	}
+	return nil
+}
+
+// labelRoutes tags each request's goroutine with its route so profiles
+// can be broken down per endpoint.
+func labelRoutes(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !profilingEnabled {
+			return next(c)
+		}
+		var err error
+		r := c.Request()
+		pprof.Do(r.Context(), pprof.Labels("route", c.Path(), "method", r.Method), func(ctx context.Context) {
+			c.SetRequest(r.WithContext(ctx))
+			err = next(c)
+		})
+		return err
+	}
+}
+
+// buildVersion is APP_VERSION, else the module version or VCS revision
+// stamped into the binary.
+func buildVersion() string {
+	if v := os.Getenv("APP_VERSION"); v != "" {
+		return v
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+			return s.Value[:12]
+		}
+	}
+	return "devel"
+}
+
+func runProfiles(args []string) int {
+	if len(args) == 0 || args[0] != "compare" {
+		fmt.Fprintf(os.Stderr, "Usage: %s profiles compare [flags] OLD NEW\n", filepath.Base(os.Args[0]))
+		return 2
+	}
+	fs := flag.NewFlagSet("profiles compare", flag.ExitOnError)
+	kind := fs.String("type", "", "profile type to compare when OLD and NEW are capture directories (default: all)")
+	sample := fs.String("sample", "", "sample type, e.g. alloc_space or inuse_objects (default: the profile's default)")
+	top := fs.Int("top", 15, "rows to show per profile")
+	cum := fs.Bool("cum", false, "compare cumulative rather than flat values")
+	tag := fs.String("tag", "", "group by this pprof label (e.g. route) instead of function")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s profiles compare [flags] OLD NEW\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintln(fs.Output(), "Diffs two profiles, or two capture directories written by PROFILE_DIR,")
+		fmt.Fprintln(fs.Output(), "listing the functions whose share changed the most.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	oldPath, newPath := fs.Arg(0), fs.Arg(1)
+
+	pairs, err := profilePairs(oldPath, newPath, *kind)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "profiles compare: %v\n", err)
+		return 1
+	}
+	for i, pair := range pairs {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := compareProfiles(os.Stdout, pair[0], pair[1], *sample, *tag, *cum, *top); err != nil {
+			fmt.Fprintf(os.Stderr, "profiles compare: %v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// profilePairs resolves OLD and NEW to matching profile files. Two
+// directories pair up their <type>.pprof files.
+func profilePairs(oldPath, newPath, kind string) ([][2]string, error) {
+	oldInfo, err := os.Stat(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	if !oldInfo.IsDir() {
+		return [][2]string{{oldPath, newPath}}, nil
+	}
+	types := allProfileTypes
+	if kind != "" {
+		types = []string{kind}
+	}
+	var pairs [][2]string
+	for _, t := range types {
+		o, n := filepath.Join(oldPath, t+".pprof"), filepath.Join(newPath, t+".pprof")
+		if _, err := os.Stat(o); err != nil {
+			continue
+		}
+		if _, err := os.Stat(n); err != nil {
+			continue
+		}
+		pairs = append(pairs, [2]string{o, n})
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no profiles in common between %s and %s", oldPath, newPath)
+	}
+	return pairs, nil
+}
+
+type profileDelta struct {
+	name     string
+	old, new int64
+}
+
+func compareProfiles(w io.Writer, oldPath, newPath, sample, tag string, cum bool, top int) error {
+	var totals [2]map[string]int64
+	var sum [2]int64
+	var unit valueType
+	for i, path := range []string{oldPath, newPath} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		p, err := parseProfile(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		idx, err := p.sampleIndex(sample)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		unit = p.SampleTypes[idx]
+		totals[i], sum[i] = aggregateProfile(p, idx, tag, cum)
+	}
+
+	keys := make(map[string]bool)
+	for _, t := range totals {
+		for k := range t {
+			keys[k] = true
+		}
+	}
+	var rows []profileDelta
+	for k := range keys {
+		rows = append(rows, profileDelta{k, totals[0][k], totals[1][k]})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		di, dj := abs64(rows[i].new-rows[i].old), abs64(rows[j].new-rows[j].old)
+		if di != dj {
+			return di > dj
+		}
+		return rows[i].name < rows[j].name
+	})
+	if len(rows) > top {
+		rows = rows[:top]
+	}
+
+	fmt.Fprintf(w, "%s (%s/%s): total %s -> %s (%s)\n", filepath.Base(newPath), unit.Type, unit.Unit,
+		formatProfileValue(sum[0], unit.Unit), formatProfileValue(sum[1], unit.Unit), percentChange(sum[0], sum[1]))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	heading := "FUNCTION"
+	if tag != "" {
+		heading = strings.ToUpper(tag)
+	}
+	fmt.Fprintf(tw, "OLD\tNEW\tDELTA\tCHANGE\t  %s\n", heading)
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t  %s\n", formatProfileValue(r.old, unit.Unit), formatProfileValue(r.new, unit.Unit),
+			formatProfileValue(r.new-r.old, unit.Unit), percentChange(r.old, r.new), r.name)
+	}
+	return tw.Flush()
+}
+
+// aggregateProfile sums sample values by leaf function (flat), by every
+// function on the stack (cum) or by a label value.
+func aggregateProfile(p *parsedProfile, idx int, tag string, cum bool) (map[string]int64, int64) {
+	out := make(map[string]int64)
+	var total int64
+	for _, s := range p.Samples {
+		if idx >= len(s.Values) {
+			continue
+		}
+		v := s.Values[idx]
+		total += v
+		switch {
+		case tag != "":
+			name, ok := s.Labels[tag]
+			if !ok {
+				name = "(no " + tag + ")"
+			}
+			out[name] += v
+		case cum:
+			seen := make(map[string]bool)
+			for _, fn := range s.Stack {
+				if !seen[fn] {
+					seen[fn] = true
+					out[fn] += v
+				}
+			}
+		case len(s.Stack) > 0:
+			out[s.Stack[0]] += v
+		}
+	}
+	return out, total
+}
+
+func formatProfileValue(v int64, unit string) string {
+	switch unit {
+	case "nanoseconds":
+		return time.Duration(v).Round(time.Microsecond).String()
+	case "bytes":
+		a, sign := abs64(v), ""
+		if v < 0 {
+			sign = "-"
+		}
+		switch {
+		case a >= 1<<30:
+			return fmt.Sprintf("%s%.1fGiB", sign, float64(a)/(1<<30))
+		case a >= 1<<20:
+			return fmt.Sprintf("%s%.1fMiB", sign, float64(a)/(1<<20))
+		case a >= 1<<10:
+			return fmt.Sprintf("%s%.1fKiB", sign, float64(a)/(1<<10))
+		}
+		return fmt.Sprintf("%dB", v)
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+func percentChange(old, new int64) string {
+	if old == 0 {
+		if new == 0 {
+			return "0%"
+		}
+		return "new"
+	}
+	return fmt.Sprintf("%+.0f%%", float64(new-old)/float64(old)*100)
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
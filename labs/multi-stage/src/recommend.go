@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// distribution is a log-bucketed histogram. Each bucket is distGrowth
+// wider than the one below it, so quantiles stay within 2% however long
+// the service runs while memory is bounded by the range of values rather
+// than their number.
+type distribution struct {
+	zero    uint64
+	buckets map[int]uint64
+	count   uint64
+	max     float64
+}
+
+const distGrowth = 1.02
+
+func (d *distribution) add(v float64) {
+	if d.buckets == nil {
+		d.buckets = make(map[int]uint64)
+	}
+	d.count++
+	d.max = max(d.max, v)
+	if v <= 0 {
+		d.zero++
+		return
+	}
+	d.buckets[int(math.Ceil(math.Log(v)/math.Log(distGrowth)))]++
+}
+
+// quantile returns the upper bound of the bucket holding the q-th value.
+func (d *distribution) quantile(q float64) float64 {
+	if d.count == 0 {
+		return 0
+	}
+	rank := max(uint64(math.Ceil(q*float64(d.count))), 1)
+	if rank <= d.zero {
+		return 0
+	}
+	keys := make([]int, 0, len(d.buckets))
+	for k := range d.buckets {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	seen := d.zero
+	for _, k := range keys {
+		seen += d.buckets[k]
+		if seen >= rank {
+			return min(math.Pow(distGrowth, float64(k)), d.max)
+		}
+	}
+	return d.max
+}
+
+type usageQuantiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+func (d *distribution) quantiles() usageQuantiles {
+	return usageQuantiles{
+		P50: d.quantile(0.50),
+		P90: d.quantile(0.90),
+		P95: d.quantile(0.95),
+		P99: d.quantile(0.99),
+		Max: d.max,
+	}
+}
+
+// usageAggregate keeps usage distributions for the life of the process,
+// long after the samples have rotated out of the history ring.
+type usageAggregate struct {
+	cg cgroupInfo
+
+	mu         sync.Mutex
+	since      time.Time
+	cpu        distribution // cores
+	memory     distribution // working set bytes
+	goroutines distribution
+
+	baseCPU cpuStat
+	baseMem memoryEvents
+}
+
+var usageStats *usageAggregate
+
+func newUsageAggregate(cg cgroupInfo) *usageAggregate {
+	a := &usageAggregate{cg: cg, since: time.Now()}
+	a.baseCPU, _ = cg.readCPUStat()
+	a.baseMem, _ = cg.readMemoryEvents()
+	return a
+}
+
+// observe records one sample. The cgroup figures are preferred because
+// they are what the limits are enforced against; the process's own CPU
+// and RSS stand in when there is no cgroup.
+func (a *usageAggregate) observe(u usageSample) {
+	cpu := u.CPUPercent
+	if a.cg.CPUDir != "" {
+		cpu = u.CgroupCPUPercent
+	}
+	mem := u.RSSBytes
+	if u.WorkingSetBytes > 0 {
+		mem = u.WorkingSetBytes
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cpu.add(cpu / 100)
+	a.memory.add(float64(mem))
+	a.goroutines.add(float64(u.Goroutines))
+}
+
+// Headroom rules. Requests cover typical load (p90 CPU, p95 memory) with
+// 20% to spare. Limits cover the peak: CPU is compressible, so its limit
+// is sized from p99 and only costs latency when exceeded; memory is not,
+// so its limit is sized from the maximum ever seen.
+const (
+	requestHeadroom = 1.2
+	minCPUCores     = 0.05
+	minMemoryBytes  = 32 << 20
+
+	// A limit this many times the recommendation is reported as wasteful.
+	wastefulFactor = 3
+	// Usage within this fraction of a limit is reported as too tight.
+	tightFraction = 0.9
+)
+
+type recommendationFinding struct {
+	Kind     string `json:"kind"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+type kubeResources struct {
+	Requests map[string]string `json:"requests"`
+	Limits   map[string]string `json:"limits"`
+}
+
+type composeResources struct {
+	Limits       map[string]string `json:"limits"`
+	Reservations map[string]string `json:"reservations"`
+}
+
+type resourceRecommendation struct {
+	CPURequestCores    float64          `json:"cpu_request_cores"`
+	CPULimitCores      float64          `json:"cpu_limit_cores"`
+	MemoryRequestBytes uint64           `json:"memory_request_bytes"`
+	MemoryLimitBytes   uint64           `json:"memory_limit_bytes"`
+	Kubernetes         kubeResources    `json:"kubernetes"`
+	Compose            composeResources `json:"compose"`
+}
+
+type recommendationReport struct {
+	ObservedFor string `json:"observed_for"`
+	Samples     uint64 `json:"samples"`
+	Confidence  string `json:"confidence"`
+	Observed    struct {
+		CPUCores    usageQuantiles `json:"cpu_cores"`
+		MemoryBytes usageQuantiles `json:"memory_working_set_bytes"`
+		Goroutines  usageQuantiles `json:"goroutines"`
+	} `json:"observed"`
+	Current     cgroupLimits            `json:"current_limits"`
+	Throttled   float64                 `json:"throttled_ratio"`
+	Recommended resourceRecommendation  `json:"recommended"`
+	Findings    []recommendationFinding `json:"findings"`
+}
+
+// recommend turns the observed distributions into requests and limits and
+// checks them against the limits the cgroup currently enforces.
+// RECOMMEND_CPU_HEADROOM (1.5) and RECOMMEND_MEMORY_HEADROOM (1.3) scale
+// the limits; recommendations are marked low confidence until
+// RECOMMEND_MIN_OBSERVATION (30m) of data has been seen.
+func (a *usageAggregate) recommend(now time.Time) recommendationReport {
+	cpuHeadroom := envFloat("RECOMMEND_CPU_HEADROOM", 1.5)
+	memHeadroom := envFloat("RECOMMEND_MEMORY_HEADROOM", 1.3)
+	minObservation := envDuration("RECOMMEND_MIN_OBSERVATION", 30*time.Minute)
+
+	var rep recommendationReport
+	a.mu.Lock()
+	observed := now.Sub(a.since)
+	rep.Samples = a.cpu.count
+	rep.Observed.CPUCores = a.cpu.quantiles()
+	rep.Observed.MemoryBytes = a.memory.quantiles()
+	rep.Observed.Goroutines = a.goroutines.quantiles()
+	a.mu.Unlock()
+
+	rep.ObservedFor = observed.Round(time.Second).String()
+	rep.Confidence = "high"
+	if observed < minObservation {
+		rep.Confidence = "low"
+		rep.Findings = append(rep.Findings, recommendationFinding{"low_confidence", "info",
+			fmt.Sprintf("only %s of usage observed; run representative load for at least %s", rep.ObservedFor, minObservation)})
+	}
+
+	cpu, mem := rep.Observed.CPUCores, rep.Observed.MemoryBytes
+	r := &rep.Recommended
+	r.CPURequestCores = roundCores(max(cpu.P90*requestHeadroom, minCPUCores))
+	r.CPULimitCores = roundCores(max(cpu.P99*cpuHeadroom, r.CPURequestCores))
+	r.MemoryRequestBytes = roundMemory(max(mem.P95*requestHeadroom, minMemoryBytes))
+	r.MemoryLimitBytes = roundMemory(max(mem.Max*memHeadroom, float64(r.MemoryRequestBytes)))
+	r.Kubernetes = kubeResources{
+		Requests: map[string]string{"cpu": kubeCPU(r.CPURequestCores), "memory": kubeMemory(r.MemoryRequestBytes)},
+		Limits:   map[string]string{"cpu": kubeCPU(r.CPULimitCores), "memory": kubeMemory(r.MemoryLimitBytes)},
+	}
+	r.Compose = composeResources{
+		Limits:       map[string]string{"cpus": composeCPU(r.CPULimitCores), "memory": composeMemory(r.MemoryLimitBytes)},
+		Reservations: map[string]string{"cpus": composeCPU(r.CPURequestCores), "memory": composeMemory(r.MemoryRequestBytes)},
+	}
+
+	rep.Current = a.cg.readLimits()
+	if st, err := a.cg.readCPUStat(); err == nil {
+		if periods := delta(a.baseCPU.NrPeriods, st.NrPeriods); periods > 0 {
+			rep.Throttled = float64(delta(a.baseCPU.NrThrottled, st.NrThrottled)) / float64(periods)
+		}
+	}
+	var memEvents memoryEvents
+	if ev, err := a.cg.readMemoryEvents(); err == nil {
+		memEvents = memoryEvents{
+			High:    delta(a.baseMem.High, ev.High),
+			Max:     delta(a.baseMem.Max, ev.Max),
+			OOM:     delta(a.baseMem.OOM, ev.OOM),
+			OOMKill: delta(a.baseMem.OOMKill, ev.OOMKill),
+		}
+	}
+	rep.Findings = append(rep.Findings, limitFindings(rep, memEvents)...)
+	if rep.Findings == nil {
+		rep.Findings = []recommendationFinding{}
+	}
+	return rep
+}
+
+func limitFindings(rep recommendationReport, ev memoryEvents) []recommendationFinding {
+	var out []recommendationFinding
+	cur, rec := rep.Current, rep.Recommended
+	cpu, mem := rep.Observed.CPUCores, rep.Observed.MemoryBytes
+
+	switch {
+	case cur.CPUCores == 0:
+		out = append(out, recommendationFinding{"no_cpu_limit", "info",
+			fmt.Sprintf("no CPU limit is set; suggest %s", kubeCPU(rec.CPULimitCores))})
+	case rep.Throttled >= 0.05 || cpu.P99 >= tightFraction*cur.CPUCores:
+		out = append(out, recommendationFinding{"cpu_limit_tight", "warning",
+			fmt.Sprintf("CPU limit %s is too tight: throttled in %.0f%% of periods, p99 usage %s; suggest %s",
+				kubeCPU(cur.CPUCores), rep.Throttled*100, kubeCPU(cpu.P99), kubeCPU(rec.CPULimitCores))})
+	case rep.Confidence == "high" && cur.CPUCores > wastefulFactor*rec.CPULimitCores:
+		out = append(out, recommendationFinding{"cpu_limit_wasteful", "info",
+			fmt.Sprintf("CPU limit %s is over %dx the p99 usage of %s; suggest %s",
+				kubeCPU(cur.CPUCores), wastefulFactor, kubeCPU(cpu.P99), kubeCPU(rec.CPULimitCores))})
+	}
+
+	switch {
+	case cur.MemoryBytes == 0:
+		out = append(out, recommendationFinding{"no_memory_limit", "info",
+			fmt.Sprintf("no memory limit is set; suggest %s", kubeMemory(rec.MemoryLimitBytes))})
+	case ev.OOM > 0 || ev.OOMKill > 0:
+		out = append(out, recommendationFinding{"memory_limit_tight", "critical",
+			fmt.Sprintf("memory limit %s was hit %d times (%d OOM kills); suggest %s",
+				kubeMemory(cur.MemoryBytes), ev.OOM, ev.OOMKill, kubeMemory(rec.MemoryLimitBytes))})
+	case ev.High > 0 || ev.Max > 0 || mem.Max >= tightFraction*float64(cur.MemoryBytes):
+		out = append(out, recommendationFinding{"memory_limit_tight", "warning",
+			fmt.Sprintf("memory limit %s is near-OOM: peak working set %s; suggest %s",
+				kubeMemory(cur.MemoryBytes), kubeMemory(uint64(mem.Max)), kubeMemory(rec.MemoryLimitBytes))})
+	case rep.Confidence == "high" && cur.MemoryBytes > wastefulFactor*rec.MemoryLimitBytes:
+		out = append(out, recommendationFinding{"memory_limit_wasteful", "info",
+			fmt.Sprintf("memory limit %s is over %dx the recommendation; suggest %s",
+				kubeMemory(cur.MemoryBytes), wastefulFactor, kubeMemory(rec.MemoryLimitBytes))})
+	}
+	return out
+}
+
+// roundCores rounds up to the next 10 millicores.
+func roundCores(c float64) float64 { return math.Ceil(c*100) / 100 }
+
+// roundMemory rounds up to the next 8Mi.
+func roundMemory(b float64) uint64 {
+	const step = 8 << 20
+	return uint64(math.Ceil(b/step)) * step
+}
+
+func kubeCPU(c float64) string      { return fmt.Sprintf("%.0fm", math.Ceil(c*1000)) }
+func kubeMemory(b uint64) string    { return fmt.Sprintf("%dMi", (b+(1<<20)-1)>>20) }
+func composeCPU(c float64) string   { return fmt.Sprintf("%.2f", c) }
+func composeMemory(b uint64) string { return fmt.Sprintf("%dM", (b+(1<<20)-1)>>20) }
+
+// recommendationsHandler serves suggested requests and limits based on
+// the usage seen since startup.
+func recommendationsHandler(w http.ResponseWriter, r *http.Request) {
+	if usageStats == nil {
+		http.Error(w, "resource history is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usageStats.recommend(time.Now()))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDownsample(t *testing.T) {
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var samples []usageSample
+	for i := 0; i < 6; i++ {
+		samples = append(samples, usageSample{
+			Time:            base.Add(time.Duration(i) * time.Second),
+			CPUPercent:      float64(i * 10),
+			RSSBytes:        uint64(100 + i),
+			Goroutines:      10 - i,
+			CgroupThrottled: 1,
+		})
+	}
+
+	got := downsample(samples, 3*time.Second)
+	if len(got) != 2 {
+		t.Fatalf("got %d buckets; want 2", len(got))
+	}
+	first := got[0]
+	if !first.Time.Equal(base) || first.CPUPercent != 10 || first.RSSBytes != 102 || first.Goroutines != 10 || first.CgroupThrottled != 3 {
+		t.Errorf("first bucket = %+v", first)
+	}
+	if got[1].CPUPercent != 40 || got[1].RSSBytes != 105 || got[1].Goroutines != 7 {
+		t.Errorf("second bucket = %+v", got[1])
+	}
+	if n := len(downsample(samples, 0)); n != len(samples) {
+		t.Errorf("step 0 returned %d samples; want all %d", n, len(samples))
+	}
+}
+
+func TestReadProcSelfStat(t *testing.T) {
+	cpu, rss, err := readProcSelfStat()
+	if err != nil {
+		t.Skip(err)
+	}
+	if cpu < 0 || rss == 0 {
+		t.Errorf("cpu = %v, rss = %d", cpu, rss)
+	}
+}
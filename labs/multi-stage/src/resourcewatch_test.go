@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCgroupFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResourceWatcherSample(t *testing.T) {
+	dir := t.TempDir()
+	w := &resourceWatcher{
+		cg:            cgroupInfo{Version: 2, CPUDir: dir, MemDir: dir},
+		throttleRatio: 0.1,
+		psiThreshold:  10,
+		stalled:       make(map[string]bool),
+	}
+
+	writeCgroupFiles(t, dir, map[string]string{
+		"cpu.stat":        "usage_usec 1000\nnr_periods 100\nnr_throttled 5\nthrottled_usec 2000\n",
+		"memory.events":   "low 0\nhigh 3\nmax 0\noom 0\noom_kill 1\n",
+		"memory.pressure": "some avg10=0.00 avg60=0.00 avg300=0.00 total=0\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=0\n",
+	})
+	if events := w.sample(time.Now()); len(events) != 0 {
+		t.Fatalf("priming sample raised %d events; want none for pre-existing counts", len(events))
+	}
+
+	writeCgroupFiles(t, dir, map[string]string{
+		"cpu.stat":        "usage_usec 9000\nnr_periods 200\nnr_throttled 55\nthrottled_usec 902000\n",
+		"memory.events":   "low 0\nhigh 3\nmax 0\noom 0\noom_kill 2\n",
+		"memory.pressure": "some avg10=42.50 avg60=10.00 avg300=1.00 total=123\nfull avg10=40.00 avg60=9.00 avg300=1.00 total=100\n",
+	})
+	kinds := map[string]ResourceEvent{}
+	for _, ev := range w.sample(time.Now()) {
+		kinds[ev.Kind] = ev
+	}
+	if ev, ok := kinds["cpu_throttled"]; !ok || ev.Values["ratio"] != 0.5 || ev.Values["throttled_usec"] != 900000 {
+		t.Errorf("cpu_throttled = %+v; want ratio 0.5 and 900000us", ev)
+	}
+	if ev, ok := kinds["oom_kill"]; !ok || ev.Severity != "critical" || ev.Values["count"] != 1 {
+		t.Errorf("oom_kill = %+v; want one critical event", ev)
+	}
+	if _, ok := kinds["memory_high"]; ok {
+		t.Errorf("memory_high fired without a change in the counter")
+	}
+	if _, ok := kinds["memory_pressure"]; !ok {
+		t.Errorf("memory_pressure did not fire at avg10=42.5")
+	}
+
+	// Pressure stays high: no repeat event until it recovers.
+	if events := w.sample(time.Now()); len(events) != 0 {
+		t.Errorf("steady state raised %v", events)
+	}
+}
+
+func TestBroadcastRingRecentWraps(t *testing.T) {
+	r := newBroadcastRing[ResourceEvent](3)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		r.publish(ResourceEvent{Kind: k})
+	}
+	got := r.recent()
+	if len(got) != 3 || got[0].Kind != "b" || got[2].Kind != "d" {
+		t.Errorf("recent = %v; want b, c, d", got)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"math"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runtimemetrics.go exports every metric the runtime/metrics package
+// supports under go_* names, following the naming client_golang uses:
+// "/gc/heap/allocs:bytes" becomes go_gc_heap_allocs_bytes_total.
+
+// runtimeReader caches one metrics.Read of every supported metric, so a
+// scrape reads the runtime once rather than once per family.
+type runtimeReader struct {
+	mu      sync.Mutex
+	samples []metrics.Sample
+	index   map[string]int
+	readAt  time.Time
+}
+
+var runtimeStats = newRuntimeReader()
+
+const runtimeReadTTL = 250 * time.Millisecond
+
+func newRuntimeReader() *runtimeReader {
+	r := &runtimeReader{index: make(map[string]int)}
+	for i, d := range metrics.All() {
+		r.samples = append(r.samples, metrics.Sample{Name: d.Name})
+		r.index[d.Name] = i
+	}
+	return r
+}
+
+func (r *runtimeReader) refresh() {
+	if time.Since(r.readAt) > runtimeReadTTL {
+		metrics.Read(r.samples)
+		r.readAt = time.Now()
+	}
+}
+
+// value returns a scalar metric as a float; unsupported names read as 0.
+func (r *runtimeReader) value(name string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i, ok := r.index[name]
+	if !ok {
+		return 0
+	}
+	r.refresh()
+	switch v := r.samples[i].Value; v.Kind() {
+	case metrics.KindUint64:
+		return float64(v.Uint64())
+	case metrics.KindFloat64:
+		return v.Float64()
+	}
+	return 0
+}
+
+// histogram returns a copy of a histogram metric, or nil. The runtime
+// reuses the histogram's memory on the next Read.
+func (r *runtimeReader) histogram(name string) *metrics.Float64Histogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i, ok := r.index[name]
+	if !ok {
+		return nil
+	}
+	r.refresh()
+	v := r.samples[i].Value
+	if v.Kind() != metrics.KindFloat64Histogram {
+		return nil
+	}
+	h := v.Float64Histogram()
+	return &metrics.Float64Histogram{
+		Counts:  append([]uint64(nil), h.Counts...),
+		Buckets: append([]float64(nil), h.Buckets...),
+	}
+}
+
+// The runtime's histograms have well over a hundred buckets; they are
+// exported on these coarser boundaries instead.
+var (
+	runtimeSecondsBuckets = []float64{1e-6, 1e-5, 5e-5, 1e-4, 2.5e-4, 5e-4, 1e-3, 2.5e-3, 5e-3, 0.01, 0.025, 0.05, 0.1, 0.25, 1}
+	runtimeBytesBuckets   = []float64{8, 16, 32, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768}
+)
+
+func init() {
+	for _, d := range metrics.All() {
+		name := runtimeMetricName(d)
+		if name == "" {
+			continue
+		}
+		help := d.Description
+		if i := strings.Index(help, ". "); i > 0 {
+			help = help[:i+1] // the first sentence is enough for HELP
+		}
+		help += " (runtime/metrics " + d.Name + ")"
+		metric := d.Name
+		switch {
+		case d.Kind == metrics.KindFloat64Histogram:
+			buckets := runtimeBytesBuckets
+			if strings.HasSuffix(d.Name, ":seconds") {
+				buckets = runtimeSecondsBuckets
+			}
+			registry.histogramFunc(name, help, buckets, func() metricSample {
+				return rebucket(runtimeStats.histogram(metric), buckets)
+			})
+		case d.Cumulative:
+			registry.counterFunc(name, help, func() float64 { return runtimeStats.value(metric) })
+		default:
+			registry.gaugeFunc(name, help, func() float64 { return runtimeStats.value(metric) })
+		}
+	}
+	registry.gaugeFunc("go_gc_cpu_fraction",
+		"Fraction of available CPU time used by the GC since the process started.", func() float64 {
+			total := runtimeStats.value("/cpu/classes/total:cpu-seconds")
+			if total == 0 {
+				return 0
+			}
+			return runtimeStats.value("/cpu/classes/gc/total:cpu-seconds") / total
+		})
+}
+
+// runtimeMetricName maps a runtime/metrics name to a Prometheus one.
+// Metrics of unknown kind are not exported.
+func runtimeMetricName(d metrics.Description) string {
+	if d.Kind == metrics.KindBad {
+		return ""
+	}
+	path, unit, _ := strings.Cut(strings.TrimPrefix(d.Name, "/"), ":")
+	name := "go_" + strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return '_'
+	}, path+"_"+unit)
+	if d.Cumulative && d.Kind != metrics.KindFloat64Histogram {
+		name += "_total"
+	}
+	return name
+}
+
+// rebucket folds a runtime histogram into cumulative counts on bounds. A
+// runtime bucket is counted under the first bound at or above its upper
+// edge. The sum is estimated from bucket midpoints, as the runtime does
+// not record one.
+func rebucket(h *metrics.Float64Histogram, bounds []float64) metricSample {
+	s := metricSample{Counts: make([]uint64, len(bounds)+1)}
+	if h == nil {
+		return s
+	}
+	for i, c := range h.Counts {
+		if c == 0 {
+			continue
+		}
+		lo, hi := h.Buckets[i], h.Buckets[i+1]
+		mid := (lo + hi) / 2
+		switch {
+		case math.IsInf(lo, -1):
+			mid = hi
+		case math.IsInf(hi, 1):
+			mid = lo
+		}
+		s.Sum += mid * float64(c)
+		s.Count += c
+		for j, b := range bounds {
+			if hi <= b {
+				s.Counts[j] += c
+			}
+		}
+	}
+	s.Counts[len(bounds)] = s.Count
+	return s
+}
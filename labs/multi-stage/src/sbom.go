@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sbom.go writes a software bill of materials for a Go binary from the
+// module information the linker embeds, as CycloneDX 1.5 or SPDX 2.3 JSON.
+// Module checksums are the go.sum h1: hashes (SHA-256 of the module's
+// file tree), so `sbom verify` can check an SBOM against go.sum.
+
+func runSBOM(args []string) int {
+	if len(args) > 0 && args[0] == "verify" {
+		return runSBOMVerify(args[1:])
+	}
+	fs := flag.NewFlagSet("sbom", flag.ExitOnError)
+	format := fs.String("format", "cyclonedx", "cyclonedx or spdx")
+	out := fs.String("o", "", "write to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s sbom [flags] [BINARY]\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(fs.Output(), "       %s sbom verify [-gosum FILE] SBOM\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintln(fs.Output(), "Writes an SBOM for a Go binary (default: this one) from its embedded")
+		fmt.Fprintln(fs.Output(), "module information. verify checks an SBOM's module checksums against go.sum.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	var info *debug.BuildInfo
+	if fs.NArg() == 1 {
+		var err error
+		if info, err = buildinfo.ReadFile(fs.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stderr, "sbom: %v\n", err)
+			return 1
+		}
+	} else {
+		var ok bool
+		if info, ok = debug.ReadBuildInfo(); !ok {
+			fmt.Fprintln(os.Stderr, "sbom: this binary has no module information")
+			return 1
+		}
+	}
+
+	var doc any
+	switch *format {
+	case "cyclonedx":
+		doc = newCycloneDX(info, sbomTime(info))
+	case "spdx":
+		doc = newSPDX(info, sbomTime(info))
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sbom: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		fmt.Fprintf(os.Stderr, "sbom: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// sbomTime is SOURCE_DATE_EPOCH, else the VCS commit time, so that
+// rebuilding the same commit gives the same SBOM.
+func sbomTime(info *debug.BuildInfo) time.Time {
+	if s := os.Getenv("SOURCE_DATE_EPOCH"); s != "" {
+		if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Unix(sec, 0).UTC()
+		}
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.time" {
+			if t, err := time.Parse(time.RFC3339, s.Value); err == nil {
+				return t.UTC()
+			}
+		}
+	}
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+// sbomModule is a dependency after replacements are applied.
+type sbomModule struct {
+	Path     string
+	Version  string
+	Sum      string // go.sum h1: hash; empty for local replacements
+	Replaces string // original path@version
+}
+
+func sbomModules(info *debug.BuildInfo) []sbomModule {
+	var mods []sbomModule
+	for _, d := range info.Deps {
+		m := sbomModule{Path: d.Path, Version: d.Version, Sum: d.Sum}
+		if r := d.Replace; r != nil {
+			m = sbomModule{Path: r.Path, Version: r.Version, Sum: r.Sum, Replaces: d.Path + "@" + d.Version}
+		}
+		if m.Version == "" {
+			m.Version = "(devel)"
+		}
+		mods = append(mods, m)
+	}
+	return mods
+}
+
+// goToolchain returns the Go version without experiment suffixes, e.g.
+// "go1.25.0" from "go1.25.0 X:nocoverageredesign".
+func goToolchain(info *debug.BuildInfo) string {
+	v, _, _ := strings.Cut(info.GoVersion, " ")
+	return v
+}
+
+func goPURL(path, version string) string {
+	if version == "" || version == "(devel)" {
+		return "pkg:golang/" + path
+	}
+	return "pkg:golang/" + path + "@" + version
+}
+
+// stdlibPURL uses the name and version form vulnerability scanners match
+// the Go standard library on.
+func stdlibPURL(info *debug.BuildInfo) string {
+	return "pkg:golang/stdlib@" + strings.TrimPrefix(goToolchain(info), "go")
+}
+
+// sumSHA256 converts a go.sum "h1:<base64>" hash to hex SHA-256.
+func sumSHA256(sum string) string {
+	b64, ok := strings.CutPrefix(sum, "h1:")
+	if !ok {
+		return ""
+	}
+	b, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(b) != sha256.Size {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// sbomUUID derives a stable UUID from the build information, so the same
+// binary always gets the same serial number and namespace.
+func sbomUUID(info *debug.BuildInfo) string {
+	h := sha256.Sum256([]byte(info.String()))
+	h[6] = h[6]&0x0f | 0x50
+	h[8] = h[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// proxyURL is where the module zip a go.sum hash covers can be fetched.
+// Upper-case letters are escaped as the module proxy protocol requires.
+func proxyURL(path, version string) string {
+	escape := func(s string) string {
+		var b strings.Builder
+		for _, r := range s {
+			if 'A' <= r && r <= 'Z' {
+				b.WriteByte('!')
+				r += 'a' - 'A'
+			}
+			b.WriteRune(r)
+		}
+		return b.String()
+	}
+	return "https://proxy.golang.org/" + escape(path) + "/@v/" + escape(version) + ".zip"
+}
+
+type cdxBOM struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	SerialNumber string          `json:"serialNumber"`
+	Version      int             `json:"version"`
+	Metadata     cdxMetadata     `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     cdxTools     `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	Type       string        `json:"type"`
+	BOMRef     string        `json:"bom-ref,omitempty"`
+	Name       string        `json:"name"`
+	Version    string        `json:"version,omitempty"`
+	PURL       string        `json:"purl,omitempty"`
+	Hashes     []cdxHash     `json:"hashes,omitempty"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+func newCycloneDX(info *debug.BuildInfo, at time.Time) *cdxBOM {
+	mainRef := goPURL(info.Main.Path, info.Main.Version)
+	main := cdxComponent{
+		Type: "application", BOMRef: mainRef, Name: info.Main.Path,
+		Version: info.Main.Version, PURL: mainRef,
+		Properties: []cdxProperty{{"go:toolchain", info.GoVersion}},
+	}
+	for _, s := range info.Settings {
+		main.Properties = append(main.Properties, cdxProperty{"go:build:" + s.Key, s.Value})
+	}
+	bom := &cdxBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + sbomUUID(info),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: at.Format(time.RFC3339),
+			Tools:     cdxTools{[]cdxComponent{{Type: "application", Name: filepath.Base(os.Args[0]) + " sbom"}}},
+			Component: main,
+		},
+	}
+	deps := cdxDependency{Ref: mainRef, DependsOn: []string{}}
+	std := stdlibPURL(info)
+	bom.Components = append(bom.Components, cdxComponent{
+		Type: "library", BOMRef: std, Name: "stdlib",
+		Version: strings.TrimPrefix(goToolchain(info), "go"), PURL: std,
+	})
+	deps.DependsOn = append(deps.DependsOn, std)
+	for _, m := range sbomModules(info) {
+		ref := goPURL(m.Path, m.Version)
+		c := cdxComponent{Type: "library", BOMRef: ref, Name: m.Path, Version: m.Version, PURL: ref}
+		if h := sumSHA256(m.Sum); h != "" {
+			c.Hashes = []cdxHash{{"SHA-256", h}}
+			c.Properties = append(c.Properties, cdxProperty{"go:sum", m.Sum})
+		}
+		if m.Replaces != "" {
+			c.Properties = append(c.Properties, cdxProperty{"go:replaces", m.Replaces})
+		}
+		bom.Components = append(bom.Components, c)
+		deps.DependsOn = append(deps.DependsOn, ref)
+	}
+	// The embedded information lists every linked module but not who
+	// requires whom, so everything hangs off the main module.
+	bom.Dependencies = []cdxDependency{deps}
+	return bom
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	DocumentDescribes []string           `json:"documentDescribes"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum    `json:"checksums,omitempty"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	Comment          string            `json:"comment,omitempty"`
+	Purpose          string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	Category string `json:"referenceCategory"`
+	Type     string `json:"referenceType"`
+	Locator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	Element string `json:"spdxElementId"`
+	Type    string `json:"relationshipType"`
+	Related string `json:"relatedSpdxElement"`
+}
+
+var spdxIDUnsafe = regexp.MustCompile(`[^A-Za-z0-9.]+`)
+
+func spdxID(name, version string) string {
+	return "SPDXRef-Package-" + strings.Trim(spdxIDUnsafe.ReplaceAllString(name+"-"+version, "-"), "-")
+}
+
+func newSPDX(info *debug.BuildInfo, at time.Time) *spdxDocument {
+	pkg := func(id, name, version, purl, purpose string) spdxPackage {
+		return spdxPackage{
+			SPDXID: id, Name: name, VersionInfo: version,
+			DownloadLocation: "NOASSERTION", LicenseConcluded: "NOASSERTION",
+			LicenseDeclared: "NOASSERTION", CopyrightText: "NOASSERTION", Purpose: purpose,
+			ExternalRefs: []spdxExternalRef{{"PACKAGE-MANAGER", "purl", purl}},
+		}
+	}
+
+	mainID := spdxID(info.Main.Path, info.Main.Version)
+	main := pkg(mainID, info.Main.Path, info.Main.Version, goPURL(info.Main.Path, info.Main.Version), "APPLICATION")
+	settings := []string{"toolchain=" + info.GoVersion}
+	for _, s := range info.Settings {
+		settings = append(settings, s.Key+"="+s.Value)
+	}
+	main.Comment = "Go build settings: " + strings.Join(settings, " ")
+
+	name := info.Main.Path
+	if name == "" {
+		name = "go-binary"
+	}
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: "https://spdx.org/spdxdocs/" + filepath.Base(name) + "-" + sbomUUID(info),
+		CreationInfo: spdxCreationInfo{
+			Created:  at.Format(time.RFC3339),
+			Creators: []string{"Tool: " + filepath.Base(os.Args[0]) + "-sbom"},
+		},
+		DocumentDescribes: []string{mainID},
+		Packages:          []spdxPackage{main},
+		Relationships:     []spdxRelationship{{"SPDXRef-DOCUMENT", "DESCRIBES", mainID}},
+	}
+
+	version := strings.TrimPrefix(goToolchain(info), "go")
+	std := pkg(spdxID("stdlib", version), "stdlib", version, stdlibPURL(info), "LIBRARY")
+	doc.Packages = append(doc.Packages, std)
+	doc.Relationships = append(doc.Relationships, spdxRelationship{mainID, "DEPENDS_ON", std.SPDXID})
+	for _, m := range sbomModules(info) {
+		p := pkg(spdxID(m.Path, m.Version), m.Path, m.Version, goPURL(m.Path, m.Version), "LIBRARY")
+		if h := sumSHA256(m.Sum); h != "" {
+			p.Checksums = []spdxChecksum{{"SHA256", h}}
+			p.DownloadLocation = proxyURL(m.Path, m.Version)
+			p.Comment = "go.sum " + m.Sum
+		}
+		if m.Replaces != "" {
+			p.SourceInfo = "replaces " + m.Replaces
+		}
+		doc.Packages = append(doc.Packages, p)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{mainID, "DEPENDS_ON", p.SPDXID})
+	}
+	return doc
+}
+
+func runSBOMVerify(args []string) int {
+	fs := flag.NewFlagSet("sbom verify", flag.ExitOnError)
+	gosum := fs.String("gosum", "go.sum", "go.sum to check against")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s sbom verify [-gosum FILE] SBOM\n", filepath.Base(os.Args[0]))
+		return 2
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sbom verify: %v\n", err)
+		return 1
+	}
+	sums, err := readGoSum(*gosum)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sbom verify: %v\n", err)
+		return 1
+	}
+	verified, problems, absent, err := verifySBOM(data, sums)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sbom verify: %v\n", err)
+		return 1
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	for _, m := range absent {
+		fmt.Printf("%s: in %s but not in the SBOM\n", m, *gosum)
+	}
+	fmt.Printf("%d modules match %s, %d problems, %d %s modules not in the SBOM\n", verified, *gosum, len(problems), len(absent), *gosum)
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readGoSum maps "path version" to the h1: hash of the module tree;
+// go.mod-only hashes are skipped.
+func readGoSum(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sums := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 3 || strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+		sums[fields[0]+" "+fields[1]] = fields[2]
+	}
+	return sums, sc.Err()
+}
+
+// verifySBOM checks every module in a CycloneDX or SPDX document against
+// go.sum. A module go.sum lists must carry a matching SHA-256 checksum;
+// modules go.sum does not list and that carry none (the main module, the
+// standard library, local replacements) are skipped. Nothing verified
+// against a non-empty go.sum is a problem too, as an SBOM stripped of
+// its checksums would otherwise pass. absent lists the go.sum modules
+// the document leaves out; test-only and unselected modules are among
+// them, so they are reported rather than failed.
+func verifySBOM(data []byte, sums map[string]string) (verified int, problems, absent []string, err error) {
+	var doc struct {
+		BOMFormat   string         `json:"bomFormat"`
+		SPDXVersion string         `json:"spdxVersion"`
+		Components  []cdxComponent `json:"components"`
+		Packages    []spdxPackage  `json:"packages"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return 0, nil, nil, err
+	}
+
+	type entry struct{ path, version, sha256 string }
+	var entries []entry
+	switch {
+	case doc.BOMFormat == "CycloneDX":
+		for _, c := range doc.Components {
+			e := entry{path: c.Name, version: c.Version}
+			for _, h := range c.Hashes {
+				if h.Alg == "SHA-256" {
+					e.sha256 = h.Content
+				}
+			}
+			entries = append(entries, e)
+		}
+	case strings.HasPrefix(doc.SPDXVersion, "SPDX-"):
+		for _, p := range doc.Packages {
+			e := entry{path: p.Name, version: p.VersionInfo}
+			for _, c := range p.Checksums {
+				if c.Algorithm == "SHA256" {
+					e.sha256 = c.Value
+				}
+			}
+			entries = append(entries, e)
+		}
+	default:
+		return 0, nil, nil, errors.New("not a CycloneDX or SPDX JSON document")
+	}
+
+	listed := make(map[string]bool)
+	for _, e := range entries {
+		key := e.path + " " + e.version
+		listed[key] = true
+		sum, ok := sums[key]
+		switch {
+		case !ok && e.sha256 == "":
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s@%s: not in go.sum", e.path, e.version))
+		case e.sha256 == "":
+			problems = append(problems, fmt.Sprintf("%s@%s: no SHA-256 checksum", e.path, e.version))
+		case !strings.EqualFold(sumSHA256(sum), e.sha256):
+			problems = append(problems, fmt.Sprintf("%s@%s: checksum %s does not match go.sum %s", e.path, e.version, e.sha256, sum))
+		default:
+			verified++
+		}
+	}
+	if verified == 0 && len(sums) > 0 {
+		problems = append(problems, "no module checksum in the SBOM matches go.sum")
+	}
+	for _, key := range sortedKeys(sums) {
+		if !listed[key] {
+			absent = append(absent, strings.Replace(key, " ", "@", 1))
+		}
+	}
+	return verified, problems, absent, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+//go:generate go run gen_syscalls.go
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runtimeSyscalls are needed by the container runtime between applying
+// the profile and exec'ing the entrypoint, so they are never observed by
+// tracing the server but must still be allowed.
+var runtimeSyscalls = []string{
+	"capget", "capset", "chdir", "close", "execve", "exit", "exit_group",
+	"fchown", "fstat", "futex", "getdents64", "getpid", "getppid",
+	"newfstatat", "openat", "prctl", "setgid", "setgroups", "setuid",
+}
+
+// seccompProfile is the subset of the Docker/OCI seccomp profile format
+// that an allowlist needs.
+type seccompProfile struct {
+	DefaultAction   string        `json:"defaultAction"`
+	DefaultErrnoRet *int          `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string      `json:"architectures,omitempty"`
+	Syscalls        []seccompRule `json:"syscalls"`
+}
+
+type seccompRule struct {
+	Names  []string `json:"names"`
+	Action string   `json:"action"`
+}
+
+// stringList is a flag.Value collecting repeated flags.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+func runSeccompProfile(args []string) int {
+	fs := flag.NewFlagSet("seccomp-profile", flag.ExitOnError)
+	binary := fs.String("binary", "", "server binary to trace (default: this executable)")
+	out := fs.String("out", "", "write the profile here instead of stdout")
+	runs := fs.Int("runs", 1, "number of traced runs to merge; 0 only merges -merge files")
+	iterations := fs.Int("iterations", 3, "passes over the route checks per run")
+	settle := fs.Duration("settle", 2*time.Second, "idle time after the checks so background work is recorded")
+	startTimeout := fs.Duration("start-timeout", 10*time.Second, "how long to wait for the server to listen")
+	var merge stringList
+	fs.Var(&merge, "merge", "existing profile to merge into the output (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s seccomp-profile [flags] [-- server args...]\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintln(fs.Output(), "Runs the server under ptrace, drives it with the built-in route checks and")
+		fmt.Fprintln(fs.Output(), "writes a seccomp allowlist of the syscalls it made.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *binary == "" {
+		self, err := os.Executable()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "seccomp-profile: %v\n", err)
+			return 1
+		}
+		*binary = self
+	}
+
+	seen := make(map[string]bool)
+	arches := make(map[string]bool)
+	for _, path := range merge {
+		if err := mergeProfileFile(path, seen, arches); err != nil {
+			fmt.Fprintf(os.Stderr, "seccomp-profile: %v\n", err)
+			return 1
+		}
+	}
+	for i := 0; i < *runs; i++ {
+		names, err := traceServer(*binary, fs.Args(), *iterations, *settle, *startTimeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "seccomp-profile: run %d: %v\n", i+1, err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "seccomp-profile: run %d recorded %d syscalls\n", i+1, len(names))
+		for _, n := range names {
+			seen[n] = true
+		}
+		arches[seccompArch] = true
+	}
+	if len(seen) == 0 {
+		fmt.Fprintln(os.Stderr, "seccomp-profile: nothing recorded; use -runs or -merge")
+		return 2
+	}
+	if *runs > 0 {
+		for _, n := range runtimeSyscalls {
+			if knownSyscall(n) {
+				seen[n] = true
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(buildSeccompProfile(seen, arches), "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "seccomp-profile: %v\n", err)
+		return 1
+	}
+	data = append(data, '\n')
+	if *out == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(*out, data, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "seccomp-profile: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "seccomp-profile: wrote %d syscalls to %s\n", len(seen), *out)
+	return 0
+}
+
+func buildSeccompProfile(names, arches map[string]bool) seccompProfile {
+	eperm := 1
+	p := seccompProfile{
+		DefaultAction:   "SCMP_ACT_ERRNO",
+		DefaultErrnoRet: &eperm,
+		Architectures:   sortedKeys(arches),
+		Syscalls:        []seccompRule{{Names: sortedKeys(names), Action: "SCMP_ACT_ALLOW"}},
+	}
+	return p
+}
+
+// mergeProfileFile adds every syscall a profile allows to seen. Rules with
+// other actions or argument filters are not allowlist entries and are
+// skipped.
+func mergeProfileFile(path string, seen, arches map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var p struct {
+		Architectures []string `json:"architectures"`
+		Syscalls      []struct {
+			Names  []string          `json:"names"`
+			Name   string            `json:"name"`
+			Action string            `json:"action"`
+			Args   []json.RawMessage `json:"args"`
+		} `json:"syscalls"`
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, a := range p.Architectures {
+		arches[a] = true
+	}
+	for _, rule := range p.Syscalls {
+		if rule.Action != "SCMP_ACT_ALLOW" || len(rule.Args) > 0 {
+			continue
+		}
+		for _, n := range rule.Names {
+			seen[n] = true
+		}
+		if rule.Name != "" {
+			seen[rule.Name] = true
+		}
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// freePort asks the kernel for an unused TCP port for the traced server.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// driveServer waits for the server at port to accept requests, then runs
+// the route checks against it.
+func driveServer(ctx context.Context, port, iterations int, startTimeout time.Duration) error {
+	baseURL := "http://127.0.0.1:" + strconv.Itoa(port)
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	deadline := time.Now().Add(startTimeout)
+	for {
+		resp, err := client.Get(baseURL + "/")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("server did not start listening on port %d: %w", port, err)
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New("server exited before it was ready")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	for i := 0; i < iterations; i++ {
+		for _, res := range runRouteChecks(client, baseURL) {
+			if res.Err != nil {
+				fmt.Fprintf(os.Stderr, "seccomp-profile: %s\n", res)
+			}
+		}
+		// A fresh connection per pass records accept and close paths too.
+		client.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMergeProfileFile(t *testing.T) {
+	profile := `{
+  "defaultAction": "SCMP_ACT_ERRNO",
+  "architectures": ["SCMP_ARCH_X86_64"],
+  "syscalls": [
+    {"names": ["read", "write"], "action": "SCMP_ACT_ALLOW"},
+    {"name": "personality", "action": "SCMP_ACT_ALLOW", "args": [{"index": 0, "value": 0, "op": "SCMP_CMP_EQ"}]},
+    {"names": ["ptrace"], "action": "SCMP_ACT_ERRNO"},
+    {"name": "futex", "action": "SCMP_ACT_ALLOW"}
+  ]
+}`
+	path := filepath.Join(t.TempDir(), "profile.json")
+	if err := os.WriteFile(path, []byte(profile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]bool{"epoll_pwait": true}
+	arches := map[string]bool{"SCMP_ARCH_AARCH64": true}
+	if err := mergeProfileFile(path, seen, arches); err != nil {
+		t.Fatal(err)
+	}
+	p := buildSeccompProfile(seen, arches)
+	wantNames := []string{"epoll_pwait", "futex", "read", "write"}
+	if got := p.Syscalls[0].Names; !reflect.DeepEqual(got, wantNames) {
+		t.Errorf("names = %v; want %v", got, wantNames)
+	}
+	wantArches := []string{"SCMP_ARCH_AARCH64", "SCMP_ARCH_X86_64"}
+	if !reflect.DeepEqual(p.Architectures, wantArches) {
+		t.Errorf("architectures = %v; want %v", p.Architectures, wantArches)
+	}
+	if p.DefaultAction != "SCMP_ACT_ERRNO" || p.DefaultErrnoRet == nil || *p.DefaultErrnoRet != 1 {
+		t.Errorf("default action = %s/%v; want SCMP_ACT_ERRNO/EPERM", p.DefaultAction, p.DefaultErrnoRet)
+	}
+}
+
+// The event stream checks must not wait for a stream that never ends.
+func TestRouteCheckEventStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sse, ok := startEventStream(w)
+		if !ok {
+			return
+		}
+		sse.comment("hello")
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	res := runRouteCheck(client, srv.URL, routeCheck{http.MethodGet, "/events?stream=1", []int{http.StatusOK}})
+	if res.Err != nil || res.Status != http.StatusOK {
+		t.Errorf("event stream check = %s; want 200 without waiting for the stream to end", res)
+	}
+}
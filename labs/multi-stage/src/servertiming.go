@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// servertiming.go reports where a request's time went in a Server-Timing
+// header, so a client benchmarking through nginx can split the latency it
+// sees between the proxy queue and the handler. There is no Redis here,
+// and c.JSON encodes straight to the response, so only queue, handler and
+// total are reported. Streaming responses send it as a trailer instead.
+
+// serverTimingEnabled is set by SERVER_TIMING=true. It is off by default
+// as the header tells clients about backend internals.
+var serverTimingEnabled, _ = strconv.ParseBool(os.Getenv("SERVER_TIMING"))
+
+type serverTimingMetric struct {
+	Name string
+	Dur  time.Duration
+	Desc string
+}
+
+// formatServerTiming renders metrics as a Server-Timing value, with
+// durations in milliseconds as the specification requires.
+func formatServerTiming(metrics []serverTimingMetric) string {
+	parts := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		ms := float64(m.Dur.Microseconds()) / 1000
+		p := fmt.Sprintf("%s;dur=%s", m.Name, strconv.FormatFloat(ms, 'f', -1, 64))
+		if m.Desc != "" {
+			p += fmt.Sprintf(";desc=%q", m.Desc)
+		}
+		parts = append(parts, p)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseRequestStart reads the time a proxy put in X-Request-Start. nginx
+// sends "t=${msec}", seconds with a fractional part; integer milliseconds
+// and microseconds, as other proxies send, are told apart by magnitude.
+func parseRequestStart(h string) (time.Time, bool) {
+	h = strings.TrimPrefix(strings.TrimSpace(h), "t=")
+	if h == "" {
+		return time.Time{}, false
+	}
+	v, err := strconv.ParseFloat(h, 64)
+	if err != nil || v <= 0 {
+		return time.Time{}, false
+	}
+	switch {
+	case v > 1e15:
+		return time.UnixMicro(int64(v)), true
+	case v > 1e12:
+		return time.UnixMilli(int64(v)), true
+	}
+	sec := int64(v)
+	return time.Unix(sec, int64((v-float64(sec))*1e9)), true
+}
+
+// requestTiming is kept on the echo context under serverTimingKey.
+type requestTiming struct {
+	start        time.Time
+	queue        time.Duration
+	handlerStart time.Time
+}
+
+const serverTimingKey = "serverTiming"
+
+func (t *requestTiming) metrics(now time.Time) []serverTimingMetric {
+	var out []serverTimingMetric
+	if t.queue > 0 {
+		out = append(out, serverTimingMetric{"queue", t.queue, "proxy"})
+	}
+	if !t.handlerStart.IsZero() {
+		out = append(out, serverTimingMetric{"handler", now.Sub(t.handlerStart), ""})
+	}
+	return append(out, serverTimingMetric{"total", now.Sub(t.start), ""})
+}
+
+// addServerTiming must be the first middleware, so the total starts when
+// the request reaches echo. The header is set as the response headers go
+// out; event streams declare a trailer and fill it in at the end.
+func addServerTiming(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !serverTimingEnabled {
+			return next(c)
+		}
+		t := &requestTiming{start: time.Now()}
+		if start, ok := parseRequestStart(c.Request().Header.Get("X-Request-Start")); ok {
+			if q := t.start.Sub(start); q > 0 {
+				t.queue = q
+			}
+		}
+		c.Set(serverTimingKey, t)
+
+		res := c.Response()
+		trailer := false
+		res.Before(func() {
+			h := res.Header()
+			if strings.HasPrefix(h.Get(echo.HeaderContentType), "text/event-stream") {
+				trailer = true
+				h.Add("Trailer", "Server-Timing")
+				return
+			}
+			h.Set("Server-Timing", formatServerTiming(t.metrics(time.Now())))
+		})
+		err := next(c)
+		if trailer {
+			res.Header().Set("Server-Timing", formatServerTiming(t.metrics(time.Now())))
+		}
+		return err
+	}
+}
+
+// markHandlerStart goes after the other middleware, so the handler
+// duration covers the route alone.
+func markHandlerStart(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if t, ok := c.Get(serverTimingKey).(*requestTiming); ok {
+			t.handlerStart = time.Now()
+		}
+		return next(c)
+	}
+}
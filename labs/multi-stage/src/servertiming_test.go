@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestServerTiming(t *testing.T) {
+	serverTimingEnabled = true
+	defer func() { serverTimingEnabled = false }()
+
+	e := newServer()
+	e.GET("/test/events", echo.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, ok := startEventStream(w)
+		if !ok {
+			return
+		}
+		s.comment("hello")
+		time.Sleep(5 * time.Millisecond)
+	})))
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/health", nil)
+	req.Header.Set("X-Request-Start", fmt.Sprintf("t=%d", time.Now().Add(-20*time.Millisecond).UnixMilli()))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	st := resp.Header.Get("Server-Timing")
+	for _, want := range []string{`queue;dur=`, `desc="proxy"`, "handler;dur=", "total;dur="} {
+		if !strings.Contains(st, want) {
+			t.Errorf("Server-Timing %q lacks %q", st, want)
+		}
+	}
+
+	resp, err = http.Get(srv.URL + "/test/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if h := resp.Header.Get("Server-Timing"); h != "" {
+		t.Errorf("event stream sent Server-Timing as a header: %q", h)
+	}
+	if tr := resp.Trailer.Get("Server-Timing"); !strings.Contains(tr, "total;dur=") {
+		t.Errorf("event stream trailer = %q; want the total", tr)
+	}
+}
+
+func TestParseRequestStart(t *testing.T) {
+	want := time.Date(2024, 5, 6, 7, 8, 9, 123000000, time.UTC)
+	for _, h := range []string{"t=1714979289.123", "t=1714979289123", "1714979289123000"} {
+		got, ok := parseRequestStart(h)
+		if !ok || got.Sub(want).Abs() > time.Millisecond {
+			t.Errorf("parseRequestStart(%q) = %v, %v; want %v", h, got.UTC(), ok, want)
+		}
+	}
+	if _, ok := parseRequestStart("garbage"); ok {
+		t.Errorf("parseRequestStart accepted garbage")
+	}
+}
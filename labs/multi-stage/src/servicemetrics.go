@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// servicemetrics.go counts requests by route: their rate, status codes
+// and duration.
+
+var (
+	httpRequests = registry.counter("http_requests_total",
+		"Requests served, by route pattern, method and status code.", "route", "method", "code")
+	httpDuration = registry.histogram("http_request_duration_seconds",
+		"Time to serve a request, by route pattern.",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "route")
+	httpInFlight = registry.gauge("http_requests_in_flight",
+		"Requests being served.")
+)
+
+// countRequests records each request under the route echo matched. An
+// error is handed to echo's error handler here, as the Logger middleware
+// does, so the status it sets is the one counted. Event streams are
+// counted but not timed: they last as long as the client stays, which
+// would swamp the duration histogram.
+func countRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		httpInFlight.with().add(1)
+		defer httpInFlight.with().add(-1)
+		err := next(c)
+		if err != nil {
+			c.Error(err)
+		}
+		route := c.Path()
+		if route == "" {
+			route = "none"
+		}
+		httpRequests.with(route, requestMethod(c.Request().Method), strconv.Itoa(c.Response().Status)).inc()
+		if !strings.HasPrefix(c.Response().Header().Get(echo.HeaderContentType), "text/event-stream") {
+			httpDuration.with(route).observe(time.Since(start).Seconds())
+		}
+		return nil
+	}
+}
+
+// requestMethod bounds the method label to the standard methods.
+func requestMethod(m string) string {
+	switch m {
+	case echo.GET, echo.HEAD, echo.POST, echo.PUT, echo.PATCH, echo.DELETE, echo.OPTIONS, echo.CONNECT, echo.TRACE:
+		return m
+	}
+	return "OTHER"
+}
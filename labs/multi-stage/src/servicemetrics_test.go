@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestCountRequestsSkipsStreamDuration(t *testing.T) {
+	e := echo.New()
+	e.Use(countRequests)
+	e.GET("/test/plain", func(c echo.Context) error { return c.String(http.StatusOK, "ok") })
+	e.GET("/test/stream", func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
+		return c.String(http.StatusOK, "data: x\n\n")
+	})
+	for _, path := range []string{"/test/plain", "/test/stream"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	var b strings.Builder
+	if err := registry.writePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		`http_requests_total{route="/test/stream",method="GET",code="200"} 1`,
+		`http_request_duration_seconds_count{route="/test/plain"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+	if strings.Contains(out, `http_request_duration_seconds_count{route="/test/stream"}`) {
+		t.Error("event stream observed in http_request_duration_seconds")
+	}
+}
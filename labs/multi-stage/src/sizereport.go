@@ -0,0 +1,470 @@
+package main
+
+import (
+	"debug/buildinfo"
+	"debug/elf"
+	"debug/gosym"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// sizereport.go attributes the bytes of a Go ELF binary to the packages and
+// modules they came from: function bodies via the pclntab, which survives
+// stripping, and data via the symbol table when it is present.
+
+type sizedSymbol struct {
+	Name    string
+	Package string
+	Size    uint64
+}
+
+type binarySize struct {
+	Path      string
+	FileSize  int64
+	Sections  map[string]uint64 // file-backed sections only
+	Symbols   []sizedSymbol
+	Modules   []string // longest first, for prefix matching
+	MainPath  string
+	Stripped  bool
+	Trimmed   bool
+	Files     []string // source paths recorded in the pclntab
+	Unclaimed uint64   // loaded bytes no symbol accounts for
+	NotLoaded uint64   // symbol table, DWARF and other non-alloc sections
+}
+
+func analyzeBinary(path string) (*binarySize, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	b := &binarySize{Path: path, FileSize: fi.Size(), Sections: make(map[string]uint64)}
+
+	if info, err := buildinfo.ReadFile(path); err == nil {
+		b.MainPath = info.Main.Path
+		b.Modules = append(b.Modules, info.Main.Path)
+		for _, d := range info.Deps {
+			b.Modules = append(b.Modules, d.Path)
+		}
+		sort.Slice(b.Modules, func(i, j int) bool { return len(b.Modules[i]) > len(b.Modules[j]) })
+		for _, s := range info.Settings {
+			if s.Key == "-trimpath" && s.Value == "true" {
+				b.Trimmed = true
+			}
+		}
+	}
+
+	var loaded uint64
+	for _, s := range f.Sections {
+		if s.Type == elf.SHT_NOBITS || s.Size == 0 {
+			continue
+		}
+		b.Sections[s.Name] = s.Size
+		switch {
+		case s.Flags&elf.SHF_ALLOC == 0:
+			b.NotLoaded += s.Size
+		case s.Name != ".gopclntab":
+			loaded += s.Size
+		}
+	}
+
+	// Function bodies from the pclntab.
+	text := f.Section(".text")
+	pcln := f.Section(".gopclntab")
+	if text == nil || pcln == nil {
+		return nil, fmt.Errorf("%s: not a Go binary (no .text or .gopclntab)", path)
+	}
+	pclnData, err := pcln.Data()
+	if err != nil {
+		return nil, err
+	}
+	table, err := gosym.NewTable(nil, gosym.NewLineTable(pclnData, text.Addr))
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading pclntab: %w", path, err)
+	}
+	var claimed uint64
+	for _, fn := range table.Funcs {
+		size := fn.End - fn.Entry
+		b.Symbols = append(b.Symbols, sizedSymbol{fn.Name, symbolPackage(fn.Name), size})
+		claimed += size
+	}
+	for file := range table.Files {
+		b.Files = append(b.Files, file)
+	}
+
+	// Data from the symbol table; text symbols are already counted.
+	syms, err := f.Symbols()
+	if err != nil {
+		b.Stripped = true
+	}
+	for _, s := range syms {
+		if s.Size == 0 || elf.ST_TYPE(s.Info) != elf.STT_OBJECT || int(s.Section) >= len(f.Sections) {
+			continue
+		}
+		sec := f.Sections[s.Section]
+		if sec.Type == elf.SHT_NOBITS || sec == pcln {
+			continue
+		}
+		b.Symbols = append(b.Symbols, sizedSymbol{s.Name, symbolPackage(s.Name), s.Size})
+		claimed += s.Size
+	}
+	if loaded > claimed {
+		b.Unclaimed = loaded - claimed
+	}
+	return b, nil
+}
+
+// symbolPackage returns the import path a symbol belongs to. Type
+// descriptors are attributed to the package defining the type; other
+// linker-generated symbols are grouped under a parenthesised name.
+func symbolPackage(name string) string {
+	if i := strings.IndexByte(name, '['); i >= 0 {
+		name = name[:i] // generic instantiation arguments
+	}
+	for _, prefix := range []string{"type:", "type."} {
+		if rest, ok := strings.CutPrefix(name, prefix); ok {
+			rest = strings.TrimLeft(rest, "*")
+			if pkg := symbolPackage(rest); pkg != rest && !strings.HasPrefix(rest, ".") {
+				return pkg
+			}
+			return "(type metadata)"
+		}
+	}
+	if rest, ok := strings.CutPrefix(name, "go:"); ok {
+		kind, _, _ := strings.Cut(rest, ".")
+		return "(go:" + kind + ")"
+	}
+	slash := strings.LastIndexByte(name, '/')
+	dot := strings.IndexByte(name[slash+1:], '.')
+	if dot < 0 {
+		return name
+	}
+	return name[:slash+1+dot]
+}
+
+// moduleOf maps a package to its module. The standard library is split
+// into the runtime and everything else, as the runtime is a fixed cost.
+func (b *binarySize) moduleOf(pkg string) string {
+	switch {
+	case strings.HasPrefix(pkg, "("):
+		return pkg
+	case pkg == "main":
+		if b.MainPath != "" {
+			return b.MainPath
+		}
+		return pkg
+	}
+	for _, m := range b.Modules {
+		if pkg == m || strings.HasPrefix(pkg, m+"/") {
+			return m
+		}
+	}
+	first, _, _ := strings.Cut(pkg, "/")
+	if !strings.Contains(first, ".") {
+		if pkg == "runtime" || strings.HasPrefix(pkg, "runtime/") || strings.HasPrefix(pkg, "internal/runtime/") {
+			return "runtime"
+		}
+		return "std"
+	}
+	return pkg
+}
+
+// totals groups symbol bytes by package or module. The pclntab, loaded
+// bytes no symbol accounts for and sections that are never loaded are
+// listed separately.
+func (b *binarySize) totals(byModule bool) map[string]uint64 {
+	out := make(map[string]uint64)
+	for _, s := range b.Symbols {
+		key := s.Package
+		if byModule {
+			key = b.moduleOf(key)
+		}
+		out[key] += s.Size
+	}
+	out["(pclntab)"] = b.Sections[".gopclntab"]
+	if b.Unclaimed > 0 {
+		out["(unattributed)"] = b.Unclaimed
+	}
+	if b.NotLoaded > 0 {
+		out["(symbols and DWARF)"] = b.NotLoaded
+	}
+	return out
+}
+
+// stripSavings estimates what -ldflags "-s -w" and -trimpath would save
+// on this binary.
+func (b *binarySize) stripSavings() (symtab, dwarf, trim uint64, trimFiles int) {
+	symtab = b.Sections[".symtab"] + b.Sections[".strtab"]
+	for name, size := range b.Sections {
+		if strings.HasPrefix(name, ".debug_") || strings.HasPrefix(name, ".zdebug_") {
+			dwarf += size
+		}
+	}
+	if b.Trimmed {
+		return symtab, dwarf, 0, 0
+	}
+	for _, file := range b.Files {
+		if t := trimmedPath(file); len(t) < len(file) {
+			trim += uint64(len(file) - len(t))
+			trimFiles++
+		}
+	}
+	return symtab, dwarf, trim, trimFiles
+}
+
+// trimmedPath approximates how -trimpath rewrites a recorded source path:
+// GOROOT and module cache prefixes are dropped. Main module files become
+// module-relative, which is not known here, so they are left alone.
+func trimmedPath(file string) string {
+	if i := strings.Index(file, "/pkg/mod/"); i >= 0 {
+		return file[i+len("/pkg/mod/"):]
+	}
+	if i := strings.Index(file, "/src/"); i >= 0 && !strings.Contains(file[:i], "/pkg/mod") {
+		rest := file[i+len("/src/"):]
+		first, _, _ := strings.Cut(rest, "/")
+		if !strings.Contains(first, ".") && filepath.IsAbs(file) {
+			return rest
+		}
+	}
+	return file
+}
+
+func runSizeReport(args []string) int {
+	fs := flag.NewFlagSet("size-report", flag.ExitOnError)
+	by := fs.String("by", "module", "group bytes by module or package")
+	top := fs.Int("top", 20, "rows to show")
+	symbols := fs.Int("symbols", 0, "also list the N largest symbols")
+	build := fs.String("build", "", "module directory to build with and without -trimpath and -ldflags \"-s -w\"")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s size-report [flags] [BINARY [OTHER]]\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintln(fs.Output(), "Attributes the bytes of a Go ELF binary (default: this one) to packages or")
+		fmt.Fprintln(fs.Output(), "modules. With two binaries, shows what changed between them.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *by != "module" && *by != "package" {
+		fs.Usage()
+		return 2
+	}
+	byModule := *by == "module"
+
+	if *build != "" {
+		if err := reportBuildVariants(os.Stdout, *build); err != nil {
+			fmt.Fprintf(os.Stderr, "size-report: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		self, err := os.Executable()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "size-report: %v\n", err)
+			return 1
+		}
+		paths = []string{self}
+	}
+	if len(paths) > 2 {
+		fs.Usage()
+		return 2
+	}
+	var reports []*binarySize
+	for _, p := range paths {
+		b, err := analyzeBinary(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "size-report: %v\n", err)
+			return 1
+		}
+		reports = append(reports, b)
+	}
+
+	if len(reports) == 2 {
+		writeSizeComparison(os.Stdout, reports[0], reports[1], byModule, *top)
+		return 0
+	}
+	writeSizeReport(os.Stdout, reports[0], byModule, *top, *symbols)
+	return 0
+}
+
+func writeSizeReport(w io.Writer, b *binarySize, byModule bool, top, symbols int) {
+	fmt.Fprintf(w, "%s: %s on disk\n\n", b.Path, formatBytes(uint64(b.FileSize)))
+	totals := b.totals(byModule)
+	var sum uint64
+	for _, v := range totals {
+		sum += v
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "SIZE\tSHARE\t  "+map[bool]string{true: "MODULE", false: "PACKAGE"}[byModule])
+	keys := sortedBySize(totals)
+	for i, k := range keys {
+		if i == top {
+			var rest uint64
+			for _, k := range keys[top:] {
+				rest += totals[k]
+			}
+			fmt.Fprintf(tw, "%s\t%.1f%%\t  (%d more)\n", formatBytes(rest), pct(rest, sum), len(keys)-top)
+			break
+		}
+		fmt.Fprintf(tw, "%s\t%.1f%%\t  %s\n", formatBytes(totals[k]), pct(totals[k], sum), k)
+	}
+	tw.Flush()
+
+	if symbols > 0 {
+		syms := append([]sizedSymbol(nil), b.Symbols...)
+		sort.Slice(syms, func(i, j int) bool { return syms[i].Size > syms[j].Size })
+		fmt.Fprintln(w, "\nLargest symbols:")
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		for i := 0; i < symbols && i < len(syms); i++ {
+			fmt.Fprintf(tw, "%s\t  %s\n", formatBytes(syms[i].Size), syms[i].Name)
+		}
+		tw.Flush()
+	}
+
+	symtab, dwarf, trim, files := b.stripSavings()
+	fmt.Fprintln(w, "\nBuild flags (estimated from this binary):")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if b.Stripped && symtab == 0 {
+		fmt.Fprintln(tw, "  -ldflags=-s\talready applied (no symbol table)")
+	} else {
+		fmt.Fprintf(tw, "  -ldflags=-s\tsaves %s (.symtab, .strtab)\n", formatBytes(symtab))
+	}
+	if dwarf == 0 {
+		fmt.Fprintln(tw, "  -ldflags=-w\talready applied (no DWARF)")
+	} else {
+		fmt.Fprintf(tw, "  -ldflags=-w\tsaves %s (DWARF debug info)\n", formatBytes(dwarf))
+	}
+	if b.Trimmed {
+		fmt.Fprintln(tw, "  -trimpath\talready applied")
+	} else {
+		fmt.Fprintf(tw, "  -trimpath\tsaves about %s by shortening %d source paths\n", formatBytes(trim), files)
+	}
+	tw.Flush()
+}
+
+func writeSizeComparison(w io.Writer, old, new *binarySize, byModule bool, top int) {
+	fmt.Fprintf(w, "%s: %s -> %s (%s)\n\n", filepath.Base(new.Path), formatBytes(uint64(old.FileSize)),
+		formatBytes(uint64(new.FileSize)), signedBytes(new.FileSize-old.FileSize))
+	a, b := old.totals(byModule), new.totals(byModule)
+	keys := make(map[string]bool)
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	names := sortedKeys(keys)
+	sort.SliceStable(names, func(i, j int) bool {
+		di := int64(b[names[i]]) - int64(a[names[i]])
+		dj := int64(b[names[j]]) - int64(a[names[j]])
+		return abs64(di) > abs64(dj)
+	})
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "OLD\tNEW\tDELTA\t  "+map[bool]string{true: "MODULE", false: "PACKAGE"}[byModule])
+	for i, k := range names {
+		d := int64(b[k]) - int64(a[k])
+		if i == top || d == 0 {
+			break
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t  %s\n", formatBytes(a[k]), formatBytes(b[k]), signedBytes(d), k)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nSections:")
+	secs := make(map[string]bool)
+	for k := range old.Sections {
+		secs[k] = true
+	}
+	for k := range new.Sections {
+		secs[k] = true
+	}
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, k := range sortedKeys(secs) {
+		if d := int64(new.Sections[k]) - int64(old.Sections[k]); d != 0 {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t  %s\n", formatBytes(old.Sections[k]), formatBytes(new.Sections[k]), signedBytes(d), k)
+		}
+	}
+	tw.Flush()
+}
+
+// reportBuildVariants builds the module in dir four ways and reports the
+// measured size of each.
+func reportBuildVariants(w io.Writer, dir string) error {
+	tmp, err := os.MkdirTemp("", "size-report-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	variants := []struct {
+		name  string
+		flags []string
+	}{
+		{"default", nil},
+		{"-trimpath", []string{"-trimpath"}},
+		{`-ldflags="-s -w"`, []string{"-ldflags=-s -w"}},
+		{`-trimpath -ldflags="-s -w"`, []string{"-trimpath", "-ldflags=-s -w"}},
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "SIZE\tSAVED\t  FLAGS")
+	var base int64
+	for i, v := range variants {
+		out := filepath.Join(tmp, fmt.Sprintf("bin%d", i))
+		cmd := exec.Command("go", append(append([]string{"build", "-o", out}, v.flags...), ".")...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("go build %s: %w", v.name, err)
+		}
+		fi, err := os.Stat(out)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			base = fi.Size()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t  %s\n", formatBytes(uint64(fi.Size())), signedBytes(fi.Size()-base), v.name)
+	}
+	return tw.Flush()
+}
+
+func sortedBySize(m map[string]uint64) []string {
+	keys := sortedKeys(m)
+	sort.SliceStable(keys, func(i, j int) bool { return m[keys[i]] > m[keys[j]] })
+	return keys
+}
+
+func formatBytes(n uint64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2fMiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+func signedBytes(d int64) string {
+	if d < 0 {
+		return "-" + formatBytes(uint64(-d))
+	}
+	return "+" + formatBytes(uint64(d))
+}
+
+func pct(v, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(v) / float64(total) * 100
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// receiveStatsD listens on a local UDP port and returns what arrived as
+// packets, split into lines.
+func receiveStatsD(t *testing.T) (net.Conn, func() (packets int, lines []string)) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, func() (int, []string) {
+		var packets int
+		var lines []string
+		buf := make([]byte, 65536)
+		for {
+			pc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				return packets, lines
+			}
+			packets++
+			lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+		}
+	}
+}
+
+func TestStatsDPush(t *testing.T) {
+	reg := newMetricRegistry()
+	requests := reg.counter("requests_total", "", "route", "code")
+	inFlight := reg.gauge("in_flight", "")
+	duration := reg.histogram("duration_seconds", "", []float64{0.1, 1}, "route")
+
+	requests.with("/counter", "200").add(3)
+	requests.with("/health", "200").inc()
+	inFlight.with().set(-2)
+	for _, v := range []float64{0.05, 0.05, 0.5, 5} {
+		duration.with("/counter").observe(v)
+	}
+
+	conn, receive := receiveStatsD(t)
+	p := newStatsdPusher(conn, false, "app.", 1432)
+	if err := p.flush(reg.snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	_, lines := receive()
+	for _, want := range []string{
+		"app.requests_total.counter.200:3|c",
+		"app.requests_total.health.200:1|c",
+		"app.in_flight:0|g",
+		"app.in_flight:-2|g",
+		"app.duration_seconds.counter.count:4|c",
+		"app.duration_seconds.counter.sum:5.6|c",
+		"app.duration_seconds.counter.p50:0.1|g",
+		"app.duration_seconds.counter.p99:1|g",
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("missing %q in %q", want, lines)
+		}
+	}
+
+	// Only what changed since the last flush is sent for counters.
+	requests.with("/counter", "200").add(2)
+	p.flush(reg.snapshot())
+	_, lines = receive()
+	if !slices.Contains(lines, "app.requests_total.counter.200:2|c") || slices.ContainsFunc(lines, func(l string) bool {
+		return strings.HasPrefix(l, "app.requests_total.health") || strings.HasPrefix(l, "app.duration_seconds")
+	}) {
+		t.Errorf("second flush = %q; want only the /counter increase and gauges", lines)
+	}
+}
+
+func TestDogStatsDTagsAndBatching(t *testing.T) {
+	reg := newMetricRegistry()
+	requests := reg.counter("requests_total", "", "route")
+	for i := 0; i < 50; i++ {
+		requests.with("/route/" + strings.Repeat("x", i)).inc()
+	}
+
+	conn, receive := receiveStatsD(t)
+	p := newStatsdPusher(conn, true, "svc.", 512)
+	p.tags = []string{"env:test"}
+	if err := p.flush(reg.snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	packets, lines := receive()
+	if len(lines) != 50 {
+		t.Fatalf("got %d lines; want 50", len(lines))
+	}
+	if packets < 2 || packets > 10 {
+		t.Errorf("50 lines went in %d packets of at most 512 bytes", packets)
+	}
+	if !slices.Contains(lines, "svc.requests_total:1|c|#env:test,route:/route/") {
+		t.Errorf("no tagged line in %q", lines[:3])
+	}
+}
+
+func TestBatchLines(t *testing.T) {
+	got := batchLines([]string{"aaaa", "bb", "cccccccccc", "d"}, 8)
+	want := []string{"aaaa\nbb", "cccccccccc", "d"}
+	if len(got) != len(want) {
+		t.Fatalf("got %q; want %q", got, want)
+	}
+	for i := range want {
+		if string(got[i]) != want[i] {
+			t.Errorf("packet %d = %q; want %q", i, got[i], want[i])
+		}
+	}
+}
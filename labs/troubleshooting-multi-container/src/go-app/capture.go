@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// captureFile is one file of a diagnostic capture directory.
+type captureFile struct {
+	name  string
+	write func(io.Writer) error
+}
+
+// writeCaptureDir writes files into a temporary directory under parent and
+// renames it to name, so a kill mid-write never leaves a half capture that
+// looks complete.
+func writeCaptureDir(parent, name string, files []captureFile) (string, error) {
+	tmp, err := os.MkdirTemp(parent, ".capture-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	for _, cf := range files {
+		f, err := os.Create(filepath.Join(tmp, cf.name))
+		if err != nil {
+			return "", err
+		}
+		err = cf.write(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", cf.name, err)
+		}
+	}
+	dst := filepath.Join(parent, name)
+	if err := os.Rename(tmp, dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// pruneCaptures keeps the newest keep capture directories in dir. Names
+// start with a UTC timestamp, so lexical order is age order.
+func pruneCaptures(dir string, keep int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var captures []string
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			captures = append(captures, e.Name())
+		}
+	}
+	sort.Strings(captures)
+	for len(captures) > keep {
+		os.RemoveAll(filepath.Join(dir, captures[0]))
+		captures = captures[1:]
+	}
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
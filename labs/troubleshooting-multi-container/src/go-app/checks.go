@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// routeCheck is a request the server is expected to answer. The list is
+// the traffic used to exercise the binary from the inside, for example
+// while recording its syscalls.
+type routeCheck struct {
+	Method string
+	Path   string
+	// Status lists acceptable response codes. The Redis-backed routes
+	// answer 503 when Redis is down and optional features answer 404
+	// when they are off; both still exercise the handler.
+	Status []int
+}
+
+// routeChecks covers every route the server registers. What they cannot
+// reach is only recorded if it happens while the server runs: the leak
+// detector (LEAK_INTERVAL), GC advisor, profiler and memory guard work on
+// their own schedule, so a profile that must cover them needs a -settle
+// longer than their interval; snapshots on slow requests or Redis
+// timeouts, shard reloads and counter durability resolution need the
+// failure itself. Features that are off in the traced environment, such
+// as the flight recorder without TRACE_DIR, are only reached as far as
+// their 404.
+var routeChecks = []routeCheck{
+	{http.MethodGet, "/", []int{http.StatusOK}},
+	{http.MethodGet, "/health", []int{http.StatusOK, http.StatusServiceUnavailable}},
+	{http.MethodGet, "/readyz", []int{http.StatusOK, http.StatusServiceUnavailable}},
+	{http.MethodGet, "/counter", []int{http.StatusOK, http.StatusServiceUnavailable}},
+	{http.MethodGet, "/metrics", []int{http.StatusOK}},
+	{http.MethodGet, "/slo", []int{http.StatusOK, http.StatusNotFound}},
+	{http.MethodGet, "/debug/security", []int{http.StatusOK}},
+	{http.MethodGet, "/debug/resources/events", []int{http.StatusOK}},
+	{http.MethodGet, "/debug/resources/events?stream=1", []int{http.StatusOK}},
+	{http.MethodGet, "/debug/resources/history", []int{http.StatusOK, http.StatusNotFound}},
+	{http.MethodGet, "/debug/resources/history?stream=1", []int{http.StatusOK, http.StatusNotFound}},
+	{http.MethodGet, "/debug/recommendations", []int{http.StatusOK, http.StatusNotFound}},
+	{http.MethodGet, "/debug/gc-advice", []int{http.StatusOK, http.StatusNotFound}},
+	{http.MethodGet, "/debug/leaks", []int{http.StatusOK, http.StatusNotFound}},
+	{http.MethodGet, "/debug/slowlog", []int{http.StatusOK, http.StatusNotFound}},
+	{http.MethodGet, "/debug/redis", []int{http.StatusOK, http.StatusNotFound}},
+	{http.MethodGet, "/debug/redis/audit", []int{http.StatusOK, http.StatusNotFound, http.StatusServiceUnavailable}},
+	{http.MethodGet, "/debug/redis/shards", []int{http.StatusOK, http.StatusNotFound}},
+	{http.MethodGet, "/debug/counter/durability", []int{http.StatusOK, http.StatusNotFound}},
+	// Writes a trace snapshot to TRACE_DIR, then lists the directory.
+	{http.MethodPost, "/debug/trace", []int{http.StatusAccepted, http.StatusNotFound}},
+	{http.MethodGet, "/debug/traces/", []int{http.StatusOK, http.StatusNotFound}},
+}
+
+type routeCheckResult struct {
+	Check    routeCheck
+	Status   int
+	Duration time.Duration
+	Err      error
+}
+
+func (r routeCheckResult) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("%s %s: %v", r.Check.Method, r.Check.Path, r.Err)
+	}
+	return fmt.Sprintf("%s %s: %d in %s", r.Check.Method, r.Check.Path, r.Status, r.Duration.Round(time.Millisecond))
+}
+
+// runRouteChecks sends every route check to baseURL once, in order. When
+// STATSD_LISTEN is set it also sends a counter to each StatsD listener,
+// so ingestion is exercised along with the routes.
+func runRouteChecks(client *http.Client, baseURL string) []routeCheckResult {
+	results := make([]routeCheckResult, 0, len(routeChecks)+2)
+	for _, check := range routeChecks {
+		results = append(results, runRouteCheck(client, baseURL, check))
+	}
+	if addr := os.Getenv("STATSD_LISTEN"); addr != "" {
+		for _, proto := range strings.Split(envOr("STATSD_LISTEN_PROTOCOLS", "udp,tcp"), ",") {
+			results = append(results, runStatsDCheck(strings.TrimSpace(proto), addr))
+		}
+	}
+	return results
+}
+
+// runStatsDCheck sends one counter line to the StatsD listener at addr.
+// A listener on all interfaces is reached through loopback.
+func runStatsDCheck(proto, addr string) routeCheckResult {
+	res := routeCheckResult{Check: routeCheck{Method: strings.ToUpper(proto), Path: addr}}
+	if host, port, err := net.SplitHostPort(addr); err == nil && (host == "" || host == "0.0.0.0" || host == "::") {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	start := time.Now()
+	conn, err := net.DialTimeout(proto, addr, 5*time.Second)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("seccomp_profile.check:1|c\n")); err != nil {
+		res.Err = err
+		return res
+	}
+	res.Duration = time.Since(start)
+	return res
+}
+
+func runRouteCheck(client *http.Client, baseURL string, check routeCheck) routeCheckResult {
+	res := routeCheckResult{Check: check}
+	req, err := http.NewRequest(check.Method, baseURL+check.Path, nil)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	// An event stream does not end, so its headers are all there is to
+	// wait for.
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		io.Copy(io.Discard, resp.Body)
+	}
+	resp.Body.Close()
+	res.Duration = time.Since(start)
+	res.Status = resp.StatusCode
+	for _, ok := range check.Status {
+		if resp.StatusCode == ok {
+			return res
+		}
+	}
+	res.Err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+	return res
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// dashboards.go generates a Grafana dashboard and Prometheus alerting
+// rules from the metric registry of this binary. Every panel and rule is
+// built only from families that are registered, and every expression is
+// checked against the registry before anything is written, so a metric
+// renamed or removed in code drops out of the output rather than leaving
+// a panel with no data.
+
+// dashQuery is one PromQL query and its legend.
+type dashQuery struct {
+	Expr   string
+	Legend string
+}
+
+type dashPanel struct {
+	Title       string
+	Description string
+	Unit        string
+	Queries     []dashQuery
+}
+
+type dashRow struct {
+	Title  string
+	Panels []dashPanel
+}
+
+// dashBuilder writes selectors for one job and remembers which families
+// the panels used, so the rest can be listed generically.
+type dashBuilder struct {
+	job      string
+	families map[string]*metricFamily
+	used     map[string]bool
+}
+
+func newDashBuilder(job string) *dashBuilder {
+	b := &dashBuilder{job: job, families: make(map[string]*metricFamily), used: make(map[string]bool)}
+	for _, f := range registry.snapshot() {
+		b.families[f.Name] = f
+	}
+	return b
+}
+
+func (b *dashBuilder) has(name string) bool {
+	_, ok := b.families[name]
+	return ok
+}
+
+// sel is a selector for name in the job, with extra matchers.
+func (b *dashBuilder) sel(name string, matchers ...string) string {
+	b.used[strings.TrimSuffix(name, "_bucket")] = true
+	return name + "{" + strings.Join(append([]string{`job="` + b.job + `"`}, matchers...), ",") + "}"
+}
+
+// panel keeps the queries whose families exist, and returns false when
+// none do.
+func (b *dashBuilder) panel(p dashPanel, needs ...[]string) (dashPanel, bool) {
+	var kept []dashQuery
+	for i, q := range p.Queries {
+		ok := true
+		for _, n := range needs[i] {
+			ok = ok && b.has(n)
+		}
+		if ok {
+			kept = append(kept, q)
+		}
+	}
+	p.Queries = kept
+	return p, len(kept) > 0
+}
+
+// family is the generic panel for one family: a rate for counters, the
+// value for gauges and quantiles for histograms, split by its labels.
+func (b *dashBuilder) family(f *metricFamily) dashPanel {
+	by := strings.Join(f.Labels, ", ")
+	legend := "value"
+	if len(f.Labels) > 0 {
+		parts := make([]string, len(f.Labels))
+		for i, l := range f.Labels {
+			parts[i] = "{{" + l + "}}"
+		}
+		legend = strings.Join(parts, " ")
+	}
+	sum := "sum"
+	if by != "" {
+		sum = "sum by (" + by + ")"
+	}
+	p := dashPanel{Title: f.Name, Description: f.Help, Unit: metricUnit(f.Name, f.Kind)}
+	switch f.Kind {
+	case counterKind:
+		p.Queries = []dashQuery{{fmt.Sprintf("%s (rate(%s[$__rate_interval]))", sum, b.sel(f.Name)), legend}}
+	case histogramKind:
+		le := strings.Join(append([]string{"le"}, f.Labels...), ", ")
+		for _, q := range [][2]string{{"0.5", "p50"}, {"0.99", "p99"}} {
+			p.Queries = append(p.Queries, dashQuery{
+				fmt.Sprintf("histogram_quantile(%s, sum by (%s) (rate(%s[$__rate_interval])))", q[0], le, b.sel(f.Name+"_bucket")),
+				q[1] + " " + legend,
+			})
+		}
+	default:
+		p.Queries = []dashQuery{{fmt.Sprintf("%s (%s)", sum, b.sel(f.Name)), legend}}
+	}
+	return p
+}
+
+// metricUnit picks a Grafana unit from the metric's name.
+func metricUnit(name, kind string) string {
+	base := strings.TrimSuffix(name, "_total")
+	switch {
+	case strings.HasSuffix(base, "_seconds") && kind == counterKind:
+		return "percentunit" // seconds per second
+	case strings.HasSuffix(base, "_seconds"):
+		return "s"
+	case strings.HasSuffix(base, "_bytes") && kind == counterKind:
+		return "Bps"
+	case strings.HasSuffix(base, "_bytes"):
+		return "bytes"
+	case strings.HasSuffix(base, "_percent"):
+		return "percent"
+	case kind == counterKind:
+		return "ops"
+	}
+	return "short"
+}
+
+func (b *dashBuilder) rows() []dashRow {
+	var rows []dashRow
+	add := func(title string, panels ...dashPanel) {
+		if len(panels) > 0 {
+			rows = append(rows, dashRow{title, panels})
+		}
+	}
+	keep := func(p dashPanel, ok bool) []dashPanel {
+		if ok {
+			return []dashPanel{p}
+		}
+		return nil
+	}
+	concat := func(ps ...[]dashPanel) []dashPanel {
+		var out []dashPanel
+		for _, p := range ps {
+			out = append(out, p...)
+		}
+		return out
+	}
+	n := func(names ...string) []string { return names }
+
+	// Rate, errors and duration per route.
+	add("Requests", concat(
+		keep(b.panel(dashPanel{Title: "Request rate", Unit: "reqps", Queries: []dashQuery{
+			{"sum by (route) (rate(" + b.sel("http_requests_total") + "[$__rate_interval]))", "{{route}}"},
+		}}, n("http_requests_total"))),
+		keep(b.panel(dashPanel{Title: "Error ratio (5xx)", Unit: "percentunit", Queries: []dashQuery{
+			{"sum by (route) (rate(" + b.sel("http_requests_total", `code=~"5.."`) + "[$__rate_interval])) / sum by (route) (rate(" +
+				b.sel("http_requests_total") + "[$__rate_interval]))", "{{route}}"},
+		}}, n("http_requests_total"))),
+		keep(b.panel(dashPanel{Title: "Duration p50 / p99", Unit: "s", Queries: []dashQuery{
+			{"histogram_quantile(0.5, sum by (le, route) (rate(" + b.sel("http_request_duration_seconds_bucket") + "[$__rate_interval])))", "p50 {{route}}"},
+			{"histogram_quantile(0.99, sum by (le, route) (rate(" + b.sel("http_request_duration_seconds_bucket") + "[$__rate_interval])))", "p99 {{route}}"},
+		}}, n("http_request_duration_seconds"), n("http_request_duration_seconds"))),
+		keep(b.panel(dashPanel{Title: "In flight", Unit: "short", Queries: []dashQuery{
+			{"sum(" + b.sel("http_requests_in_flight") + ")", "in flight"},
+		}}, n("http_requests_in_flight"))),
+	)...)
+
+	var redisPanels []dashPanel
+	for _, f := range registry.snapshot() {
+		if strings.HasPrefix(f.Name, "redis_pool_") {
+			redisPanels = append(redisPanels, b.family(f))
+		}
+	}
+	add("Redis pool", redisPanels...)
+
+	// Go 1.22 renamed the GC pause histogram; chart whichever this
+	// runtime has.
+	pauses := "go_sched_pauses_total_gc_seconds"
+	if !b.has(pauses) {
+		pauses = "go_gc_pauses_seconds"
+	}
+	add("Runtime", concat(
+		keep(b.panel(dashPanel{Title: "Goroutines", Unit: "short", Queries: []dashQuery{
+			{b.sel("go_sched_goroutines_goroutines"), "goroutines"},
+		}}, n("go_sched_goroutines_goroutines"))),
+		keep(b.panel(dashPanel{Title: "Heap", Unit: "bytes", Queries: []dashQuery{
+			{b.sel("go_gc_heap_live_bytes"), "live"},
+			{b.sel("go_gc_heap_goal_bytes"), "goal"},
+			{b.sel("go_memory_classes_total_bytes"), "mapped by the runtime"},
+			{b.sel("go_gc_gomemlimit_bytes") + " < 2^62", "GOMEMLIMIT"},
+		}}, n("go_gc_heap_live_bytes"), n("go_gc_heap_goal_bytes"), n("go_memory_classes_total_bytes"), n("go_gc_gomemlimit_bytes"))),
+		keep(b.panel(dashPanel{Title: "Allocation rate", Unit: "Bps", Queries: []dashQuery{
+			{"rate(" + b.sel("go_gc_heap_allocs_bytes_total") + "[$__rate_interval])", "allocated"},
+		}}, n("go_gc_heap_allocs_bytes_total"))),
+		keep(b.panel(dashPanel{Title: "GC CPU", Unit: "percentunit", Queries: []dashQuery{
+			{"rate(" + b.sel("go_cpu_classes_gc_total_cpu_seconds_total") + "[$__rate_interval]) / rate(" +
+				b.sel("go_cpu_classes_total_cpu_seconds_total") + "[$__rate_interval])", "GC share of CPU"},
+		}}, n("go_cpu_classes_gc_total_cpu_seconds_total", "go_cpu_classes_total_cpu_seconds_total"))),
+		keep(b.panel(dashPanel{Title: "GC cycles", Unit: "ops", Queries: []dashQuery{
+			{"rate(" + b.sel("go_gc_cycles_total_gc_cycles_total") + "[$__rate_interval])", "cycles"},
+		}}, n("go_gc_cycles_total_gc_cycles_total"))),
+		keep(b.panel(dashPanel{Title: "GC pauses p99", Unit: "s", Queries: []dashQuery{
+			{"histogram_quantile(0.99, sum by (le) (rate(" + b.sel(pauses+"_bucket") + "[$__rate_interval])))", "stop the world"},
+		}}, n(pauses))),
+		keep(b.panel(dashPanel{Title: "Scheduler latency p99", Unit: "s", Queries: []dashQuery{
+			{"histogram_quantile(0.99, sum by (le) (rate(" + b.sel("go_sched_latencies_seconds_bucket") + "[$__rate_interval])))", "runnable to running"},
+		}}, n("go_sched_latencies_seconds"))),
+		keep(b.panel(dashPanel{Title: "GOMAXPROCS", Unit: "short", Queries: []dashQuery{
+			{b.sel("go_sched_gomaxprocs_threads"), "GOMAXPROCS"},
+		}}, n("go_sched_gomaxprocs_threads"))),
+	)...)
+
+	add("Container resources", concat(
+		keep(b.panel(dashPanel{Title: "CPU", Unit: "short", Description: "Cores in use against the quota.", Queries: []dashQuery{
+			{"rate(" + b.sel("cgroup_cpu_usage_seconds_total") + "[$__rate_interval])", "used"},
+			{b.sel("cgroup_cpu_limit_cores") + " > 0", "limit"},
+		}}, n("cgroup_cpu_usage_seconds_total"), n("cgroup_cpu_limit_cores"))),
+		keep(b.panel(dashPanel{Title: "CPU throttling", Unit: "percentunit", Description: "Share of time the cgroup was throttled.", Queries: []dashQuery{
+			{"rate(" + b.sel("cgroup_cpu_throttled_seconds_total") + "[$__rate_interval])", "throttled"},
+		}}, n("cgroup_cpu_throttled_seconds_total"))),
+		keep(b.panel(dashPanel{Title: "Memory", Unit: "bytes", Queries: []dashQuery{
+			{b.sel("cgroup_memory_usage_bytes"), "usage"},
+			{b.sel("cgroup_memory_working_set_bytes"), "working set"},
+			{b.sel("cgroup_memory_limit_bytes") + " > 0", "limit"},
+		}}, n("cgroup_memory_usage_bytes"), n("cgroup_memory_working_set_bytes"), n("cgroup_memory_limit_bytes"))),
+		keep(b.panel(dashPanel{Title: "Memory events", Unit: "short", Queries: []dashQuery{
+			{"sum by (event) (increase(" + b.sel("cgroup_memory_events_total") + "[$__rate_interval]))", "{{event}}"},
+		}}, n("cgroup_memory_events_total"))),
+		keep(b.panel(dashPanel{Title: "Pressure stall", Unit: "percent", Queries: []dashQuery{
+			{b.sel("cgroup_pressure_avg10_percent"), "{{resource}} {{kind}}"},
+		}}, n("cgroup_pressure_avg10_percent"))),
+	)...)
+
+	// Whatever the panels above did not use, apart from the long tail of
+	// runtime metrics, gets a generic panel.
+	var rest []dashPanel
+	for _, f := range registry.snapshot() {
+		if !b.used[f.Name] && !strings.HasPrefix(f.Name, "go_") && !strings.HasPrefix(f.Name, "redis_pool_") {
+			rest = append(rest, b.family(f))
+		}
+	}
+	add("Diagnostics", rest...)
+	return rows
+}
+
+// grafanaDashboard is the subset of the dashboard model that is written.
+type grafanaDashboard struct {
+	UID           string            `json:"uid"`
+	Title         string            `json:"title"`
+	Tags          []string          `json:"tags"`
+	Timezone      string            `json:"timezone"`
+	SchemaVersion int               `json:"schemaVersion"`
+	Refresh       string            `json:"refresh"`
+	Time          map[string]string `json:"time"`
+	Templating    struct {
+		List []map[string]any `json:"list"`
+	} `json:"templating"`
+	Panels []map[string]any `json:"panels"`
+}
+
+func grafanaJSON(rows []dashRow, title, job string) ([]byte, error) {
+	d := grafanaDashboard{
+		UID:           job + "-generated",
+		Title:         title,
+		Tags:          []string{job, "generated"},
+		Timezone:      "browser",
+		SchemaVersion: 39,
+		Refresh:       "30s",
+		Time:          map[string]string{"from": "now-1h", "to": "now"},
+	}
+	d.Templating.List = []map[string]any{
+		{"name": "datasource", "label": "Data source", "type": "datasource", "query": "prometheus"},
+	}
+	ds := map[string]string{"type": "prometheus", "uid": "${datasource}"}
+	id, y := 1, 0
+	for _, row := range rows {
+		d.Panels = append(d.Panels, map[string]any{
+			"id": id, "type": "row", "title": row.Title, "collapsed": false, "panels": []any{},
+			"gridPos": map[string]int{"h": 1, "w": 24, "x": 0, "y": y},
+		})
+		id, y = id+1, y+1
+		for i, p := range row.Panels {
+			targets := make([]map[string]any, len(p.Queries))
+			for j, q := range p.Queries {
+				targets[j] = map[string]any{
+					"refId": string(rune('A' + j)), "expr": q.Expr, "legendFormat": q.Legend, "datasource": ds,
+				}
+			}
+			d.Panels = append(d.Panels, map[string]any{
+				"id": id, "type": "timeseries", "title": p.Title, "description": p.Description,
+				"datasource": ds, "targets": targets,
+				"fieldConfig": map[string]any{"defaults": map[string]any{"unit": p.Unit}, "overrides": []any{}},
+				"gridPos":     map[string]int{"h": 8, "w": 12, "x": 12 * (i % 2), "y": y + 8*(i/2)},
+			})
+			id++
+		}
+		y += 8 * ((len(row.Panels) + 1) / 2)
+	}
+	return json.MarshalIndent(d, "", "  ")
+}
+
+// promRule is one alerting rule.
+type promRule struct {
+	Alert       string
+	Expr        string
+	For         string
+	Severity    string
+	Summary     string
+	Description string
+}
+
+type promRuleGroup struct {
+	Name  string
+	Rules []promRule
+}
+
+func (b *dashBuilder) alertRules() []promRuleGroup {
+	var groups []promRuleGroup
+	group := func(name string, rules ...promRule) {
+		if len(rules) > 0 {
+			groups = append(groups, promRuleGroup{b.job + "." + name, rules})
+		}
+	}
+	when := func(r promRule, names ...string) []promRule {
+		for _, n := range names {
+			if !b.has(n) {
+				return nil
+			}
+		}
+		return []promRule{r}
+	}
+	concat := func(rs ...[]promRule) []promRule {
+		var out []promRule
+		for _, r := range rs {
+			out = append(out, r...)
+		}
+		return out
+	}
+
+	group("requests", concat(
+		[]promRule{{
+			Alert: "GoAppDown", Expr: `up{job="` + b.job + `"} == 0`, For: "2m", Severity: "page",
+			Summary: "{{ $labels.instance }} is not being scraped",
+		}},
+		when(promRule{
+			Alert: "GoAppHighErrorRate", For: "5m", Severity: "page",
+			Expr: "sum by (route) (rate(" + b.sel("http_requests_total", `code=~"5.."`) + "[5m])) / sum by (route) (rate(" +
+				b.sel("http_requests_total") + "[5m])) > 0.05",
+			Summary: "More than 5% of {{ $labels.route }} requests are failing",
+		}, "http_requests_total"),
+		when(promRule{
+			Alert: "GoAppHighLatency", For: "10m", Severity: "ticket",
+			Expr:    "histogram_quantile(0.99, sum by (le, route) (rate(" + b.sel("http_request_duration_seconds_bucket") + "[5m]))) > 0.5",
+			Summary: "p99 latency of {{ $labels.route }} is over 500ms",
+		}, "http_request_duration_seconds"),
+	)...)
+
+	group("slo", concat(
+		when(promRule{
+			Alert: "SLOErrorBudgetBurnFast", Severity: "page",
+			Expr:        "max by (slo) (" + b.sel("slo_alert_firing", `severity="page"`) + ") == 1",
+			Summary:     "{{ $labels.slo }} is burning its error budget fast",
+			Description: "A page-level multiwindow burn-rate alert is firing; see /slo for the burn rates.",
+		}, "slo_alert_firing"),
+		when(promRule{
+			Alert: "SLOErrorBudgetBurnSlow", Severity: "ticket",
+			Expr:    "max by (slo) (" + b.sel("slo_alert_firing", `severity="ticket"`) + ") == 1",
+			Summary: "{{ $labels.slo }} is burning its error budget",
+		}, "slo_alert_firing"),
+		when(promRule{
+			Alert: "SLOErrorBudgetExhausted", For: "15m", Severity: "ticket",
+			Expr:    "min by (slo) (" + b.sel("slo_error_budget_remaining") + ") < 0",
+			Summary: "{{ $labels.slo }} has spent its error budget",
+		}, "slo_error_budget_remaining"),
+	)...)
+
+	group("redis", concat(
+		when(promRule{
+			Alert: "RedisPoolTimeouts", For: "5m", Severity: "ticket",
+			Expr:    "increase(" + b.sel("redis_pool_timeouts_total") + "[5m]) > 0",
+			Summary: "Requests on {{ $labels.instance }} are timing out waiting for a Redis connection",
+		}, "redis_pool_timeouts_total"),
+	)...)
+
+	group("resources", concat(
+		when(promRule{
+			Alert: "ContainerCPUThrottled", For: "15m", Severity: "ticket",
+			Expr:    "rate(" + b.sel("cgroup_cpu_throttled_seconds_total") + "[5m]) > 0.25",
+			Summary: "{{ $labels.instance }} is CPU throttled over a quarter of the time",
+		}, "cgroup_cpu_throttled_seconds_total"),
+		when(promRule{
+			Alert: "ContainerMemoryNearLimit", For: "15m", Severity: "ticket",
+			Expr:    b.sel("cgroup_memory_working_set_bytes") + " / (" + b.sel("cgroup_memory_limit_bytes") + " > 0) > 0.9",
+			Summary: "{{ $labels.instance }} working set is over 90% of its memory limit",
+		}, "cgroup_memory_working_set_bytes", "cgroup_memory_limit_bytes"),
+		when(promRule{
+			Alert: "ContainerOOMKilled", Severity: "page",
+			Expr:    "increase(" + b.sel("cgroup_memory_events_total", `event="oom_kill"`) + "[10m]) > 0",
+			Summary: "A process in {{ $labels.instance }}'s cgroup was OOM killed",
+		}, "cgroup_memory_events_total"),
+	)...)
+
+	group("runtime", concat(
+		when(promRule{
+			Alert: "GoAppLeakSuspected", For: "30m", Severity: "ticket",
+			Expr:    "max by (kind) (" + b.sel("leak_suspects") + ") > 0",
+			Summary: "The leak detector reports growing {{ $labels.kind }}; see /debug/leaks",
+		}, "leak_suspects"),
+		when(promRule{
+			Alert: "GoAppGCCPUHigh", For: "15m", Severity: "ticket",
+			Expr: "rate(" + b.sel("go_cpu_classes_gc_total_cpu_seconds_total") + "[5m]) / rate(" +
+				b.sel("go_cpu_classes_total_cpu_seconds_total") + "[5m]) > 0.25",
+			Summary: "GC is using over a quarter of {{ $labels.instance }}'s CPU; see /debug/gc-advice",
+		}, "go_cpu_classes_gc_total_cpu_seconds_total", "go_cpu_classes_total_cpu_seconds_total"),
+	)...)
+	return groups
+}
+
+// writeRulesYAML writes groups in the Prometheus rule file format. The
+// values are quoted, so no YAML library is needed.
+func writeRulesYAML(w io.Writer, groups []promRuleGroup) {
+	fmt.Fprintln(w, "# Generated by `go-app dashboards`; edit the generator, not this file.")
+	fmt.Fprintln(w, "groups:")
+	for _, g := range groups {
+		fmt.Fprintf(w, "  - name: %s\n    rules:\n", strconv.Quote(g.Name))
+		for _, r := range g.Rules {
+			fmt.Fprintf(w, "      - alert: %s\n", r.Alert)
+			fmt.Fprintf(w, "        expr: %s\n", strconv.Quote(r.Expr))
+			if r.For != "" {
+				fmt.Fprintf(w, "        for: %s\n", r.For)
+			}
+			fmt.Fprintf(w, "        labels:\n          severity: %s\n", r.Severity)
+			fmt.Fprintf(w, "        annotations:\n          summary: %s\n", strconv.Quote(r.Summary))
+			if r.Description != "" {
+				fmt.Fprintf(w, "          description: %s\n", strconv.Quote(r.Description))
+			}
+		}
+	}
+}
+
+var seriesName = regexp.MustCompile(`([a-zA-Z_:][a-zA-Z0-9_:]*)\{`)
+
+// missingSeries lists the metric names expr selects that the registry does
+// not export. Histogram families export _bucket, _sum and _count; up is
+// Prometheus's own.
+func (b *dashBuilder) missingSeries(expr string) []string {
+	var missing []string
+	for _, m := range seriesName.FindAllStringSubmatch(expr, -1) {
+		name := m[1]
+		if name == "up" || b.has(name) {
+			continue
+		}
+		base := name
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			base = strings.TrimSuffix(base, suffix)
+		}
+		if f, ok := b.families[base]; ok && f.Kind == histogramKind {
+			continue
+		}
+		missing = append(missing, name)
+	}
+	return missing
+}
+
+// checkGenerated fails if any panel or rule selects a series the registry
+// does not have.
+func (b *dashBuilder) checkGenerated(rows []dashRow, groups []promRuleGroup) error {
+	var problems []string
+	for _, row := range rows {
+		for _, p := range row.Panels {
+			for _, q := range p.Queries {
+				for _, m := range b.missingSeries(q.Expr) {
+					problems = append(problems, fmt.Sprintf("panel %q: %s", p.Title, m))
+				}
+			}
+		}
+	}
+	for _, g := range groups {
+		for _, r := range g.Rules {
+			for _, m := range b.missingSeries(r.Expr) {
+				problems = append(problems, fmt.Sprintf("alert %s: %s", r.Alert, m))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("unregistered series: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func runDashboards(args []string) int {
+	fs := flag.NewFlagSet("dashboards", flag.ExitOnError)
+	dir := fs.String("o", ".", "directory to write go-app-dashboard.json and go-app-alerts.yml to")
+	job := fs.String("job", "go-app", "Prometheus job label the queries select")
+	title := fs.String("title", "go-app", "dashboard title")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s dashboards [flags]\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintln(fs.Output(), "Generates a Grafana dashboard and Prometheus alerting rules for the")
+		fmt.Fprintln(fs.Output(), "metrics this binary exports.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	b := newDashBuilder(*job)
+	rows := b.rows()
+	groups := b.alertRules()
+	if err := b.checkGenerated(rows, groups); err != nil {
+		fmt.Fprintf(os.Stderr, "dashboards: %v\n", err)
+		return 1
+	}
+	dashboard, err := grafanaJSON(rows, *title, *job)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dashboards: %v\n", err)
+		return 1
+	}
+	var rules strings.Builder
+	writeRulesYAML(&rules, groups)
+
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "dashboards: %v\n", err)
+		return 1
+	}
+	for _, out := range []struct {
+		name string
+		data []byte
+	}{
+		{"go-app-dashboard.json", append(dashboard, '\n')},
+		{"go-app-alerts.yml", []byte(rules.String())},
+	} {
+		path := filepath.Join(*dir, out.name)
+		if err := os.WriteFile(path, out.data, 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "dashboards: %v\n", err)
+			return 1
+		}
+		fmt.Println(path)
+	}
+	return 0
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDashboardsReferenceRegisteredSeries(t *testing.T) {
+	b := newDashBuilder("go-app")
+	rows := b.rows()
+	groups := b.alertRules()
+	if err := b.checkGenerated(rows, groups); err != nil {
+		t.Fatal(err)
+	}
+
+	titles := map[string]bool{}
+	for _, r := range rows {
+		titles[r.Title] = true
+	}
+	for _, want := range []string{"Requests", "Redis pool", "Runtime", "Container resources"} {
+		if !titles[want] {
+			t.Errorf("no %q row in %v", want, titles)
+		}
+	}
+
+	data, err := grafanaJSON(rows, "go-app", "go-app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d struct {
+		Panels []struct {
+			Type    string `json:"type"`
+			Targets []struct {
+				Expr string `json:"expr"`
+			} `json:"targets"`
+		} `json:"panels"`
+	}
+	if err := json.Unmarshal(data, &d); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Panels) < 20 {
+		t.Errorf("dashboard has only %d panels", len(d.Panels))
+	}
+
+	var rules strings.Builder
+	writeRulesYAML(&rules, groups)
+	for _, want := range []string{"alert: GoAppHighErrorRate", "alert: SLOErrorBudgetBurnFast", "alert: RedisPoolTimeouts"} {
+		if !strings.Contains(rules.String(), want) {
+			t.Errorf("rules lack %q", want)
+		}
+	}
+}
+
+func TestMissingSeries(t *testing.T) {
+	b := newDashBuilder("go-app")
+	expr := `rate(http_request_duration_seconds_bucket{job="x"}[5m]) + up{job="x"} + no_such_metric_total{job="x"} + http_requests_total_bucket{job="x"}`
+	got := b.missingSeries(expr)
+	if strings.Join(got, ",") != "no_such_metric_total,http_requests_total_bucket" {
+		t.Errorf("missingSeries = %v", got)
+	}
+}
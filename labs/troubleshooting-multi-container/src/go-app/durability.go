@@ -0,0 +1,578 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// durability.go notices when Redis loses the counters, as it does when it
+// restarts without persistence or evicts them, rather than letting
+// /counter quietly start again from 1. go-app stores a random epoch token
+// beside the counters; the token vanishing means the dataset was lost, and
+// a counter lower than go-app has already seen means a key was. The
+// highest values seen are checkpointed to a file so a loss that happens
+// while go-app is down is caught too. What happens on a loss is the
+// policy: restore adds the checkpointed values back, alert only records
+// it, and refuse fails /counter until someone decides at
+// /debug/counter/durability.
+
+const counterEpochKey = "go_visit_counter:epoch"
+
+// durableCounters are the keys checked and checkpointed.
+var durableCounters = []string{"go_visit_counter"}
+
+var (
+	counterLossEvents = registry.counter("counter_loss_events_total",
+		"Detected losses of counter data, by reason: epoch_missing when the dataset was lost, went_backwards when a counter was.", "reason")
+	counterRestored = registry.counter("counter_restored_increments_total",
+		"Increments added back to counters from the checkpoint after a loss.")
+	counterWritesRefused = registry.counter("counter_writes_refused_total",
+		"Counter increments refused while a loss awaits a decision under the refuse policy.")
+	counterDataLost = registry.gauge("counter_data_lost",
+		"1 while a detected loss has not been resolved.")
+	redisRestarts = registry.counter("redis_restarts_total",
+		"Changes of the Redis run_id seen by go-app.")
+)
+
+// counterSnapshot is what one check reads from Redis.
+type counterSnapshot struct {
+	RunID  string
+	Epoch  string
+	Values map[string]int64
+}
+
+// counterStore is the Redis side of the guard.
+type counterStore interface {
+	read(ctx context.Context, keys []string) (counterSnapshot, error)
+	// claimEpoch sets the epoch if it is unset and returns the epoch now
+	// stored, which is someone else's if they got there first.
+	claimEpoch(ctx context.Context, epoch string) (string, error)
+	// restore claims the epoch and, only if that succeeded, adds
+	// increments to the counters. Of several replicas seeing the same
+	// loss, one restores.
+	restore(ctx context.Context, epoch string, add map[string]int64) (bool, error)
+}
+
+type redisCounterStore struct{ client *redis.Client }
+
+func (s redisCounterStore) read(ctx context.Context, keys []string) (counterSnapshot, error) {
+	var info *redis.StringCmd
+	var epoch *redis.StringCmd
+	var values *redis.SliceCmd
+	s.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		info = p.Info(ctx, "server")
+		epoch = p.Get(ctx, counterEpochKey)
+		values = p.MGet(ctx, keys...)
+		return nil
+	})
+	for _, err := range []error{info.Err(), epoch.Err(), values.Err()} {
+		if err != nil && err != redis.Nil {
+			return counterSnapshot{}, err
+		}
+	}
+	snap := counterSnapshot{
+		RunID:  parseRedisInfo(info.Val())["run_id"],
+		Epoch:  epoch.Val(),
+		Values: make(map[string]int64),
+	}
+	for i, v := range values.Val() {
+		if s, ok := v.(string); ok {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return counterSnapshot{}, fmt.Errorf("%s: %v", keys[i], err)
+			}
+			snap.Values[keys[i]] = n
+		}
+	}
+	return snap, nil
+}
+
+func (s redisCounterStore) claimEpoch(ctx context.Context, epoch string) (string, error) {
+	if err := s.client.SetNX(ctx, counterEpochKey, epoch, 0).Err(); err != nil {
+		return "", err
+	}
+	return s.client.Get(ctx, counterEpochKey).Result()
+}
+
+func (s redisCounterStore) restore(ctx context.Context, epoch string, add map[string]int64) (bool, error) {
+	won, err := s.client.SetNX(ctx, counterEpochKey, epoch, 0).Result()
+	if err != nil || !won {
+		return false, err
+	}
+	_, err = s.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, k := range sortedKeys(add) {
+			p.IncrBy(ctx, k, add[k])
+		}
+		return nil
+	})
+	return true, err
+}
+
+// counterLoss is one detected loss and what was done about it.
+type counterLoss struct {
+	Time     time.Time        `json:"time"`
+	Reason   string           `json:"reason"`
+	Detail   string           `json:"detail"`
+	Policy   string           `json:"policy"`
+	Action   string           `json:"action"`
+	Expected map[string]int64 `json:"expected"`
+	Found    map[string]int64 `json:"found"`
+}
+
+// counterCheckpoint is the checkpoint file.
+type counterCheckpoint struct {
+	Time     time.Time        `json:"time"`
+	Epoch    string           `json:"epoch"`
+	RunID    string           `json:"run_id"`
+	Counters map[string]int64 `json:"counters"`
+}
+
+type counterGuard struct {
+	policy string // restore, alert or refuse
+	file   string
+	store  counterStore
+	now    func() time.Time
+
+	// busy serialises check and resolve, which talk to Redis while
+	// holding it. mu guards the state below and is never held across a
+	// Redis call, so /counter's note and refusing do not wait on one.
+	busy          sync.Mutex
+	mu            sync.Mutex
+	epoch         string
+	runID         string
+	high          map[string]int64 // highest value seen per counter
+	checkpointed  time.Time
+	checkpointErr string
+	lost          *counterLoss // unresolved, under the refuse policy
+	events        []counterLoss
+}
+
+var counterGuardian *counterGuard
+
+// startCounterDurability checks the counters every COUNTER_CHECK_INTERVAL
+// (5s) and writes COUNTER_CHECKPOINT_FILE every
+// COUNTER_CHECKPOINT_INTERVAL (30s). The file defaults to the temporary
+// directory, which only survives go-app restarting in place; mount a
+// volume to keep it across containers. COUNTER_LOSS_POLICY is restore
+// (the default), alert or refuse. COUNTER_DURABILITY=false turns it off,
+// as sharding does.
+func startCounterDurability(ctx context.Context, client *redis.Client) {
+	if on, _ := strconv.ParseBool(envOr("COUNTER_DURABILITY", "true")); !on {
+		return
+	}
+	if redisShards != nil {
+		// The epoch and run_id describe one server; with shards they
+		// would need one of each per shard. startRedisShards has said so.
+		return
+	}
+	policy := envOr("COUNTER_LOSS_POLICY", "restore")
+	if policy != "restore" && policy != "alert" && policy != "refuse" {
+		log.Printf("Counter durability disabled: COUNTER_LOSS_POLICY must be restore, alert or refuse, not %q", policy)
+		return
+	}
+	g := newCounterGuard(redisCounterStore{client}, policy, envOr("COUNTER_CHECKPOINT_FILE", filepath.Join(os.TempDir(), "go-app-counters.json")))
+	if cp, err := readCounterCheckpoint(g.file); err == nil {
+		g.loadCheckpoint(cp)
+		log.Printf("Counter checkpoint from %s: epoch %s, %v", cp.Time.Format(time.RFC3339), cp.Epoch, cp.Counters)
+	} else if !os.IsNotExist(err) {
+		log.Printf("Counter checkpoint %s unreadable, starting without it: %v", g.file, err)
+	}
+	counterGuardian = g
+	log.Printf("Guarding counters against Redis data loss (policy %s, checkpoint %s)", policy, g.file)
+
+	checkEvery := envDuration("COUNTER_CHECK_INTERVAL", 5*time.Second)
+	checkpointEvery := envDuration("COUNTER_CHECKPOINT_INTERVAL", 30*time.Second)
+	go func() {
+		t := time.NewTicker(checkEvery)
+		defer t.Stop()
+		for {
+			checkCtx, cancel := context.WithTimeout(ctx, checkEvery)
+			if err := g.check(checkCtx); err != nil {
+				slog.Debug("counter check failed", "err", err)
+			} else if g.now().Sub(g.lastCheckpoint()) >= checkpointEvery {
+				g.writeCheckpoint()
+			}
+			cancel()
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+func newCounterGuard(store counterStore, policy, file string) *counterGuard {
+	return &counterGuard{
+		policy: policy,
+		file:   file,
+		store:  store,
+		now:    time.Now,
+		high:   make(map[string]int64),
+	}
+}
+
+func (g *counterGuard) loadCheckpoint(cp counterCheckpoint) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.epoch, g.runID, g.checkpointed = cp.Epoch, cp.RunID, cp.Time
+	for k, v := range cp.Counters {
+		g.high[k] = max(g.high[k], v)
+	}
+}
+
+// note records a value go-app saw, such as INCR's reply, so the
+// high-water mark is fresher than the last check.
+func (g *counterGuard) note(key string, v int64) {
+	g.mu.Lock()
+	g.high[key] = max(g.high[key], v)
+	g.mu.Unlock()
+}
+
+// refusing reports the unresolved loss writes are refused for.
+func (g *counterGuard) refusing() *counterLoss {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.lost
+}
+
+// check compares Redis with what go-app has seen and acts on a loss.
+func (g *counterGuard) check(ctx context.Context) error {
+	g.busy.Lock()
+	defer g.busy.Unlock()
+	snap, err := g.store.read(ctx, durableCounters)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	if g.runID != "" && snap.RunID != "" && snap.RunID != g.runID {
+		redisRestarts.with().inc()
+		log.Printf("Redis restarted (run_id %s -> %s)", g.runID, snap.RunID)
+	}
+	if snap.RunID != "" {
+		g.runID = snap.RunID
+	}
+	waiting, epoch := g.lost != nil, g.epoch
+	g.mu.Unlock()
+	if waiting {
+		return nil // waiting for a decision
+	}
+
+	switch {
+	case snap.Epoch == "" && epoch == "":
+		// Nothing to compare with: a new dataset, or go-app's first run.
+		if epoch, err = g.store.claimEpoch(ctx, newCounterEpoch(g.now())); err != nil {
+			return err
+		}
+	case snap.Epoch == "":
+		g.lose(ctx, snap, "epoch_missing", fmt.Sprintf("epoch %s is gone from Redis", epoch))
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch {
+	case snap.Epoch == "":
+		g.epoch = epoch // claimed above
+	case snap.Epoch != g.epoch:
+		// Another replica handled a loss, or go-app is new to this
+		// dataset. Either way its counters are the truth from here.
+		if g.epoch != "" {
+			log.Printf("Counter epoch changed from %s to %s elsewhere; adopting it", g.epoch, snap.Epoch)
+		}
+		g.epoch = snap.Epoch
+		g.high = make(map[string]int64)
+	default:
+		for _, k := range durableCounters {
+			if v := snap.Values[k]; v < g.high[k] {
+				// The dataset survived but a key did not, so there is no
+				// epoch for replicas to race on; restoring is left to
+				// an operator.
+				g.record(snap, "went_backwards", fmt.Sprintf("%s is %d, below %d already seen", k, v, g.high[k]), "alerted")
+				g.high[k] = v
+			}
+		}
+	}
+	for k, v := range snap.Values {
+		g.high[k] = max(g.high[k], v)
+	}
+	return nil
+}
+
+// lose applies the policy to a lost dataset. g.busy is held.
+func (g *counterGuard) lose(ctx context.Context, snap counterSnapshot, reason, detail string) {
+	switch g.policy {
+	case "restore":
+		g.mu.Lock()
+		add := restoreIncrements(g.high, snap.Values)
+		g.mu.Unlock()
+		epoch := newCounterEpoch(g.now())
+		won, err := g.store.restore(ctx, epoch, add)
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		switch {
+		case err != nil:
+			g.record(snap, reason, detail, "restore failed: "+err.Error())
+			return
+		case !won:
+			// Another replica restored first; the next check adopts its
+			// epoch.
+			return
+		}
+		action := "restored"
+		if len(add) == 0 {
+			action = "counters intact; epoch reset"
+		}
+		g.record(snap, reason, detail, action)
+		g.applyRestore(epoch, snap, add)
+	case "alert":
+		g.mu.Lock()
+		g.record(snap, reason, detail, "alerted")
+		g.mu.Unlock()
+		if err := g.restart(ctx, snap); err != nil {
+			slog.Warn("counter epoch not reset; the loss will be reported again", "err", err)
+		}
+	case "refuse":
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.record(snap, reason, detail, "refusing writes")
+		ev := g.events[len(g.events)-1]
+		g.lost = &ev
+		counterDataLost.with().set(1)
+	}
+}
+
+// applyRestore takes on the epoch a restore claimed. g.mu is held.
+func (g *counterGuard) applyRestore(epoch string, snap counterSnapshot, add map[string]int64) {
+	for k, v := range add {
+		counterRestored.with().add(float64(v))
+		g.high[k] = max(g.high[k], snap.Values[k]+v)
+	}
+	g.epoch = epoch
+}
+
+// restoreIncrements is what a restore adds back: the whole expected value
+// for each counter Redis has below it, since what is there was counted
+// from zero after the loss. A counter at or above it survived, as when
+// only the epoch key was evicted, and is left alone.
+func restoreIncrements(expected, found map[string]int64) map[string]int64 {
+	add := make(map[string]int64)
+	for k, v := range expected {
+		if v > 0 && found[k] < v {
+			add[k] = v
+		}
+	}
+	return add
+}
+
+// restart accepts the counters as Redis has them under a new epoch.
+// g.busy is held.
+func (g *counterGuard) restart(ctx context.Context, snap counterSnapshot) error {
+	epoch, err := g.store.claimEpoch(ctx, newCounterEpoch(g.now()))
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.epoch = epoch
+	g.high = make(map[string]int64)
+	for k, v := range snap.Values {
+		g.high[k] = v
+	}
+	return nil
+}
+
+// record logs a loss and keeps the last 20. g.mu is held.
+func (g *counterGuard) record(snap counterSnapshot, reason, detail, action string) {
+	expected := make(map[string]int64)
+	for _, k := range durableCounters {
+		expected[k] = g.high[k]
+	}
+	ev := counterLoss{Time: g.now(), Reason: reason, Detail: detail, Policy: g.policy, Action: action, Expected: expected, Found: snap.Values}
+	g.events = append(g.events, ev)
+	if len(g.events) > 20 {
+		g.events = append([]counterLoss(nil), g.events[len(g.events)-20:]...)
+	}
+	counterLossEvents.with(reason).inc()
+	slog.Error("counter data lost", "reason", reason, "detail", detail, "action", action, "expected", expected, "found", snap.Values)
+}
+
+// resolve ends a refused state, restoring the checkpointed values or
+// accepting the counters as they are.
+func (g *counterGuard) resolve(ctx context.Context, restore bool) error {
+	g.busy.Lock()
+	defer g.busy.Unlock()
+	lost := g.refusing()
+	if lost == nil {
+		return fmt.Errorf("no unresolved loss")
+	}
+	snap, err := g.store.read(ctx, durableCounters)
+	if err != nil {
+		return err
+	}
+	if restore {
+		add := restoreIncrements(lost.Expected, snap.Values)
+		epoch := newCounterEpoch(g.now())
+		won, err := g.store.restore(ctx, epoch, add)
+		if err != nil {
+			return err
+		}
+		if !won {
+			return fmt.Errorf("the epoch was set by someone else meanwhile; check the counters before deciding again")
+		}
+		g.mu.Lock()
+		g.applyRestore(epoch, snap, add)
+		g.mu.Unlock()
+	} else if err := g.restart(ctx, snap); err != nil {
+		return err
+	}
+	log.Printf("Counter loss resolved (restore=%t)", restore)
+	g.mu.Lock()
+	g.lost = nil
+	g.mu.Unlock()
+	counterDataLost.with().set(0)
+	return nil
+}
+
+func (g *counterGuard) lastCheckpoint() time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.checkpointed
+}
+
+// writeCheckpoint saves the high-water marks, through a temporary file
+// so a crash never leaves half a checkpoint. Nothing is written while a
+// loss is unresolved, to keep the values a restore needs.
+func (g *counterGuard) writeCheckpoint() {
+	g.mu.Lock()
+	if g.lost != nil || g.epoch == "" {
+		g.mu.Unlock()
+		return
+	}
+	cp := counterCheckpoint{Time: g.now(), Epoch: g.epoch, RunID: g.runID, Counters: make(map[string]int64)}
+	for k, v := range g.high {
+		cp.Counters[k] = v
+	}
+	g.mu.Unlock()
+
+	err := writeCounterCheckpoint(g.file, cp)
+	g.mu.Lock()
+	if err != nil {
+		if g.checkpointErr == "" {
+			slog.Warn("counter checkpoint failed", "file", g.file, "err", err)
+		}
+		g.checkpointErr = err.Error()
+	} else {
+		g.checkpointed, g.checkpointErr = cp.Time, ""
+	}
+	g.mu.Unlock()
+}
+
+func writeCounterCheckpoint(path string, cp counterCheckpoint) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".counters-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func readCounterCheckpoint(path string) (counterCheckpoint, error) {
+	var cp counterCheckpoint
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cp, err
+	}
+	err = json.Unmarshal(data, &cp)
+	return cp, err
+}
+
+// newCounterEpoch makes a token that is unique and says when it began.
+func newCounterEpoch(now time.Time) string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return now.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+type counterDurabilityStatus struct {
+	Policy        string           `json:"policy"`
+	Epoch         string           `json:"epoch"`
+	RedisRunID    string           `json:"redis_run_id"`
+	HighWater     map[string]int64 `json:"high_water"`
+	Checkpoint    string           `json:"checkpoint_file"`
+	CheckpointAt  time.Time        `json:"checkpoint_time,omitzero"`
+	CheckpointErr string           `json:"checkpoint_error,omitempty"`
+	Unresolved    *counterLoss     `json:"unresolved_loss,omitempty"`
+	Events        []counterLoss    `json:"events"`
+}
+
+// counterDurabilityHandler reports the guard's state. Under the refuse
+// policy, POST action=restore or action=accept resolves a loss.
+func counterDurabilityHandler(w http.ResponseWriter, r *http.Request) {
+	g := counterGuardian
+	if g == nil {
+		http.Error(w, "counter durability is disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		action := r.FormValue("action")
+		if action != "restore" && action != "accept" {
+			http.Error(w, "action must be restore or accept", http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		if err := g.resolve(ctx, action == "restore"); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	g.mu.Lock()
+	st := counterDurabilityStatus{
+		Policy:        g.policy,
+		Epoch:         g.epoch,
+		RedisRunID:    g.runID,
+		HighWater:     make(map[string]int64),
+		Checkpoint:    g.file,
+		CheckpointAt:  g.checkpointed,
+		CheckpointErr: g.checkpointErr,
+		Unresolved:    g.lost,
+		Events:        append([]counterLoss{}, g.events...),
+	}
+	for k, v := range g.high {
+		st.HighWater[k] = v
+	}
+	g.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(st)
+}
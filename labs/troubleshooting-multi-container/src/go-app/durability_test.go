@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeCounterStore is a Redis holding the epoch and counters.
+type fakeCounterStore struct {
+	runID  string
+	epoch  string
+	values map[string]int64
+}
+
+func (s *fakeCounterStore) read(ctx context.Context, keys []string) (counterSnapshot, error) {
+	snap := counterSnapshot{RunID: s.runID, Epoch: s.epoch, Values: make(map[string]int64)}
+	for _, k := range keys {
+		if v, ok := s.values[k]; ok {
+			snap.Values[k] = v
+		}
+	}
+	return snap, nil
+}
+
+func (s *fakeCounterStore) claimEpoch(ctx context.Context, epoch string) (string, error) {
+	if s.epoch == "" {
+		s.epoch = epoch
+	}
+	return s.epoch, nil
+}
+
+func (s *fakeCounterStore) restore(ctx context.Context, epoch string, add map[string]int64) (bool, error) {
+	if s.epoch != "" {
+		return false, nil
+	}
+	s.epoch = epoch
+	for k, v := range add {
+		s.values[k] += v
+	}
+	return true, nil
+}
+
+// flush is Redis restarting without persistence.
+func (s *fakeCounterStore) flush(runID string) {
+	s.runID, s.epoch, s.values = runID, "", make(map[string]int64)
+}
+
+func TestCounterGuardRestore(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeCounterStore{runID: "a", values: map[string]int64{"go_visit_counter": 41}}
+	g := newCounterGuard(store, "restore", "")
+	if err := g.check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if store.epoch == "" || g.epoch != store.epoch {
+		t.Fatalf("epoch not claimed: store %q, guard %q", store.epoch, g.epoch)
+	}
+	store.values["go_visit_counter"]++
+	g.note("go_visit_counter", 42)
+
+	// Redis comes back empty and two visits land before the next check.
+	store.flush("b")
+	store.values["go_visit_counter"] = 2
+	g.check(ctx)
+	if got := store.values["go_visit_counter"]; got != 44 {
+		t.Errorf("restored counter = %d, want 44", got)
+	}
+	if len(g.events) != 1 || g.events[0].Reason != "epoch_missing" || g.events[0].Action != "restored" {
+		t.Errorf("events %+v", g.events)
+	}
+	if g.epoch != store.epoch {
+		t.Errorf("guard epoch %q, store %q", g.epoch, store.epoch)
+	}
+
+	// A second replica with the old epoch sees the new one and adopts it.
+	other := newCounterGuard(store, "restore", "")
+	other.epoch = "old"
+	other.high["go_visit_counter"] = 42
+	other.check(ctx)
+	if other.epoch != store.epoch || len(other.events) != 0 || store.values["go_visit_counter"] != 44 {
+		t.Errorf("second replica: epoch %q, events %v, counter %d", other.epoch, other.events, store.values["go_visit_counter"])
+	}
+
+	// The key alone going backwards is alerted on, not restored.
+	store.values["go_visit_counter"] = 1
+	g.check(ctx)
+	if len(g.events) != 2 || g.events[1].Reason != "went_backwards" || store.values["go_visit_counter"] != 1 {
+		t.Errorf("events %+v, counter %d", g.events, store.values["go_visit_counter"])
+	}
+}
+
+// Only the epoch key going, as under eviction, leaves the counter as it
+// was; restoring must not add the high-water mark on top of it.
+func TestCounterGuardRestoreEpochOnly(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeCounterStore{runID: "a", values: map[string]int64{"go_visit_counter": 41}}
+	g := newCounterGuard(store, "restore", "")
+	g.check(ctx)
+	store.epoch = ""
+	store.values["go_visit_counter"]++
+	g.check(ctx)
+	if got := store.values["go_visit_counter"]; got != 42 {
+		t.Errorf("counter = %d after the epoch alone was lost, want 42", got)
+	}
+	if store.epoch == "" || g.epoch != store.epoch {
+		t.Errorf("epoch not reclaimed: store %q, guard %q", store.epoch, g.epoch)
+	}
+	if len(g.events) != 1 || g.events[0].Reason != "epoch_missing" {
+		t.Errorf("events %+v", g.events)
+	}
+}
+
+func TestCounterGuardRefuse(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeCounterStore{runID: "a", values: map[string]int64{"go_visit_counter": 10}}
+	g := newCounterGuard(store, "refuse", "")
+	g.check(ctx)
+	store.flush("b")
+	g.check(ctx)
+	if g.refusing() == nil {
+		t.Fatal("writes not refused after a loss")
+	}
+	g.check(ctx)
+	if len(g.events) != 1 {
+		t.Errorf("loss recorded %d times while unresolved", len(g.events))
+	}
+	if err := g.resolve(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if g.refusing() != nil || store.values["go_visit_counter"] != 10 || store.epoch == "" {
+		t.Errorf("after restore: refusing %v, counter %d, epoch %q", g.refusing(), store.values["go_visit_counter"], store.epoch)
+	}
+	if err := g.resolve(ctx, true); err == nil {
+		t.Error("resolved a loss twice")
+	}
+
+	// Accepting keeps what Redis has.
+	store.flush("c")
+	store.values["go_visit_counter"] = 3
+	g.check(ctx)
+	if err := g.resolve(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if store.values["go_visit_counter"] != 3 || g.high["go_visit_counter"] != 3 {
+		t.Errorf("after accept: counter %d, high %d", store.values["go_visit_counter"], g.high["go_visit_counter"])
+	}
+}
+
+func TestCounterGuardAlert(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeCounterStore{runID: "a", values: map[string]int64{"go_visit_counter": 10}}
+	g := newCounterGuard(store, "alert", "")
+	g.check(ctx)
+	store.flush("b")
+	g.check(ctx)
+	g.check(ctx)
+	if len(g.events) != 1 || g.events[0].Action != "alerted" || g.refusing() != nil {
+		t.Errorf("events %+v", g.events)
+	}
+	if store.values["go_visit_counter"] != 0 || store.epoch == "" {
+		t.Errorf("alert changed the counter to %d, epoch %q", store.values["go_visit_counter"], store.epoch)
+	}
+}
+
+// A loss while go-app was down is caught from the checkpoint.
+func TestCounterCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "counters.json")
+	store := &fakeCounterStore{runID: "a", values: map[string]int64{"go_visit_counter": 7}}
+	g := newCounterGuard(store, "restore", file)
+	g.check(ctx)
+	g.writeCheckpoint()
+	if g.checkpointErr != "" || time.Since(g.lastCheckpoint()) > time.Minute {
+		t.Fatalf("checkpoint not written: %s", g.checkpointErr)
+	}
+
+	store.flush("b")
+	cp, err := readCounterCheckpoint(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := newCounterGuard(store, "restore", file)
+	restarted.loadCheckpoint(cp)
+	restarted.check(ctx)
+	if store.values["go_visit_counter"] != 7 {
+		t.Errorf("counter after restart = %d, want 7", store.values["go_visit_counter"])
+	}
+}
+
+// slowCounterStore stalls claimEpoch until released.
+type slowCounterStore struct {
+	*fakeCounterStore
+	entered, release chan struct{}
+}
+
+func (s *slowCounterStore) claimEpoch(ctx context.Context, epoch string) (string, error) {
+	close(s.entered)
+	<-s.release
+	return s.fakeCounterStore.claimEpoch(ctx, epoch)
+}
+
+// A slow Redis holds up the background check, not /counter.
+func TestCounterGuardUnlockedDuringRedisCalls(t *testing.T) {
+	store := &slowCounterStore{
+		fakeCounterStore: &fakeCounterStore{runID: "a", values: map[string]int64{"go_visit_counter": 4}},
+		entered:          make(chan struct{}),
+		release:          make(chan struct{}),
+	}
+	g := newCounterGuard(store, "restore", "")
+	done := make(chan error)
+	go func() { done <- g.check(context.Background()) }()
+	<-store.entered
+
+	served := make(chan struct{})
+	go func() {
+		g.refusing()
+		g.note("go_visit_counter", 5)
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("note and refusing waited for the check's Redis call")
+	}
+	close(store.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if g.epoch == "" || g.high["go_visit_counter"] != 5 {
+		t.Errorf("after check: epoch %q, high %d", g.epoch, g.high["go_visit_counter"])
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// flightrec.go keeps the last few seconds of execution trace in memory so
+// a latency spike can be examined with `go tool trace` after it happened,
+// instead of hoping to catch it with an on-demand profile.
+
+var traceDumps = registry.counter("trace_dumps_total",
+	"Flight recorder snapshots written to disk.", "reason")
+
+type flightRecorder struct {
+	fr          *trace.FlightRecorder
+	dir         string
+	minInterval time.Duration
+	retain      int
+	pending     chan traceSnapshot // to writeSnapshots
+
+	mu       sync.Mutex
+	last     time.Time
+	lastFile string
+}
+
+// traceSnapshot is one snapshot waiting to be written.
+type traceSnapshot struct {
+	path, reason string
+}
+
+func newFlightRecorder(cfg trace.FlightRecorderConfig, dir string, minInterval time.Duration, retain int) *flightRecorder {
+	r := &flightRecorder{
+		fr:          trace.NewFlightRecorder(cfg),
+		dir:         dir,
+		minInterval: minInterval,
+		retain:      retain,
+		pending:     make(chan traceSnapshot, 1),
+	}
+	go r.writeSnapshots()
+	return r
+}
+
+var flightRec *flightRecorder
+
+// startFlightRecorder runs the recorder unless TRACE_FLIGHT_RECORDER=false.
+// TRACE_WINDOW (10s) and TRACE_MAX_BYTES (16MiB) bound the window;
+// snapshots go to TRACE_DIR when a request is slower than
+// SLOWLOG_THRESHOLD (see slowlog.go), a Redis call times out, or
+// POST /debug/trace is hit. At most one snapshot is written per
+// TRACE_MIN_INTERVAL (30s), manual ones included, and TRACE_RETAIN (10)
+// are kept.
+func startFlightRecorder() {
+	if on, err := strconv.ParseBool(envOr("TRACE_FLIGHT_RECORDER", "true")); err == nil && !on {
+		return
+	}
+	maxBytes, err := strconv.ParseUint(envOr("TRACE_MAX_BYTES", strconv.Itoa(16<<20)), 10, 64)
+	if err != nil {
+		maxBytes = 16 << 20
+	}
+	retain, err := strconv.Atoi(envOr("TRACE_RETAIN", "10"))
+	if err != nil || retain <= 0 {
+		retain = 10
+	}
+	r := newFlightRecorder(trace.FlightRecorderConfig{
+		MinAge:   envDuration("TRACE_WINDOW", 10*time.Second),
+		MaxBytes: maxBytes,
+	}, envOr("TRACE_DIR", filepath.Join(os.TempDir(), "traces")),
+		envDuration("TRACE_MIN_INTERVAL", 30*time.Second), retain)
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		log.Printf("Flight recorder disabled: %v", err)
+		return
+	}
+	if err := r.fr.Start(); err != nil {
+		log.Printf("Flight recorder disabled: %v", err)
+		return
+	}
+	flightRec = r
+	log.Printf("Flight recorder running, snapshots to %s for requests over %s", r.dir, slowThreshold)
+}
+
+// dump asks for the current window to be written to a file and returns
+// the path it will have; the file appears once it is complete. Within
+// minInterval of the previous snapshot it returns that file instead: its
+// window already covers the event, and a burst of slow requests would
+// otherwise write a burst of near-identical traces. Nothing is written
+// on the caller's goroutine, so neither a slow request nor a timed-out
+// Redis command waits for the disk.
+func (r *flightRecorder) dump(reason string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if r.lastFile != "" && now.Sub(r.last) < r.minInterval {
+		return r.lastFile, nil
+	}
+	path := filepath.Join(r.dir, fmt.Sprintf("%s-%s.trace", now.UTC().Format("20060102T150405.000Z"), reason))
+	select {
+	case r.pending <- traceSnapshot{path, reason}:
+	default:
+		return "", errors.New("the previous snapshot is still being written")
+	}
+	r.last, r.lastFile = now, path
+	return path, nil
+}
+
+// writeSnapshots writes the snapshots dump asks for, one at a time. The
+// recorder keeps its whole window, so a snapshot written a moment after
+// the event still covers it.
+func (r *flightRecorder) writeSnapshots() {
+	for snap := range r.pending {
+		if err := r.write(snap.path); err != nil {
+			slog.Warn("flight recorder snapshot failed", "reason", snap.reason, "trace", snap.path, "err", err)
+			continue
+		}
+		traceDumps.with(snap.reason).inc()
+		r.prune()
+	}
+}
+
+// write saves the window through a temporary file, so the trace URL never
+// serves half a snapshot.
+func (r *flightRecorder) write(path string) error {
+	f, err := os.CreateTemp(r.dir, ".trace-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = r.fr.WriteTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (r *flightRecorder) prune() {
+	files, _ := filepath.Glob(filepath.Join(r.dir, "*.trace"))
+	sort.Strings(files)
+	for len(files) > r.retain {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+}
+
+// traceURL is where a snapshot can be downloaded from this server.
+func traceURL(path string) string {
+	return "/debug/traces/" + filepath.Base(path)
+}
+
+// statusWriter records the response status for middleware. It forwards
+// Flush so event streams keep working through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// traceRedisTimeouts is a go-redis hook that snapshots the flight
+// recorder when a command or pipeline times out.
+type traceRedisTimeouts struct{}
+
+func (traceRedisTimeouts) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if isTimeout(err) {
+			dumpForRedis("dial "+addr, err)
+		}
+		return conn, err
+	}
+}
+
+func (traceRedisTimeouts) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if isTimeout(err) {
+			dumpForRedis(cmd.Name(), err)
+		}
+		return err
+	}
+}
+
+func (traceRedisTimeouts) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		if isTimeout(err) {
+			dumpForRedis(fmt.Sprintf("pipeline (%d commands)", len(cmds)), err)
+		}
+		return err
+	}
+}
+
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+func dumpForRedis(op string, err error) {
+	if flightRec == nil {
+		return
+	}
+	attrs := []any{"op", op, "err", err}
+	if path, derr := flightRec.dump("redis_timeout"); derr != nil {
+		attrs = append(attrs, "trace_err", derr)
+	} else {
+		attrs = append(attrs, "trace", path, "trace_url", traceURL(path))
+	}
+	slog.Warn("redis timeout", attrs...)
+}
+
+// traceDumpHandler snapshots the recorder on POST and returns where the
+// trace will be, which is the previous snapshot within
+// TRACE_MIN_INTERVAL of it.
+func traceDumpHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST to take a snapshot", http.StatusMethodNotAllowed)
+		return
+	}
+	if flightRec == nil {
+		http.Error(w, "flight recorder is disabled", http.StatusNotFound)
+		return
+	}
+	path, err := flightRec.dump("manual")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"file": path, "url": traceURL(path)})
+}
+
+// tracesHandler serves snapshots from TRACE_DIR for `go tool trace`.
+func tracesHandler(w http.ResponseWriter, r *http.Request) {
+	if flightRec == nil {
+		http.Error(w, "flight recorder is disabled", http.StatusNotFound)
+		return
+	}
+	http.StripPrefix("/debug/traces/", http.FileServer(http.Dir(flightRec.dir))).ServeHTTP(w, r)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime/trace"
+	"testing"
+	"time"
+)
+
+func TestTraceSlowRequests(t *testing.T) {
+	r := newFlightRecorder(trace.FlightRecorderConfig{MinAge: time.Second}, t.TempDir(), time.Minute, 2)
+	if err := r.fr.Start(); err != nil {
+		t.Skip(err)
+	}
+	defer r.fr.Stop()
+	flightRec = r
+	slowlog = &slowLog{entries: newBroadcastRing[slowRequest](4)}
+	defer func(d time.Duration) { flightRec, slowlog, slowThreshold = nil, nil, d }(slowThreshold)
+	slowThreshold = 20 * time.Millisecond
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(30 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusTeapot)
+	})
+	h := recordSlowRequests(mux, mux)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+	if r.lastFile != "" {
+		t.Fatalf("fast request wrote %s", r.lastFile)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	// The snapshot is written after the response.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fi, err := os.Stat(r.lastFile)
+		if err == nil && fi.Size() > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slow request snapshot %q: %v", r.lastFile, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The slow log entry links the snapshot.
+	if e := slowlog.entries.recent(); len(e) != 1 || e[0].TraceURL != traceURL(r.lastFile) {
+		t.Errorf("slow log = %+v; want one entry linking %s", e, traceURL(r.lastFile))
+	}
+
+	// Later dumps inside the interval reuse the snapshot, manual ones
+	// included.
+	first := r.lastFile
+	for _, reason := range []string{"slow_request", "manual"} {
+		if path, _ := r.dump(reason); path != first {
+			t.Errorf("rate-limited %s dump = %s; want %s", reason, path, first)
+		}
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	if !isTimeout(context.DeadlineExceeded) || !isTimeout(os.ErrDeadlineExceeded) {
+		t.Error("deadline errors not treated as timeouts")
+	}
+	if isTimeout(nil) || isTimeout(errors.New("connection refused")) {
+		t.Error("non-timeout error treated as a timeout")
+	}
+}
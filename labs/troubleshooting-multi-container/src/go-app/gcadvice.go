@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// gcadvice.go watches how the garbage collector behaves under the
+// container's limits and suggests GOGC and GOMEMLIMIT values, served at
+// /debug/gc-advice.
+
+// gcSnapshot is one reading of the runtime counters the advisor works
+// from. Cumulative values are differenced across the window.
+type gcSnapshot struct {
+	Time        time.Time
+	Cycles      float64
+	GCCPU       float64 // cpu-seconds
+	TotalCPU    float64 // available cpu-seconds, GOMAXPROCS x wall time
+	IdleCPU     float64
+	LiveHeap    float64
+	HeapGoal    float64
+	GoMemory    float64 // all memory the runtime has mapped, less released heap
+	NonHeap     float64 // stacks, runtime metadata and other non-heap memory
+	GOGC        float64
+	MemoryLimit float64
+	Pauses      []uint64 // cumulative GC pause histogram counts
+}
+
+// The first of gcPauseMetrics is preferred; /gc/pauses:seconds is its
+// deprecated predecessor, for older toolchains.
+var gcPauseMetrics = []string{"/sched/pauses/total/gc:seconds", "/gc/pauses:seconds"}
+
+func readGCSnapshot(now time.Time) (gcSnapshot, []float64) {
+	v := runtimeStats.value
+	s := gcSnapshot{
+		Time:        now,
+		Cycles:      v("/gc/cycles/total:gc-cycles"),
+		GCCPU:       v("/cpu/classes/gc/total:cpu-seconds"),
+		TotalCPU:    v("/cpu/classes/total:cpu-seconds"),
+		IdleCPU:     v("/cpu/classes/idle:cpu-seconds"),
+		LiveHeap:    v("/gc/heap/live:bytes"),
+		HeapGoal:    v("/gc/heap/goal:bytes"),
+		GOGC:        v("/gc/gogc:percent"),
+		MemoryLimit: v("/gc/gomemlimit:bytes"),
+	}
+	heap := v("/memory/classes/heap/objects:bytes") + v("/memory/classes/heap/unused:bytes") +
+		v("/memory/classes/heap/free:bytes")
+	released := v("/memory/classes/heap/released:bytes")
+	s.GoMemory = v("/memory/classes/total:bytes") - released
+	s.NonHeap = max(s.GoMemory-heap, 0)
+	for _, name := range gcPauseMetrics {
+		if h := runtimeStats.histogram(name); h != nil {
+			s.Pauses = h.Counts
+			return s, h.Buckets
+		}
+	}
+	return s, nil
+}
+
+type gcAdvisor struct {
+	cg       cgroupInfo
+	window   time.Duration
+	interval time.Duration
+
+	mu           sync.Mutex
+	snapshots    []gcSnapshot
+	pauseBuckets []float64
+}
+
+var gcAdvice *gcAdvisor
+
+// startGCAdvisor samples the runtime every GC_ADVICE_INTERVAL (10s) and
+// bases its advice on the last GC_ADVICE_WINDOW (5m). GC_ADVICE=false
+// turns it off.
+func startGCAdvisor(ctx context.Context) {
+	if on, err := strconv.ParseBool(envOr("GC_ADVICE", "true")); err == nil && !on {
+		return
+	}
+	a := &gcAdvisor{
+		cg:       detectCgroup(),
+		window:   envDuration("GC_ADVICE_WINDOW", 5*time.Minute),
+		interval: envDuration("GC_ADVICE_INTERVAL", 10*time.Second),
+	}
+	a.record(time.Now())
+	gcAdvice = a
+	log.Printf("GC advisor sampling every %s over a %s window", a.interval, a.window)
+
+	go func() {
+		t := time.NewTicker(a.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				a.record(now)
+			}
+		}
+	}()
+}
+
+func (a *gcAdvisor) record(now time.Time) {
+	s, buckets := readGCSnapshot(now)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pauseBuckets = buckets
+	a.snapshots = append(a.snapshots, s)
+	// Keep one snapshot older than the window as its baseline.
+	for len(a.snapshots) > 2 && now.Sub(a.snapshots[1].Time) >= a.window {
+		a.snapshots = a.snapshots[1:]
+	}
+}
+
+type gcObservation struct {
+	Window           string  `json:"window"`
+	Cycles           float64 `json:"gc_cycles"`
+	GCPerSecond      float64 `json:"gc_per_second"`
+	GCCPUFraction    float64 `json:"gc_cpu_fraction"` // of the CPU the process used
+	GCCPUOfAvailable float64 `json:"gc_cpu_fraction_of_available"`
+	PauseP99Seconds  float64 `json:"gc_pause_p99_seconds"`
+	PeakLiveHeap     uint64  `json:"peak_live_heap_bytes"`
+	PeakGoMemory     uint64  `json:"peak_go_memory_bytes"`
+	NonHeapBytes     uint64  `json:"non_heap_bytes"`
+	HeapGoal         uint64  `json:"heap_goal_bytes"`
+	GOMAXPROCS       int     `json:"gomaxprocs"`
+}
+
+type gcSettings struct {
+	GOGC       string `json:"GOGC"`
+	GOMEMLIMIT string `json:"GOMEMLIMIT"`
+}
+
+type gcAdviceReport struct {
+	Observed  gcObservation           `json:"observed"`
+	Container cgroupLimits            `json:"container_limits"`
+	Current   gcSettings              `json:"current"`
+	Suggested gcSettings              `json:"suggested"`
+	Findings  []recommendationFinding `json:"findings"`
+}
+
+// observe reduces the window to rates and peaks.
+func (a *gcAdvisor) observe() (gcObservation, gcSnapshot) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	first, last := a.snapshots[0], a.snapshots[len(a.snapshots)-1]
+	obs := gcObservation{
+		Window:     last.Time.Sub(first.Time).Round(time.Second).String(),
+		Cycles:     last.Cycles - first.Cycles,
+		HeapGoal:   uint64(last.HeapGoal),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+	}
+	if secs := last.Time.Sub(first.Time).Seconds(); secs > 0 {
+		obs.GCPerSecond = obs.Cycles / secs
+	}
+	gc := last.GCCPU - first.GCCPU
+	if avail := last.TotalCPU - first.TotalCPU; avail > 0 {
+		obs.GCCPUOfAvailable = gc / avail
+		if used := avail - (last.IdleCPU - first.IdleCPU); used > 0 {
+			obs.GCCPUFraction = gc / used
+		}
+	}
+	for _, s := range a.snapshots {
+		obs.PeakLiveHeap = max(obs.PeakLiveHeap, uint64(s.LiveHeap))
+		obs.PeakGoMemory = max(obs.PeakGoMemory, uint64(s.GoMemory))
+		obs.NonHeapBytes = max(obs.NonHeapBytes, uint64(s.NonHeap))
+	}
+	if len(first.Pauses) == len(last.Pauses) && len(a.pauseBuckets) == len(last.Pauses)+1 {
+		obs.PauseP99Seconds = histogramQuantile(a.pauseBuckets, first.Pauses, last.Pauses, 0.99)
+	}
+	return obs, last
+}
+
+// histogramQuantile returns the upper edge of the bucket holding the q-th
+// value counted between two readings of a cumulative runtime histogram.
+func histogramQuantile(buckets []float64, before, after []uint64, q float64) float64 {
+	var total uint64
+	for i := range after {
+		total += after[i] - before[i]
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i := range after {
+		seen += after[i] - before[i]
+		if seen >= rank {
+			if math.IsInf(buckets[i+1], 1) {
+				return buckets[i]
+			}
+			return buckets[i+1]
+		}
+	}
+	return 0
+}
+
+// Advice thresholds. The GC normally costs a few percent of a service's
+// CPU; beyond gcCPUHigh it is worth trading memory for fewer cycles.
+const (
+	gcCPUHigh        = 0.10
+	gcCPUTarget      = 0.05
+	gcPauseLong      = 0.010
+	maxSuggestedGOGC = 800
+)
+
+func (a *gcAdvisor) advise() gcAdviceReport {
+	obs, last := a.observe()
+	return adviseGC(obs, last, a.cg.readLimits(), envFloat("GC_ADVICE_MEMLIMIT_RATIO", 0.9))
+}
+
+// adviseGC suggests settings from an observation. GOMEMLIMIT is sized to
+// ratio of the container's memory limit, leaving the rest for memory the
+// Go runtime does not manage. GOGC is scaled by how far the GC's share of
+// CPU is above gcCPUTarget, as GC work is roughly inversely proportional
+// to GOGC, but only as far as the projected heap fits in memory.
+func adviseGC(obs gcObservation, last gcSnapshot, limits cgroupLimits, ratio float64) gcAdviceReport {
+	rep := gcAdviceReport{Observed: obs, Container: limits}
+	gogc := int(last.GOGC)
+	limitSet := last.MemoryLimit > 0 && last.MemoryLimit < math.MaxInt64
+	rep.Current.GOGC = strconv.Itoa(gogc)
+	if gogc < 0 {
+		rep.Current.GOGC = "off"
+	}
+	rep.Current.GOMEMLIMIT = "off"
+	if limitSet {
+		rep.Current.GOMEMLIMIT = goMemLimit(uint64(last.MemoryLimit))
+	}
+	rep.Suggested = rep.Current
+	finding := func(kind, severity, format string, args ...any) {
+		rep.Findings = append(rep.Findings, recommendationFinding{kind, severity, fmt.Sprintf(format, args...)})
+	}
+
+	if obs.Cycles < 3 {
+		finding("low_confidence", "info",
+			"only %.0f GC cycles in the last %s; run representative load before acting on this advice", obs.Cycles, obs.Window)
+	}
+
+	// GOMEMLIMIT from the container limit.
+	memLimit := uint64(last.MemoryLimit)
+	container := limits.MemoryBytes
+	switch {
+	case container == 0 && !limitSet:
+		finding("no_memory_limit", "info", "no container memory limit or GOMEMLIMIT; the heap may grow to %dx the live heap", 1+max(gogc, 0)/100)
+	case container == 0:
+	case !limitSet:
+		memLimit = uint64(float64(container) * ratio)
+		rep.Suggested.GOMEMLIMIT = goMemLimit(memLimit)
+		finding("no_gomemlimit", "warning",
+			"container memory limit is %s but GOMEMLIMIT is unset, so the GC will not react before the OOM killer does; set GOMEMLIMIT=%s",
+			kubeMemory(container), rep.Suggested.GOMEMLIMIT)
+	case memLimit > container:
+		memLimit = uint64(float64(container) * ratio)
+		rep.Suggested.GOMEMLIMIT = goMemLimit(memLimit)
+		finding("gomemlimit_above_container", "critical",
+			"GOMEMLIMIT %s is above the container limit %s; set GOMEMLIMIT=%s",
+			rep.Current.GOMEMLIMIT, kubeMemory(container), rep.Suggested.GOMEMLIMIT)
+	case float64(memLimit) < float64(container)*ratio/2:
+		memLimit = uint64(float64(container) * ratio)
+		rep.Suggested.GOMEMLIMIT = goMemLimit(memLimit)
+		finding("gomemlimit_low", "info",
+			"GOMEMLIMIT %s uses under half of the container limit %s; set GOMEMLIMIT=%s to collect less often",
+			rep.Current.GOMEMLIMIT, kubeMemory(container), rep.Suggested.GOMEMLIMIT)
+	}
+	if !limitSet && container == 0 {
+		memLimit = 0
+	}
+
+	// A heap goal below what GOGC alone would give means the memory limit
+	// is driving collection.
+	live := float64(obs.PeakLiveHeap)
+	limitBound := limitSet && gogc > 0 && last.HeapGoal < 0.95*last.LiveHeap*(1+float64(gogc)/100)
+	if limitBound && obs.GCCPUFraction > gcCPUHigh {
+		finding("gc_thrashing", "critical",
+			"the GC is running to stay under GOMEMLIMIT %s and used %.0f%% of CPU; the live heap (%s) needs more memory, or less of it",
+			rep.Current.GOMEMLIMIT, obs.GCCPUFraction*100, kubeMemory(obs.PeakLiveHeap))
+	}
+
+	switch {
+	case gogc <= 0 || limitBound:
+	case obs.Cycles >= 3 && obs.GCCPUFraction > gcCPUHigh:
+		suggested := roundGOGC(float64(gogc) * obs.GCCPUFraction / gcCPUTarget)
+		if memLimit > 0 && live > 0 {
+			// Largest GOGC whose heap goal still fits beside non-heap memory.
+			fits := (float64(memLimit)-float64(obs.NonHeapBytes))/live - 1
+			suggested = min(suggested, int(fits*100)/25*25)
+		}
+		if suggested <= gogc {
+			finding("gc_cpu_high", "warning",
+				"GC used %.0f%% of CPU (%.1f cycles/s) but the heap has no room to grow under %s; raise the memory limit or reduce the live heap",
+				obs.GCCPUFraction*100, obs.GCPerSecond, goMemLimit(memLimit))
+			break
+		}
+		rep.Suggested.GOGC = strconv.Itoa(suggested)
+		finding("gc_cpu_high", "warning",
+			"GC used %.0f%% of CPU (%.1f cycles/s); GOGC=%d should cut GC work about %.1fx, with the heap growing to about %s",
+			obs.GCCPUFraction*100, obs.GCPerSecond, suggested, float64(suggested)/float64(gogc),
+			kubeMemory(uint64(live*(1+float64(suggested)/100))))
+	case obs.Cycles >= 3 && obs.GCCPUFraction < gcCPUTarget/4 && gogc > 100 && memLimit == 0:
+		rep.Suggested.GOGC = "100"
+		finding("gc_heap_oversized", "info",
+			"GC used only %.1f%% of CPU at GOGC=%d; GOGC=100 would roughly halve the heap above the live %s",
+			obs.GCCPUFraction*100, gogc, kubeMemory(obs.PeakLiveHeap))
+	}
+
+	if obs.PauseP99Seconds > gcPauseLong {
+		finding("gc_pause_long", "info", "p99 GC pause is %s",
+			time.Duration(obs.PauseP99Seconds*float64(time.Second)).Round(time.Microsecond))
+	}
+	if limits.CPUCores > 0 && float64(obs.GOMAXPROCS) > math.Ceil(limits.CPUCores) {
+		finding("gomaxprocs_above_cpu_limit", "warning",
+			"GOMAXPROCS=%d exceeds the CPU limit of %s cores, so GC workers get throttled; set GOMAXPROCS=%.0f",
+			obs.GOMAXPROCS, composeCPU(limits.CPUCores), math.Ceil(limits.CPUCores))
+	}
+	if rep.Findings == nil {
+		rep.Findings = []recommendationFinding{}
+	}
+	return rep
+}
+
+// roundGOGC rounds up to a multiple of 25 below 200 and of 50 above, and
+// caps the result, as past a few hundred the heap grows faster than GC
+// work shrinks.
+func roundGOGC(v float64) int {
+	step := 25.0
+	if v > 200 {
+		step = 50
+	}
+	return int(min(math.Ceil(v/step)*step, maxSuggestedGOGC))
+}
+
+// goMemLimit formats bytes in the GOMEMLIMIT syntax, rounded down to MiB.
+func goMemLimit(b uint64) string { return fmt.Sprintf("%dMiB", b>>20) }
+
+func gcAdviceHandler(w http.ResponseWriter, r *http.Request) {
+	if gcAdvice == nil {
+		http.Error(w, "GC advisor is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gcAdvice.advise())
+}
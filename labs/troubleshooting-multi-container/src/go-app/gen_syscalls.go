@@ -0,0 +1,96 @@
+//go:build ignore
+
+// gen_syscalls writes the syscall name tables used by seccomp-profile. It
+// reads the SYS_* constants that golang.org/x/sys vendors into the Go
+// toolchain, so the tables track whatever Go release runs it:
+//
+//	go run gen_syscalls.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var arches = []struct {
+	goarch  string
+	seccomp string
+	reg     string
+}{
+	{"amd64", "SCMP_ARCH_X86_64", "regs.Orig_rax"},
+	{"arm64", "SCMP_ARCH_AARCH64", "regs.Regs[8]"},
+}
+
+var sysRE = regexp.MustCompile(`^\s*SYS_(\w+)\s*=\s*(\d+)`)
+
+func main() {
+	out, err := exec.Command("go", "env", "GOROOT").Output()
+	if err != nil {
+		log.Fatal(err)
+	}
+	goroot := strings.TrimSpace(string(out))
+
+	for _, a := range arches {
+		src := filepath.Join(goroot, "src/cmd/vendor/golang.org/x/sys/unix", "zsysnum_linux_"+a.goarch+".go")
+		names, err := readSysnum(src)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "// Code generated by gen_syscalls.go from zsysnum_linux_%s.go. DO NOT EDIT.\n\n", a.goarch)
+		fmt.Fprintf(&buf, "package main\n\nimport \"syscall\"\n\n")
+		fmt.Fprintf(&buf, "const seccompArch = %q\n\n", a.seccomp)
+		fmt.Fprintf(&buf, "func syscallNumber(regs *syscall.PtraceRegs) uint64 { return %s }\n\n", a.reg)
+		fmt.Fprintf(&buf, "var syscallNames = map[uint64]string{\n")
+		nums := make([]int, 0, len(names))
+		for n := range names {
+			nums = append(nums, n)
+		}
+		sort.Ints(nums)
+		for _, n := range nums {
+			fmt.Fprintf(&buf, "\t%d: %q,\n", n, names[n])
+		}
+		fmt.Fprintf(&buf, "}\n")
+
+		code, err := format.Source(buf.Bytes())
+		if err != nil {
+			log.Fatal(err)
+		}
+		dst := "syscalls_linux_" + a.goarch + ".go"
+		if err := os.WriteFile(dst, code, 0o644); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("wrote %s (%d syscalls)", dst, len(names))
+	}
+}
+
+func readSysnum(path string) (map[int]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names := make(map[int]string)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		m := sysRE.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		names[n] = strings.ToLower(m[1])
+	}
+	return names, sc.Err()
+}
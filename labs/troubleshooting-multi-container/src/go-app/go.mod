@@ -1,6 +1,6 @@
 module go-app
 
-go 1.21
+go 1.25
 
 require github.com/redis/go-redis/v9 v9.3.0
 
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestHealthFormats(t *testing.T) {
+	redisClient = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer redisClient.Close()
+
+	// The original shape is kept for clients that do not ask.
+	rec := httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest("GET", "/health", nil))
+	var legacy HealthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &legacy); err != nil || legacy.Status != "unhealthy" {
+		t.Fatalf("legacy /health = %s (%v)", rec.Body, err)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("legacy Content-Type = %q", ct)
+	}
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	req.Header.Set("Accept", "application/health+json")
+	rec = httptest.NewRecorder()
+	healthHandler(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d; want 503", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != healthJSON {
+		t.Errorf("Content-Type = %q; want %q", ct, healthJSON)
+	}
+	var h healthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Status != "fail" || h.Version == "" || h.ReleaseID == "" || h.ServiceID == "" {
+		t.Errorf("report = %+v", h)
+	}
+	c := h.Checks["redis:responseTime"]
+	if len(c) != 1 || c[0].Status != "fail" || c[0].ObservedUnit != "ms" || c[0].Time.IsZero() {
+		t.Errorf("redis:responseTime = %+v", c)
+	}
+	if len(h.Checks["uptime"]) != 1 {
+		t.Errorf("no uptime check in %+v", h.Checks)
+	}
+}
+
+func TestHealthReportStatus(t *testing.T) {
+	h := newHealthReport("test")
+	h.add("a", healthCheck{Status: "warn"})
+	h.add("b", healthCheck{Status: "pass"})
+	if h.Status != "warn" || h.httpStatus() != http.StatusOK {
+		t.Errorf("status = %s/%d; want warn/200", h.Status, h.httpStatus())
+	}
+	h.add("c", healthCheck{Status: "fail"})
+	if h.Status != "fail" || h.httpStatus() != http.StatusServiceUnavailable {
+		t.Errorf("status = %s/%d; want fail/503", h.Status, h.httpStatus())
+	}
+}
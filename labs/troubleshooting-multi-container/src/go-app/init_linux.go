@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// prSetChildSubreaper is PR_SET_CHILD_SUBREAPER from <linux/prctl.h>.
+const prSetChildSubreaper = 36
+
+// child is the runtime state of one supervised program.
+type child struct {
+	prog     *program
+	pid      int
+	started  time.Time
+	restarts int
+	backoff  backoff
+	done     bool
+	exitCode int
+}
+
+// supervisor owns every child process. All state is touched only from the
+// run loop, so starting a process and reaping it can never race.
+type supervisor struct {
+	cfg      *initConfig
+	log      *log.Logger
+	stdout   *lockedWriter
+	stderr   *lockedWriter
+	children []*child
+	byPid    map[int]*child
+	restarts chan *child
+	stopping bool
+	copiers  sync.WaitGroup
+}
+
+func supervise(cfg *initConfig) int {
+	logger := log.New(os.Stderr, "init: ", log.LstdFlags)
+	if os.Getpid() != 1 {
+		// Not PID 1, so orphans would be reparented past us. Ask the
+		// kernel to hand them to us instead so they still get reaped.
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+			logger.Printf("running as pid %d and could not become a subreaper: %v", os.Getpid(), errno)
+		}
+	}
+
+	s := &supervisor{
+		cfg:      cfg,
+		log:      logger,
+		stdout:   &lockedWriter{w: os.Stdout},
+		stderr:   &lockedWriter{w: os.Stderr},
+		byPid:    make(map[int]*child),
+		restarts: make(chan *child, len(cfg.Programs)),
+	}
+	for i := range cfg.Programs {
+		s.children = append(s.children, &child{
+			prog:    &cfg.Programs[i],
+			backoff: backoff{min: cfg.backoffMin, max: cfg.backoffMax},
+		})
+	}
+	return s.run()
+}
+
+func (s *supervisor) run() int {
+	sigs := make(chan os.Signal, 32)
+	signal.Notify(sigs)
+	defer signal.Stop(sigs)
+
+	for _, c := range s.children {
+		if err := s.start(c); err != nil {
+			s.log.Printf("%s: %v", c.prog.Name, err)
+			c.done, c.exitCode = true, 127
+		}
+	}
+
+	var kill <-chan time.Time
+	for !s.finished() {
+		select {
+		case sig := <-sigs:
+			switch sig {
+			case syscall.SIGCHLD:
+				s.reap()
+			case syscall.SIGURG, syscall.SIGPIPE:
+				// SIGURG is the runtime's preemption signal; neither
+				// is meant for the children.
+			case syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT:
+				if !s.stopping {
+					s.log.Printf("received %v, stopping children", sig)
+					s.stopping = true
+					s.cancelRestarts()
+					kill = time.After(s.cfg.stopTimeout)
+				}
+				s.signalAll(sig.(syscall.Signal))
+			default:
+				s.signalAll(sig.(syscall.Signal))
+			}
+		case c := <-s.restarts:
+			if c.done {
+				continue
+			}
+			if err := s.start(c); err != nil {
+				s.log.Printf("%s: restart failed: %v", c.prog.Name, err)
+				s.exited(c, 127)
+			}
+		case <-kill:
+			s.log.Printf("stop timeout of %s elapsed, sending SIGKILL", s.cfg.stopTimeout)
+			s.signalAll(syscall.SIGKILL)
+		}
+	}
+	s.drainOutput(time.Second)
+	return s.exitCode()
+}
+
+// drainOutput gives the log copiers a moment to flush the last lines of
+// exited programs. A grandchild holding a pipe open must not block exit.
+func (s *supervisor) drainOutput(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.copiers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+func (s *supervisor) start(c *child) error {
+	path, err := exec.LookPath(c.prog.Command[0])
+	if err != nil {
+		return err
+	}
+	attr := &os.ProcAttr{
+		Dir: c.prog.Dir,
+		Env: append(os.Environ(), c.prog.Env...),
+		Sys: &syscall.SysProcAttr{},
+	}
+
+	var closeAfterStart []*os.File
+	if s.cfg.passthrough {
+		attr.Files = []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	} else {
+		// Each program gets its own process group so a signal reaches
+		// everything it spawned, and its own pipes so output can be
+		// prefixed with its name.
+		attr.Sys.Setpgid = true
+		devnull, err := os.Open(os.DevNull)
+		if err != nil {
+			return err
+		}
+		outR, outW, err := os.Pipe()
+		if err != nil {
+			devnull.Close()
+			return err
+		}
+		errR, errW, err := os.Pipe()
+		if err != nil {
+			devnull.Close()
+			outR.Close()
+			outW.Close()
+			return err
+		}
+		attr.Files = []*os.File{devnull, outW, errW}
+		closeAfterStart = []*os.File{devnull, outW, errW}
+		s.copiers.Add(2)
+		go func() {
+			defer s.copiers.Done()
+			copyPrefixed(s.stdout, c.prog.Name, outR)
+			outR.Close()
+		}()
+		go func() {
+			defer s.copiers.Done()
+			copyPrefixed(s.stderr, c.prog.Name, errR)
+			errR.Close()
+		}()
+	}
+
+	proc, err := os.StartProcess(path, c.prog.Command, attr)
+	for _, f := range closeAfterStart {
+		f.Close()
+	}
+	if err != nil {
+		return err
+	}
+	// Exit statuses are collected by reap, never through proc.Wait.
+	c.pid = proc.Pid
+	proc.Release()
+	c.started = time.Now()
+	s.byPid[c.pid] = c
+	s.log.Printf("%s: started pid %d", c.prog.Name, c.pid)
+	return nil
+}
+
+// reap collects every exited child, supervised or not. Orphans adopted by
+// PID 1 are reaped here too, which is what keeps zombies from piling up.
+func (s *supervisor) reap() {
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return
+		}
+		c, ok := s.byPid[pid]
+		if !ok {
+			continue
+		}
+		delete(s.byPid, pid)
+		code := ws.ExitStatus()
+		if ws.Signaled() {
+			code = 128 + int(ws.Signal())
+			s.log.Printf("%s: pid %d killed by %v", c.prog.Name, pid, ws.Signal())
+		} else {
+			s.log.Printf("%s: pid %d exited with status %d", c.prog.Name, pid, code)
+		}
+		s.exited(c, code)
+	}
+}
+
+func (s *supervisor) exited(c *child, code int) {
+	c.pid = 0
+	c.exitCode = code
+	if s.stopping || !c.prog.shouldRestart(code, c.restarts) {
+		c.done = true
+		return
+	}
+	if time.Since(c.started) >= s.cfg.stableAfter {
+		c.backoff.reset()
+	}
+	c.restarts++
+	delay := c.backoff.next()
+	s.log.Printf("%s: restarting in %s (restart %d)", c.prog.Name, delay, c.restarts)
+	time.AfterFunc(delay, func() { s.restarts <- c })
+}
+
+// cancelRestarts marks programs waiting out their backoff as finished so
+// a shutdown does not wait for them. Their timers still fire; run ignores
+// them, or has already returned.
+func (s *supervisor) cancelRestarts() {
+	for _, c := range s.children {
+		if c.pid == 0 {
+			c.done = true
+		}
+	}
+}
+
+func (s *supervisor) signalAll(sig syscall.Signal) {
+	for pid := range s.byPid {
+		target := pid
+		if !s.cfg.passthrough {
+			target = -pid
+		}
+		if err := syscall.Kill(target, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+			s.log.Printf("forward %v to pid %d: %v", sig, pid, err)
+		}
+	}
+}
+
+func (s *supervisor) finished() bool {
+	for _, c := range s.children {
+		if !c.done {
+			return false
+		}
+	}
+	return true
+}
+
+// exitCode mirrors the child's status in passthrough mode, like tini. With
+// several programs it reports failure if any of them ended badly on its own.
+func (s *supervisor) exitCode() int {
+	if s.cfg.passthrough {
+		return s.children[0].exitCode
+	}
+	if s.stopping {
+		return 0
+	}
+	for _, c := range s.children {
+		if c.exitCode != 0 {
+			return 1
+		}
+	}
+	return 0
+}
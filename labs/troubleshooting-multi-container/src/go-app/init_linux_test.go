@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// A program that forks and exits leaves its child to init. Both the
+// program and the orphan must be reaped, and the program restarted.
+func TestSuperviseReapsOrphansAndRestarts(t *testing.T) {
+	pids := filepath.Join(t.TempDir(), "pids")
+	cfg := &initConfig{
+		BackoffMin: "10ms",
+		Programs: []program{
+			{Name: "forker", Command: []string{"/bin/sh", "-c", `sleep 0.2 & echo $! >> "$PIDS"`},
+				Env: []string{"PIDS=" + pids}, Restart: restartAlways, MaxRestarts: 2},
+			// Keeps init running until the orphans have exited.
+			{Name: "waiter", Command: []string{"/bin/sh", "-c", "sleep 1"}, Restart: restartNo},
+		},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if code := supervise(cfg); code != 0 {
+		t.Fatalf("supervise = %d; want 0", code)
+	}
+
+	data, err := os.ReadFile(pids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphans := strings.Fields(string(data))
+	if len(orphans) != 3 {
+		t.Fatalf("forker ran %d times; want 3 (2 restarts)", len(orphans))
+	}
+	for _, s := range orphans {
+		pid, err := strconv.Atoi(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ws syscall.WaitStatus
+		if _, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil); !errors.Is(err, syscall.ECHILD) {
+			t.Errorf("orphan %d was not reaped: wait4 = %v", pid, err)
+		}
+	}
+}
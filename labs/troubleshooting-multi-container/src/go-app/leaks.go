@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leaks.go watches for goroutines and heap that only ever grow. Goroutines
+// are counted by the statement that created them, so a leak in the SSE
+// handlers or a background loop shows up as one steadily rising group.
+// Growth is tested with Mann-Kendall, which asks whether the series rises
+// more often than chance allows without assuming any shape.
+
+var leakSuspects = registry.gauge("leak_suspects",
+	"Series the leak detector currently reports as growing, by kind.", "kind")
+
+type leakSample struct {
+	Time       time.Time
+	Goroutines int
+	HeapLive   float64
+	ByCreator  map[string]int
+}
+
+type leakDetector struct {
+	samples       *broadcastRing[leakSample]
+	alpha         float64
+	minSamples    int
+	minGoroutines float64
+	minHeapGrowth float64
+
+	mu       sync.Mutex
+	stacks   map[string]string // example stack per creator
+	report   leakReport
+	reported map[string]bool // suspects logged and still growing
+}
+
+var leaks *leakDetector
+
+// startLeakDetector samples every LEAK_INTERVAL (1m), keeping LEAK_SAMPLES
+// (60). A series is reported once it rises with LEAK_CONFIDENCE (0.99)
+// and has grown by LEAK_MIN_GOROUTINES (10) goroutines or, for the heap,
+// LEAK_MIN_HEAP_GROWTH (0.2) of its starting size. Sampling starts after
+// LEAK_WARMUP (5m) so caches and connection pools filling up at startup
+// are not mistaken for leaks. LEAK_DETECTOR=false turns it off.
+func startLeakDetector(ctx context.Context) {
+	if on, err := strconv.ParseBool(envOr("LEAK_DETECTOR", "true")); err == nil && !on {
+		return
+	}
+	size, err := strconv.Atoi(envOr("LEAK_SAMPLES", "60"))
+	if err != nil || size < 8 {
+		size = 60
+	}
+	d := newLeakDetector(size)
+	d.alpha = 1 - envFloat("LEAK_CONFIDENCE", 0.99)
+	d.minGoroutines = envFloat("LEAK_MIN_GOROUTINES", 10)
+	d.minHeapGrowth = envFloat("LEAK_MIN_HEAP_GROWTH", 0.2)
+	interval := envDuration("LEAK_INTERVAL", time.Minute)
+	warmup := envDuration("LEAK_WARMUP", 5*time.Minute)
+	leaks = d
+	log.Printf("Leak detector sampling every %s over %d samples after %s", interval, size, warmup)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(warmup):
+		}
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			d.sample(time.Now())
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+func newLeakDetector(size int) *leakDetector {
+	return &leakDetector{
+		samples:       newBroadcastRing[leakSample](size),
+		alpha:         0.01,
+		minSamples:    8,
+		minGoroutines: 10,
+		minHeapGrowth: 0.2,
+		stacks:        make(map[string]string),
+		reported:      make(map[string]bool),
+	}
+}
+
+func (d *leakDetector) sample(now time.Time) {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 2); err != nil {
+		slog.Error("leak detector: goroutine dump failed", "err", err)
+		return
+	}
+	groups := parseGoroutineDump(buf.String())
+	s := leakSample{Time: now, HeapLive: runtimeStats.value("/gc/heap/live:bytes"), ByCreator: make(map[string]int)}
+	d.mu.Lock()
+	for key, g := range groups {
+		s.ByCreator[key] = g.count
+		s.Goroutines += g.count
+		d.stacks[key] = g.stack
+	}
+	d.mu.Unlock()
+	d.add(s)
+}
+
+// add records a sample and refreshes the report.
+func (d *leakDetector) add(s leakSample) {
+	d.samples.publish(s)
+	rep := d.analyze(d.samples.recent())
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range rep.Suspects {
+		rep.Suspects[i].Stack = d.stacks[rep.Suspects[i].CreatedBy]
+	}
+	d.report = rep
+	// Forget stacks of creators that have aged out of every sample.
+	for key := range d.stacks {
+		if _, ok := rep.seen[key]; !ok {
+			delete(d.stacks, key)
+		}
+	}
+
+	leakSuspects.with("goroutine").set(float64(len(rep.Suspects)))
+	heap := 0.0
+	if rep.Heap.Growing {
+		heap = 1
+	}
+	leakSuspects.with("heap").set(heap)
+	current := map[string]bool{"(heap)": rep.Heap.Growing}
+	for _, sus := range rep.Suspects {
+		current[sus.CreatedBy] = true
+	}
+	for key := range d.reported {
+		if !current[key] {
+			delete(d.reported, key) // recovered; log again if it recurs
+		}
+	}
+	for _, sus := range rep.Suspects {
+		if !d.reported[sus.CreatedBy] {
+			d.reported[sus.CreatedBy] = true
+			slog.Warn("possible goroutine leak", "created_by", sus.CreatedBy,
+				"count", sus.Trend.Last, "per_hour", sus.Trend.SlopePerHour, "p", sus.Trend.PValue)
+		}
+	}
+	if rep.Heap.Growing && !d.reported["(heap)"] {
+		d.reported["(heap)"] = true
+		slog.Warn("possible heap leak", "live_bytes", rep.Heap.Last, "per_hour", rep.Heap.SlopePerHour, "p", rep.Heap.PValue)
+	}
+}
+
+type leakTrend struct {
+	First        float64 `json:"first"`
+	Last         float64 `json:"last"`
+	SlopePerHour float64 `json:"slope_per_hour"`
+	PValue       float64 `json:"p_value"`
+	Growing      bool    `json:"growing"`
+}
+
+type leakSuspect struct {
+	CreatedBy string    `json:"created_by"`
+	Trend     leakTrend `json:"trend"`
+	Stack     string    `json:"stack"`
+}
+
+type leakReport struct {
+	Samples    int           `json:"samples"`
+	Window     string        `json:"window"`
+	Confidence float64       `json:"confidence"`
+	Goroutines leakTrend     `json:"goroutines"`
+	Heap       leakTrend     `json:"heap_live_bytes"`
+	Suspects   []leakSuspect `json:"suspects"`
+
+	seen map[string]struct{}
+}
+
+// analyze tests the total goroutine count, the live heap and every
+// creator's count for growth.
+func (d *leakDetector) analyze(samples []leakSample) leakReport {
+	rep := leakReport{Samples: len(samples), Confidence: 1 - d.alpha, Suspects: []leakSuspect{}, seen: make(map[string]struct{})}
+	if len(samples) == 0 {
+		return rep
+	}
+	rep.Window = samples[len(samples)-1].Time.Sub(samples[0].Time).Round(time.Second).String()
+	times := make([]time.Time, len(samples))
+	total := make([]float64, len(samples))
+	var heapTimes []time.Time
+	var heap []float64
+	for i, s := range samples {
+		times[i], total[i] = s.Time, float64(s.Goroutines)
+		// The live heap reads zero until the first GC has finished.
+		if s.HeapLive > 0 {
+			heapTimes, heap = append(heapTimes, s.Time), append(heap, s.HeapLive)
+		}
+		for key := range s.ByCreator {
+			rep.seen[key] = struct{}{}
+		}
+	}
+	rep.Goroutines = d.trend(times, total, d.minGoroutines)
+	if len(heap) > 0 {
+		rep.Heap = d.trend(heapTimes, heap, d.minHeapGrowth*heap[0])
+	}
+
+	for key := range rep.seen {
+		counts := make([]float64, len(samples))
+		for i, s := range samples {
+			counts[i] = float64(s.ByCreator[key])
+		}
+		if t := d.trend(times, counts, d.minGoroutines); t.Growing {
+			rep.Suspects = append(rep.Suspects, leakSuspect{CreatedBy: key, Trend: t})
+		}
+	}
+	sort.Slice(rep.Suspects, func(i, j int) bool {
+		return rep.Suspects[i].Trend.SlopePerHour > rep.Suspects[j].Trend.SlopePerHour
+	})
+	return rep
+}
+
+// trend fits a series; it is growing when the rise is significant at
+// alpha and amounts to at least minGrowth.
+func (d *leakDetector) trend(times []time.Time, xs []float64, minGrowth float64) leakTrend {
+	t := leakTrend{First: xs[0], Last: xs[len(xs)-1]}
+	if len(xs) < 2 {
+		t.PValue = 1
+		return t
+	}
+	t.PValue = mannKendall(xs)
+	t.SlopePerHour = theilSen(times, xs)
+	t.Growing = len(xs) >= d.minSamples && t.PValue < d.alpha && t.SlopePerHour > 0 &&
+		t.Last-t.First >= max(minGrowth, 1)
+	return t
+}
+
+// mannKendall returns the one-sided p-value that xs is increasing, using
+// the normal approximation with the correction for tied values.
+func mannKendall(xs []float64) float64 {
+	n := len(xs)
+	var s float64
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			switch {
+			case xs[j] > xs[i]:
+				s++
+			case xs[j] < xs[i]:
+				s--
+			}
+		}
+	}
+	ties := make(map[float64]int)
+	for _, x := range xs {
+		ties[x]++
+	}
+	nf := float64(n)
+	variance := nf * (nf - 1) * (2*nf + 5)
+	for _, t := range ties {
+		tf := float64(t)
+		variance -= tf * (tf - 1) * (2*tf + 5)
+	}
+	variance /= 18
+	if s <= 0 || variance <= 0 {
+		return 1
+	}
+	z := (s - 1) / math.Sqrt(variance)
+	return 0.5 * math.Erfc(z/math.Sqrt2)
+}
+
+// theilSen returns the median of the pairwise slopes, per hour. Unlike a
+// least-squares fit it is not dragged about by a single burst.
+func theilSen(times []time.Time, xs []float64) float64 {
+	var slopes []float64
+	for i := range xs {
+		for j := i + 1; j < len(xs); j++ {
+			if dt := times[j].Sub(times[i]).Hours(); dt > 0 {
+				slopes = append(slopes, (xs[j]-xs[i])/dt)
+			}
+		}
+	}
+	if len(slopes) == 0 {
+		return 0
+	}
+	sort.Float64s(slopes)
+	mid := len(slopes) / 2
+	if len(slopes)%2 == 0 {
+		return (slopes[mid-1] + slopes[mid]) / 2
+	}
+	return slopes[mid]
+}
+
+type goroutineGroup struct {
+	count int
+	stack string
+}
+
+// maxLeakStackFrames bounds the example stack kept for each creator.
+const maxLeakStackFrames = 12
+
+// parseGoroutineDump groups a debug=2 goroutine dump by the "created by"
+// frame, keyed as "function file:line". Goroutines with no creator, such
+// as main, are grouped under their own top frame.
+func parseGoroutineDump(dump string) map[string]goroutineGroup {
+	groups := make(map[string]goroutineGroup)
+	for _, block := range strings.Split(strings.TrimSpace(dump), "\n\n") {
+		lines := strings.Split(block, "\n")
+		if len(lines) < 2 || !strings.HasPrefix(lines[0], "goroutine ") {
+			continue
+		}
+		key := ""
+		for i, line := range lines {
+			if fn, ok := strings.CutPrefix(line, "created by "); ok {
+				if j := strings.Index(fn, " in goroutine "); j >= 0 {
+					fn = fn[:j]
+				}
+				key = fn
+				if i+1 < len(lines) {
+					key += " " + frameLocation(lines[i+1])
+				}
+				break
+			}
+		}
+		if key == "" {
+			key = lines[1] + " " + frameLocation(lines[min(2, len(lines)-1)])
+		}
+		g := groups[key]
+		g.count++
+		if g.stack == "" {
+			frames := lines[1:]
+			if len(frames) > 2*maxLeakStackFrames {
+				frames = append(frames[:2*maxLeakStackFrames:2*maxLeakStackFrames], "...")
+			}
+			g.stack = lines[0] + "\n" + strings.Join(frames, "\n")
+		}
+		groups[key] = g
+	}
+	return groups
+}
+
+// frameLocation turns "\t/src/file.go:12 +0x1d" into "/src/file.go:12".
+func frameLocation(line string) string {
+	line = strings.TrimSpace(line)
+	if i := strings.LastIndex(line, " +0x"); i >= 0 {
+		line = line[:i]
+	}
+	return line
+}
+
+// warnings returns readiness warnings for the current report.
+func (d *leakDetector) warnings() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out []string
+	for _, s := range d.report.Suspects {
+		out = append(out, fmt.Sprintf("goroutines created by %s are growing (%.0f now, %+.0f/h)",
+			s.CreatedBy, s.Trend.Last, s.Trend.SlopePerHour))
+	}
+	if h := d.report.Heap; h.Growing {
+		out = append(out, fmt.Sprintf("live heap is growing (%s now, %+.1fMiB/h)",
+			kubeMemory(uint64(h.Last)), h.SlopePerHour/(1<<20)))
+	}
+	return out
+}
+
+func leaksHandler(w http.ResponseWriter, r *http.Request) {
+	if leaks == nil {
+		http.Error(w, "leak detector is disabled", http.StatusNotFound)
+		return
+	}
+	leaks.mu.Lock()
+	rep := leaks.report
+	leaks.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(rep)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeakDetectorFlagsGrowingCreator(t *testing.T) {
+	d := newLeakDetector(30)
+	start := time.Unix(0, 0)
+	for i := 0; i < 30; i++ {
+		d.add(leakSample{
+			Time:     start.Add(time.Duration(i) * time.Minute),
+			HeapLive: float64(10<<20 + (i%3)<<10), // noise, no trend
+			ByCreator: map[string]int{
+				"main.sseHandler /app/sse.go:40":   5 + 2*i + i%2, // leaking
+				"net/http.(*Server).Serve x.go:10": 3 + i%4,       // busy but steady
+			},
+		})
+	}
+	rep := d.report
+	if len(rep.Suspects) != 1 || rep.Suspects[0].CreatedBy != "main.sseHandler /app/sse.go:40" {
+		t.Fatalf("suspects = %+v; want only the SSE handler", rep.Suspects)
+	}
+	if s := rep.Suspects[0].Trend; s.PValue >= 0.01 || s.SlopePerHour < 100 || s.SlopePerHour > 140 {
+		t.Errorf("SSE trend = %+v; want p < 0.01 and about 120/h", s)
+	}
+	if rep.Heap.Growing {
+		t.Errorf("heap reported growing: %+v", rep.Heap)
+	}
+	if w := d.warnings(); len(w) != 1 || !strings.Contains(w[0], "sseHandler") {
+		t.Errorf("warnings = %q", w)
+	}
+}
+
+func TestLeakDetectorIgnoresSmallGrowth(t *testing.T) {
+	d := newLeakDetector(20)
+	for i := 0; i < 20; i++ {
+		d.add(leakSample{Time: time.Unix(int64(i*60), 0), ByCreator: map[string]int{"f x.go:1": i / 4}})
+	}
+	if len(d.report.Suspects) != 0 {
+		t.Errorf("growth of 4 goroutines reported as a leak: %+v", d.report.Suspects)
+	}
+}
+
+func TestParseGoroutineDumpGroupsByCreator(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	for i := 0; i < 3; i++ {
+		go func() { <-block }()
+	}
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 2); err != nil {
+		t.Fatal(err)
+	}
+	for key, g := range parseGoroutineDump(buf.String()) {
+		if strings.HasPrefix(key, "go-app.TestParseGoroutineDumpGroupsByCreator") {
+			if g.count != 3 || !strings.Contains(key, "leaks_test.go:") || !strings.HasPrefix(g.stack, "goroutine ") {
+				t.Errorf("group %q = %+v; want 3 goroutines with a stack", key, g)
+			}
+			return
+		}
+	}
+	t.Errorf("no group for this test's goroutines in:\n%s", buf.String())
+}
@@ -2,11 +2,12 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -28,12 +29,39 @@ type HealthResponse struct {
 	Redis  string `json:"redis"`
 }
 
+type ReadyResponse struct {
+	Status   string   `json:"status"`
+	Redis    string   `json:"redis"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
 type CounterResponse struct {
 	Counter int64  `json:"counter,omitempty"`
 	Error   string `json:"error,omitempty"`
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "init":
+			os.Exit(runInit(os.Args[2:]))
+		case "seccomp-profile":
+			os.Exit(runSeccompProfile(os.Args[2:]))
+		case "profiles":
+			os.Exit(runProfiles(os.Args[2:]))
+		case "size-report":
+			os.Exit(runSizeReport(os.Args[2:]))
+		case "sbom":
+			os.Exit(runSBOM(os.Args[2:]))
+		case "dashboards":
+			os.Exit(runDashboards(os.Args[2:]))
+		case "rebalance-shards":
+			os.Exit(runRebalanceShards(os.Args[2:]))
+		}
+	}
+
+	checkSecurityPosture()
+
 	redisHost := os.Getenv("REDIS_HOST")
 	if redisHost == "" {
 		redisHost = "redis"
@@ -50,10 +78,47 @@ func main() {
 		Addr:        redisAddr,
 		DialTimeout: 5 * time.Second,
 	})
+	redisClient.AddHook(traceRedisTimeouts{})
+	redisClient.AddHook(timeRedisCommands{})
+	counterRedis = redisClient
+	if ring := startRedisShards(ctx); ring != nil {
+		counterRedis = ring
+	}
 
 	http.HandleFunc("/", homeHandler)
 	http.HandleFunc("/health", healthHandler)
+	http.HandleFunc("/readyz", readyzHandler)
 	http.HandleFunc("/counter", counterHandler)
+	http.HandleFunc("/debug/security", securityHandler)
+	http.HandleFunc("/debug/resources/events", resourceEventsHandler)
+	http.HandleFunc("/debug/resources/history", resourceHistoryHandler)
+	http.HandleFunc("/debug/recommendations", recommendationsHandler)
+	http.HandleFunc("/debug/gc-advice", gcAdviceHandler)
+	http.HandleFunc("/debug/leaks", leaksHandler)
+	http.HandleFunc("/debug/slowlog", slowlogHandler)
+	http.HandleFunc("/debug/redis", redisDebugHandler)
+	http.HandleFunc("/debug/redis/audit", redisAuditHandler)
+	http.HandleFunc("/debug/redis/shards", redisShardsHandler)
+	http.HandleFunc("/debug/counter/durability", counterDurabilityHandler)
+	http.HandleFunc("/slo", sloHandler)
+	http.HandleFunc("/debug/trace", traceDumpHandler)
+	http.HandleFunc("/debug/traces/", tracesHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+
+	startResourceWatcher(ctx)
+	startUsageHistory(ctx)
+	startMemGuard(ctx)
+	startGCAdvisor(ctx)
+	startLeakDetector(ctx)
+	startSlowLog()
+	startFlightRecorder()
+	startSLOs(ctx)
+	startStatsD(ctx, "go-app")
+	startStatsDIngest(ctx, counterRedis)
+	startRedisAudit(ctx, redisClient)
+	startCounterDurability(ctx, redisClient)
+	startRedisExporter(ctx, redisClient)
+	startProfiler(ctx, "go-app")
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -61,52 +126,113 @@ func main() {
 	}
 
 	log.Printf("Starting Go API server on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := http.ListenAndServe(":"+port, serverHandler(http.DefaultServeMux)); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// serverHandler wraps mux in the request middleware, outermost first.
+func serverHandler(mux *http.ServeMux) http.Handler {
+	return timeRequests(countRequests(mux, recordSLOs(mux, recordSlowRequests(mux, addServerTiming(markHandlerStart(labelRoutes(mux)))))))
+}
+
 func homeHandler(w http.ResponseWriter, r *http.Request) {
-	response := Response{
+	writeJSONResponse(w, r, http.StatusOK, Response{
 		Service: "Go API",
 		Status:  "running",
-	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	})
 }
 
+// healthHandler reports whether Redis answers. Clients that accept
+// application/health+json get the draft format, with Redis response time
+// and process checks; see healthcheck.go.
 func healthHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	_, err := redisClient.Ping(ctx).Result()
+	if redisShards != nil {
+		shardHealthHandler(w, r)
+		return
+	}
+	begin := time.Now()
+	_, err := redisClient.Ping(r.Context()).Result()
+	if wantsHealthJSON(r) {
+		now := time.Now()
+		h := newHealthReport("go-app")
+		c := healthCheck{
+			ComponentID:   redisClient.Options().Addr,
+			ComponentType: "datastore",
+			ObservedValue: millis(now.Sub(begin)),
+			ObservedUnit:  "ms",
+			Status:        "pass",
+			Time:          now,
+		}
+		if err != nil {
+			c.Status, c.Output = "fail", err.Error()
+			h.Output = "redis is unreachable"
+		}
+		h.add("redis:responseTime", c)
+		h.addProcessChecks(now)
+		writeHealthReport(w, r, h)
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		json.NewEncoder(w).Encode(HealthResponse{
+		writeJSONResponse(w, r, http.StatusServiceUnavailable, HealthResponse{
 			Status: "unhealthy",
 			Redis:  "disconnected: " + err.Error(),
 		})
 		return
 	}
 
-	json.NewEncoder(w).Encode(HealthResponse{
+	writeJSONResponse(w, r, http.StatusOK, HealthResponse{
 		Status: "healthy",
 		Redis:  "connected",
 	})
 }
 
-func counterHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// readyzHandler reports whether the service can take traffic. With
+// LEAK_READYZ=true, suspected leaks are listed as warnings; they do not
+// make the service unready, as restarting it is a decision for a person.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	resp := ReadyResponse{Status: "ready", Redis: "connected"}
+	status := http.StatusOK
+	if redisShards != nil {
+		_, down, err := redisShards.reachable(r.Context())
+		if err != nil {
+			resp.Status, resp.Redis = "not ready", "disconnected: "+err.Error()
+			status = http.StatusServiceUnavailable
+		} else if len(down) > 0 {
+			resp.Warnings = append(resp.Warnings, "redis shards down: "+strings.Join(down, ", "))
+		}
+	} else if _, err := redisClient.Ping(r.Context()).Result(); err != nil {
+		resp.Status, resp.Redis = "not ready", "disconnected: "+err.Error()
+		status = http.StatusServiceUnavailable
+	}
+	if on, _ := strconv.ParseBool(os.Getenv("LEAK_READYZ")); on && leaks != nil {
+		resp.Warnings = append(resp.Warnings, leaks.warnings()...)
+	}
+	writeJSONResponse(w, r, status, resp)
+}
 
-	count, err := redisClient.Incr(ctx, "go_visit_counter").Result()
+func counterHandler(w http.ResponseWriter, r *http.Request) {
+	if counterGuardian != nil {
+		if loss := counterGuardian.refusing(); loss != nil {
+			counterWritesRefused.with().inc()
+			writeJSONResponse(w, r, http.StatusServiceUnavailable, CounterResponse{
+				Error: "counter data lost (" + loss.Detail + "); writes refused until resolved at /debug/counter/durability",
+			})
+			return
+		}
+	}
+	count, err := counterRedis.Incr(r.Context(), "go_visit_counter").Result()
 	if err != nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		json.NewEncoder(w).Encode(CounterResponse{
+		writeJSONResponse(w, r, http.StatusServiceUnavailable, CounterResponse{
 			Error: err.Error(),
 		})
 		return
 	}
+	if counterGuardian != nil {
+		counterGuardian.note("go_visit_counter", count)
+	}
 
-	json.NewEncoder(w).Encode(CounterResponse{
+	writeJSONResponse(w, r, http.StatusOK, CounterResponse{
 		Counter: count,
 	})
 }
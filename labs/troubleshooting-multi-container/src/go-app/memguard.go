@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// memguard.go captures evidence while the process is still alive: when
+// memory use crosses a fraction of the limit it writes a heap profile, a
+// goroutine dump and a runtime/metrics snapshot to MEMGUARD_DIR, which is
+// expected to be a volume that survives the OOM kill.
+
+var memguardCaptures = registry.counter("memguard_captures_total",
+	"Diagnostic captures written by the memory guard.", "threshold")
+
+type memGuard struct {
+	cg          cgroupInfo
+	dir         string
+	thresholds  []float64 // ascending fractions of the limit
+	minInterval time.Duration
+	retain      int
+
+	armed       []bool
+	lastCapture time.Time
+	deferred    float64 // threshold waiting out the rate limit, already logged
+}
+
+// startMemGuard is enabled by MEMGUARD_DIR. MEMGUARD_THRESHOLDS (0.8,0.9,0.95)
+// are fractions of the limit, each firing once per crossing;
+// MEMGUARD_MIN_INTERVAL (5m) rate-limits captures and MEMGUARD_RETAIN (10)
+// bounds how many are kept.
+func startMemGuard(ctx context.Context) {
+	dir := os.Getenv("MEMGUARD_DIR")
+	if dir == "" {
+		return
+	}
+	thresholds, err := parseThresholds(envOr("MEMGUARD_THRESHOLDS", "0.8,0.9,0.95"))
+	if err != nil {
+		log.Printf("Memory guard disabled: MEMGUARD_THRESHOLDS: %v", err)
+		return
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Printf("Memory guard disabled: %v", err)
+		return
+	}
+	retain, err := strconv.Atoi(envOr("MEMGUARD_RETAIN", "10"))
+	if err != nil || retain <= 0 {
+		retain = 10
+	}
+	g := &memGuard{
+		cg:          detectCgroup(),
+		dir:         dir,
+		thresholds:  thresholds,
+		minInterval: envDuration("MEMGUARD_MIN_INTERVAL", 5*time.Minute),
+		retain:      retain,
+		armed:       make([]bool, len(thresholds)),
+	}
+	for i := range g.armed {
+		g.armed[i] = true
+	}
+	if _, limit := g.usage(); limit == 0 {
+		log.Printf("Memory guard disabled: no cgroup memory.max or GOMEMLIMIT to measure against")
+		return
+	}
+	log.Printf("Memory guard writing captures to %s at %v of the memory limit", dir, thresholds)
+
+	interval := envDuration("MEMGUARD_INTERVAL", time.Second)
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				g.check(now)
+			}
+		}
+	}()
+}
+
+func parseThresholds(s string) ([]float64, error) {
+	var out []float64
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil || v <= 0 || v >= 1 {
+			return nil, fmt.Errorf("%q is not a fraction between 0 and 1", f)
+		}
+		out = append(out, v)
+	}
+	sort.Float64s(out)
+	return out, nil
+}
+
+// usage returns memory in use and the limit it is measured against: the
+// cgroup's memory.current against memory.max, or the Go heap against
+// GOMEMLIMIT when the container has no limit.
+func (g *memGuard) usage() (used, limit uint64) {
+	if l := g.cg.readLimits(); l.MemoryBytes > 0 {
+		if cur, err := g.cg.readMemoryCurrent(); err == nil {
+			return cur, l.MemoryBytes
+		}
+	}
+	if gl := debug.SetMemoryLimit(-1); gl != math.MaxInt64 {
+		s := []metrics.Sample{{Name: "/memory/classes/total:bytes"}}
+		metrics.Read(s)
+		return s[0].Value.Uint64(), uint64(gl)
+	}
+	return 0, 0
+}
+
+// check captures once when usage rises through a threshold. A threshold
+// re-arms after usage falls 5 points below it, so a process hovering at
+// the line does not capture on every tick. A crossing inside the rate
+// limit stays armed and is captured once the limit allows, so a fast
+// climb still gets the capture nearest the OOM.
+func (g *memGuard) check(now time.Time) {
+	used, limit := g.usage()
+	if limit == 0 {
+		return
+	}
+	ratio := float64(used) / float64(limit)
+	crossed := -1
+	for i, th := range g.thresholds {
+		switch {
+		case ratio >= th && g.armed[i]:
+			crossed = i
+		case ratio < th-0.05:
+			g.armed[i] = true
+		}
+	}
+	if crossed < 0 {
+		return
+	}
+	if !g.lastCapture.IsZero() && now.Sub(g.lastCapture) < g.minInterval {
+		if g.deferred != g.thresholds[crossed] {
+			g.deferred = g.thresholds[crossed]
+			slog.Warn("memory guard threshold crossed, capture deferred by the rate limit",
+				"threshold", g.thresholds[crossed], "ratio", ratio)
+		}
+		return
+	}
+	for i, th := range g.thresholds {
+		if ratio >= th {
+			g.armed[i] = false
+		}
+	}
+	g.deferred = 0
+	g.lastCapture = now
+	path, err := g.capture(now, g.thresholds[crossed], used, limit)
+	if err != nil {
+		slog.Error("memory guard capture failed", "err", err)
+		return
+	}
+	memguardCaptures.with(formatFloat(g.thresholds[crossed])).inc()
+	msg := fmt.Sprintf("memory at %.0f%% of limit, diagnostics written to %s", ratio*100, path)
+	slog.Warn(msg, "used_bytes", used, "limit_bytes", limit)
+	resourceEvents.publish(ResourceEvent{
+		Time:     now,
+		Kind:     "memory_capture",
+		Severity: "warning",
+		Message:  msg,
+		Values:   map[string]float64{"ratio": ratio, "threshold": g.thresholds[crossed]},
+	})
+	pruneCaptures(g.dir, g.retain)
+}
+
+func (g *memGuard) capture(now time.Time, threshold float64, used, limit uint64) (string, error) {
+	name := fmt.Sprintf("%s-%02.0fpct", now.UTC().Format("20060102T150405Z"), threshold*100)
+	return writeCaptureDir(g.dir, name, []captureFile{
+		{"heap.pprof", func(w io.Writer) error { return pprof.Lookup("heap").WriteTo(w, 0) }},
+		{"goroutines.txt", func(w io.Writer) error { return pprof.Lookup("goroutine").WriteTo(w, 2) }},
+		{"metrics.json", writeRuntimeMetrics},
+		{"capture.json", func(w io.Writer) error {
+			return writeJSON(w, map[string]any{
+				"time":        now,
+				"threshold":   threshold,
+				"used_bytes":  used,
+				"limit_bytes": limit,
+				"cgroup":      g.cg,
+			})
+		}},
+	})
+}
+
+// writeRuntimeMetrics dumps every supported runtime/metrics value.
+func writeRuntimeMetrics(w io.Writer) error {
+	descs := metrics.All()
+	samples := make([]metrics.Sample, len(descs))
+	for i, d := range descs {
+		samples[i].Name = d.Name
+	}
+	metrics.Read(samples)
+	out := make(map[string]any, len(samples))
+	for _, s := range samples {
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			out[s.Name] = s.Value.Uint64()
+		case metrics.KindFloat64:
+			out[s.Name] = s.Value.Float64()
+		case metrics.KindFloat64Histogram:
+			h := s.Value.Float64Histogram()
+			out[s.Name] = map[string]any{"counts": h.Counts, "buckets": finiteBuckets(h.Buckets)}
+		}
+	}
+	return writeJSON(w, out)
+}
+
+// finiteBuckets replaces the ±Inf bucket edges JSON cannot represent.
+func finiteBuckets(b []float64) []any {
+	out := make([]any, len(b))
+	for i, v := range b {
+		if math.IsInf(v, 0) {
+			out[i] = formatFloat(v)
+		} else {
+			out[i] = v
+		}
+	}
+	return out
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemGuardCapturesOncePerCrossing(t *testing.T) {
+	cgDir, outDir := t.TempDir(), t.TempDir()
+	g := &memGuard{
+		cg:          cgroupInfo{Version: 2, CPUDir: cgDir, MemDir: cgDir},
+		dir:         outDir,
+		thresholds:  []float64{0.8, 0.9},
+		minInterval: time.Minute,
+		retain:      1,
+		armed:       []bool{true, true},
+	}
+	setUsage := func(cur string) {
+		writeCgroupFiles(t, cgDir, map[string]string{"memory.max": "1000\n", "memory.current": cur + "\n"})
+	}
+	captures := func() []string {
+		entries, _ := os.ReadDir(outDir)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	setUsage("850")
+	g.check(now)
+	got := captures()
+	if len(got) != 1 {
+		t.Fatalf("captures = %v; want one after crossing 80%%", got)
+	}
+	for _, f := range []string{"heap.pprof", "goroutines.txt", "metrics.json", "capture.json"} {
+		if _, err := os.Stat(filepath.Join(outDir, got[0], f)); err != nil {
+			t.Errorf("capture is missing %s: %v", f, err)
+		}
+	}
+
+	// Still above 80%: no new capture. Crossing 90% inside the rate
+	// limit is deferred, not dropped.
+	g.check(now.Add(time.Second))
+	setUsage("950")
+	g.check(now.Add(2 * time.Second))
+	if n := len(captures()); n != 1 {
+		t.Fatalf("%d captures; want the rate limit to hold at 1", n)
+	}
+	g.check(now.Add(time.Minute + time.Second))
+	got90 := captures()
+	if len(got90) != 1 || !strings.HasSuffix(got90[0], "-90pct") {
+		t.Fatalf("captures = %v; want the deferred 90%% capture once the rate limit passed", got90)
+	}
+	g.check(now.Add(3 * time.Minute))
+	if got := captures(); got[0] != got90[0] {
+		t.Errorf("captures = %v; want no repeat while above 90%%", got)
+	}
+
+	// Drop well below, rise again after the rate limit: a fresh capture
+	// replaces the old one under retain=1.
+	setUsage("500")
+	g.check(now.Add(4 * time.Minute))
+	setUsage("850")
+	g.check(now.Add(5 * time.Minute))
+	if got2 := captures(); len(got2) != 1 || got2[0] == got90[0] || !strings.HasSuffix(got2[0], "-80pct") {
+		t.Errorf("captures = %v; want a single newer 80%% capture than %s", got2, got90[0])
+	}
+}
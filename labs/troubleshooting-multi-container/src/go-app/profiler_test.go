@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProfileLabelsAndStacks(t *testing.T) {
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		t.Skip(err)
+	}
+	pprof.Do(context.Background(), pprof.Labels("route", "/counter"), func(context.Context) {
+		spin(300 * time.Millisecond)
+	})
+	pprof.StopCPUProfile()
+
+	p, err := parseProfile(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := p.sampleIndex("")
+	if err != nil || p.SampleTypes[idx].Unit != "nanoseconds" {
+		t.Fatalf("default sample type = %v (%v); want cpu nanoseconds", p.SampleTypes, err)
+	}
+	byRoute, total := aggregateProfile(p, idx, "route", false)
+	if total == 0 || byRoute["/counter"] == 0 {
+		t.Fatalf("route totals = %v of %d; want samples labelled /counter", byRoute, total)
+	}
+	cum, _ := aggregateProfile(p, idx, "", true)
+	if !hasKeyContaining(cum, "spin") {
+		t.Errorf("cumulative functions do not include spin: %v", cum)
+	}
+}
+
+func TestCompareCaptureDirs(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"old", "new"} {
+		dir := filepath.Join(root, name)
+		os.Mkdir(dir, 0o755)
+		f, err := os.Create(filepath.Join(dir, "heap.pprof"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pprof.Lookup("heap").WriteTo(f, 0)
+		f.Close()
+	}
+	pairs, err := profilePairs(filepath.Join(root, "old"), filepath.Join(root, "new"), "")
+	if err != nil || len(pairs) != 1 {
+		t.Fatalf("pairs = %v, %v; want the heap profiles paired", pairs, err)
+	}
+	var out bytes.Buffer
+	if err := compareProfiles(&out, pairs[0][0], pairs[0][1], "", "", false, 5); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "inuse_space/bytes") {
+		t.Errorf("output does not name the heap default sample type:\n%s", out.String())
+	}
+}
+
+func spin(d time.Duration) int {
+	n := 0
+	for end := time.Now().Add(d); time.Now().Before(end); {
+		n++
+	}
+	return n
+}
+
+func hasKeyContaining(m map[string]int64, s string) bool {
+	for k := range m {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
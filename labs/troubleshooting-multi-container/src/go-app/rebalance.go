@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// rebalance.go moves counter keys to the shard that owns them after the
+// shard list changes. Counters add up, so a move is GETDEL on the old
+// shard and INCRBY on the owner: an increment that reaches the old shard
+// meanwhile, from a go-app that has not reloaded yet, is moved by the
+// next run rather than lost.
+
+// shardMove is one key to move.
+type shardMove struct {
+	Key, From, To string
+}
+
+// planShardMoves lists the keys found on each shard that belong on
+// another. Every key on a retired shard moves.
+func planShardMoves(found map[string][]string, h redis.ConsistentHash, retired map[string]bool) []shardMove {
+	var moves []shardMove
+	for _, from := range sortedKeys(found) {
+		keys := slices.Clone(found[from])
+		slices.Sort(keys)
+		for _, k := range keys {
+			if to := shardOwner(h, k); to != from || retired[from] {
+				moves = append(moves, shardMove{k, from, to})
+			}
+		}
+	}
+	return moves
+}
+
+func runRebalanceShards(args []string) int {
+	fs := flag.NewFlagSet("rebalance-shards", flag.ExitOnError)
+	spec := fs.String("shards", "", "current shards, name=host:port,... (default REDIS_SHARDS_FILE or REDIS_SHARDS)")
+	from := fs.String("from", "", "shards removed from the list, name=host:port,..., to empty")
+	patterns := "go_visit_counter"
+	if p := statsdKeyPrefix(); p != "" {
+		patterns += "," + p + "*"
+	}
+	match := fs.String("match", patterns, "comma-separated key patterns to move")
+	dryRun := fs.Bool("dry-run", false, "list the moves without making them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s rebalance-shards [flags]\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintln(fs.Output(), "Moves counter keys to the Redis shard that owns them under the current")
+		fmt.Fprintln(fs.Output(), "shard list, adding each to any value already there.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var shards []redisShard
+	var err error
+	if *spec != "" {
+		shards, err = parseShardSpec(*spec)
+	} else {
+		shards, _, err = readShardConfig()
+	}
+	if err == nil && len(shards) == 0 {
+		err = errors.New("no shards: set -shards, REDIS_SHARDS_FILE or REDIS_SHARDS")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rebalance-shards: %v\n", err)
+		return 2
+	}
+	old, err := parseShardSpec(*from)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rebalance-shards: -from: %v\n", err)
+		return 2
+	}
+	retired := make(map[string]bool)
+	for _, o := range old {
+		if slices.ContainsFunc(shards, func(s redisShard) bool { return s.Name == o.Name }) {
+			fmt.Fprintf(os.Stderr, "rebalance-shards: -from %s: name a removed shard differently from the current ones\n", o.Name)
+			return 2
+		}
+		retired[o.Name] = true
+	}
+
+	ctx := context.Background()
+	clients := make(map[string]*redis.Client)
+	for _, s := range append(slices.Clone(shards), old...) {
+		clients[s.Name] = redis.NewClient(&redis.Options{Addr: s.Addr, DialTimeout: 5 * time.Second})
+		defer clients[s.Name].Close()
+	}
+
+	found := make(map[string][]string)
+	for name, c := range clients {
+		for _, pattern := range strings.Split(*match, ",") {
+			iter := c.Scan(ctx, 0, strings.TrimSpace(pattern), 500).Iterator()
+			for iter.Next(ctx) {
+				found[name] = append(found[name], iter.Val())
+			}
+			if err := iter.Err(); err != nil {
+				fmt.Fprintf(os.Stderr, "rebalance-shards: %s: %v\n", name, err)
+				return 1
+			}
+		}
+	}
+
+	moves := planShardMoves(found, newRendezvousHash(shardNames(shards)), retired)
+	if *dryRun {
+		for _, m := range moves {
+			fmt.Printf("would move %s %s -> %s\n", m.Key, m.From, m.To)
+		}
+		fmt.Printf("%d keys to move\n", len(moves))
+		return 0
+	}
+	stores := make(map[string]counterKeys, len(clients))
+	for name, c := range clients {
+		stores[name] = c
+	}
+	moved, failed := applyShardMoves(ctx, moves, stores, os.Stdout, os.Stderr)
+	fmt.Printf("%d keys moved, %d failed\n", moved, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// counterKeys is the part of a Redis client a move uses.
+type counterKeys interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+	GetDel(ctx context.Context, key string) *redis.StringCmd
+	Set(ctx context.Context, key string, value any, expiration time.Duration) *redis.StatusCmd
+	IncrBy(ctx context.Context, key string, value int64) *redis.IntCmd
+}
+
+// applyShardMoves makes each move, reporting it on out and a failure on
+// errOut.
+func applyShardMoves(ctx context.Context, moves []shardMove, stores map[string]counterKeys, out, errOut io.Writer) (moved, failed int) {
+	for _, m := range moves {
+		n, err := moveCounter(ctx, stores[m.From], stores[m.To], m.Key)
+		switch {
+		case errors.Is(err, redis.Nil):
+			// Gone since the scan; nothing to move.
+		case err != nil:
+			failed++
+			fmt.Fprintf(errOut, "%s %s -> %s: %v\n", m.Key, m.From, m.To, err)
+		default:
+			moved++
+			fmt.Fprintf(out, "moved %s %s -> %s (+%d)\n", m.Key, m.From, m.To, n)
+		}
+	}
+	return moved, failed
+}
+
+// moveCounter takes key off src and adds it to dst. A value that is not a
+// counter is put back untouched; if dst refuses the increment it goes
+// back onto src.
+func moveCounter(ctx context.Context, src, dst counterKeys, key string) (int64, error) {
+	// Checking first keeps GETDEL from taking a key of another type,
+	// which it would refuse anyway, or a string that is not a number.
+	v, err := src.Get(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+		return 0, fmt.Errorf("not a counter: %q", v)
+	}
+	v, err = src.GetDel(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		src.Set(ctx, key, v, 0)
+		return 0, fmt.Errorf("not a counter: %q", v)
+	}
+	if err := dst.IncrBy(ctx, key, n).Err(); err != nil {
+		if perr := src.IncrBy(ctx, key, n).Err(); perr != nil {
+			return 0, fmt.Errorf("%v; putting %d back also failed: %v", err, n, perr)
+		}
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDistributionQuantile(t *testing.T) {
+	var d distribution
+	for i := 0; i <= 1000; i++ {
+		d.add(float64(i))
+	}
+	for _, c := range []struct{ q, want float64 }{{0.5, 500}, {0.99, 990}, {1, 1000}} {
+		if got := d.quantile(c.q); math.Abs(got-c.want)/c.want > 0.02 {
+			t.Errorf("quantile(%v) = %v; want %v within 2%%", c.q, got, c.want)
+		}
+	}
+	if d.max != 1000 || d.count != 1001 {
+		t.Errorf("max = %v, count = %d", d.max, d.count)
+	}
+}
+
+func TestRecommendFlagsTightLimits(t *testing.T) {
+	dir := t.TempDir()
+	cg := cgroupInfo{Version: 2, CPUDir: dir, MemDir: dir}
+	writeCgroupFiles(t, dir, map[string]string{
+		"cpu.stat":      "usage_usec 0\nnr_periods 100\nnr_throttled 0\nthrottled_usec 0\n",
+		"memory.events": "low 0\nhigh 0\nmax 0\noom 0\noom_kill 0\n",
+		"cpu.max":       "400000 100000\n",
+		"memory.max":    "104857600\n",
+	})
+	a := newUsageAggregate(cg)
+	a.since = time.Now().Add(-time.Hour)
+	for i := 0; i < 100; i++ {
+		a.observe(usageSample{CgroupCPUPercent: 20, WorkingSetBytes: 96 << 20, Goroutines: 8})
+	}
+	writeCgroupFiles(t, dir, map[string]string{
+		"cpu.stat":      "usage_usec 0\nnr_periods 200\nnr_throttled 0\nthrottled_usec 0\n",
+		"memory.events": "low 0\nhigh 0\nmax 2\noom 1\noom_kill 1\n",
+	})
+
+	rep := a.recommend(time.Now())
+	if rep.Confidence != "high" {
+		t.Errorf("confidence = %s; want high after an hour", rep.Confidence)
+	}
+	kinds := map[string]string{}
+	for _, f := range rep.Findings {
+		kinds[f.Kind] = f.Severity
+	}
+	if kinds["memory_limit_tight"] != "critical" {
+		t.Errorf("findings = %+v; want critical memory_limit_tight after an OOM", rep.Findings)
+	}
+	// 4 cores against a p99 of ~0.2 cores is wasteful.
+	if kinds["cpu_limit_wasteful"] != "info" {
+		t.Errorf("findings = %+v; want cpu_limit_wasteful", rep.Findings)
+	}
+	if got := rep.Recommended.Kubernetes.Requests["cpu"]; got != "240m" {
+		t.Errorf("cpu request = %s; want 240m (p90 0.2 cores + 20%%)", got)
+	}
+	if rep.Recommended.MemoryLimitBytes < 96<<20*13/10 {
+		t.Errorf("memory limit %d is below peak plus headroom", rep.Recommended.MemoryLimitBytes)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisaudit.go checks the Redis server for settings that put the
+// counters at risk: an eviction policy that can drop them, persistence
+// that loses them on restart, and an ACL user allowed far more than
+// go-app needs. It runs once at startup and on demand at
+// /debug/redis/audit.
+
+var redisAuditFindings = registry.gauge("redis_audit_findings",
+	"Findings of the last Redis configuration audit, by severity.", "severity")
+
+// redisCommandsNeeded are the commands go-app sends: the counter, the
+// StatsD listener's INCRBY, the connection handshake, the durability
+// checks, the exporter, the shard rebalancer and this audit.
+var redisCommandsNeeded = []string{"ping", "incr", "incrby", "hello", "client|setinfo",
+	"get", "mget", "setnx", "info", "config|get", "acl|whoami", "acl|getuser", "acl|dryrun",
+	"client|setname", "slowlog|get", "slowlog|len", "latency|latest", "scan", "getdel"}
+
+// redisKeysNeeded are the key patterns go-app writes. Without a StatsD
+// key prefix the ingested names depend on STATSD_RULES and are left out.
+func redisKeysNeeded() []string {
+	keys := []string{"go_visit_counter", counterEpochKey}
+	if p := statsdKeyPrefix(); p != "" {
+		keys = append(keys, p+"*")
+	}
+	return keys
+}
+
+// redisRiskyCommands are tried with ACL DRYRUN; go-app needs none of them.
+var redisRiskyCommands = [][]string{
+	{"FLUSHALL"},
+	{"FLUSHDB"},
+	{"DEL", "go_visit_counter"},
+	{"CONFIG", "SET", "appendonly", "no"},
+	{"SHUTDOWN"},
+	{"KEYS", "*"},
+	{"ACL", "SETUSER", "someone"},
+}
+
+// redisServerState is what the audit reads from the server. Anything it
+// could not read is in Errors, keyed by what was asked.
+type redisServerState struct {
+	Config       map[string]string `json:"config"`
+	Info         map[string]string `json:"-"`
+	User         string            `json:"user,omitempty"`
+	UserFlags    []string          `json:"user_flags,omitempty"`
+	UserCommands string            `json:"user_commands,omitempty"`
+	UserKeys     string            `json:"user_keys,omitempty"`
+	Allowed      []string          `json:"risky_commands_allowed,omitempty"`
+	Errors       map[string]string `json:"errors,omitempty"`
+}
+
+type redisAuditReport struct {
+	Time         time.Time               `json:"time"`
+	Addr         string                  `json:"addr"`
+	Version      string                  `json:"redis_version,omitempty"`
+	Status       string                  `json:"status"` // ok, warning or critical
+	Findings     []recommendationFinding `json:"findings"`
+	SuggestedACL string                  `json:"suggested_acl"`
+	Server       redisServerState        `json:"server"`
+}
+
+func readRedisServer(ctx context.Context, client *redis.Client) redisServerState {
+	s := redisServerState{Config: make(map[string]string), Info: make(map[string]string), Errors: make(map[string]string)}
+	for _, pattern := range []string{"maxmemory", "maxmemory-policy", "save", "appendonly", "appendfsync"} {
+		kv, err := client.ConfigGet(ctx, pattern).Result()
+		if err != nil {
+			s.Errors["config get "+pattern] = err.Error()
+			continue
+		}
+		for k, v := range kv {
+			s.Config[k] = v
+		}
+	}
+	for _, section := range []string{"server", "memory", "persistence"} {
+		info, err := client.Info(ctx, section).Result()
+		if err != nil {
+			s.Errors["info "+section] = err.Error()
+			continue
+		}
+		for k, v := range parseRedisInfo(info) {
+			s.Info[k] = v
+		}
+	}
+
+	user, err := client.Do(ctx, "ACL", "WHOAMI").Text()
+	if err != nil {
+		s.Errors["acl whoami"] = err.Error()
+		return s
+	}
+	s.User = user
+	v, err := client.Do(ctx, "ACL", "GETUSER", user).Result()
+	if err != nil {
+		s.Errors["acl getuser"] = err.Error()
+	} else {
+		fields := redisReplyMap(v)
+		s.UserFlags = redisStrings(fields["flags"])
+		s.UserCommands = fmt.Sprint(fields["commands"])
+		if keys, ok := fields["keys"].(string); ok {
+			s.UserKeys = keys
+		} else {
+			s.UserKeys = strings.Join(redisStrings(fields["keys"]), " ")
+		}
+	}
+	for _, cmd := range redisRiskyCommands {
+		args := []any{"ACL", "DRYRUN", user}
+		for _, a := range cmd {
+			args = append(args, a)
+		}
+		// DRYRUN replies OK, or a message saying why the user may not; an
+		// error means DRYRUN itself was refused or is unknown (Redis < 7).
+		reply, err := client.Do(ctx, args...).Text()
+		if err != nil {
+			s.Errors["acl dryrun"] = err.Error()
+			break
+		}
+		if reply == "OK" {
+			s.Allowed = append(s.Allowed, strings.ToLower(strings.Join(cmd[:min(len(cmd), 2)], " ")))
+		}
+	}
+	return s
+}
+
+// parseRedisInfo reads INFO's "key:value" lines.
+func parseRedisInfo(info string) map[string]string {
+	out := make(map[string]string)
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// redisReplyMap reads a map reply: a map under RESP3, alternating keys
+// and values under RESP2.
+func redisReplyMap(v any) map[string]any {
+	out := make(map[string]any)
+	switch v := v.(type) {
+	case map[any]any:
+		for k, val := range v {
+			out[fmt.Sprint(k)] = val
+		}
+	case []any:
+		for i := 0; i+1 < len(v); i += 2 {
+			out[fmt.Sprint(v[i])] = v[i+1]
+		}
+	}
+	return out
+}
+
+func redisStrings(v any) []string {
+	var out []string
+	switch v := v.(type) {
+	case []any:
+		for _, s := range v {
+			out = append(out, fmt.Sprint(s))
+		}
+	case map[any]bool: // RESP3 sets
+		for s := range v {
+			out = append(out, fmt.Sprint(s))
+		}
+	}
+	return out
+}
+
+// auditRedis turns the server state into findings. "critical" means the
+// counters can be lost in normal operation.
+func auditRedis(s redisServerState) []recommendationFinding {
+	var out []recommendationFinding
+	finding := func(kind, severity, format string, args ...any) {
+		out = append(out, recommendationFinding{kind, severity, fmt.Sprintf(format, args...)})
+	}
+
+	// Eviction. The counters have no TTL, so only allkeys-* policies can
+	// evict them.
+	policy := s.Config["maxmemory-policy"]
+	maxmemory, _ := strconv.ParseUint(s.Config["maxmemory"], 10, 64)
+	switch {
+	case policy == "":
+		if _, denied := s.Errors["config get maxmemory-policy"]; denied {
+			finding("config_unreadable", "warning",
+				"cannot read the eviction policy (%s); check by hand that it is not allkeys-*", s.Errors["config get maxmemory-policy"])
+		}
+	case strings.HasPrefix(policy, "allkeys-") && maxmemory > 0:
+		finding("eviction_evicts_counters", "critical",
+			"maxmemory-policy %s evicts any key, go_visit_counter included, once memory reaches %s; use noeviction or a volatile-* policy",
+			policy, kubeMemory(maxmemory))
+	case strings.HasPrefix(policy, "allkeys-"):
+		finding("eviction_evicts_counters", "warning",
+			"maxmemory-policy %s will evict the counters as soon as maxmemory is set; use noeviction or a volatile-* policy", policy)
+	case strings.HasPrefix(policy, "volatile-"):
+		finding("eviction_volatile", "info",
+			"maxmemory-policy %s only evicts keys with a TTL; the counters have none, but writes fail with OOM once nothing is left to evict", policy)
+	case policy == "noeviction" && maxmemory > 0:
+		finding("eviction_noeviction", "info",
+			"at maxmemory (%s) writes fail with OOM errors rather than losing counters", kubeMemory(maxmemory))
+	}
+	if used, _ := strconv.ParseUint(s.Info["used_memory"], 10, 64); maxmemory > 0 && float64(used) > 0.9*float64(maxmemory) {
+		finding("memory_near_limit", "warning", "used memory %s is over 90%% of maxmemory %s", kubeMemory(used), kubeMemory(maxmemory))
+	}
+
+	// Persistence.
+	save, aof := s.Config["save"], s.Config["appendonly"]
+	switch {
+	case aof == "" && save == "":
+		// CONFIG was not readable; reported above.
+	case aof == "no" && strings.TrimSpace(save) == "":
+		finding("persistence_disabled", "critical",
+			"RDB snapshots and the AOF are both off; the counters reset whenever Redis restarts")
+	case aof == "no":
+		finding("persistence_rdb_only", "info",
+			"only RDB snapshots (save %q); increments since the last snapshot are lost if Redis crashes", save)
+	case s.Config["appendfsync"] == "no":
+		finding("aof_fsync_disabled", "warning",
+			"appendfsync no leaves flushing the AOF to the OS; tens of seconds of increments can be lost on a crash")
+	}
+	if st := s.Info["rdb_last_bgsave_status"]; st != "" && st != "ok" {
+		finding("rdb_save_failing", "critical", "the last RDB snapshot failed (%s); check disk space and permissions", st)
+	}
+	if st := s.Info["aof_last_write_status"]; st != "" && st != "ok" {
+		finding("aof_write_failing", "critical", "the last AOF write failed (%s)", st)
+	}
+
+	// ACL.
+	if s.User != "" {
+		if hasString(s.UserFlags, "nopass") {
+			finding("acl_no_password", "warning", "user %q needs no password", s.User)
+		}
+		if hasString(s.UserFlags, "allcommands") || strings.Contains(s.UserCommands, "+@all") {
+			finding("acl_all_commands", "warning",
+				"user %q may run every command; go-app needs only %s", s.User, strings.Join(redisCommandsNeeded, " "))
+		}
+		if hasString(s.UserFlags, "allkeys") || s.UserKeys == "~*" {
+			finding("acl_all_keys", "info", "user %q may touch every key; go-app needs only %s", s.User, strings.Join(redisKeysNeeded(), " "))
+		}
+		if len(s.Allowed) > 0 {
+			finding("acl_risky_commands", "warning", "user %q may run %s, which go-app never sends", s.User, strings.Join(s.Allowed, ", "))
+		}
+	} else if err, ok := s.Errors["acl whoami"]; ok {
+		finding("acl_unreadable", "info", "cannot inspect the ACL (%s)", err)
+	}
+	return out
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// suggestedRedisACL is an ACL SETUSER line granting go-app what it needs.
+func suggestedRedisACL() string {
+	var b strings.Builder
+	b.WriteString("ACL SETUSER go-app on >PASSWORD resetkeys")
+	for _, k := range redisKeysNeeded() {
+		b.WriteString(" ~" + k)
+	}
+	b.WriteString(" -@all")
+	for _, c := range redisCommandsNeeded {
+		b.WriteString(" +" + c)
+	}
+	return b.String()
+}
+
+func runRedisAudit(ctx context.Context, client *redis.Client) redisAuditReport {
+	s := readRedisServer(ctx, client)
+	rep := redisAuditReport{
+		Time:         time.Now(),
+		Addr:         client.Options().Addr,
+		Version:      s.Info["redis_version"],
+		Status:       "ok",
+		Findings:     auditRedis(s),
+		SuggestedACL: suggestedRedisACL(),
+		Server:       s,
+	}
+	counts := map[string]float64{"info": 0, "warning": 0, "critical": 0}
+	for _, f := range rep.Findings {
+		counts[f.Severity]++
+		if f.Severity == "critical" || f.Severity == "warning" && rep.Status == "ok" {
+			rep.Status = f.Severity
+		}
+	}
+	for sev, n := range counts {
+		redisAuditFindings.with(sev).set(n)
+	}
+	return rep
+}
+
+// startRedisAudit audits the server once Redis answers. REDIS_AUDIT sets
+// what happens to the findings: warn (the default) logs them, fail also
+// exits when any is critical, after waiting up to REDIS_AUDIT_TIMEOUT
+// (30s) for Redis, and off skips the startup audit.
+func startRedisAudit(ctx context.Context, client *redis.Client) {
+	mode := envOr("REDIS_AUDIT", "warn")
+	if redisShards != nil {
+		mode = "off" // see rejectSingleServerFeatures
+	}
+	switch mode {
+	case "off":
+		return
+	case "fail":
+		waitCtx, cancel := context.WithTimeout(ctx, envDuration("REDIS_AUDIT_TIMEOUT", 30*time.Second))
+		defer cancel()
+		if !waitForRedis(waitCtx, client) {
+			log.Printf("Redis audit: Redis did not answer within REDIS_AUDIT_TIMEOUT; refusing to start")
+			os.Exit(1)
+		}
+		if logRedisAudit(runRedisAudit(ctx, client)) == "critical" {
+			log.Printf("Redis audit: critical findings and REDIS_AUDIT=fail; refusing to start")
+			os.Exit(1)
+		}
+	case "warn":
+		go func() {
+			if waitForRedis(ctx, client) {
+				logRedisAudit(runRedisAudit(ctx, client))
+			}
+		}()
+	default:
+		log.Printf("Redis audit skipped: REDIS_AUDIT must be warn, fail or off, not %q", mode)
+	}
+}
+
+func waitForRedis(ctx context.Context, client *redis.Client) bool {
+	for {
+		if client.Ping(ctx).Err() == nil {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func logRedisAudit(rep redisAuditReport) string {
+	for _, f := range rep.Findings {
+		if f.Severity == "info" {
+			continue
+		}
+		slog.Warn("redis audit", "kind", f.Kind, "severity", f.Severity, "message", f.Message)
+	}
+	log.Printf("Redis audit of %s: %s, %d findings; details at /debug/redis/audit", rep.Addr, rep.Status, len(rep.Findings))
+	return rep.Status
+}
+
+// redisAuditHandler runs the audit now.
+func redisAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if redisShards != nil {
+		http.Error(w, "redis audit is disabled with sharding", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := redisClient.Ping(ctx).Err(); err != nil {
+		http.Error(w, "redis unreachable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	rep := runRedisAudit(ctx, redisClient)
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(rep)
+}
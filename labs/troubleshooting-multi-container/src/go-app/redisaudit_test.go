@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func findingKinds(fs []recommendationFinding) map[string]string {
+	kinds := make(map[string]string)
+	for _, f := range fs {
+		kinds[f.Kind] = f.Severity
+	}
+	return kinds
+}
+
+func TestAuditRedis(t *testing.T) {
+	// Scenario 5's fixed compose file: a memory cap with allkeys-lru and
+	// no persistence, as the default user.
+	s := redisServerState{
+		Config: map[string]string{"maxmemory": "104857600", "maxmemory-policy": "allkeys-lru",
+			"save": "", "appendonly": "no", "appendfsync": "everysec"},
+		Info:         parseRedisInfo("# Memory\r\nused_memory:100000000\r\n# Persistence\r\nrdb_last_bgsave_status:ok\r\n"),
+		User:         "default",
+		UserFlags:    []string{"on", "nopass", "allkeys", "allcommands"},
+		UserCommands: "+@all",
+		UserKeys:     "~*",
+		Allowed:      []string{"flushall", "config set"},
+	}
+	got := findingKinds(auditRedis(s))
+	want := map[string]string{
+		"eviction_evicts_counters": "critical",
+		"memory_near_limit":        "warning",
+		"persistence_disabled":     "critical",
+		"acl_no_password":          "warning",
+		"acl_all_commands":         "warning",
+		"acl_all_keys":             "info",
+		"acl_risky_commands":       "warning",
+	}
+	for k, sev := range want {
+		if got[k] != sev {
+			t.Errorf("%s: got severity %q, want %q", k, got[k], sev)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("findings %v, want %v", got, want)
+	}
+
+	// A least-privilege user on a durable server.
+	s = redisServerState{
+		Config: map[string]string{"maxmemory": "0", "maxmemory-policy": "noeviction",
+			"save": "3600 1 300 100 60 10000", "appendonly": "yes", "appendfsync": "everysec"},
+		Info:         map[string]string{"rdb_last_bgsave_status": "ok", "aof_last_write_status": "ok"},
+		User:         "go-app",
+		UserFlags:    []string{"on"},
+		UserCommands: "-@all +incr +incrby +ping",
+		UserKeys:     "~go_visit_counter ~statsd:*",
+	}
+	if fs := auditRedis(s); len(fs) != 0 {
+		t.Errorf("durable, least-privilege server: %v", fs)
+	}
+
+	// Volatile policies leave the counters alone; a failing AOF does not.
+	s.Config["maxmemory-policy"] = "volatile-lru"
+	s.Config["appendfsync"] = "no"
+	s.Info["aof_last_write_status"] = "err"
+	got = findingKinds(auditRedis(s))
+	if got["eviction_volatile"] != "info" || got["aof_fsync_disabled"] != "warning" || got["aof_write_failing"] != "critical" {
+		t.Errorf("findings %v", got)
+	}
+
+	// Managed Redis often refuses CONFIG and ACL.
+	s = redisServerState{Config: map[string]string{}, Errors: map[string]string{
+		"config get maxmemory-policy": "ERR unknown command 'CONFIG'",
+		"acl whoami":                  "NOPERM this user has no permissions",
+	}}
+	got = findingKinds(auditRedis(s))
+	if got["config_unreadable"] != "warning" || got["acl_unreadable"] != "info" || len(got) != 2 {
+		t.Errorf("findings %v", got)
+	}
+}
+
+func TestRedisReplyMap(t *testing.T) {
+	resp2 := []any{"flags", []any{"on", "allcommands"}, "commands", "+@all", "keys", "~*"}
+	resp3 := map[any]any{"flags": map[any]bool{"on": true, "allcommands": true}, "commands": "+@all", "keys": "~*"}
+	for _, v := range []any{resp2, resp3} {
+		m := redisReplyMap(v)
+		if !hasString(redisStrings(m["flags"]), "allcommands") || m["commands"] != "+@all" || m["keys"] != "~*" {
+			t.Errorf("redisReplyMap(%v) = %v", v, m)
+		}
+	}
+}
+
+func TestSuggestedRedisACL(t *testing.T) {
+	acl := suggestedRedisACL()
+	for _, want := range []string{"~go_visit_counter", "~statsd:*", "-@all", "+incrby", "+config|get"} {
+		if !strings.Contains(acl, " "+want) {
+			t.Errorf("%q lacks %s", acl, want)
+		}
+	}
+}
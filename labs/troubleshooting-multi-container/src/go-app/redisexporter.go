@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisexporter.go scrapes Redis's own view of itself, so finding out
+// whether Redis is the bottleneck does not take a shell in its container.
+// INFO gives memory, clients, keyspace and command stats; SLOWLOG GET the
+// commands that ran slowly; LATENCY LATEST the latency monitor's spikes
+// (only recorded when latency-monitor-threshold is set). All of it is
+// published as metrics and at /debug/redis. The scrapes use a client of
+// their own with one connection, so a slow INFO never holds a pooled
+// connection a request is waiting for.
+
+// redisInfoMetric maps an INFO field to a metric.
+type redisInfoMetric struct {
+	field  string
+	family *metricFamily
+}
+
+var redisInfoMetrics = func() []redisInfoMetric {
+	var out []redisInfoMetric
+	add := func(field, name, kind, help string) {
+		if kind == counterKind {
+			out = append(out, redisInfoMetric{field, registry.counter(name, help)})
+		} else {
+			out = append(out, redisInfoMetric{field, registry.gauge(name, help)})
+		}
+	}
+	add("uptime_in_seconds", "redis_uptime_seconds", gaugeKind, "Seconds since Redis started.")
+	add("connected_clients", "redis_connected_clients", gaugeKind, "Client connections open to Redis.")
+	add("blocked_clients", "redis_blocked_clients", gaugeKind, "Clients waiting in a blocking command.")
+	add("used_memory", "redis_memory_used_bytes", gaugeKind, "Memory Redis has allocated.")
+	add("used_memory_rss", "redis_memory_rss_bytes", gaugeKind, "Resident memory of the Redis process.")
+	add("used_memory_peak", "redis_memory_peak_bytes", gaugeKind, "Most memory Redis has allocated.")
+	add("maxmemory", "redis_memory_max_bytes", gaugeKind, "Redis maxmemory; 0 when unlimited.")
+	add("mem_fragmentation_ratio", "redis_memory_fragmentation_ratio", gaugeKind, "Resident memory over allocated memory.")
+	add("instantaneous_ops_per_sec", "redis_instantaneous_ops_per_second", gaugeKind, "Commands per second, as Redis samples it.")
+	add("total_connections_received", "redis_connections_received_total", counterKind, "Connections Redis has accepted.")
+	add("rejected_connections", "redis_rejected_connections_total", counterKind, "Connections Redis rejected for maxclients.")
+	add("total_commands_processed", "redis_commands_processed_total", counterKind, "Commands Redis has run.")
+	add("keyspace_hits", "redis_keyspace_hits_total", counterKind, "Key lookups that found the key.")
+	add("keyspace_misses", "redis_keyspace_misses_total", counterKind, "Key lookups that did not.")
+	add("expired_keys", "redis_expired_keys_total", counterKind, "Keys removed because their TTL ran out.")
+	add("evicted_keys", "redis_evicted_keys_total", counterKind, "Keys evicted for maxmemory.")
+	return out
+}()
+
+var (
+	redisUp = registry.gauge("redis_up",
+		"1 if the last Redis scrape succeeded.")
+	redisScrapeDuration = registry.gauge("redis_exporter_scrape_duration_seconds",
+		"Time the last Redis INFO scrape took.")
+	redisScrapeErrors = registry.counter("redis_exporter_scrape_errors_total",
+		"Redis scrapes that failed.")
+	redisDBKeys = registry.gauge("redis_db_keys",
+		"Keys in each Redis database.", "db")
+	redisDBExpiring = registry.gauge("redis_db_keys_expiring",
+		"Keys with a TTL in each Redis database.", "db")
+	redisSlowlogLength = registry.gauge("redis_slowlog_length",
+		"Entries in the Redis slow log.")
+	redisSlowlogEntries = registry.counter("redis_slowlog_entries_total",
+		"Slow log entries seen by the exporter, by command.", "command")
+	redisLatencyLatest = registry.gauge("redis_latency_latest_seconds",
+		"Latest spike recorded by the Redis latency monitor, by event.", "event")
+	redisLatencyMax = registry.gauge("redis_latency_max_seconds",
+		"Largest spike recorded by the Redis latency monitor, by event.", "event")
+)
+
+type redisLatencyEvent struct {
+	Event  string    `json:"event"`
+	Time   time.Time `json:"time"`
+	Latest float64   `json:"latest_ms"`
+	Max    float64   `json:"max_ms"`
+}
+
+type redisSlowEntry struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_ms"`
+	Command  string    `json:"command"`
+	Client   string    `json:"client,omitempty"`
+}
+
+type redisExporter struct {
+	client  *redis.Client
+	entries int64 // SLOWLOG GET count
+
+	mu         sync.Mutex
+	infoAt     time.Time
+	infoErr    string
+	info       map[string]map[string]string // section, field, value
+	slowAt     time.Time
+	slowErr    string
+	slowlog    []redisSlowEntry
+	slowPrimed bool  // a slow log scrape has set lastSlowID
+	lastSlowID int64 // highest slow log ID seen; -1 when the log was empty
+	slowlogLen int64
+	latency    []redisLatencyEvent
+}
+
+var redisExp *redisExporter
+
+// startRedisExporter scrapes INFO every REDIS_EXPORTER_INTERVAL (15s) and
+// SLOWLOG and LATENCY every REDIS_EXPORTER_SLOWLOG_INTERVAL (1m), keeping
+// the last REDIS_EXPORTER_SLOWLOG_ENTRIES (32) slow commands, when
+// REDIS_EXPORTER is true and the counters are not sharded.
+func startRedisExporter(ctx context.Context, client *redis.Client) {
+	if on, _ := strconv.ParseBool(envOr("REDIS_EXPORTER", "false")); !on || redisShards != nil {
+		return
+	}
+	entries, err := strconv.ParseInt(envOr("REDIS_EXPORTER_SLOWLOG_ENTRIES", "32"), 10, 64)
+	if err != nil || entries <= 0 {
+		entries = 32
+	}
+	// A client of its own, with the same address and credentials but
+	// one connection and none of the request hooks.
+	opts := *client.Options()
+	opts.PoolSize = 1
+	opts.MinIdleConns = 0
+	opts.MaxIdleConns = 1
+	opts.ClientName = "go-app-exporter"
+	e := newRedisExporter(redis.NewClient(&opts), entries)
+	redisExp = e
+
+	infoEvery := envDuration("REDIS_EXPORTER_INTERVAL", 15*time.Second)
+	slowEvery := envDuration("REDIS_EXPORTER_SLOWLOG_INTERVAL", time.Minute)
+	log.Printf("Exporting Redis INFO every %s and SLOWLOG/LATENCY every %s at /debug/redis", infoEvery, slowEvery)
+	go func() {
+		defer e.client.Close()
+		info := time.NewTicker(infoEvery)
+		defer info.Stop()
+		slow := time.NewTicker(slowEvery)
+		defer slow.Stop()
+		e.scrapeInfo(ctx, infoEvery)
+		e.scrapeSlow(ctx, slowEvery)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-info.C:
+				e.scrapeInfo(ctx, infoEvery)
+			case <-slow.C:
+				e.scrapeSlow(ctx, slowEvery)
+			}
+		}
+	}()
+}
+
+func newRedisExporter(client *redis.Client, entries int64) *redisExporter {
+	return &redisExporter{client: client, entries: entries}
+}
+
+func (e *redisExporter) scrapeInfo(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	info, err := e.client.Info(ctx).Result()
+	redisScrapeDuration.with().set(time.Since(start).Seconds())
+	if err != nil {
+		redisScrapeErrors.with().inc()
+		redisUp.with().set(0)
+		slog.Debug("redis exporter: INFO failed", "err", err)
+		e.mu.Lock()
+		e.infoAt, e.infoErr = time.Now(), err.Error()
+		e.mu.Unlock()
+		return
+	}
+	redisUp.with().set(1)
+	e.updateInfo(time.Now(), parseRedisInfoSections(info))
+}
+
+func (e *redisExporter) updateInfo(now time.Time, sections map[string]map[string]string) {
+	for _, m := range redisInfoMetrics {
+		for _, fields := range sections {
+			if v, ok := fields[m.field]; ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					m.family.with().set(f)
+				}
+			}
+		}
+	}
+	for db, v := range sections["keyspace"] {
+		keys, expires := parseKeyspace(v)
+		redisDBKeys.with(db).set(float64(keys))
+		redisDBExpiring.with(db).set(float64(expires))
+	}
+	e.mu.Lock()
+	e.infoAt, e.infoErr, e.info = now, "", sections
+	e.mu.Unlock()
+}
+
+func (e *redisExporter) scrapeSlow(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var slow *redis.SlowLogCmd
+	var size, latency *redis.Cmd
+	e.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		slow = p.SlowLogGet(ctx, e.entries)
+		size = p.Do(ctx, "SLOWLOG", "LEN")
+		latency = p.Do(ctx, "LATENCY", "LATEST")
+		return nil
+	})
+	// The two are separate so an ACL that refuses one does not hide the
+	// other.
+	var errs []string
+	n, err := size.Int64()
+	if err == nil {
+		err = slow.Err()
+	}
+	if err == nil {
+		e.updateSlow(slow.Val(), n)
+	} else {
+		errs = append(errs, "SLOWLOG: "+err.Error())
+	}
+	events, err := parseLatencyLatest(latency.Val())
+	if err == nil {
+		err = latency.Err()
+	}
+	if err == nil {
+		e.updateLatency(events)
+	} else {
+		errs = append(errs, "LATENCY: "+err.Error())
+	}
+	if len(errs) > 0 {
+		redisScrapeErrors.with().inc()
+		slog.Debug("redis exporter: scrape failed", "err", errs)
+	}
+	e.mu.Lock()
+	e.slowAt, e.slowErr = time.Now(), strings.Join(errs, "; ")
+	e.mu.Unlock()
+}
+
+func (e *redisExporter) updateSlow(slow []redis.SlowLog, size int64) {
+	redisSlowlogLength.with().set(float64(size))
+	entries := make([]redisSlowEntry, len(slow))
+	for i, s := range slow {
+		entries[i] = redisSlowEntry{
+			ID:       s.ID,
+			Time:     s.Time,
+			Duration: float64(s.Duration.Microseconds()) / 1e3,
+			Command:  strings.Join(s.Args, " "),
+			Client:   s.ClientAddr,
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// Count entries newer than the last scrape. The first scrape only
+	// sets the mark, so go-app restarting does not count old entries
+	// again. IDs only go down after a Redis restart, which empties the
+	// log, so every entry then is new.
+	newest := int64(-1)
+	for _, s := range slow {
+		newest = max(newest, s.ID)
+	}
+	if e.slowPrimed {
+		restarted := newest < e.lastSlowID
+		for _, s := range slow {
+			if s.ID > e.lastSlowID || restarted {
+				redisSlowlogEntries.with(redisSlowCommandName(s.Args)).inc()
+			}
+		}
+	}
+	e.slowPrimed, e.lastSlowID = true, newest
+	e.slowlog, e.slowlogLen = entries, size
+}
+
+func (e *redisExporter) updateLatency(events []redisLatencyEvent) {
+	for _, ev := range events {
+		redisLatencyLatest.with(ev.Event).set(ev.Latest / 1e3)
+		redisLatencyMax.with(ev.Event).set(ev.Max / 1e3)
+	}
+	e.mu.Lock()
+	e.latency = events
+	e.mu.Unlock()
+}
+
+// parseRedisInfoSections reads INFO into its "# Section" blocks, keyed
+// by the lower-cased section name.
+func parseRedisInfoSections(info string) map[string]map[string]string {
+	out := make(map[string]map[string]string)
+	section := "default"
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#"):
+			section = strings.ToLower(strings.TrimSpace(line[1:]))
+		default:
+			if k, v, ok := strings.Cut(line, ":"); ok {
+				if out[section] == nil {
+					out[section] = make(map[string]string)
+				}
+				out[section][k] = v
+			}
+		}
+	}
+	return out
+}
+
+// parseKeyspace reads a keyspace line's "keys=1,expires=0,avg_ttl=0".
+func parseKeyspace(v string) (keys, expires int64) {
+	for _, kv := range strings.Split(v, ",") {
+		k, n, _ := strings.Cut(kv, "=")
+		switch k {
+		case "keys":
+			keys, _ = strconv.ParseInt(n, 10, 64)
+		case "expires":
+			expires, _ = strconv.ParseInt(n, 10, 64)
+		}
+	}
+	return keys, expires
+}
+
+// parseLatencyLatest reads LATENCY LATEST: one [event, unix time, latest
+// ms, max ms] array per event.
+func parseLatencyLatest(v any) ([]redisLatencyEvent, error) {
+	rows, ok := v.([]any)
+	if v == nil {
+		return nil, nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("LATENCY LATEST: unexpected reply %T", v)
+	}
+	var out []redisLatencyEvent
+	for _, r := range rows {
+		f, ok := r.([]any)
+		if !ok || len(f) < 4 {
+			return nil, fmt.Errorf("LATENCY LATEST: unexpected row %v", r)
+		}
+		ev := redisLatencyEvent{Event: fmt.Sprint(f[0])}
+		var nums [3]int64
+		for i := range nums {
+			switch n := f[i+1].(type) {
+			case int64:
+				nums[i] = n
+			default:
+				return nil, fmt.Errorf("LATENCY LATEST: unexpected value %v in %v", f[i+1], r)
+			}
+		}
+		ev.Time = time.Unix(nums[0], 0)
+		ev.Latest, ev.Max = float64(nums[1]), float64(nums[2])
+		out = append(out, ev)
+	}
+	return out, nil
+}
+
+// redisSlowCommandName is the command as a metric label: the command
+// itself, with the subcommand for container commands like CONFIG GET.
+func redisSlowCommandName(args []string) string {
+	if len(args) == 0 {
+		return "unknown"
+	}
+	name := strings.ToLower(args[0])
+	switch name {
+	case "acl", "client", "cluster", "command", "config", "debug", "function", "latency",
+		"memory", "module", "object", "pubsub", "script", "slowlog", "xinfo", "xgroup":
+		if len(args) > 1 {
+			name += "|" + strings.ToLower(args[1])
+		}
+	}
+	return name
+}
+
+type redisDebugReport struct {
+	Addr      string                       `json:"addr"`
+	InfoTime  time.Time                    `json:"info_time,omitzero"`
+	InfoError string                       `json:"info_error,omitempty"`
+	Info      map[string]map[string]string `json:"info"`
+	SlowTime  time.Time                    `json:"slowlog_time,omitzero"`
+	SlowError string                       `json:"slowlog_error,omitempty"`
+	SlowLen   int64                        `json:"slowlog_length"`
+	Slowlog   []redisSlowEntry             `json:"slowlog"`
+	Latency   []redisLatencyEvent          `json:"latency"`
+}
+
+// redisDebugHandler serves the last scrapes. ?section=memory,clients
+// narrows INFO to those sections.
+func redisDebugHandler(w http.ResponseWriter, r *http.Request) {
+	e := redisExp
+	if e == nil {
+		http.Error(w, "redis exporter is disabled", http.StatusNotFound)
+		return
+	}
+	e.mu.Lock()
+	rep := redisDebugReport{
+		Addr:      e.client.Options().Addr,
+		InfoTime:  e.infoAt,
+		InfoError: e.infoErr,
+		Info:      make(map[string]map[string]string),
+		SlowTime:  e.slowAt,
+		SlowError: e.slowErr,
+		SlowLen:   e.slowlogLen,
+		Slowlog:   e.slowlog,
+		Latency:   e.latency,
+	}
+	want := []string{"server", "clients", "memory", "stats", "keyspace"}
+	if s := r.URL.Query().Get("section"); s != "" {
+		want = strings.Split(strings.ToLower(s), ",")
+	}
+	for _, s := range want {
+		if fields, ok := e.info[s]; ok {
+			rep.Info[s] = fields
+		}
+	}
+	e.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(rep)
+}
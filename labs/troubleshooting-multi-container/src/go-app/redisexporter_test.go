@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisInfoFixture = "# Server\r\nredis_version:7.2.4\r\nuptime_in_seconds:3600\r\n\r\n" +
+	"# Clients\r\nconnected_clients:3\r\n\r\n" +
+	"# Memory\r\nused_memory:1048576\r\nmem_fragmentation_ratio:1.25\r\n\r\n" +
+	"# Stats\r\nkeyspace_hits:90\r\nkeyspace_misses:10\r\nevicted_keys:2\r\n\r\n" +
+	"# Keyspace\r\ndb0:keys=12,expires=2,avg_ttl=500\r\n"
+
+func metricValue(f *metricFamily, labels ...string) float64 {
+	for _, s := range f.samples() {
+		if len(s.LabelValues) == len(labels) && (len(labels) == 0 || s.LabelValues[0] == labels[0]) {
+			return s.Value
+		}
+	}
+	return -1
+}
+
+func TestRedisExporterInfo(t *testing.T) {
+	sections := parseRedisInfoSections(redisInfoFixture)
+	if sections["server"]["redis_version"] != "7.2.4" || sections["keyspace"]["db0"] != "keys=12,expires=2,avg_ttl=500" {
+		t.Fatalf("sections %v", sections)
+	}
+	e := newRedisExporter(nil, 32)
+	e.updateInfo(time.Now(), sections)
+	for _, c := range []struct {
+		f    *metricFamily
+		db   string
+		want float64
+	}{
+		{registry.byName["redis_uptime_seconds"], "", 3600},
+		{registry.byName["redis_memory_fragmentation_ratio"], "", 1.25},
+		{registry.byName["redis_keyspace_misses_total"], "", 10},
+		{registry.byName["redis_evicted_keys_total"], "", 2},
+		{redisDBKeys, "db0", 12},
+		{redisDBExpiring, "db0", 2},
+	} {
+		var labels []string
+		if c.db != "" {
+			labels = []string{c.db}
+		}
+		if got := metricValue(c.f, labels...); got != c.want {
+			t.Errorf("%s = %v, want %v", c.f.Name, got, c.want)
+		}
+	}
+}
+
+func TestRedisExporterSlowlog(t *testing.T) {
+	e := newRedisExporter(nil, 32)
+	entry := func(id int64, args ...string) redis.SlowLog {
+		return redis.SlowLog{ID: id, Time: time.Unix(1700000000, 0), Duration: 25 * time.Millisecond, Args: args}
+	}
+	before := max(metricValue(redisSlowlogEntries, "keys"), 0)
+
+	// The first scrape only sets the mark.
+	e.updateSlow([]redis.SlowLog{entry(4, "KEYS", "*"), entry(3, "KEYS", "*")}, 2)
+	if got := max(metricValue(redisSlowlogEntries, "keys"), 0); got != before {
+		t.Errorf("first scrape counted %v entries", got-before)
+	}
+	e.updateSlow([]redis.SlowLog{entry(6, "KEYS", "*"), entry(5, "CONFIG", "GET", "save"), entry(4, "KEYS", "*")}, 3)
+	if got := metricValue(redisSlowlogEntries, "keys"); got != before+1 {
+		t.Errorf("keys entries = %v, want %v", got, before+1)
+	}
+	if got := metricValue(redisSlowlogEntries, "config|get"); got < 1 {
+		t.Errorf("config|get entries = %v", got)
+	}
+	// Redis restarted: IDs start again at 0.
+	e.updateSlow([]redis.SlowLog{entry(0, "KEYS", "*")}, 1)
+	if got := metricValue(redisSlowlogEntries, "keys"); got != before+2 {
+		t.Errorf("after restart keys entries = %v, want %v", got, before+2)
+	}
+	if len(e.slowlog) != 1 || e.slowlog[0].Duration != 25 || e.slowlog[0].Command != "KEYS *" {
+		t.Errorf("slowlog %+v", e.slowlog)
+	}
+}
+
+func TestParseLatencyLatest(t *testing.T) {
+	events, err := parseLatencyLatest([]any{[]any{"command", int64(1700000000), int64(12), int64(250)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Event != "command" || events[0].Latest != 12 || events[0].Max != 250 {
+		t.Errorf("events %+v", events)
+	}
+	if _, err := parseLatencyLatest([]any{[]any{"command"}}); err == nil {
+		t.Error("short row accepted")
+	}
+	if events, err := parseLatencyLatest([]any{}); err != nil || len(events) != 0 {
+		t.Errorf("empty reply: %v, %v", events, err)
+	}
+}
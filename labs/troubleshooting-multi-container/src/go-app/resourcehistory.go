@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// usageSample is one second of the process as seen from the inside, so a
+// load test can be lined up against memory and CPU after the fact.
+type usageSample struct {
+	Time       time.Time `json:"time"`
+	CPUPercent float64   `json:"cpu_percent"` // 100 = one full core
+	RSSBytes   uint64    `json:"rss_bytes"`
+	HeapBytes  uint64    `json:"heap_bytes"`
+	Goroutines int       `json:"goroutines"`
+	OpenFDs    int       `json:"open_fds"`
+
+	CgroupMemoryBytes uint64  `json:"cgroup_memory_bytes,omitempty"`
+	WorkingSetBytes   uint64  `json:"working_set_bytes,omitempty"`
+	CgroupCPUPercent  float64 `json:"cgroup_cpu_percent,omitempty"`
+	CgroupThrottled   uint64  `json:"cgroup_throttled_periods,omitempty"`
+}
+
+// clockTicks is USER_HZ, the unit of utime and stime in /proc/self/stat.
+// It is 100 on every Linux platform Go supports.
+const clockTicks = 100
+
+var usageHistory *broadcastRing[usageSample]
+
+// usageSampler turns cumulative counters into per-interval rates.
+type usageSampler struct {
+	cg        cgroupInfo
+	last      time.Time
+	lastCPU   float64 // process CPU seconds
+	lastCgCPU uint64  // cgroup usage_usec
+	lastThrot uint64
+	metrics   []metrics.Sample
+}
+
+// startUsageHistory samples the process every RESOURCE_HISTORY_INTERVAL
+// (1s) into a ring of RESOURCE_HISTORY_SIZE (3600) samples.
+func startUsageHistory(ctx context.Context) {
+	if on, err := strconv.ParseBool(envOr("RESOURCE_HISTORY", "true")); err == nil && !on {
+		return
+	}
+	interval := envDuration("RESOURCE_HISTORY_INTERVAL", time.Second)
+	size, err := strconv.Atoi(envOr("RESOURCE_HISTORY_SIZE", "3600"))
+	if err != nil || size <= 0 {
+		size = 3600
+	}
+	usageHistory = newBroadcastRing[usageSample](size)
+	cg := detectCgroup()
+	usageStats = newUsageAggregate(cg)
+	s := newUsageSampler(cg)
+	s.sample(time.Now()) // prime the rate baselines
+	log.Printf("Recording resource history every %s (%s retained)", interval, time.Duration(size)*interval)
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				u := s.sample(now)
+				usageHistory.publish(u)
+				usageStats.observe(u)
+			}
+		}
+	}()
+}
+
+func newUsageSampler(cg cgroupInfo) *usageSampler {
+	return &usageSampler{
+		cg: cg,
+		metrics: []metrics.Sample{
+			{Name: "/memory/classes/heap/objects:bytes"},
+			{Name: "/sched/goroutines:goroutines"},
+		},
+	}
+}
+
+func (s *usageSampler) sample(now time.Time) usageSample {
+	u := usageSample{Time: now}
+	elapsed := now.Sub(s.last).Seconds()
+	first := s.last.IsZero()
+	s.last = now
+
+	metrics.Read(s.metrics)
+	u.HeapBytes = s.metrics[0].Value.Uint64()
+	u.Goroutines = int(s.metrics[1].Value.Uint64())
+	if u.Goroutines == 0 {
+		u.Goroutines = runtime.NumGoroutine()
+	}
+
+	if cpu, rss, err := readProcSelfStat(); err == nil {
+		if !first && elapsed > 0 {
+			u.CPUPercent = (cpu - s.lastCPU) / elapsed * 100
+		}
+		s.lastCPU = cpu
+		u.RSSBytes = rss
+	}
+	if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+		u.OpenFDs = len(entries)
+	}
+
+	if mem, err := s.cg.readMemoryCurrent(); err == nil {
+		u.CgroupMemoryBytes = mem
+	}
+	if ws, err := s.cg.readWorkingSet(); err == nil {
+		u.WorkingSetBytes = ws
+	}
+	if st, err := s.cg.readCPUStat(); err == nil {
+		if !first && elapsed > 0 {
+			u.CgroupCPUPercent = float64(delta(s.lastCgCPU, st.UsageUsec)) / 1e6 / elapsed * 100
+			u.CgroupThrottled = delta(s.lastThrot, st.NrThrottled)
+		}
+		s.lastCgCPU, s.lastThrot = st.UsageUsec, st.NrThrottled
+	}
+	return u
+}
+
+// readProcSelfStat returns the process's user+system CPU seconds and its
+// resident set size.
+func readProcSelfStat() (cpuSeconds float64, rssBytes uint64, err error) {
+	data, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	// The command name is parenthesised and may contain spaces, so
+	// split after the last ')'. Fields then start at state (field 3).
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("malformed /proc/self/stat")
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 22 {
+		return 0, 0, fmt.Errorf("short /proc/self/stat")
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64) // field 14
+	stime, _ := strconv.ParseUint(fields[12], 10, 64) // field 15
+	rss, _ := strconv.ParseUint(fields[21], 10, 64)   // field 24, in pages
+	return float64(utime+stime) / clockTicks, rss * uint64(os.Getpagesize()), nil
+}
+
+// downsample merges samples into step-wide buckets. Rates are averaged,
+// gauges keep their peak (a spike must survive downsampling) and
+// throttled periods are summed.
+func downsample(samples []usageSample, step time.Duration) []usageSample {
+	if step <= 0 || len(samples) == 0 {
+		return samples
+	}
+	var out []usageSample
+	var cur usageSample
+	var n int
+	var bucket time.Time
+	flush := func() {
+		if n == 0 {
+			return
+		}
+		cur.Time = bucket
+		cur.CPUPercent /= float64(n)
+		cur.CgroupCPUPercent /= float64(n)
+		out = append(out, cur)
+	}
+	for _, s := range samples {
+		b := s.Time.Truncate(step)
+		if n > 0 && !b.Equal(bucket) {
+			flush()
+			cur, n = usageSample{}, 0
+		}
+		bucket = b
+		n++
+		cur.CPUPercent += s.CPUPercent
+		cur.CgroupCPUPercent += s.CgroupCPUPercent
+		cur.CgroupThrottled += s.CgroupThrottled
+		cur.RSSBytes = max(cur.RSSBytes, s.RSSBytes)
+		cur.HeapBytes = max(cur.HeapBytes, s.HeapBytes)
+		cur.Goroutines = max(cur.Goroutines, s.Goroutines)
+		cur.OpenFDs = max(cur.OpenFDs, s.OpenFDs)
+		cur.CgroupMemoryBytes = max(cur.CgroupMemoryBytes, s.CgroupMemoryBytes)
+		cur.WorkingSetBytes = max(cur.WorkingSetBytes, s.WorkingSetBytes)
+	}
+	flush()
+	return out
+}
+
+// resourceHistoryHandler serves the recorded history as JSON, optionally
+// limited with ?window=15m and downsampled with ?step=10s. With
+// ?stream=1 or Accept: text/event-stream it streams new samples live.
+func resourceHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if usageHistory == nil {
+		http.Error(w, "resource history is disabled", http.StatusNotFound)
+		return
+	}
+	if wantsEventStream(r) {
+		streamUsage(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	var window, step time.Duration
+	for _, p := range []struct {
+		name string
+		dst  *time.Duration
+	}{{"window", &window}, {"step", &step}} {
+		if v := q.Get(p.name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				http.Error(w, "invalid "+p.name+": "+v, http.StatusBadRequest)
+				return
+			}
+			*p.dst = d
+		}
+	}
+
+	samples := usageHistory.recent()
+	if window > 0 {
+		cutoff := time.Now().Add(-window)
+		i := 0
+		for i < len(samples) && samples[i].Time.Before(cutoff) {
+			i++
+		}
+		samples = samples[i:]
+	}
+	samples = downsample(samples, step)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Step    string        `json:"step,omitempty"`
+		Samples []usageSample `json:"samples"`
+	}{q.Get("step"), samples})
+}
+
+func streamUsage(w http.ResponseWriter, r *http.Request) {
+	samples, cancel := usageHistory.subscribe()
+	defer cancel()
+	sse, ok := startEventStream(w)
+	if !ok {
+		return
+	}
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case s := <-samples:
+			if sse.send("usage", s) != nil {
+				return
+			}
+		case <-keepalive.C:
+			if sse.comment("keepalive") != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ResourceEvent is emitted when the cgroup reports pressure the service
+// would otherwise never notice: CPU throttling, memory reclaim or OOM
+// kills, and PSI stalls.
+type ResourceEvent struct {
+	Time     time.Time          `json:"time"`
+	Kind     string             `json:"kind"`
+	Severity string             `json:"severity"`
+	Message  string             `json:"message"`
+	Values   map[string]float64 `json:"values,omitempty"`
+}
+
+var (
+	resourceEventsTotal = registry.counter("resource_events_total",
+		"Resource events raised by the cgroup watcher.", "kind")
+	cgroupThrottledPeriods = registry.counter("cgroup_cpu_throttled_periods_total",
+		"CFS periods in which the cgroup was throttled.")
+	cgroupThrottledSeconds = registry.counter("cgroup_cpu_throttled_seconds_total",
+		"Time the cgroup spent throttled.")
+	cgroupMemoryEvents = registry.counter("cgroup_memory_events_total",
+		"memory.events counters: high, max, oom and oom_kill.", "event")
+	cgroupPressure = registry.gauge("cgroup_pressure_avg10_percent",
+		"PSI share of the last 10s in which tasks stalled on a resource.", "resource", "kind")
+)
+
+// resourceWatcher samples the cgroup and turns counter deltas into events.
+type resourceWatcher struct {
+	cg            cgroupInfo
+	interval      time.Duration
+	throttleRatio float64
+	psiThreshold  float64
+	events        *broadcastRing[ResourceEvent]
+
+	primed  bool
+	prevCPU cpuStat
+	prevMem memoryEvents
+	stalled map[string]bool
+}
+
+var resourceEvents = newBroadcastRing[ResourceEvent](256)
+
+// startResourceWatcher runs the watcher in the background. It is on by
+// default; RESOURCE_WATCH=false turns it off.
+func startResourceWatcher(ctx context.Context) {
+	if on, err := strconv.ParseBool(envOr("RESOURCE_WATCH", "true")); err == nil && !on {
+		return
+	}
+	w := &resourceWatcher{
+		cg:            detectCgroup(),
+		interval:      envDuration("RESOURCE_WATCH_INTERVAL", 5*time.Second),
+		throttleRatio: envFloat("RESOURCE_THROTTLE_RATIO", 0.1),
+		psiThreshold:  envFloat("RESOURCE_PSI_THRESHOLD", 10),
+		events:        resourceEvents,
+		stalled:       make(map[string]bool),
+	}
+	if w.cg.Version == 0 {
+		log.Printf("Resource watcher disabled: no cgroup found under %s", cgroupMount)
+		return
+	}
+	log.Printf("Resource watcher sampling cgroup v%d every %s", w.cg.Version, w.interval)
+	go w.run(ctx)
+}
+
+func (w *resourceWatcher) run(ctx context.Context) {
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		for _, ev := range w.sample(time.Now()) {
+			w.emit(ev)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (w *resourceWatcher) emit(ev ResourceEvent) {
+	resourceEventsTotal.with(ev.Kind).inc()
+	attrs := []any{"kind", ev.Kind}
+	keys := make([]string, 0, len(ev.Values))
+	for k := range ev.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		attrs = append(attrs, k, ev.Values[k])
+	}
+	level := slog.LevelWarn
+	if ev.Severity == "critical" {
+		level = slog.LevelError
+	} else if ev.Severity == "info" {
+		level = slog.LevelInfo
+	}
+	slog.Log(context.Background(), level, ev.Message, attrs...)
+	w.events.publish(ev)
+}
+
+// sample reads the cgroup once and returns the events implied by the
+// change since the previous sample. The first call only primes the
+// baseline so pre-existing counts do not fire.
+func (w *resourceWatcher) sample(now time.Time) []ResourceEvent {
+	var events []ResourceEvent
+
+	if cur, err := w.cg.readCPUStat(); err == nil {
+		if w.primed {
+			events = append(events, w.cpuEvents(now, w.prevCPU, cur)...)
+		}
+		w.prevCPU = cur
+	}
+	if cur, err := w.cg.readMemoryEvents(); err == nil {
+		if w.primed {
+			events = append(events, w.memoryEvents(now, w.prevMem, cur)...)
+		}
+		w.prevMem = cur
+	}
+	for _, res := range []string{"cpu", "memory", "io"} {
+		some, full, err := w.cg.readPressure(res)
+		if err != nil {
+			continue
+		}
+		cgroupPressure.with(res, "some").set(some.Avg10)
+		cgroupPressure.with(res, "full").set(full.Avg10)
+		if ev, ok := w.pressureEvent(now, res, some); ok {
+			events = append(events, ev)
+		}
+	}
+	w.primed = true
+	return events
+}
+
+func (w *resourceWatcher) cpuEvents(now time.Time, prev, cur cpuStat) []ResourceEvent {
+	periods := delta(prev.NrPeriods, cur.NrPeriods)
+	throttled := delta(prev.NrThrottled, cur.NrThrottled)
+	throttledUsec := delta(prev.ThrottledUsec, cur.ThrottledUsec)
+	cgroupThrottledPeriods.with().add(float64(throttled))
+	cgroupThrottledSeconds.with().add(float64(throttledUsec) / 1e6)
+
+	if throttled == 0 || periods == 0 {
+		return nil
+	}
+	ratio := float64(throttled) / float64(periods)
+	if ratio < w.throttleRatio {
+		return nil
+	}
+	return []ResourceEvent{{
+		Time:     now,
+		Kind:     "cpu_throttled",
+		Severity: "warning",
+		Message:  fmt.Sprintf("CPU throttled in %d of %d periods (%.0f%%)", throttled, periods, ratio*100),
+		Values: map[string]float64{
+			"nr_periods":     float64(periods),
+			"nr_throttled":   float64(throttled),
+			"throttled_usec": float64(throttledUsec),
+			"ratio":          ratio,
+		},
+	}}
+}
+
+func (w *resourceWatcher) memoryEvents(now time.Time, prev, cur memoryEvents) []ResourceEvent {
+	var events []ResourceEvent
+	for _, c := range []struct {
+		event, kind, severity, msg string
+		prev, cur                  uint64
+	}{
+		{"high", "memory_high", "warning", "memory.high exceeded, reclaim is throttling allocations", prev.High, cur.High},
+		{"max", "memory_max", "warning", "memory.max reached, allocations are failing or reclaiming", prev.Max, cur.Max},
+		{"oom", "oom", "critical", "cgroup ran out of memory", prev.OOM, cur.OOM},
+		{"oom_kill", "oom_kill", "critical", "a process in the cgroup was OOM-killed", prev.OOMKill, cur.OOMKill},
+	} {
+		d := delta(c.prev, c.cur)
+		if d == 0 {
+			continue
+		}
+		cgroupMemoryEvents.with(c.event).add(float64(d))
+		events = append(events, ResourceEvent{
+			Time:     now,
+			Kind:     c.kind,
+			Severity: c.severity,
+			Message:  c.msg,
+			Values:   map[string]float64{"count": float64(d), "total": float64(c.cur)},
+		})
+	}
+	return events
+}
+
+// pressureEvent fires once when avg10 rises above the threshold and once
+// when it falls back, rather than on every sample in between.
+func (w *resourceWatcher) pressureEvent(now time.Time, resource string, some pressure) (ResourceEvent, bool) {
+	high := some.Avg10 >= w.psiThreshold
+	if high == w.stalled[resource] {
+		return ResourceEvent{}, false
+	}
+	w.stalled[resource] = high
+	ev := ResourceEvent{
+		Time:   now,
+		Kind:   resource + "_pressure",
+		Values: map[string]float64{"avg10": some.Avg10, "avg60": some.Avg60, "threshold": w.psiThreshold},
+	}
+	if high {
+		ev.Severity = "warning"
+		ev.Message = fmt.Sprintf("%s pressure: tasks stalled %.1f%% of the last 10s", resource, some.Avg10)
+	} else {
+		ev.Severity = "info"
+		ev.Message = fmt.Sprintf("%s pressure back below %.1f%%", resource, w.psiThreshold)
+	}
+	return ev, true
+}
+
+// delta tolerates counters that reset, e.g. after the cgroup is recreated.
+func delta(prev, cur uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// resourceEventsHandler returns recent events as JSON, or streams them as
+// server-sent events when the client asks for text/event-stream.
+func resourceEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !wantsEventStream(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Cgroup cgroupInfo      `json:"cgroup"`
+			Events []ResourceEvent `json:"events"`
+		}{detectCgroup(), resourceEvents.recent()})
+		return
+	}
+
+	events, cancel := resourceEvents.subscribe()
+	defer cancel()
+	sse, ok := startEventStream(w)
+	if !ok {
+		return
+	}
+	for _, ev := range resourceEvents.recent() {
+		sse.send("resource", ev)
+	}
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			if sse.send("resource", ev) != nil {
+				return
+			}
+		case <-keepalive.C:
+			if sse.comment("keepalive") != nil {
+				return
+			}
+		}
+	}
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+func envFloat(key string, def float64) float64 {
+	if f, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return f
+	}
+	return def
+}
@@ -0,0 +1,56 @@
+package main
+
+import "sync"
+
+// broadcastRing keeps the last N values published and fans new ones out to
+// live subscribers. It backs the resource event stream and usage history.
+type broadcastRing[T any] struct {
+	mu   sync.Mutex
+	buf  []T
+	next int
+	full bool
+	subs map[chan T]struct{}
+}
+
+func newBroadcastRing[T any](size int) *broadcastRing[T] {
+	return &broadcastRing[T]{buf: make([]T, size), subs: make(map[chan T]struct{})}
+}
+
+func (r *broadcastRing[T]) publish(v T) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf[r.next] = v
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+	for ch := range r.subs {
+		select {
+		case ch <- v:
+		default:
+			// A slow reader misses values rather than stalling the producer.
+		}
+	}
+}
+
+// recent returns the buffered values, oldest first.
+func (r *broadcastRing[T]) recent() []T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]T{}, r.buf[:r.next]...)
+	}
+	return append(append([]T{}, r.buf[r.next:]...), r.buf[:r.next]...)
+}
+
+func (r *broadcastRing[T]) subscribe() (<-chan T, func()) {
+	ch := make(chan T, 16)
+	r.mu.Lock()
+	r.subs[ch] = struct{}{}
+	r.mu.Unlock()
+	return ch, func() {
+		r.mu.Lock()
+		delete(r.subs, ch)
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testBuildInfo() *debug.BuildInfo {
+	return &debug.BuildInfo{
+		GoVersion: "go1.21.5",
+		Path:      "example.com/app",
+		Main:      debug.Module{Path: "example.com/app", Version: "(devel)"},
+		Deps: []*debug.Module{
+			{Path: "github.com/labstack/echo/v4", Version: "v4.10.2", Sum: "h1:n1jAhnq/elIFTHr1EYpiYtyKgx4RW9ccVgkqByZaN2M="},
+			{Path: "golang.org/x/net", Version: "v0.8.0", Sum: "h1:Zrh2ngAOFYneWTAIAPethzeaQLuHwhuBkuV6ZiRnUaQ=",
+				Replace: &debug.Module{Path: "golang.org/x/net", Version: "v0.8.1", Sum: "h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}},
+			{Path: "example.com/local", Version: "v1.0.0", Replace: &debug.Module{Path: "../local"}},
+		},
+		Settings: []debug.BuildSetting{{Key: "CGO_ENABLED", Value: "0"}, {Key: "-trimpath", Value: "true"}},
+	}
+}
+
+func TestSBOMVerifiesAgainstGoSum(t *testing.T) {
+	info := testBuildInfo()
+	sums := map[string]string{
+		"github.com/labstack/echo/v4 v4.10.2": "h1:n1jAhnq/elIFTHr1EYpiYtyKgx4RW9ccVgkqByZaN2M=",
+		"golang.org/x/net v0.8.1":             "h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+	}
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for name, tc := range map[string]struct {
+		doc      any
+		replaced string
+	}{
+		"cyclonedx": {newCycloneDX(info, at), `"go:replaces","value":"golang.org/x/net@v0.8.0"`},
+		"spdx":      {newSPDX(info, at), `"sourceInfo":"replaces golang.org/x/net@v0.8.0"`},
+	} {
+		data, err := json.Marshal(tc.doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"pkg:golang/stdlib@1.21.5", "-trimpath", tc.replaced} {
+			if !strings.Contains(string(data), want) {
+				t.Errorf("%s SBOM does not contain %q", name, want)
+			}
+		}
+
+		verified, problems, absent, err := verifySBOM(data, sums)
+		if err != nil || verified != 2 || len(problems) != 0 || len(absent) != 0 {
+			t.Errorf("%s: verified %d, problems %v, absent %v, err %v; want 2 modules verified", name, verified, problems, absent, err)
+		}
+
+		tampered := map[string]string{
+			"github.com/labstack/echo/v4 v4.10.2": "h1:Zrh2ngAOFYneWTAIAPethzeaQLuHwhuBkuV6ZiRnUaQ=",
+			"github.com/test/only v1.0.0":         "h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+		}
+		_, problems, absent, _ = verifySBOM(data, tampered)
+		if len(problems) != 3 {
+			t.Errorf("%s against tampered go.sum: problems %v; want a mismatch, a missing module and nothing verified", name, problems)
+		}
+		if len(absent) != 1 || absent[0] != "github.com/test/only@v1.0.0" {
+			t.Errorf("%s: absent %v; want the go.sum module the SBOM leaves out", name, absent)
+		}
+	}
+}
+
+// An SBOM with its checksums removed must not pass.
+func TestSBOMVerifyWithoutChecksums(t *testing.T) {
+	info := testBuildInfo()
+	for _, d := range info.Deps {
+		d.Sum = ""
+		if d.Replace != nil {
+			d.Replace.Sum = ""
+		}
+	}
+	data, err := json.Marshal(newCycloneDX(info, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sums := map[string]string{"github.com/labstack/echo/v4 v4.10.2": "h1:n1jAhnq/elIFTHr1EYpiYtyKgx4RW9ccVgkqByZaN2M="}
+	verified, problems, _, err := verifySBOM(data, sums)
+	if err != nil || verified != 0 || len(problems) != 2 {
+		t.Errorf("verified %d, problems %v, err %v; want echo reported unchecked and nothing verified", verified, problems, err)
+	}
+}
+
+func TestSumSHA256(t *testing.T) {
+	got := sumSHA256("h1:n1jAhnq/elIFTHr1EYpiYtyKgx4RW9ccVgkqByZaN2M=")
+	if len(got) != 64 || !strings.HasPrefix(got, "9f58c086") {
+		t.Errorf("sumSHA256 = %q", got)
+	}
+	if got := sumSHA256("h2:abc"); got != "" {
+		t.Errorf("sumSHA256 of unknown hash = %q; want empty", got)
+	}
+	if got := proxyURL("github.com/BurntSushi/toml", "v1.2.0"); got != "https://proxy.golang.org/github.com/!burnt!sushi/toml/@v/v1.2.0.zip" {
+		t.Errorf("proxyURL = %q", got)
+	}
+}
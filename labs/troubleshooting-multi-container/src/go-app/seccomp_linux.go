@@ -0,0 +1,167 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	ptraceOExitKill  = 0x100000 // PTRACE_O_EXITKILL
+	syscallStopTrap  = syscall.SIGTRAP | 0x80
+	ptraceTraceFlags = syscall.PTRACE_O_TRACESYSGOOD | syscall.PTRACE_O_TRACECLONE |
+		syscall.PTRACE_O_TRACEFORK | syscall.PTRACE_O_TRACEVFORK |
+		syscall.PTRACE_O_TRACEEXEC | ptraceOExitKill
+)
+
+func knownSyscall(name string) bool {
+	for _, n := range syscallNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// traceServer starts binary under ptrace, exercises it with the route
+// checks, stops it with SIGTERM and returns the names of every syscall
+// any of its threads made.
+func traceServer(binary string, args []string, iterations int, settle, startTimeout time.Duration) ([]string, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	type traceResult struct {
+		nums map[uint64]bool
+		err  error
+	}
+	started := make(chan int, 1)
+	done := make(chan traceResult, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// ptrace requests must come from the thread that started the
+		// tracee, so the whole trace runs on one locked OS thread.
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		nums, err := ptraceRun(binary, args, port, started)
+		done <- traceResult{nums, err}
+		// Unblocks driveServer if the server dies during startup.
+		cancel()
+	}()
+
+	var pid int
+	select {
+	case pid = <-started:
+	case res := <-done:
+		return nil, res.err
+	}
+
+	driveErr := driveServer(ctx, port, iterations, startTimeout)
+	if driveErr == nil {
+		time.Sleep(settle)
+	}
+	syscall.Kill(pid, syscall.SIGTERM)
+
+	var res traceResult
+	select {
+	case res = <-done:
+	case <-time.After(10 * time.Second):
+		syscall.Kill(pid, syscall.SIGKILL)
+		res = <-done
+	}
+	if driveErr != nil {
+		return nil, driveErr
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	names := make([]string, 0, len(res.nums))
+	for n := range res.nums {
+		name, ok := syscallNames[n]
+		if !ok {
+			name = "syscall_" + strconv.FormatUint(n, 10)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// ptraceRun forks binary as a tracee and records syscall numbers until every
+// traced thread and process has exited.
+func ptraceRun(binary string, args []string, port int, started chan<- int) (map[uint64]bool, error) {
+	env := append(os.Environ(), "PORT="+strconv.Itoa(port))
+	proc, err := os.StartProcess(binary, append([]string{binary}, args...), &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{nil, os.Stderr, os.Stderr},
+		Sys:   &syscall.SysProcAttr{Ptrace: true, Pdeathsig: syscall.SIGKILL},
+	})
+	if err != nil {
+		return nil, err
+	}
+	pid := proc.Pid
+	proc.Release()
+
+	// The tracee stops with SIGTRAP right after exec.
+	var ws syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &ws, syscall.WALL, nil); err != nil {
+		return nil, err
+	}
+	if err := syscall.PtraceSetOptions(pid, ptraceTraceFlags); err != nil {
+		syscall.Kill(pid, syscall.SIGKILL)
+		return nil, err
+	}
+	if err := syscall.PtraceSyscall(pid, 0); err != nil {
+		syscall.Kill(pid, syscall.SIGKILL)
+		return nil, err
+	}
+	started <- pid
+
+	nums := make(map[uint64]bool)
+	known := map[int]bool{pid: true}
+	var regs syscall.PtraceRegs
+	for {
+		tid, err := syscall.Wait4(-1, &ws, syscall.WALL, nil)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if errors.Is(err, syscall.ECHILD) {
+			return nums, nil
+		}
+		if err != nil {
+			return nums, err
+		}
+		if ws.Exited() || ws.Signaled() {
+			delete(known, tid)
+			continue
+		}
+		if !ws.Stopped() {
+			continue
+		}
+
+		sig := ws.StopSignal()
+		deliver := 0
+		switch {
+		case sig == syscallStopTrap:
+			if syscall.PtraceGetRegs(tid, &regs) == nil {
+				nums[syscallNumber(&regs)] = true
+			}
+		case sig == syscall.SIGTRAP && ws.TrapCause() != 0:
+			// clone, fork or exec event; the new task reports
+			// itself with its own initial SIGSTOP.
+		case sig == syscall.SIGSTOP && !known[tid]:
+			known[tid] = true
+		default:
+			deliver = int(sig)
+		}
+		// ESRCH means the task died between the stop and now.
+		syscall.PtraceSyscall(tid, deliver)
+	}
+}
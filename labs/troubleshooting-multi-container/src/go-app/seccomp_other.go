@@ -0,0 +1,17 @@
+//go:build !linux || !(amd64 || arm64)
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+const seccompArch = ""
+
+func knownSyscall(name string) bool { return false }
+
+func traceServer(binary string, args []string, iterations int, settle, startTimeout time.Duration) ([]string, error) {
+	return nil, fmt.Errorf("syscall tracing needs linux/amd64 or linux/arm64, not %s/%s", runtime.GOOS, runtime.GOARCH)
+}
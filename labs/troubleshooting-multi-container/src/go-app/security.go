@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// capNames maps capability bit numbers to their names, per
+// <linux/capability.h>.
+var capNames = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_DAC_READ_SEARCH", "CAP_FOWNER",
+	"CAP_FSETID", "CAP_KILL", "CAP_SETGID", "CAP_SETUID",
+	"CAP_SETPCAP", "CAP_LINUX_IMMUTABLE", "CAP_NET_BIND_SERVICE", "CAP_NET_BROADCAST",
+	"CAP_NET_ADMIN", "CAP_NET_RAW", "CAP_IPC_LOCK", "CAP_IPC_OWNER",
+	"CAP_SYS_MODULE", "CAP_SYS_RAWIO", "CAP_SYS_CHROOT", "CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT", "CAP_SYS_ADMIN", "CAP_SYS_BOOT", "CAP_SYS_NICE",
+	"CAP_SYS_RESOURCE", "CAP_SYS_TIME", "CAP_SYS_TTY_CONFIG", "CAP_MKNOD",
+	"CAP_LEASE", "CAP_AUDIT_WRITE", "CAP_AUDIT_CONTROL", "CAP_SETFCAP",
+	"CAP_MAC_OVERRIDE", "CAP_MAC_ADMIN", "CAP_SYSLOG", "CAP_WAKE_ALARM",
+	"CAP_BLOCK_SUSPEND", "CAP_AUDIT_READ", "CAP_PERFMON", "CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+// dangerousCaps are capabilities that amount to, or trivially lead to,
+// control of the host. None of them is in Docker's default set.
+var dangerousCaps = map[string]bool{
+	"CAP_SYS_ADMIN":       true,
+	"CAP_SYS_MODULE":      true,
+	"CAP_SYS_RAWIO":       true,
+	"CAP_SYS_PTRACE":      true,
+	"CAP_SYS_BOOT":        true,
+	"CAP_SYS_TIME":        true,
+	"CAP_NET_ADMIN":       true,
+	"CAP_DAC_READ_SEARCH": true,
+	"CAP_MAC_ADMIN":       true,
+	"CAP_MAC_OVERRIDE":    true,
+	"CAP_BPF":             true,
+	"CAP_PERFMON":         true,
+	"CAP_SYSLOG":          true,
+}
+
+var seccompModes = map[string]string{"0": "disabled", "1": "strict", "2": "filter"}
+
+type CapSet struct {
+	Raw   string   `json:"raw"`
+	Names []string `json:"names"`
+}
+
+type SecurityReport struct {
+	UID            []int             `json:"uid"`
+	GID            []int             `json:"gid"`
+	Groups         []int             `json:"groups"`
+	Capabilities   map[string]CapSet `json:"capabilities"`
+	NoNewPrivs     bool              `json:"no_new_privs"`
+	Seccomp        string            `json:"seccomp"`
+	LSM            string            `json:"lsm,omitempty"`
+	LSMLabel       string            `json:"lsm_label,omitempty"`
+	ReadOnlyRootfs bool              `json:"read_only_rootfs"`
+	RootfsProbe    string            `json:"rootfs_probe"`
+	Warnings       []string          `json:"warnings,omitempty"`
+}
+
+// checkSecurityPosture logs the runtime posture at startup. With
+// SECURITY_STRICT=true it refuses to start as root or with dangerous
+// capabilities instead of only warning about them.
+func checkSecurityPosture() {
+	report := collectSecurityReport()
+	log.Printf("Security posture: %s", report.summary())
+	for _, w := range report.Warnings {
+		log.Printf("Security warning: %s", w)
+	}
+
+	strict, _ := strconv.ParseBool(os.Getenv("SECURITY_STRICT"))
+	if violations := report.strictViolations(); strict && len(violations) > 0 {
+		log.Fatalf("Refusing to start in strict security mode: %s", strings.Join(violations, "; "))
+	}
+}
+
+func securityHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(collectSecurityReport())
+}
+
+// collectSecurityReport inspects the running process. It only reads
+// /proc and probes the root filesystem, so it is safe to call per request.
+func collectSecurityReport() SecurityReport {
+	r := SecurityReport{
+		Capabilities: make(map[string]CapSet),
+		Seccomp:      "unknown",
+	}
+	if err := r.readProcStatus("/proc/self/status"); err != nil {
+		// Not Linux, or /proc is not mounted; fall back to what the
+		// os package can tell us.
+		r.UID = []int{os.Getuid(), os.Geteuid()}
+		r.GID = []int{os.Getgid(), os.Getegid()}
+		r.Warnings = append(r.Warnings, "cannot read /proc/self/status: "+err.Error())
+	}
+	r.LSM, r.LSMLabel = readLSMLabel()
+	r.ReadOnlyRootfs, r.RootfsProbe = probeRootfs("/")
+	r.Warnings = append(r.Warnings, r.findings()...)
+	return r
+}
+
+func (r *SecurityReport) readProcStatus(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		key, value, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Uid":
+			r.UID = parseInts(value)
+		case "Gid":
+			r.GID = parseInts(value)
+		case "Groups":
+			r.Groups = parseInts(value)
+		case "CapInh", "CapPrm", "CapEff", "CapBnd", "CapAmb":
+			set, err := decodeCaps(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			r.Capabilities[capSetNames[key]] = set
+		case "NoNewPrivs":
+			r.NoNewPrivs = value == "1"
+		case "Seccomp":
+			if mode, ok := seccompModes[value]; ok {
+				r.Seccomp = mode
+			}
+		}
+	}
+	return sc.Err()
+}
+
+var capSetNames = map[string]string{
+	"CapInh": "inheritable",
+	"CapPrm": "permitted",
+	"CapEff": "effective",
+	"CapBnd": "bounding",
+	"CapAmb": "ambient",
+}
+
+// decodeCaps turns a hex capability mask such as 00000000a80425fb into
+// capability names. Bits newer than capNames are reported by number.
+func decodeCaps(hex string) (CapSet, error) {
+	mask, err := strconv.ParseUint(hex, 16, 64)
+	if err != nil {
+		return CapSet{}, err
+	}
+	set := CapSet{Raw: hex, Names: []string{}}
+	for mask != 0 {
+		bit := bits.TrailingZeros64(mask)
+		mask &^= 1 << bit
+		if bit < len(capNames) {
+			set.Names = append(set.Names, capNames[bit])
+		} else {
+			set.Names = append(set.Names, "CAP_"+strconv.Itoa(bit))
+		}
+	}
+	return set, nil
+}
+
+func parseInts(s string) []int {
+	out := []int{}
+	for _, f := range strings.Fields(s) {
+		if n, err := strconv.Atoi(f); err == nil {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// readLSMLabel returns the AppArmor profile or SELinux context the process
+// is confined by, if any.
+func readLSMLabel() (lsm, label string) {
+	for _, path := range []string{"/proc/self/attr/apparmor/current", "/proc/self/attr/current"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		label = strings.TrimRight(string(data), "\x00\n")
+		if label == "" {
+			continue
+		}
+		if _, err := os.Stat("/sys/fs/selinux"); err == nil || strings.Count(label, ":") >= 3 {
+			return "selinux", label
+		}
+		return "apparmor", label
+	}
+	return "", ""
+}
+
+// probeRootfs decides whether dir is read-only by trying to create a file
+// in it. EROFS is conclusive; a permission error only tells us this user
+// cannot write there, so the mount flags are consulted as well.
+func probeRootfs(dir string) (readOnly bool, detail string) {
+	f, err := os.CreateTemp(dir, ".security-probe-*")
+	if err == nil {
+		name := f.Name()
+		f.Close()
+		os.Remove(name)
+		return false, "write succeeded"
+	}
+	if errors.Is(err, syscall.EROFS) {
+		return true, "read-only file system"
+	}
+	if ro, ok := mountReadOnly("/proc/self/mountinfo", dir); ok {
+		if ro {
+			return true, "mounted ro; write failed: " + unwrapPathError(err)
+		}
+		return false, "mounted rw; write failed: " + unwrapPathError(err)
+	}
+	return false, "write failed: " + unwrapPathError(err)
+}
+
+// mountReadOnly reports whether the mount at mountPoint has the ro option.
+func mountReadOnly(mountinfo, mountPoint string) (readOnly, found bool) {
+	f, err := os.Open(mountinfo)
+	if err != nil {
+		return false, false
+	}
+	defer f.Close()
+
+	mountPoint = filepath.Clean(mountPoint)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 6 || fields[4] != mountPoint {
+			continue
+		}
+		// Later entries shadow earlier ones at the same mount point.
+		readOnly, found = false, true
+		for _, opt := range strings.Split(fields[5], ",") {
+			if opt == "ro" {
+				readOnly = true
+			}
+		}
+	}
+	return readOnly, found
+}
+
+func unwrapPathError(err error) string {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		return pe.Err.Error()
+	}
+	return err.Error()
+}
+
+// findings lists the ways this process is more privileged than the
+// multi-stage image intends (nonroot, no capabilities, read-only root).
+func (r *SecurityReport) findings() []string {
+	var out []string
+	if r.runsAsRoot() {
+		out = append(out, "running as root (uid 0)")
+	}
+	if caps := r.dangerousCaps(); len(caps) > 0 {
+		out = append(out, "dangerous capabilities available: "+strings.Join(caps, ", "))
+	}
+	if !r.NoNewPrivs {
+		out = append(out, "no_new_privs is not set")
+	}
+	if r.Seccomp == "disabled" {
+		out = append(out, "seccomp is disabled")
+	}
+	if !r.ReadOnlyRootfs {
+		out = append(out, "root filesystem is not read-only")
+	}
+	return out
+}
+
+func (r *SecurityReport) runsAsRoot() bool {
+	// UID is real, effective, saved, filesystem; any zero is root-capable.
+	for _, id := range r.UID {
+		if id == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *SecurityReport) dangerousCaps() []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, set := range []string{"effective", "permitted", "ambient"} {
+		for _, name := range r.Capabilities[set].Names {
+			if dangerousCaps[name] && !seen[name] {
+				seen[name] = true
+				out = append(out, name)
+			}
+		}
+	}
+	return out
+}
+
+// strictViolations returns the reasons strict mode refuses to start.
+func (r *SecurityReport) strictViolations() []string {
+	var out []string
+	if r.runsAsRoot() {
+		out = append(out, "process runs as root")
+	}
+	if caps := r.dangerousCaps(); len(caps) > 0 {
+		out = append(out, "process holds "+strings.Join(caps, ", "))
+	}
+	return out
+}
+
+func (r *SecurityReport) summary() string {
+	eff := "none"
+	if names := r.Capabilities["effective"].Names; len(names) > 0 {
+		eff = strings.Join(names, ",")
+	}
+	rootfs := "rw"
+	if r.ReadOnlyRootfs {
+		rootfs = "ro"
+	}
+	label := r.LSM
+	if label == "" {
+		label = "none"
+	} else {
+		label += "=" + r.LSMLabel
+	}
+	return fmt.Sprintf("uid=%v gid=%v caps=%s no_new_privs=%t seccomp=%s lsm=%s rootfs=%s",
+		r.UID, r.GID, eff, r.NoNewPrivs, r.Seccomp, label, rootfs)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const procStatusNonroot = `Name:	server
+Umask:	0022
+State:	S (sleeping)
+Uid:	65532	65532	65532	65532
+Gid:	65532	65532	65532	65532
+Groups:	65532
+NoNewPrivs:	1
+Seccomp:	2
+Seccomp_filters:	1
+CapInh:	0000000000000000
+CapPrm:	0000000000000000
+CapEff:	0000000000000000
+CapBnd:	00000000a80425fb
+CapAmb:	0000000000000000
+`
+
+func TestDecodeCapsDockerDefault(t *testing.T) {
+	set, err := decodeCaps("00000000a80425fb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_FOWNER", "CAP_FSETID", "CAP_KILL",
+		"CAP_SETGID", "CAP_SETUID", "CAP_SETPCAP", "CAP_NET_BIND_SERVICE", "CAP_NET_RAW",
+		"CAP_SYS_CHROOT", "CAP_MKNOD", "CAP_AUDIT_WRITE", "CAP_SETFCAP",
+	}
+	if !reflect.DeepEqual(set.Names, want) {
+		t.Errorf("got %v, want %v", set.Names, want)
+	}
+}
+
+func TestReadProcStatus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status")
+	if err := os.WriteFile(path, []byte(procStatusNonroot), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r := SecurityReport{Capabilities: make(map[string]CapSet)}
+	if err := r.readProcStatus(path); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.UID, []int{65532, 65532, 65532, 65532}) {
+		t.Errorf("uid = %v", r.UID)
+	}
+	if !r.NoNewPrivs || r.Seccomp != "filter" {
+		t.Errorf("no_new_privs = %v, seccomp = %q; want true, filter", r.NoNewPrivs, r.Seccomp)
+	}
+	if n := len(r.Capabilities["bounding"].Names); n != 14 {
+		t.Errorf("bounding set has %d caps; want 14", n)
+	}
+	if v := r.strictViolations(); len(v) != 0 {
+		t.Errorf("strict violations for nonroot: %v", v)
+	}
+}
+
+func TestStrictViolations(t *testing.T) {
+	admin, _ := decodeCaps("0000000000200000")
+	r := SecurityReport{
+		UID:          []int{0, 0, 0, 0},
+		Capabilities: map[string]CapSet{"effective": admin},
+	}
+	v := r.strictViolations()
+	if len(v) != 2 || !strings.Contains(v[1], "CAP_SYS_ADMIN") {
+		t.Errorf("got %v; want root and CAP_SYS_ADMIN violations", v)
+	}
+}
+
+func TestMountReadOnly(t *testing.T) {
+	mountinfo := `22 1 0:21 / / rw,relatime - overlay overlay rw
+23 22 0:22 / /proc rw,nosuid - proc proc rw
+24 1 0:21 / / ro,relatime - overlay overlay ro
+`
+	path := filepath.Join(t.TempDir(), "mountinfo")
+	if err := os.WriteFile(path, []byte(mountinfo), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ro, found := mountReadOnly(path, "/")
+	if !found || !ro {
+		t.Errorf("got ro=%v found=%v; want the last / entry to win", ro, found)
+	}
+	if _, found := mountReadOnly(path, "/data"); found {
+		t.Errorf("found a mount for /data")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// servertiming.go reports where a request's time went in a Server-Timing
+// header, so a client benchmarking through nginx can split the latency it
+// sees between the proxy queue, the handler and Redis. Streaming
+// responses send it as a trailer instead, once the total is known.
+
+// serverTimingEnabled is set by SERVER_TIMING=true. It is off by default
+// as the header tells clients about backend internals.
+var serverTimingEnabled, _ = strconv.ParseBool(os.Getenv("SERVER_TIMING"))
+
+type serverTimingMetric struct {
+	Name string
+	Dur  time.Duration
+	Desc string
+}
+
+// formatServerTiming renders metrics as a Server-Timing value, with
+// durations in milliseconds as the specification requires.
+func formatServerTiming(metrics []serverTimingMetric) string {
+	parts := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		p := fmt.Sprintf("%s;dur=%s", m.Name, strconv.FormatFloat(millis(m.Dur), 'f', -1, 64))
+		if m.Desc != "" {
+			p += fmt.Sprintf(";desc=%q", m.Desc)
+		}
+		parts = append(parts, p)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseRequestStart reads the time a proxy put in X-Request-Start. nginx
+// is configured to send "t=${msec}", seconds with a fractional part;
+// integer milliseconds and microseconds, as other proxies send, are told
+// apart by their magnitude.
+func parseRequestStart(h string) (time.Time, bool) {
+	h = strings.TrimPrefix(strings.TrimSpace(h), "t=")
+	if h == "" {
+		return time.Time{}, false
+	}
+	v, err := strconv.ParseFloat(h, 64)
+	if err != nil || v <= 0 {
+		return time.Time{}, false
+	}
+	switch {
+	case v > 1e15:
+		return time.UnixMicro(int64(v)), true
+	case v > 1e12:
+		return time.UnixMilli(int64(v)), true
+	}
+	sec := int64(v)
+	return time.Unix(sec, int64((v-float64(sec))*1e9)), true
+}
+
+// serverTiming summarises the timeline so far. Redis dials happen inside
+// a command, so only commands and pipelines are added up.
+func (t *requestTimeline) serverTiming(now time.Time) []serverTimingMetric {
+	var out []serverTimingMetric
+	if t.queue > 0 {
+		out = append(out, serverTimingMetric{"queue", t.queue, "proxy"})
+	}
+	var redis, encode time.Duration
+	t.mu.Lock()
+	for _, p := range t.phases {
+		d := time.Duration(p.DurationMS * float64(time.Millisecond))
+		switch p.Name {
+		case "redis", "redis_pipeline":
+			redis += d
+		case "encode":
+			encode += d
+		}
+	}
+	handlerStart := t.handlerStart
+	t.mu.Unlock()
+	if !handlerStart.IsZero() {
+		out = append(out, serverTimingMetric{"handler", now.Sub(handlerStart), ""})
+	}
+	out = append(out,
+		serverTimingMetric{"redis", redis, ""},
+		serverTimingMetric{"encode", encode, ""},
+		serverTimingMetric{"total", now.Sub(t.start), ""})
+	return out
+}
+
+// addServerTiming sets the Server-Timing header as the response headers
+// go out. Event streams declare it as a trailer and send it at the end.
+func addServerTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := timelineFrom(r.Context())
+		if !serverTimingEnabled || t == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tw := &serverTimingWriter{ResponseWriter: w, t: t}
+		next.ServeHTTP(tw, r)
+		switch {
+		case tw.trailer:
+			w.Header().Set("Server-Timing", formatServerTiming(t.serverTiming(time.Now())))
+		case !tw.wroteHeader:
+			tw.writeTiming(false)
+		}
+	})
+}
+
+type serverTimingWriter struct {
+	http.ResponseWriter
+	t           *requestTimeline
+	wroteHeader bool
+	trailer     bool
+}
+
+// writeTiming runs as the headers go out. A response flushed before it
+// wrote anything, or an event stream, is treated as streaming.
+func (w *serverTimingWriter) writeTiming(streaming bool) {
+	w.wroteHeader = true
+	h := w.Header()
+	if streaming || strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") {
+		w.trailer = true
+		h.Add("Trailer", "Server-Timing")
+		return
+	}
+	h.Set("Server-Timing", formatServerTiming(w.t.serverTiming(time.Now())))
+}
+
+func (w *serverTimingWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.writeTiming(false)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *serverTimingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.writeTiming(false)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *serverTimingWriter) Flush() {
+	if !w.wroteHeader {
+		w.writeTiming(true)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *serverTimingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
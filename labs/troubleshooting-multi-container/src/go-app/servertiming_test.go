@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerTimingHeaderAndTrailer(t *testing.T) {
+	serverTimingEnabled = true
+	defer func() { serverTimingEnabled = false }()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json", func(w http.ResponseWriter, r *http.Request) {
+		end := beginPhase(r.Context(), "redis", "get k")
+		time.Sleep(5 * time.Millisecond)
+		end(nil)
+		writeJSONResponse(w, r, http.StatusOK, map[string]string{"ok": "yes"})
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+		time.Sleep(5 * time.Millisecond)
+	})
+	srv := httptest.NewServer(serverHandler(mux))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/json", nil)
+	req.Header.Set("X-Request-Start", fmt.Sprintf("t=%.3f", float64(time.Now().Add(-20*time.Millisecond).UnixMilli())/1000))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	st := resp.Header.Get("Server-Timing")
+	for _, want := range []string{`queue;dur=`, `desc="proxy"`, "handler;dur=", "redis;dur=5", "encode;dur=", "total;dur="} {
+		if !strings.Contains(st, want) {
+			t.Errorf("Server-Timing %q lacks %q", st, want)
+		}
+	}
+
+	resp, err = http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if h := resp.Header.Get("Server-Timing"); h != "" {
+		t.Errorf("event stream sent Server-Timing as a header: %q", h)
+	}
+	if tr := resp.Trailer.Get("Server-Timing"); !strings.Contains(tr, "total;dur=") {
+		t.Errorf("event stream trailer = %q; want the total", tr)
+	}
+}
+
+func TestParseRequestStart(t *testing.T) {
+	want := time.Date(2024, 5, 6, 7, 8, 9, 123000000, time.UTC)
+	for _, h := range []string{"t=1714979289.123", "t=1714979289123", "1714979289123000"} {
+		got, ok := parseRequestStart(h)
+		if !ok || got.Sub(want).Abs() > time.Millisecond {
+			t.Errorf("parseRequestStart(%q) = %v, %v; want %v", h, got.UTC(), ok, want)
+		}
+	}
+	if _, ok := parseRequestStart("garbage"); ok {
+		t.Errorf("parseRequestStart accepted garbage")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// servicemetrics.go publishes the series the generated dashboards chart
+// beyond the runtime's own: request rate, errors and duration per route,
+// the Redis connection pool, and the cgroup's CPU and memory use.
+
+var (
+	httpRequests = registry.counter("http_requests_total",
+		"Requests served, by route pattern, method and status code.", "route", "method", "code")
+	httpDuration = registry.histogram("http_request_duration_seconds",
+		"Time to serve a request, by route pattern. Event streams are left out.",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "route")
+	httpInFlight = registry.gauge("http_requests_in_flight",
+		"Requests being served.")
+)
+
+func init() {
+	pool := func(field func(s *redis.PoolStats) uint32) func() float64 {
+		return func() float64 {
+			if redisClient == nil {
+				return 0
+			}
+			return float64(field(redisClient.PoolStats()))
+		}
+	}
+	registry.counterFunc("redis_pool_hits_total",
+		"Times a free connection was found in the Redis pool.", pool(func(s *redis.PoolStats) uint32 { return s.Hits }))
+	registry.counterFunc("redis_pool_misses_total",
+		"Times no free connection was found in the Redis pool and one was dialled.", pool(func(s *redis.PoolStats) uint32 { return s.Misses }))
+	registry.counterFunc("redis_pool_timeouts_total",
+		"Times waiting for a Redis pool connection timed out.", pool(func(s *redis.PoolStats) uint32 { return s.Timeouts }))
+	registry.counterFunc("redis_pool_stale_connections_total",
+		"Stale connections removed from the Redis pool.", pool(func(s *redis.PoolStats) uint32 { return s.StaleConns }))
+	registry.gaugeFunc("redis_pool_connections",
+		"Connections open in the Redis pool.", pool(func(s *redis.PoolStats) uint32 { return s.TotalConns }))
+	registry.gaugeFunc("redis_pool_idle_connections",
+		"Idle connections in the Redis pool.", pool(func(s *redis.PoolStats) uint32 { return s.IdleConns }))
+
+	registry.counterFunc("cgroup_cpu_usage_seconds_total",
+		"CPU time used by the cgroup.", func() float64 {
+			st, err := scrapeCgroup().readCPUStat()
+			if err != nil {
+				return 0
+			}
+			return float64(st.UsageUsec) / 1e6
+		})
+	registry.gaugeFunc("cgroup_cpu_limit_cores",
+		"CPU quota of the cgroup in cores; 0 when unlimited.", func() float64 {
+			return scrapeCgroup().readLimits().CPUCores
+		})
+	registry.gaugeFunc("cgroup_memory_usage_bytes",
+		"Memory charged to the cgroup.", func() float64 {
+			v, _ := scrapeCgroup().readMemoryCurrent()
+			return float64(v)
+		})
+	registry.gaugeFunc("cgroup_memory_working_set_bytes",
+		"Memory charged to the cgroup less inactive file cache, as the kubelet counts it.", func() float64 {
+			v, _ := scrapeCgroup().readWorkingSet()
+			return float64(v)
+		})
+	registry.gaugeFunc("cgroup_memory_limit_bytes",
+		"Memory limit of the cgroup; 0 when unlimited.", func() float64 {
+			return float64(scrapeCgroup().readLimits().MemoryBytes)
+		})
+}
+
+// scrapeCgroup finds the cgroup once, on the first scrape.
+var scrapeCgroup = sync.OnceValue(detectCgroup)
+
+// countRequests records the rate, errors and duration of requests by the
+// route pattern mux matched.
+func countRequests(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpInFlight.with().add(1)
+		defer httpInFlight.with().add(-1)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "none"
+		}
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.with(route, requestMethod(r.Method), strconv.Itoa(status)).inc()
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+			httpDuration.with(route).observe(time.Since(start).Seconds())
+		}
+	})
+}
+
+// requestMethod bounds the method label to the standard methods.
+func requestMethod(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return m
+	}
+	return "OTHER"
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// shards.go spreads the counters over several standalone Redis servers
+// with client-side consistent hashing, for more counter throughput than
+// one server gives without running Redis Cluster. Counter traffic goes
+// through a redis.Ring that always hashes over every configured shard: a
+// shard that is down fails the commands for its keys rather than the
+// ring handing them to a stand-in, where INCR would quietly start again
+// from 1. Each shard is also pinged on a connection of its own so its
+// health is known. The shard list can be reloaded from a file, after
+// which `go-app rebalance-shards` moves keys to their new owners.
+// The Redis audit, exporter and counter durability guard each watch one
+// server, REDIS_HOST, which holds no counters once they are sharded; with
+// sharding on they are off, and asking for them stops go-app.
+
+// redisShard is one configured server. Keys hash on the name, so a shard
+// can move to a new address without its keys changing owner.
+type redisShard struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+var (
+	redisShardUp = registry.gauge("redis_shard_up",
+		"1 if the shard answered its last health check.", "shard")
+	redisShardPing = registry.gauge("redis_shard_ping_seconds",
+		"Round trip of the shard's last health check.", "shard")
+	redisShardCount = registry.gauge("redis_shards",
+		"Shards configured for the counters.")
+	redisShardReloads = registry.counter("redis_shard_reloads_total",
+		"Reloads of the shard list, by result: changed, unchanged or error.", "result")
+)
+
+// counterRedis is where the counters live: redisClient, or the ring when
+// sharding is on.
+var counterRedis redis.Cmdable
+
+// parseShardSpec reads "name=host:port" entries separated by commas or
+// newlines; # starts a comment. A bare host:port is named after itself.
+func parseShardSpec(spec string) ([]redisShard, error) {
+	var shards []redisShard
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(spec, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		for _, item := range strings.Split(line, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			name, addr, ok := strings.Cut(item, "=")
+			if !ok {
+				name, addr = item, item
+			}
+			name, addr = strings.TrimSpace(name), strings.TrimSpace(addr)
+			if name == "" || !strings.Contains(addr, ":") {
+				return nil, fmt.Errorf("%q: want name=host:port", item)
+			}
+			if seen[name] {
+				return nil, fmt.Errorf("shard %q listed twice", name)
+			}
+			seen[name] = true
+			shards = append(shards, redisShard{name, addr})
+		}
+	}
+	return shards, nil
+}
+
+// readShardConfig returns the shard list from REDIS_SHARDS_FILE, or else
+// REDIS_SHARDS; nil means sharding is off.
+func readShardConfig() ([]redisShard, string, error) {
+	if file := os.Getenv("REDIS_SHARDS_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, file, err
+		}
+		shards, err := parseShardSpec(string(data))
+		if err == nil && len(shards) == 0 {
+			err = fmt.Errorf("no shards listed")
+		}
+		return shards, file, err
+	}
+	shards, err := parseShardSpec(os.Getenv("REDIS_SHARDS"))
+	return shards, "", err
+}
+
+func shardAddrs(shards []redisShard) map[string]string {
+	m := make(map[string]string, len(shards))
+	for _, s := range shards {
+		m[s.Name] = s.Addr
+	}
+	return m
+}
+
+func shardNames(shards []redisShard) []string {
+	names := make([]string, len(shards))
+	for i, s := range shards {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// rendezvousHash is highest-random-weight hashing over shard names: a key
+// goes to the shard scoring highest for it. Adding a shard moves only the
+// keys it now wins, and removing one moves only its own. The ring and
+// the rebalancer share it, so they agree on every key's owner.
+type rendezvousHash []string
+
+func newRendezvousHash(shards []string) redis.ConsistentHash {
+	return rendezvousHash(slices.Clone(shards))
+}
+
+func (h rendezvousHash) Get(key string) string {
+	var best string
+	var bestScore uint64
+	for _, name := range h {
+		f := fnv.New64a()
+		f.Write([]byte(name))
+		f.Write([]byte{0})
+		f.Write([]byte(key))
+		if score := mix64(f.Sum64()); best == "" || score > bestScore {
+			best, bestScore = name, score
+		}
+	}
+	return best
+}
+
+// mix64 is the splitmix64 finaliser; FNV alone leaves keys that differ
+// only in their last byte too close together.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// shardKey is the part of a key that is hashed: the {hash tag} if it has
+// one, as the ring does, so related keys can be kept together.
+func shardKey(key string) string {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			return key[i+1 : i+1+j]
+		}
+	}
+	return key
+}
+
+// shardOwner is the shard a key belongs on.
+func shardOwner(h redis.ConsistentHash, key string) string {
+	return h.Get(shardKey(key))
+}
+
+type shardHealth struct {
+	redisShard
+	Up      bool      `json:"up"`
+	PingMs  float64   `json:"ping_ms"`
+	Error   string    `json:"error,omitempty"`
+	Since   time.Time `json:"since,omitzero"` // when Up last changed
+	Checked time.Time `json:"checked,omitzero"`
+}
+
+type redisShardSet struct {
+	ring *redis.Ring
+	file string
+
+	mu        sync.Mutex
+	shards    []redisShard
+	probes    map[string]*redis.Client // by name, for health checks
+	health    map[string]*shardHealth
+	reloaded  time.Time
+	reloadErr string
+}
+
+var redisShards *redisShardSet
+
+// startRedisShards turns sharding on when REDIS_SHARDS
+// ("a=redis-a:6379,b=redis-b:6379") or REDIS_SHARDS_FILE (the same, one
+// per line if preferred) is set, and returns the ring. Each shard is
+// pinged every REDIS_SHARD_HEALTH_INTERVAL (5s). The file is re-read on
+// SIGHUP and every REDIS_SHARDS_RELOAD_INTERVAL (10s). A shard list
+// that is set but unusable stops go-app: running unsharded would count
+// into REDIS_HOST, away from the counters on the shards.
+func startRedisShards(ctx context.Context) *redis.Ring {
+	shards, file, err := readShardConfig()
+	switch {
+	case err != nil && file != "":
+		log.Fatalf("REDIS_SHARDS_FILE %s: %v", file, err)
+	case err != nil:
+		log.Fatalf("REDIS_SHARDS: %v", err)
+	case len(shards) == 0 && os.Getenv("REDIS_SHARDS") != "":
+		log.Fatalf("REDIS_SHARDS: no shards listed")
+	case len(shards) == 0:
+		return nil
+	}
+	rejectSingleServerFeatures()
+	ring := newShardRing(shards)
+	s := &redisShardSet{
+		ring:   ring,
+		file:   file,
+		probes: make(map[string]*redis.Client),
+		health: make(map[string]*shardHealth),
+	}
+	s.apply(shards)
+	redisShards = s
+	log.Printf("Sharding counters over %d Redis servers: %s", len(shards), shardSpecString(shards))
+
+	go s.checkHealth(ctx, envDuration("REDIS_SHARD_HEALTH_INTERVAL", 5*time.Second))
+	go s.watchConfig(ctx, envDuration("REDIS_SHARDS_RELOAD_INTERVAL", 10*time.Second))
+	return ring
+}
+
+// rejectSingleServerFeatures stops go-app when a feature that watches
+// REDIS_HOST is turned on together with sharding, rather than letting it
+// report on a server the counters no longer live on.
+func rejectSingleServerFeatures() {
+	var on []string
+	if v := os.Getenv("REDIS_AUDIT"); v != "" && v != "off" {
+		on = append(on, "REDIS_AUDIT="+v)
+	}
+	for _, name := range []string{"REDIS_EXPORTER", "COUNTER_DURABILITY"} {
+		if v, _ := strconv.ParseBool(os.Getenv(name)); v {
+			on = append(on, name+"="+os.Getenv(name))
+		}
+	}
+	if len(on) > 0 {
+		log.Fatalf("%s cannot be used with Redis sharding: they check REDIS_HOST, not the shards", strings.Join(on, ", "))
+	}
+	log.Printf("Redis audit, exporter and counter durability are off with sharding")
+}
+
+// newShardRing returns a ring over shards. The ring's heartbeat is what
+// marks a shard down and rehashes its keys onto the others, so it is
+// pushed out of reach: counters must not move while their owner is
+// down, and checkHealth does the watching instead.
+func newShardRing(shards []redisShard) *redis.Ring {
+	return redis.NewRing(&redis.RingOptions{
+		Addrs:              shardAddrs(shards),
+		NewConsistentHash:  newRendezvousHash,
+		HeartbeatFrequency: math.MaxInt64,
+		DialTimeout:        5 * time.Second,
+		NewClient: func(opt *redis.Options) *redis.Client {
+			c := redis.NewClient(opt)
+			c.AddHook(traceRedisTimeouts{})
+			c.AddHook(timeRedisCommands{})
+			return c
+		},
+	})
+}
+
+func shardSpecString(shards []redisShard) string {
+	parts := make([]string, len(shards))
+	for i, s := range shards {
+		parts[i] = s.Name + "=" + s.Addr
+	}
+	return strings.Join(parts, ",")
+}
+
+// apply makes shards the configuration, opening probes for new or moved
+// shards and forgetting removed ones.
+func (s *redisShardSet) apply(shards []redisShard) (added, removed []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	want := shardAddrs(shards)
+	for _, old := range s.shards {
+		if want[old.Name] != old.Addr {
+			s.probes[old.Name].Close()
+			delete(s.probes, old.Name)
+			delete(s.health, old.Name)
+			if _, still := want[old.Name]; !still {
+				removed = append(removed, old.Name)
+				redisShardUp.remove(old.Name)
+				redisShardPing.remove(old.Name)
+			}
+		}
+	}
+	for _, sh := range shards {
+		if _, ok := s.probes[sh.Name]; ok {
+			continue
+		}
+		if !slices.ContainsFunc(s.shards, func(o redisShard) bool { return o.Name == sh.Name }) {
+			added = append(added, sh.Name)
+		}
+		s.probes[sh.Name] = redis.NewClient(&redis.Options{
+			Addr:        sh.Addr,
+			DialTimeout: 2 * time.Second,
+			ReadTimeout: 2 * time.Second,
+			PoolSize:    1,
+			ClientName:  "go-app-health",
+		})
+		s.health[sh.Name] = &shardHealth{redisShard: sh}
+	}
+	s.shards = shards
+	s.reloaded = time.Now()
+	redisShardCount.with().set(float64(len(shards)))
+	return added, removed
+}
+
+// reload re-reads the file and hands any change to the ring.
+func (s *redisShardSet) reload() error {
+	shards, _, err := readShardConfig()
+	if err == nil && len(shards) == 0 {
+		err = fmt.Errorf("no shards listed")
+	}
+	if err != nil {
+		redisShardReloads.with("error").inc()
+		s.mu.Lock()
+		s.reloadErr = err.Error()
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Lock()
+	same := slices.Equal(s.shards, shards)
+	s.reloadErr = ""
+	s.mu.Unlock()
+	if same {
+		redisShardReloads.with("unchanged").inc()
+		return nil
+	}
+	s.ring.SetAddrs(shardAddrs(shards))
+	added, removed := s.apply(shards)
+	redisShardReloads.with("changed").inc()
+	log.Printf("Redis shards reloaded: %s (added %v, removed %v); run `go-app rebalance-shards` to move keys to their new owners",
+		shardSpecString(shards), added, removed)
+	return nil
+}
+
+func (s *redisShardSet) watchConfig(ctx context.Context, every time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var poll <-chan time.Time
+	if s.file != "" {
+		t := time.NewTicker(every)
+		defer t.Stop()
+		poll = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if s.file == "" {
+				log.Printf("SIGHUP: REDIS_SHARDS is fixed for the life of the process; use REDIS_SHARDS_FILE to reload shards")
+				continue
+			}
+		case <-poll:
+		}
+		if err := s.reload(); err != nil {
+			slog.Warn("redis shard reload failed; keeping the current shards", "file", s.file, "err", err)
+		}
+	}
+}
+
+func (s *redisShardSet) checkHealth(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, every)
+		s.ping(pingCtx)
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// ping checks every shard concurrently and returns the results.
+func (s *redisShardSet) ping(ctx context.Context) []shardHealth {
+	s.mu.Lock()
+	probes := make(map[string]*redis.Client, len(s.probes))
+	for name, c := range s.probes {
+		probes[name] = c
+	}
+	s.mu.Unlock()
+
+	type result struct {
+		name    string
+		elapsed time.Duration
+		err     error
+	}
+	results := make(chan result, len(probes))
+	for name, c := range probes {
+		go func() {
+			start := time.Now()
+			err := c.Ping(ctx).Err()
+			results <- result{name, time.Since(start), err}
+		}()
+	}
+	now := time.Now()
+	for range probes {
+		r := <-results
+		up := r.err == nil
+		if up {
+			redisShardUp.with(r.name).set(1)
+			redisShardPing.with(r.name).set(r.elapsed.Seconds())
+		} else {
+			redisShardUp.with(r.name).set(0)
+		}
+		s.mu.Lock()
+		if h, ok := s.health[r.name]; ok {
+			if h.Up != up || h.Since.IsZero() {
+				if !h.Since.IsZero() {
+					log.Printf("Redis shard %s (%s) is now %s", h.Name, h.Addr, map[bool]string{true: "up", false: "down"}[up])
+				}
+				h.Since = now
+			}
+			h.Up, h.PingMs, h.Checked, h.Error = up, millis(r.elapsed), now, ""
+			if r.err != nil {
+				h.Error = r.err.Error()
+			}
+		}
+		s.mu.Unlock()
+	}
+	return s.status()
+}
+
+// status returns the last health of each shard, in configured order.
+func (s *redisShardSet) status() []shardHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]shardHealth, 0, len(s.shards))
+	for _, sh := range s.shards {
+		if h, ok := s.health[sh.Name]; ok {
+			out = append(out, *h)
+		}
+	}
+	return out
+}
+
+type redisShardsReport struct {
+	File        string        `json:"file,omitempty"`
+	Reloaded    time.Time     `json:"reloaded"`
+	ReloadError string        `json:"reload_error,omitempty"`
+	Shards      []shardHealth `json:"shards"`
+	// Commands for keys on these shards fail until they are back.
+	Unavailable  []string `json:"unavailable,omitempty"`
+	VisitCounter string   `json:"visit_counter_shard"`
+}
+
+// redisShardsHandler reports each shard's health, checked now. POST
+// reloads the shard file first.
+func redisShardsHandler(w http.ResponseWriter, r *http.Request) {
+	s := redisShards
+	if s == nil {
+		http.Error(w, "redis sharding is disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if s.file == "" {
+			http.Error(w, "shards come from REDIS_SHARDS; set REDIS_SHARDS_FILE to reload them", http.StatusConflict)
+			return
+		}
+		if err := s.reload(); err != nil {
+			http.Error(w, "reload failed, keeping the current shards: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	shards := s.ping(ctx)
+	s.mu.Lock()
+	rep := redisShardsReport{File: s.file, Reloaded: s.reloaded, ReloadError: s.reloadErr, Shards: shards,
+		VisitCounter: shardOwner(newRendezvousHash(shardNames(s.shards)), "go_visit_counter")}
+	s.mu.Unlock()
+	for _, h := range shards {
+		if !h.Up {
+			rep.Unavailable = append(rep.Unavailable, h.Name)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(rep)
+}
+
+// reachable pings the shards now. Only the keys on a shard that is down
+// fail, so the counters are only unavailable when every shard is; down
+// lists the others.
+func (s *redisShardSet) reachable(ctx context.Context) (shards []shardHealth, down []string, err error) {
+	shards = s.ping(ctx)
+	var firstErr string
+	for _, h := range shards {
+		if !h.Up {
+			down = append(down, h.Name)
+			if firstErr == "" {
+				firstErr = h.Error
+			}
+		}
+	}
+	if len(down) == len(shards) {
+		return shards, down, fmt.Errorf("all %d shards down: %s", len(shards), firstErr)
+	}
+	return shards, down, nil
+}
+
+// shardHealthHandler is /health with sharding on: one check per shard,
+// warning while some are down and failing when all are.
+func shardHealthHandler(w http.ResponseWriter, r *http.Request) {
+	shards, down, err := redisShards.reachable(r.Context())
+	if wantsHealthJSON(r) {
+		now := time.Now()
+		h := newHealthReport("go-app")
+		for _, sh := range shards {
+			c := healthCheck{
+				ComponentID:   sh.Name + "=" + sh.Addr,
+				ComponentType: "datastore",
+				ObservedValue: sh.PingMs,
+				ObservedUnit:  "ms",
+				Status:        "pass",
+				Time:          now,
+			}
+			if !sh.Up {
+				c.Status, c.Output = "warn", sh.Error
+				if err != nil {
+					c.Status = "fail"
+				}
+			}
+			h.add("redis:responseTime", c)
+		}
+		if err != nil {
+			h.Output = "redis is unreachable"
+		}
+		h.addProcessChecks(now)
+		writeHealthReport(w, r, h)
+		return
+	}
+	if err != nil {
+		writeJSONResponse(w, r, http.StatusServiceUnavailable, HealthResponse{
+			Status: "unhealthy",
+			Redis:  "disconnected: " + err.Error(),
+		})
+		return
+	}
+	resp := HealthResponse{Status: "healthy", Redis: "connected"}
+	if len(down) > 0 {
+		resp.Redis = "connected; shards down, their keys failing: " + strings.Join(down, ", ")
+	}
+	writeJSONResponse(w, r, http.StatusOK, resp)
+}
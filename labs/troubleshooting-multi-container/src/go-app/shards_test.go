@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestParseShardSpec(t *testing.T) {
+	got, err := parseShardSpec("a=redis-a:6379, b=redis-b:6379\n# spare\nredis-c:6380\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []redisShard{{"a", "redis-a:6379"}, {"b", "redis-b:6379"}, {"redis-c:6380", "redis-c:6380"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, bad := range []string{"a=redis-a", "=redis-a:6379", "a=x:1,a=y:2"} {
+		if _, err := parseShardSpec(bad); err == nil {
+			t.Errorf("parseShardSpec(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestRendezvousHash(t *testing.T) {
+	three := newRendezvousHash([]string{"a", "b", "c"})
+	four := newRendezvousHash([]string{"a", "b", "c", "d"})
+	counts := make(map[string]int)
+	moved := 0
+	for i := range 3000 {
+		key := fmt.Sprintf("statsd:legacy.visits.%d", i)
+		before, after := three.Get(key), four.Get(key)
+		counts[before]++
+		if before != after {
+			moved++
+			if after != "d" {
+				t.Fatalf("%s moved %s -> %s; adding d should only move keys to d", key, before, after)
+			}
+		}
+	}
+	for name, n := range counts {
+		if n < 800 || n > 1200 {
+			t.Errorf("shard %s got %d of 3000 keys", name, n)
+		}
+	}
+	if moved < 600 || moved > 900 {
+		t.Errorf("adding a fourth shard moved %d of 3000 keys, want about 750", moved)
+	}
+	if three.Get("x") != newRendezvousHash([]string{"c", "a", "b"}).Get("x") {
+		t.Error("owner depends on shard order")
+	}
+}
+
+func TestShardKey(t *testing.T) {
+	for key, want := range map[string]string{
+		"go_visit_counter":         "go_visit_counter",
+		"{go_visit_counter}:epoch": "go_visit_counter",
+		"a{}b":                     "a{}b",
+		"a{b":                      "a{b",
+	} {
+		if got := shardKey(key); got != want {
+			t.Errorf("shardKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestPlanShardMoves(t *testing.T) {
+	h := newRendezvousHash([]string{"a", "b"})
+	keys := []string{"go_visit_counter", "statsd:x", "statsd:y", "statsd:z"}
+	found := map[string][]string{"a": keys, "old": {"statsd:x"}}
+	moves := planShardMoves(found, h, map[string]bool{"old": true})
+	var want []shardMove
+	for _, k := range keys {
+		if owner := h.Get(k); owner != "a" {
+			want = append(want, shardMove{k, "a", owner})
+		}
+	}
+	want = append(want, shardMove{"statsd:x", "old", h.Get("statsd:x")})
+	if !reflect.DeepEqual(moves, want) {
+		t.Errorf("moves %v, want %v", moves, want)
+	}
+}
+
+// fakeRedis answers PING, INCR and INCRBY over RESP, enough for a ring shard.
+func fakeRedis(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var mu sync.Mutex
+	counters := make(map[string]int64)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					var n int
+					if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+						return
+					}
+					args := make([]string, n)
+					for i := range args {
+						var size int
+						fmt.Fscanf(r, "$%d\r\n", &size)
+						b := make([]byte, size+2)
+						io.ReadFull(r, b)
+						args[i] = string(b[:size])
+					}
+					switch strings.ToUpper(args[0]) {
+					case "PING":
+						io.WriteString(c, "+PONG\r\n")
+					case "INCR", "INCRBY":
+						by := int64(1)
+						if len(args) > 2 {
+							by, _ = strconv.ParseInt(args[2], 10, 64)
+						}
+						mu.Lock()
+						counters[args[1]] += by
+						v := counters[args[1]]
+						mu.Unlock()
+						fmt.Fprintf(c, ":%d\r\n", v)
+					default:
+						fmt.Fprintf(c, "-ERR unknown command '%s'\r\n", args[0])
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// A key whose shard is down fails rather than being counted afresh on
+// another shard.
+func TestShardRingFailsKeysOfDownShard(t *testing.T) {
+	shards := []redisShard{{"a", fakeRedis(t)}, {"b", "127.0.0.1:1"}}
+	ring := newShardRing(shards)
+	defer ring.Close()
+	h := newRendezvousHash(shardNames(shards))
+	keys := make(map[string]string)
+	for i := 0; len(keys) < 2; i++ {
+		k := fmt.Sprintf("k%d", i)
+		if _, ok := keys[h.Get(k)]; !ok {
+			keys[h.Get(k)] = k
+		}
+	}
+
+	// Long enough for go-redis's default heartbeat (500ms) to have
+	// voted b down three times and rehashed its keys.
+	ctx := context.Background()
+	for deadline := time.Now().Add(1600 * time.Millisecond); time.Now().Before(deadline); {
+		if n, err := ring.Incr(ctx, keys["a"]).Result(); err != nil {
+			t.Fatalf("INCR on the up shard: %v", err)
+		} else if n == 0 {
+			t.Fatal("INCR on the up shard returned 0")
+		}
+		if n, err := ring.Incr(ctx, keys["b"]).Result(); err == nil {
+			t.Fatalf("INCR %s, owned by the down shard, = %d; want an error", keys["b"], n)
+		}
+	}
+	if n := ring.Len(); n != 2 {
+		t.Errorf("ring has %d live shards; want both kept", n)
+	}
+}
+
+// fakeCounterKeys is a shard holding string values.
+type fakeCounterKeys struct {
+	values   map[string]string
+	failIncr error
+}
+
+func (f *fakeCounterKeys) Get(ctx context.Context, key string) *redis.StringCmd {
+	v, ok := f.values[key]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(v, nil)
+}
+
+func (f *fakeCounterKeys) GetDel(ctx context.Context, key string) *redis.StringCmd {
+	cmd := f.Get(ctx, key)
+	delete(f.values, key)
+	return cmd
+}
+
+func (f *fakeCounterKeys) Set(ctx context.Context, key string, value any, expiration time.Duration) *redis.StatusCmd {
+	f.values[key] = fmt.Sprint(value)
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (f *fakeCounterKeys) IncrBy(ctx context.Context, key string, value int64) *redis.IntCmd {
+	if f.failIncr != nil {
+		return redis.NewIntResult(0, f.failIncr)
+	}
+	n, err := strconv.ParseInt(f.values[key], 10, 64)
+	if f.values[key] != "" && err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	n += value
+	f.values[key] = strconv.FormatInt(n, 10)
+	return redis.NewIntResult(n, nil)
+}
+
+func TestMoveCounter(t *testing.T) {
+	ctx := context.Background()
+	src := &fakeCounterKeys{values: map[string]string{"c": "5", "s": "text"}}
+	dst := &fakeCounterKeys{values: map[string]string{"c": "2"}}
+	if n, err := moveCounter(ctx, src, dst, "c"); err != nil || n != 5 {
+		t.Fatalf("move = %d, %v; want 5", n, err)
+	}
+	if _, ok := src.values["c"]; ok || dst.values["c"] != "7" {
+		t.Errorf("after move: src %v, dst %v; want c gone and 7", src.values, dst.values)
+	}
+	if _, err := moveCounter(ctx, src, dst, "s"); err == nil || src.values["s"] != "text" {
+		t.Errorf("moving a non-counter: err %v, src %v; want an error and s untouched", err, src.values)
+	}
+	if _, err := moveCounter(ctx, src, dst, "gone"); !errors.Is(err, redis.Nil) {
+		t.Errorf("moving a missing key: %v; want redis.Nil", err)
+	}
+
+	// dst refusing the increment puts the value back on src.
+	src.values["c"] = "3"
+	dst.failIncr = errors.New("READONLY")
+	if _, err := moveCounter(ctx, src, dst, "c"); err == nil || src.values["c"] != "3" {
+		t.Errorf("refused move: err %v, src %v; want an error and c back at 3", err, src.values)
+	}
+	// If putting it back fails too, the error says what was lost.
+	src.failIncr = errors.New("LOADING")
+	_, err := moveCounter(ctx, src, dst, "c")
+	if err == nil || !strings.Contains(err.Error(), "putting 3 back also failed") {
+		t.Errorf("err = %v; want it to report the value not put back", err)
+	}
+}
+
+func TestApplyShardMoves(t *testing.T) {
+	stores := map[string]counterKeys{
+		"a": &fakeCounterKeys{values: map[string]string{"x": "1", "y": "2"}},
+		"b": &fakeCounterKeys{values: map[string]string{}},
+		"c": &fakeCounterKeys{values: map[string]string{}, failIncr: errors.New("READONLY")},
+	}
+	moves := []shardMove{{"x", "a", "b"}, {"y", "a", "c"}, {"z", "a", "b"}}
+	var out, errOut strings.Builder
+	moved, failed := applyShardMoves(context.Background(), moves, stores, &out, &errOut)
+	if moved != 1 || failed != 1 {
+		t.Errorf("moved %d, failed %d; want 1 and 1 (z is gone)", moved, failed)
+	}
+	if out.String() != "moved x a -> b (+1)\n" || !strings.HasPrefix(errOut.String(), "y a -> c: READONLY") {
+		t.Errorf("out %q, errors %q", out.String(), errOut.String())
+	}
+}
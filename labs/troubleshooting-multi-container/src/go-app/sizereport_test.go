@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestSymbolPackage(t *testing.T) {
+	for name, want := range map[string]string{
+		"github.com/labstack/echo/v4.(*Echo).ServeHTTP":        "github.com/labstack/echo/v4",
+		"net/http.(*conn).serve.func1":                         "net/http",
+		"main.main":                                            "main",
+		"slices.SortFunc[go.shape.*uint8,go.shape.func(a.b)]":  "slices",
+		"type:*github.com/labstack/echo/v4.Echo":               "github.com/labstack/echo/v4",
+		"type:int":                                             "(type metadata)",
+		"type:.eq.[8]string":                                   "(type metadata)",
+		"go:string.*":                                          "(go:string)",
+		"go:itab.*net/http.response,net/http.ResponseWriter":   "(go:itab)",
+		"vendor/golang.org/x/net/http2/hpack.(*Decoder).Write": "vendor/golang.org/x/net/http2/hpack",
+	} {
+		if got := symbolPackage(name); got != want {
+			t.Errorf("symbolPackage(%q) = %q; want %q", name, got, want)
+		}
+	}
+}
+
+func TestAnalyzeSelf(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("size-report reads ELF binaries")
+	}
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := analyzeBinary(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	totals := b.totals(true)
+	if totals["runtime"] == 0 || totals["std"] == 0 || totals["(pclntab)"] == 0 {
+		t.Errorf("totals = %v; want runtime, std and pclntab bytes", totals)
+	}
+	if b.moduleOf("main") != b.MainPath {
+		t.Errorf("main attributed to %q; want %q", b.moduleOf("main"), b.MainPath)
+	}
+}
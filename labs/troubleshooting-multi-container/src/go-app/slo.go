@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// slo.go evaluates service level objectives in-process: per route, the
+// share of requests that did not fail with a 5xx, and the share that were
+// served under a latency threshold. /slo reports each objective's error
+// budget over the compliance window and its burn rate over the windows
+// the multiwindow alerts in the SRE workbook use. Counts live in memory,
+// so a restart starts the window afresh; the slo_events_total counter
+// lets Prometheus compute the same over longer history.
+
+var (
+	sloEvents = registry.counter("slo_events_total",
+		"Requests counted against an objective, by whether they met it.", "slo", "result")
+	sloTarget = registry.gauge("slo_target",
+		"Fraction of requests an objective requires to be good.", "slo")
+	sloSLI = registry.gauge("slo_sli",
+		"Fraction of requests that were good over the compliance window.", "slo")
+	sloBudgetRemaining = registry.gauge("slo_error_budget_remaining",
+		"Fraction of the error budget left in the compliance window; negative once overspent.", "slo")
+	sloBurnRate = registry.gauge("slo_burn_rate",
+		"Rate the error budget is being spent over a window; 1 spends it exactly over the compliance window.", "slo", "window")
+	sloAlertFiring = registry.gauge("slo_alert_firing",
+		"1 while both windows of a burn-rate alert are over its factor.", "slo", "severity")
+)
+
+// sloAlertRule is a multiwindow burn-rate alert: it fires while the burn
+// rate over both windows exceeds Factor. The factors are the workbook's
+// for a 30 day window, where 14.4 over an hour spends 2% of the budget.
+type sloAlertRule struct {
+	Severity    string
+	Long, Short time.Duration
+	Factor      float64
+}
+
+var sloAlertRules = []sloAlertRule{
+	{"page", time.Hour, 5 * time.Minute, 14.4},
+	{"page", 6 * time.Hour, 30 * time.Minute, 6},
+	{"ticket", 24 * time.Hour, 2 * time.Hour, 3},
+	{"ticket", 72 * time.Hour, 6 * time.Hour, 1},
+}
+
+// sloBurnWindows are the windows burn rates are reported over: every
+// window the alert rules use.
+var sloBurnWindows = []time.Duration{5 * time.Minute, 30 * time.Minute, time.Hour,
+	2 * time.Hour, 6 * time.Hour, 24 * time.Hour, 72 * time.Hour}
+
+// sloBuckets counts good and total requests in fixed-width time buckets,
+// reused round-robin.
+type sloBuckets struct {
+	width time.Duration
+	b     []sloBucket
+}
+
+type sloBucket struct {
+	start       int64 // bucket number, time / width
+	good, total uint64
+}
+
+func newSLOBuckets(width, span time.Duration) *sloBuckets {
+	return &sloBuckets{width: width, b: make([]sloBucket, int(span/width)+1)}
+}
+
+func (r *sloBuckets) add(now time.Time, good bool) {
+	n := now.UnixNano() / int64(r.width)
+	b := &r.b[n%int64(len(r.b))]
+	if b.start != n {
+		*b = sloBucket{start: n}
+	}
+	b.total++
+	if good {
+		b.good++
+	}
+}
+
+// sum counts the buckets overlapping the last d. The oldest bucket may
+// reach up to one width further back.
+func (r *sloBuckets) sum(now time.Time, d time.Duration) (good, total uint64) {
+	n := now.UnixNano() / int64(r.width)
+	oldest := now.Add(-d).UnixNano() / int64(r.width)
+	for _, b := range r.b {
+		if b.start >= oldest && b.start <= n && b.total > 0 {
+			good += b.good
+			total += b.total
+		}
+	}
+	return good, total
+}
+
+// sloObjective is one objective. Threshold is zero for availability.
+type sloObjective struct {
+	Name      string
+	Route     string // a mux pattern, or * for every route
+	Target    float64
+	Budget    float64 // 1 - Target
+	Threshold time.Duration
+
+	minutes *sloBuckets // the last 6h, for short burn windows
+	hours   *sloBuckets // the compliance window
+}
+
+func (o *sloObjective) kind() string {
+	if o.Threshold > 0 {
+		return "latency"
+	}
+	return "availability"
+}
+
+// good reports whether a request meets the objective, and whether it
+// counts at all: latency objectives leave out failed requests, which the
+// availability objective already counts.
+func (o *sloObjective) good(status int, elapsed time.Duration) (good, counted bool) {
+	if o.Threshold == 0 {
+		return status < 500, true
+	}
+	if status >= 500 {
+		return false, false
+	}
+	return elapsed <= o.Threshold, true
+}
+
+func (o *sloObjective) sum(now time.Time, d time.Duration) (good, total uint64) {
+	if d <= 6*time.Hour {
+		return o.minutes.sum(now, d)
+	}
+	return o.hours.sum(now, d)
+}
+
+type sloTracker struct {
+	window     time.Duration
+	objectives []*sloObjective
+
+	mu sync.Mutex
+}
+
+var slos *sloTracker
+
+// defaultSLOs are 99.9% of /counter requests without a 5xx, and 99% of
+// them under 100ms.
+const defaultSLOs = "/counter=99.9%;/counter=99%<100ms"
+
+// startSLOs evaluates the objectives in SLO_OBJECTIVES over SLO_WINDOW
+// (30d), refreshing the slo_* gauges every SLO_INTERVAL (30s).
+// Objectives are separated by semicolons: "ROUTE=99.9%" for availability
+// and "ROUTE=99%<100ms" for latency, with ROUTE a mux pattern or * for
+// all routes together. SLO=false turns it off.
+func startSLOs(ctx context.Context) {
+	if on, err := strconv.ParseBool(envOr("SLO", "true")); err == nil && !on {
+		return
+	}
+	window := envDuration("SLO_WINDOW", 30*24*time.Hour)
+	objectives, err := parseSLOs(envOr("SLO_OBJECTIVES", defaultSLOs), window)
+	if err != nil {
+		log.Printf("SLOs disabled: SLO_OBJECTIVES: %v", err)
+		return
+	}
+	t := &sloTracker{window: window, objectives: objectives}
+	slos = t
+	names := make([]string, len(objectives))
+	for i, o := range objectives {
+		names[i] = o.Name
+		sloTarget.with(o.Name).set(o.Target)
+	}
+	log.Printf("Tracking SLOs %s over %s", strings.Join(names, ", "), window)
+
+	interval := envDuration("SLO_INTERVAL", 30*time.Second)
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				t.updateMetrics(t.report(time.Now()))
+			}
+		}
+	}()
+}
+
+func parseSLOs(s string, window time.Duration) ([]*sloObjective, error) {
+	var out []*sloObjective
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.LastIndex(item, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q: want ROUTE=TARGET%%[<DURATION]", item)
+		}
+		o := &sloObjective{Route: strings.TrimSpace(item[:i])}
+		target, threshold, hasThreshold := strings.Cut(item[i+1:], "<")
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(target), "%"), 64)
+		if err != nil || pct <= 0 || pct >= 100 {
+			return nil, fmt.Errorf("%q: target must be a percentage between 0 and 100", item)
+		}
+		// Rounded so 99.9% is 0.999 and its budget 0.001, not 0.000999…
+		o.Target = math.Round(pct*1e6) / 1e8
+		o.Budget = math.Round((100-pct)*1e6) / 1e8
+		if hasThreshold {
+			if o.Threshold, err = time.ParseDuration(strings.TrimSpace(threshold)); err != nil || o.Threshold <= 0 {
+				return nil, fmt.Errorf("%q: bad latency threshold", item)
+			}
+		}
+		o.Name = sloName(o.Route) + "_" + o.kind()
+		if hasThreshold {
+			o.Name += "_" + strings.TrimSpace(threshold)
+		}
+		if seen[o.Name] {
+			return nil, fmt.Errorf("%q: objective listed twice", item)
+		}
+		seen[o.Name] = true
+		o.minutes = newSLOBuckets(time.Minute, 6*time.Hour)
+		o.hours = newSLOBuckets(time.Hour, window)
+		out = append(out, o)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no objectives")
+	}
+	return out, nil
+}
+
+// sloName turns a route pattern into a label-friendly name: "/counter"
+// becomes "counter", "*" becomes "all".
+func sloName(route string) string {
+	if route == "*" {
+		return "all"
+	}
+	name := strings.Trim(strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return '_'
+	}, route), "_")
+	if name == "" {
+		return "root"
+	}
+	return name
+}
+
+func (t *sloTracker) record(route string, status int, elapsed time.Duration, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, o := range t.objectives {
+		if o.Route != "*" && o.Route != route {
+			continue
+		}
+		good, counted := o.good(status, elapsed)
+		if !counted {
+			continue
+		}
+		o.minutes.add(now, good)
+		o.hours.add(now, good)
+		result := "bad"
+		if good {
+			result = "good"
+		}
+		sloEvents.with(o.Name, result).inc()
+	}
+}
+
+// recordSLOs counts every request against the objectives for its route.
+// Event streams stay open by design and are left out.
+func recordSLOs(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slos == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+			return
+		}
+		_, route := mux.Handler(r)
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		now := time.Now()
+		slos.record(route, status, now.Sub(start), now)
+	})
+}
+
+type sloBudget struct {
+	Allowed   float64 `json:"allowed"`   // bad requests the target allows so far
+	Spent     uint64  `json:"spent"`     // bad requests so far
+	Remaining float64 `json:"remaining"` // fraction left; negative once overspent
+}
+
+type sloAlert struct {
+	Severity string  `json:"severity"`
+	Long     string  `json:"long_window"`
+	Short    string  `json:"short_window"`
+	Factor   float64 `json:"factor"`
+	Firing   bool    `json:"firing"`
+}
+
+type sloStatus struct {
+	Name        string             `json:"name"`
+	Route       string             `json:"route"`
+	Kind        string             `json:"kind"`
+	Target      float64            `json:"target"`
+	ThresholdMS float64            `json:"threshold_ms,omitempty"`
+	Window      string             `json:"window"`
+	Total       uint64             `json:"total"`
+	Good        uint64             `json:"good"`
+	SLI         float64            `json:"sli"`
+	ErrorBudget sloBudget          `json:"error_budget"`
+	BurnRates   map[string]float64 `json:"burn_rates"`
+	Alerts      []sloAlert         `json:"alerts"`
+}
+
+// burnRate is the error rate over a window as a multiple of the rate the
+// target allows. No requests means nothing is burning.
+func burnRate(good, total uint64, budget float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(total-good) / float64(total) / budget
+}
+
+func (t *sloTracker) report(now time.Time) []sloStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]sloStatus, 0, len(t.objectives))
+	for _, o := range t.objectives {
+		good, total := o.sum(now, t.window)
+		s := sloStatus{
+			Name:        o.Name,
+			Route:       o.Route,
+			Kind:        o.kind(),
+			Target:      o.Target,
+			ThresholdMS: millis(o.Threshold),
+			Window:      t.window.String(),
+			Total:       total,
+			Good:        good,
+			SLI:         1,
+			ErrorBudget: sloBudget{Remaining: 1},
+			BurnRates:   make(map[string]float64),
+		}
+		if total > 0 {
+			s.SLI = float64(good) / float64(total)
+			s.ErrorBudget.Allowed = o.Budget * float64(total)
+			s.ErrorBudget.Spent = total - good
+			s.ErrorBudget.Remaining = 1 - float64(s.ErrorBudget.Spent)/s.ErrorBudget.Allowed
+		}
+		for _, d := range sloBurnWindows {
+			g, n := o.sum(now, d)
+			s.BurnRates[sloWindowName(d)] = burnRate(g, n, o.Budget)
+		}
+		for _, rule := range sloAlertRules {
+			s.Alerts = append(s.Alerts, sloAlert{
+				Severity: rule.Severity,
+				Long:     sloWindowName(rule.Long),
+				Short:    sloWindowName(rule.Short),
+				Factor:   rule.Factor,
+				Firing: s.BurnRates[sloWindowName(rule.Long)] > rule.Factor &&
+					s.BurnRates[sloWindowName(rule.Short)] > rule.Factor,
+			})
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func (t *sloTracker) updateMetrics(report []sloStatus) {
+	for _, s := range report {
+		sloSLI.with(s.Name).set(s.SLI)
+		sloBudgetRemaining.with(s.Name).set(s.ErrorBudget.Remaining)
+		for window, rate := range s.BurnRates {
+			sloBurnRate.with(s.Name, window).set(rate)
+		}
+		firing := map[string]float64{"page": 0, "ticket": 0}
+		for _, a := range s.Alerts {
+			if a.Firing {
+				firing[a.Severity] = 1
+			}
+		}
+		for _, severity := range sortedKeys(firing) {
+			sloAlertFiring.with(s.Name, severity).set(firing[severity])
+		}
+	}
+}
+
+// sloWindowName writes windows the way alert rules do: 5m, 6h, 3d.
+func sloWindowName(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return strconv.Itoa(int(d/(24*time.Hour))) + "d"
+	case d%time.Hour == 0:
+		return strconv.Itoa(int(d/time.Hour)) + "h"
+	}
+	return strconv.Itoa(int(d/time.Minute)) + "m"
+}
+
+// sloHandler reports every objective, those with firing alerts first.
+func sloHandler(w http.ResponseWriter, r *http.Request) {
+	if slos == nil {
+		http.Error(w, "SLO tracking is disabled", http.StatusNotFound)
+		return
+	}
+	report := slos.report(time.Now())
+	slos.updateMetrics(report)
+	sort.SliceStable(report, func(i, j int) bool { return firingAlerts(report[i]) > firingAlerts(report[j]) })
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]any{"objectives": report})
+}
+
+func firingAlerts(s sloStatus) int {
+	n := 0
+	for _, a := range s.Alerts {
+		if a.Firing {
+			n++
+		}
+	}
+	return n
+}
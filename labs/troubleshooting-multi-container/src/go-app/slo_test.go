@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseSLOs(t *testing.T) {
+	objs, err := parseSLOs("/counter=99.9%; /counter=99%<100ms ;*=99.5%", 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name      string
+		target    float64
+		threshold time.Duration
+	}{
+		{"counter_availability", 0.999, 0},
+		{"counter_latency_100ms", 0.99, 100 * time.Millisecond},
+		{"all_availability", 0.995, 0},
+	}
+	if len(objs) != len(want) {
+		t.Fatalf("got %d objectives; want %d", len(objs), len(want))
+	}
+	for i, w := range want {
+		if o := objs[i]; o.Name != w.name || o.Target != w.target || o.Threshold != w.threshold {
+			t.Errorf("objective %d = %s %v %v; want %s %v %v", i, o.Name, o.Target, o.Threshold, w.name, w.target, w.threshold)
+		}
+	}
+	for _, bad := range []string{"", "/counter", "/counter=100%", "/counter=abc", "/x=99%<soon", "/x=99%;/x=99.9%"} {
+		if _, err := parseSLOs(bad, time.Hour); err == nil {
+			t.Errorf("parseSLOs(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestSLOBudgetAndBurnRate(t *testing.T) {
+	objs, err := parseSLOs("/counter=99%;/counter=90%<100ms", 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &sloTracker{window: 30 * 24 * time.Hour, objectives: objs}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// A day ago: 1000 good requests.
+	for i := 0; i < 1000; i++ {
+		tr.record("/counter", http.StatusOK, 10*time.Millisecond, now.Add(-24*time.Hour))
+	}
+	// The last few minutes: 100 requests, 20 of them 5xx and 10 slow.
+	for i := 0; i < 100; i++ {
+		status, elapsed := http.StatusOK, 10*time.Millisecond
+		switch {
+		case i < 20:
+			status = http.StatusBadGateway
+		case i < 30:
+			elapsed = time.Second
+		}
+		tr.record("/counter", status, elapsed, now.Add(-2*time.Minute))
+	}
+	tr.record("/other", http.StatusInternalServerError, 0, now)
+
+	rep := tr.report(now)
+	avail, lat := rep[0], rep[1]
+	if avail.Total != 1100 || avail.Good != 1080 {
+		t.Errorf("availability counted %d/%d; want 1080/1100", avail.Good, avail.Total)
+	}
+	// 20 bad of the 11 allowed: the budget is overspent.
+	if avail.ErrorBudget.Spent != 20 || avail.ErrorBudget.Remaining > -0.8 {
+		t.Errorf("availability budget = %+v", avail.ErrorBudget)
+	}
+	// 20% errors against a 1% allowance is a burn rate of 20 over 5m.
+	if r := avail.BurnRates["5m"]; r < 19.9 || r > 20.1 {
+		t.Errorf("5m burn rate = %v; want 20", r)
+	}
+	// The day's burn is 20/1100/1% = 1.8: under the 1d ticket's 3, over
+	// the 3d ticket's 1.
+	for i, want := range []bool{true, true, false, true} {
+		if avail.Alerts[i].Firing != want {
+			t.Errorf("alert %+v firing = %v; want %v", avail.Alerts[i], avail.Alerts[i].Firing, want)
+		}
+	}
+	// Failed requests are left out of latency: 10 slow of 1080.
+	if lat.Total != 1080 || lat.Good != 1070 {
+		t.Errorf("latency counted %d/%d; want 1070/1080", lat.Good, lat.Total)
+	}
+	if r := lat.BurnRates["5m"]; r < 1.24 || r > 1.26 {
+		t.Errorf("latency 5m burn rate = %v; want 1.25", r)
+	}
+
+	// Past the short windows the burn stops.
+	later := tr.report(now.Add(2 * time.Hour))
+	if r := later[0].BurnRates["5m"]; r != 0 {
+		t.Errorf("5m burn rate two hours later = %v; want 0", r)
+	}
+}
+
+func TestSLOWindowName(t *testing.T) {
+	for d, want := range map[time.Duration]string{5 * time.Minute: "5m", 6 * time.Hour: "6h", 72 * time.Hour: "3d"} {
+		if got := sloWindowName(d); got != want {
+			t.Errorf("sloWindowName(%v) = %q; want %q", d, got, want)
+		}
+	}
+}
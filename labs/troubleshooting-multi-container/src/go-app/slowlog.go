@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// slowlog.go keeps the requests that took longer than a threshold, each
+// with a timeline of where its time went: waiting to reach the handler,
+// every Redis command, encoding the response and writing it. It is the
+// HTTP counterpart of Redis's SLOWLOG. The same threshold decides when
+// the flight recorder snapshots a slow request.
+
+var slowRequests = registry.counter("slowlog_requests_total",
+	"Requests recorded in the slow log, by route.", "route")
+
+// requestPhase is one step of a request. Offsets are from when the
+// request reached the server.
+type requestPhase struct {
+	Name       string  `json:"name"`
+	Detail     string  `json:"detail,omitempty"`
+	OffsetMS   float64 `json:"offset_ms"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// requestTimeline collects the phases of one request. Redis pipelines
+// and handlers may record from several goroutines.
+type requestTimeline struct {
+	start time.Time
+	queue time.Duration // spent in the proxy, from X-Request-Start
+
+	mu           sync.Mutex
+	phases       []requestPhase
+	handlerStart time.Time
+}
+
+type timelineKey struct{}
+
+func timelineFrom(ctx context.Context) *requestTimeline {
+	t, _ := ctx.Value(timelineKey{}).(*requestTimeline)
+	return t
+}
+
+// beginPhase starts a phase and returns the function that ends it. It is
+// a no-op when the request is not being timed.
+func beginPhase(ctx context.Context, name, detail string) func(error) {
+	t := timelineFrom(ctx)
+	if t == nil {
+		return func(error) {}
+	}
+	begin := time.Now()
+	return func(err error) {
+		p := requestPhase{
+			Name:       name,
+			Detail:     detail,
+			OffsetMS:   millis(begin.Sub(t.start)),
+			DurationMS: millis(time.Since(begin)),
+		}
+		if err != nil {
+			p.Error = err.Error()
+		}
+		t.mu.Lock()
+		t.phases = append(t.phases, p)
+		t.mu.Unlock()
+	}
+}
+
+// markPhase records an instant, such as the handler starting.
+func markPhase(ctx context.Context, name string) { beginPhase(ctx, name, "")(nil) }
+
+func millis(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+type slowRequest struct {
+	Time       time.Time      `json:"time"`
+	Method     string         `json:"method"`
+	Path       string         `json:"path"`
+	Route      string         `json:"route"`
+	Status     int            `json:"status"`
+	DurationMS float64        `json:"duration_ms"`
+	QueueMS    float64        `json:"proxy_queue_ms,omitempty"`
+	Phases     []requestPhase `json:"phases"`
+	TraceURL   string         `json:"trace_url,omitempty"`
+}
+
+type slowLog struct {
+	entries *broadcastRing[slowRequest]
+}
+
+var slowlog *slowLog
+
+// slowThreshold is when a request counts as slow, for the slow log and
+// the flight recorder alike.
+var slowThreshold = 250 * time.Millisecond
+
+// startSlowLog records requests slower than SLOWLOG_THRESHOLD (250ms),
+// keeping the last SLOWLOG_SIZE (128). SLOWLOG=false turns it off; the
+// threshold still applies to flight recorder snapshots.
+func startSlowLog() {
+	slowThreshold = envDuration("SLOWLOG_THRESHOLD", slowThreshold)
+	if on, err := strconv.ParseBool(envOr("SLOWLOG", "true")); err == nil && !on {
+		return
+	}
+	size, err := strconv.Atoi(envOr("SLOWLOG_SIZE", "128"))
+	if err != nil || size <= 0 {
+		size = 128
+	}
+	slowlog = &slowLog{entries: newBroadcastRing[slowRequest](size)}
+	log.Printf("Slow log recording requests over %s (%d kept)", slowThreshold, size)
+}
+
+// timeRequests starts a timeline for every request while the slow log or
+// Server-Timing needs one. It must be the outermost middleware so the
+// timeline starts when the request reaches the server.
+func timeRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slowlog == nil && !serverTimingEnabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t := &requestTimeline{start: time.Now()}
+		if start, ok := parseRequestStart(r.Header.Get("X-Request-Start")); ok {
+			t.queue = max(t.start.Sub(start), 0)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), timelineKey{}, t)))
+	})
+}
+
+// recordSlowRequests logs each request slower than slowThreshold once,
+// keeping it in the slow log with its timeline and snapshotting the
+// flight recorder, whichever of the two is on. The route pattern comes
+// from mux.
+func recordSlowRequests(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slowlog == nil && flightRec == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t := timelineFrom(r.Context())
+		start := time.Now()
+		if t != nil {
+			start = t.start
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		elapsed := time.Since(start)
+		if elapsed < slowThreshold || strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+			return
+		}
+
+		_, route := mux.Handler(r)
+		entry := slowRequest{
+			Time:       start,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Route:      route,
+			Status:     sw.status,
+			DurationMS: millis(elapsed),
+		}
+		if t != nil {
+			t.mu.Lock()
+			entry.QueueMS = millis(t.queue)
+			entry.Phases = append([]requestPhase{}, t.phases...)
+			t.mu.Unlock()
+			// Phases are appended as they end; list them as they began.
+			sort.SliceStable(entry.Phases, func(i, j int) bool { return entry.Phases[i].OffsetMS < entry.Phases[j].OffsetMS })
+		}
+		attrs := []any{"method", entry.Method, "path", entry.Path, "route", entry.Route,
+			"status", entry.Status, "duration_ms", entry.DurationMS}
+		if len(entry.Phases) > 0 {
+			phases := make([]string, len(entry.Phases))
+			for i, p := range entry.Phases {
+				phases[i] = fmt.Sprintf("%s@%gms+%gms", p.Name, p.OffsetMS, p.DurationMS)
+				if p.Detail != "" {
+					phases[i] = fmt.Sprintf("%s(%s)@%gms+%gms", p.Name, p.Detail, p.OffsetMS, p.DurationMS)
+				}
+			}
+			attrs = append(attrs, "phases", strings.Join(phases, " "))
+		}
+		if flightRec != nil {
+			if path, err := flightRec.dump("slow_request"); err != nil {
+				attrs = append(attrs, "trace_err", err)
+			} else {
+				entry.TraceURL = traceURL(path)
+				attrs = append(attrs, "trace", path, "trace_url", entry.TraceURL)
+			}
+		}
+		if slowlog != nil {
+			slowlog.entries.publish(entry)
+			slowRequests.with(route).inc()
+		}
+		slog.Warn("slow request", attrs...)
+	})
+}
+
+// markHandlerStart ends the queued phase. It goes just outside the
+// per-route middleware, so everything between timeRequests and here
+// counts as queueing.
+func markHandlerStart(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t := timelineFrom(r.Context()); t != nil {
+			now := time.Now()
+			t.mu.Lock()
+			t.handlerStart = now
+			t.phases = append(t.phases, requestPhase{Name: "queued", DurationMS: millis(now.Sub(t.start))})
+			t.mu.Unlock()
+			markPhase(r.Context(), "handler_start")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSONResponse encodes v and writes it with status, timing encoding
+// and writing separately. A Content-Type already set, such as a more
+// specific JSON type, is kept.
+func writeJSONResponse(w http.ResponseWriter, r *http.Request, status int, v any) {
+	end := beginPhase(r.Context(), "encode", "")
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(v)
+	end(err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	end = beginPhase(r.Context(), "write", strconv.Itoa(buf.Len())+" bytes")
+	_, err = w.Write(buf.Bytes())
+	end(err)
+}
+
+// timeRedisCommands is a go-redis hook that adds each command to the
+// request's timeline.
+type timeRedisCommands struct{}
+
+func (timeRedisCommands) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		end := beginPhase(ctx, "redis_dial", addr)
+		conn, err := next(ctx, network, addr)
+		end(err)
+		return conn, err
+	}
+}
+
+func (timeRedisCommands) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		end := beginPhase(ctx, "redis", redisCommandDetail(cmd))
+		err := next(ctx, cmd)
+		end(redisError(err))
+		return err
+	}
+}
+
+func (timeRedisCommands) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		names := make([]string, len(cmds))
+		for i, c := range cmds {
+			names[i] = c.Name()
+		}
+		end := beginPhase(ctx, "redis_pipeline", strings.Join(names, " "))
+		err := next(ctx, cmds)
+		end(redisError(err))
+		return err
+	}
+}
+
+// redisCommandDetail is the command and its key; values are left out.
+func redisCommandDetail(cmd redis.Cmder) string {
+	args := cmd.Args()
+	if len(args) > 1 {
+		return fmt.Sprintf("%s %v", cmd.Name(), args[1])
+	}
+	return cmd.Name()
+}
+
+// redisError drops redis.Nil, which is a normal reply rather than a
+// failure.
+func redisError(err error) error {
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
+
+// slowlogHandler lists recorded requests, newest first. ?limit=N,
+// ?route=PATTERN and ?min=DURATION narrow the list.
+func slowlogHandler(w http.ResponseWriter, r *http.Request) {
+	if slowlog == nil {
+		http.Error(w, "slow log is disabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+	var minDuration time.Duration
+	if s := q.Get("min"); s != "" {
+		if minDuration, err = time.ParseDuration(s); err != nil {
+			http.Error(w, "bad min: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	route := q.Get("route")
+
+	entries := slowlog.entries.recent()
+	out := []slowRequest{}
+	for i := len(entries) - 1; i >= 0 && len(out) < limit; i-- {
+		e := entries[i]
+		if route != "" && e.Route != route || e.DurationMS < millis(minDuration) {
+			continue
+		}
+		out = append(out, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"threshold_ms": millis(slowThreshold),
+		"requests":     out,
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestSlowLogRecordsPhases(t *testing.T) {
+	slowlog = &slowLog{entries: newBroadcastRing[slowRequest](4)}
+	defer func(d time.Duration) { slowlog, slowThreshold = nil, d }(slowThreshold)
+	slowThreshold = 20 * time.Millisecond
+
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	client.AddHook(timeRedisCommands{})
+	defer client.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		client.Incr(r.Context(), "k") // fails to connect; still timed
+		end := beginPhase(r.Context(), "work", "")
+		time.Sleep(30 * time.Millisecond)
+		end(nil)
+		writeJSONResponse(w, r, http.StatusAccepted, map[string]int{"n": 1})
+	})
+	mux.HandleFunc("/fast", func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewServer(serverHandler(mux))
+	defer srv.Close()
+
+	for _, path := range []string{"/fast", "/slow"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	rec := httptest.NewRecorder()
+	slowlogHandler(rec, httptest.NewRequest("GET", "/debug/slowlog?route=/slow", nil))
+	var got struct {
+		Requests []slowRequest `json:"requests"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Requests) != 1 {
+		t.Fatalf("slow log has %d entries; want only /slow", len(got.Requests))
+	}
+	e := got.Requests[0]
+	if e.Route != "/slow" || e.Status != http.StatusAccepted || e.DurationMS < 30 {
+		t.Errorf("entry = %+v", e)
+	}
+	var names []string
+	for _, p := range e.Phases {
+		names = append(names, p.Name)
+		if p.Name == "redis_dial" && p.Error == "" {
+			t.Errorf("dial phase has no error: %+v", p)
+		}
+	}
+	want := []string{"queued", "handler_start", "redis", "redis_dial", "work", "encode", "write"}
+	if len(names) != len(want) {
+		t.Fatalf("phases %v; want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("phases %v; want %v", names, want)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsd.go pushes the metric registry to a StatsD or DogStatsD agent over
+// UDP, for environments that collect metrics that way instead of
+// scraping /metrics. The registry already aggregates: each flush sends a
+// counter's increase since the last flush, a gauge's current value, and
+// for a histogram the count and sum of the interval's observations with
+// p50 and p99 estimated from its buckets. Counters that did not move are
+// not sent. Lines are batched into packets of at most the configured
+// size.
+
+type statsdPusher struct {
+	w         io.Writer
+	dogstatsd bool
+	prefix    string
+	tags      []string // DogStatsD only
+	maxPacket int
+
+	last     map[string]float64      // counter values at the last flush
+	lastHist map[string]metricSample // histogram samples at the last flush
+}
+
+// startStatsD pushes to STATSD_ADDR (host:port) when it is set.
+// STATSD_FORMAT is statsd or dogstatsd; DogStatsD sends labels as tags,
+// with STATSD_TAGS (k:v,k:v) added to every line, where plain StatsD
+// folds them into the name. STATSD_PREFIX (service.) is prepended to
+// names, STATSD_FLUSH_INTERVAL (10s) sets how often, and
+// STATSD_MAX_PACKET (1432, what fits an Ethernet MTU) bounds packets.
+func startStatsD(ctx context.Context, service string) {
+	addr := envOr("STATSD_ADDR", "")
+	if addr == "" {
+		return
+	}
+	format := envOr("STATSD_FORMAT", "statsd")
+	if format != "statsd" && format != "dogstatsd" {
+		log.Printf("StatsD disabled: STATSD_FORMAT must be statsd or dogstatsd, not %q", format)
+		return
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		log.Printf("StatsD disabled: %v", err)
+		return
+	}
+	maxPacket, err := strconv.Atoi(envOr("STATSD_MAX_PACKET", "1432"))
+	if err != nil || maxPacket < 64 {
+		maxPacket = 1432
+	}
+	p := newStatsdPusher(conn, format == "dogstatsd", envOr("STATSD_PREFIX", service+"."), maxPacket)
+	if tags := envOr("STATSD_TAGS", ""); tags != "" {
+		p.tags = strings.Split(tags, ",")
+	}
+	interval := envDuration("STATSD_FLUSH_INTERVAL", 10*time.Second)
+	log.Printf("Pushing metrics to %s as %s every %s", addr, format, interval)
+
+	go func() {
+		defer conn.Close()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				p.flush(registry.snapshot())
+				return
+			case <-t.C:
+				if err := p.flush(registry.snapshot()); err != nil {
+					// The agent may not be up yet; UDP reports that as a
+					// refused write on the next send.
+					slog.Debug("statsd flush failed", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+func newStatsdPusher(w io.Writer, dogstatsd bool, prefix string, maxPacket int) *statsdPusher {
+	return &statsdPusher{
+		w:         w,
+		dogstatsd: dogstatsd,
+		prefix:    prefix,
+		maxPacket: maxPacket,
+		last:      make(map[string]float64),
+		lastHist:  make(map[string]metricSample),
+	}
+}
+
+// flush sends one interval's lines, a packet per write.
+func (p *statsdPusher) flush(families []*metricFamily) error {
+	var firstErr error
+	for _, packet := range batchLines(p.lines(families), p.maxPacket) {
+		if _, err := p.w.Write(packet); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (p *statsdPusher) lines(families []*metricFamily) []string {
+	var out []string
+	for _, f := range families {
+		for _, s := range f.samples() {
+			key := f.Name + "\xff" + strings.Join(s.LabelValues, "\xff")
+			switch f.Kind {
+			case counterKind:
+				delta := s.Value - p.last[key]
+				if delta < 0 { // the counter was reset
+					delta = s.Value
+				}
+				p.last[key] = s.Value
+				if delta != 0 {
+					out = append(out, p.line(f, s.LabelValues, "", formatFloat(delta), "c"))
+				}
+			case histogramKind:
+				prev, seen := p.lastHist[key]
+				p.lastHist[key] = s
+				if !seen || len(prev.Counts) != len(s.Counts) || s.Count < prev.Count {
+					prev = metricSample{Counts: make([]uint64, len(s.Counts))}
+				}
+				n := s.Count - prev.Count
+				if n == 0 {
+					continue
+				}
+				out = append(out,
+					p.line(f, s.LabelValues, "count", strconv.FormatUint(n, 10), "c"),
+					p.line(f, s.LabelValues, "sum", formatFloat(s.Sum-prev.Sum), "c"),
+					p.line(f, s.LabelValues, "p50", formatFloat(bucketQuantile(f.Buckets, prev.Counts, s.Counts, 0.5)), "g"),
+					p.line(f, s.LabelValues, "p99", formatFloat(bucketQuantile(f.Buckets, prev.Counts, s.Counts, 0.99)), "g"))
+			default:
+				v := s.Value
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					continue
+				}
+				if v < 0 && !p.dogstatsd {
+					// StatsD reads a signed gauge as a change; zero it
+					// first so the value is absolute.
+					out = append(out, p.line(f, s.LabelValues, "", "0", "g"))
+				}
+				out = append(out, p.line(f, s.LabelValues, "", formatFloat(v), "g"))
+			}
+		}
+	}
+	return out
+}
+
+// line formats one metric. DogStatsD carries labels as tags; plain StatsD
+// appends their values to the name.
+func (p *statsdPusher) line(f *metricFamily, values []string, suffix, value, kind string) string {
+	name := p.prefix + f.Name
+	if !p.dogstatsd {
+		for _, v := range values {
+			name += "." + statsdSanitize(v)
+		}
+	}
+	if suffix != "" {
+		name += "." + suffix
+	}
+	line := name + ":" + value + "|" + kind
+	if p.dogstatsd {
+		tags := append([]string(nil), p.tags...)
+		for i, l := range f.Labels {
+			tags = append(tags, l+":"+statsdTagValue(values[i]))
+		}
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+	}
+	return line
+}
+
+// statsdSanitize makes a label value safe in a dotted StatsD name:
+// "/counter" becomes "counter" and "GET /x/{id}" "GET_x_id".
+func statsdSanitize(v string) string {
+	s := strings.Trim(strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, v), "_")
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// statsdTagValue strips the characters DogStatsD uses as separators.
+func statsdTagValue(v string) string {
+	return strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_").Replace(v)
+}
+
+// batchLines packs lines, newline separated, into packets of at most
+// maxBytes. A longer line is sent on its own.
+func batchLines(lines []string, maxBytes int) [][]byte {
+	var packets [][]byte
+	var cur []byte
+	for _, l := range lines {
+		if len(cur) > 0 && len(cur)+1+len(l) > maxBytes {
+			packets = append(packets, cur)
+			cur = nil
+		}
+		if len(cur) > 0 {
+			cur = append(cur, '\n')
+		}
+		cur = append(cur, l...)
+	}
+	if len(cur) > 0 {
+		packets = append(packets, cur)
+	}
+	return packets
+}
+
+// bucketQuantile estimates quantile q of the observations between two
+// cumulative histogram samples, as the upper bound of the bucket it falls
+// in. Observations above the last bound report that bound.
+func bucketQuantile(bounds []float64, before, after []uint64, q float64) float64 {
+	total := after[len(after)-1] - before[len(before)-1]
+	if total == 0 || len(bounds) == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	for i, b := range bounds {
+		if after[i]-before[i] >= rank {
+			return b
+		}
+	}
+	return bounds[len(bounds)-1]
+}
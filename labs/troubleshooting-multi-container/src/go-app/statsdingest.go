@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// statsdingest.go accepts StatsD counters from legacy services, over UDP
+// and TCP, and adds them to Redis counters alongside go-app's own.
+// Increments are summed in memory and written in one pipeline per flush,
+// so a busy emitter costs Redis one INCRBY per counter per interval
+// rather than one per packet. Only counters are taken; gauges, timers and
+// sets are counted as unsupported and dropped.
+
+var statsdIngestLines = registry.counter("statsd_ingest_lines_total",
+	"StatsD lines received by the ingestion listener, by result: accepted, dropped by a rule, unsupported type, invalid, or overflow when too many counters were waiting.", "result")
+
+var statsdIngestFractionsDropped = registry.counter("statsd_ingest_fractions_dropped_total",
+	"Sample-rate fractions discarded because too many counters already held one.")
+
+var statsdIngestErrors = registry.counter("statsd_ingest_redis_errors_total",
+	"Counter increments the ingestion listener could not write to Redis and will retry.")
+
+// statsdSample is one parsed StatsD line.
+type statsdSample struct {
+	Name  string
+	Value float64
+	Type  string
+	Rate  float64
+	Tags  map[string]string
+}
+
+// parseStatsDLine parses name:value|type[|@rate][|#tag:value,...].
+func parseStatsDLine(line string) (statsdSample, error) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return statsdSample{}, errors.New("no name")
+	}
+	fields := strings.Split(rest, "|")
+	if len(fields) < 2 {
+		return statsdSample{}, errors.New("no type")
+	}
+	s := statsdSample{Name: name, Type: fields[1], Rate: 1}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return statsdSample{}, fmt.Errorf("bad value %q", fields[0])
+	}
+	s.Value = v
+	for _, f := range fields[2:] {
+		switch {
+		case strings.HasPrefix(f, "@"):
+			rate, err := strconv.ParseFloat(f[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return statsdSample{}, fmt.Errorf("bad sample rate %q", f)
+			}
+			s.Rate = rate
+		case strings.HasPrefix(f, "#"):
+			s.Tags = make(map[string]string)
+			for _, tag := range strings.Split(f[1:], ",") {
+				k, v, _ := strings.Cut(tag, ":")
+				if k != "" {
+					s.Tags[k] = v
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+// statsdRule drops or renames metrics. Rules apply in order; a drop ends
+// the list.
+type statsdRule struct {
+	drop        bool
+	match       *regexp.Regexp
+	replacement string
+}
+
+// parseStatsDRules reads semicolon-separated rules: "drop REGEXP" or
+// "rewrite REGEXP REPLACEMENT", where REPLACEMENT may use $1 or ${name}
+// for the expression's groups.
+func parseStatsDRules(s string) ([]statsdRule, error) {
+	var rules []statsdRule
+	for _, item := range strings.Split(s, ";") {
+		f := strings.Fields(item)
+		if len(f) == 0 {
+			continue
+		}
+		var r statsdRule
+		switch {
+		case f[0] == "drop" && len(f) == 2:
+			r.drop = true
+		case f[0] == "rewrite" && len(f) == 3:
+			r.replacement = f[2]
+		default:
+			return nil, fmt.Errorf("%q: want \"drop REGEXP\" or \"rewrite REGEXP REPLACEMENT\"", strings.TrimSpace(item))
+		}
+		re, err := regexp.Compile(f[1])
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", strings.TrimSpace(item), err)
+		}
+		r.match = re
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// counterSink adds increments to stored counters, returning those it
+// could not write but may on a later try.
+type counterSink interface {
+	increment(ctx context.Context, deltas map[string]int64) (retry map[string]int64)
+}
+
+// redisCounterSink writes increments with INCRBY in one pipeline. An
+// error reply, such as WRONGTYPE for a key that is not a counter, will not
+// go away on a retry and is logged instead. The durability guard is told
+// the new value of a counter it watches, as /counter tells it.
+type redisCounterSink struct{ client redis.Cmdable }
+
+func (s redisCounterSink) increment(ctx context.Context, deltas map[string]int64) map[string]int64 {
+	pipe := s.client.Pipeline()
+	keys := sortedKeys(deltas)
+	cmds := make([]*redis.IntCmd, len(keys))
+	for i, k := range keys {
+		cmds[i] = pipe.IncrBy(ctx, k, deltas[k])
+	}
+	pipe.Exec(ctx)
+	retry := make(map[string]int64)
+	for i, c := range cmds {
+		var reply redis.Error
+		switch err := c.Err(); {
+		case err == nil:
+			if counterGuardian != nil && slices.Contains(durableCounters, keys[i]) {
+				counterGuardian.note(keys[i], c.Val())
+			}
+		case errors.As(err, &reply):
+			slog.Warn("statsd ingest: increment rejected", "key", keys[i], "err", err)
+		default:
+			retry[keys[i]] = deltas[keys[i]]
+		}
+	}
+	return retry
+}
+
+type statsdIngester struct {
+	rules     []statsdRule
+	tagKeys   []string // tags appended to the name, in order
+	keyPrefix string
+	batch     int
+	maxKeys   int // distinct counters pending, and fractions held
+	sink      counterSink
+
+	mu        sync.Mutex
+	pending   map[string]float64
+	fractions map[string]float64 // left by sample rates; not counted towards batch
+	full      chan struct{}
+}
+
+// startStatsDIngest listens on STATSD_LISTEN (e.g. :8125) over the
+// protocols in STATSD_LISTEN_PROTOCOLS (udp,tcp). Counters are renamed by
+// STATSD_RULES, have the values of the tags in STATSD_TAG_KEYS appended
+// (name.value), and are added to the Redis key STATSD_KEY_PREFIX
+// (statsd:) + name every STATSD_INGEST_FLUSH_INTERVAL (1s), or sooner
+// once STATSD_INGEST_BATCH (1000) counters are waiting. Senders are not
+// trusted to keep names few: beyond STATSD_INGEST_MAX_KEYS (10000)
+// distinct counters waiting, lines for new ones are dropped. An empty
+// STATSD_KEY_PREFIX uses names as they are, so a rule rewriting a legacy
+// name to go_visit_counter adds to the counter go-app serves.
+func startStatsDIngest(ctx context.Context, client redis.Cmdable) {
+	addr := envOr("STATSD_LISTEN", "")
+	if addr == "" {
+		return
+	}
+	rules, err := parseStatsDRules(envOr("STATSD_RULES", ""))
+	if err != nil {
+		log.Printf("StatsD ingestion disabled: STATSD_RULES: %v", err)
+		return
+	}
+	batch, err := strconv.Atoi(envOr("STATSD_INGEST_BATCH", "1000"))
+	if err != nil || batch <= 0 {
+		batch = 1000
+	}
+	in := newStatsDIngester(redisCounterSink{client}, rules, batch)
+	in.keyPrefix = statsdKeyPrefix()
+	if n, err := strconv.Atoi(envOr("STATSD_INGEST_MAX_KEYS", "")); err == nil && n > 0 {
+		in.maxKeys = max(n, batch)
+	}
+	if keys := envOr("STATSD_TAG_KEYS", ""); keys != "" {
+		in.tagKeys = strings.Split(keys, ",")
+	}
+
+	for _, proto := range strings.Split(envOr("STATSD_LISTEN_PROTOCOLS", "udp,tcp"), ",") {
+		switch proto = strings.TrimSpace(proto); proto {
+		case "udp":
+			pc, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				log.Printf("StatsD ingestion: %v", err)
+				continue
+			}
+			go in.serveUDP(ctx, pc)
+		case "tcp":
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				log.Printf("StatsD ingestion: %v", err)
+				continue
+			}
+			go in.serveTCP(ctx, l)
+		default:
+			log.Printf("StatsD ingestion: unknown protocol %q", proto)
+			continue
+		}
+		log.Printf("Accepting StatsD counters on %s/%s into Redis keys %s*", addr, proto, in.keyPrefix)
+	}
+	go in.run(ctx, envDuration("STATSD_INGEST_FLUSH_INTERVAL", time.Second))
+}
+
+// statsdKeyPrefix is STATSD_KEY_PREFIX, which unlike most settings may be
+// set to empty.
+func statsdKeyPrefix() string {
+	if p, ok := os.LookupEnv("STATSD_KEY_PREFIX"); ok {
+		return p
+	}
+	return "statsd:"
+}
+
+func newStatsDIngester(sink counterSink, rules []statsdRule, batch int) *statsdIngester {
+	return &statsdIngester{
+		rules:     rules,
+		batch:     batch,
+		maxKeys:   max(10000, batch),
+		sink:      sink,
+		pending:   make(map[string]float64),
+		fractions: make(map[string]float64),
+		full:      make(chan struct{}, 1),
+	}
+}
+
+// handle parses one line and adds it to the pending increments.
+func (in *statsdIngester) handle(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	s, err := parseStatsDLine(line)
+	if err != nil {
+		statsdIngestLines.with("invalid").inc()
+		return
+	}
+	if s.Type != "c" {
+		statsdIngestLines.with("unsupported").inc()
+		return
+	}
+	name, ok := in.counterName(s)
+	if !ok {
+		statsdIngestLines.with("dropped").inc()
+		return
+	}
+	key := in.keyPrefix + name
+
+	in.mu.Lock()
+	if _, ok := in.pending[key]; !ok && len(in.pending) >= in.maxKeys {
+		in.mu.Unlock()
+		statsdIngestLines.with("overflow").inc()
+		return
+	}
+	in.pending[key] += s.Value / s.Rate
+	full := len(in.pending) >= in.batch
+	in.mu.Unlock()
+	statsdIngestLines.with("accepted").inc()
+	if full {
+		select {
+		case in.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// counterName applies the tag keys and rules, reporting false if the
+// metric is dropped.
+func (in *statsdIngester) counterName(s statsdSample) (string, bool) {
+	name := s.Name
+	for _, k := range in.tagKeys {
+		if v, ok := s.Tags[k]; ok {
+			name += "." + v
+		}
+	}
+	for _, r := range in.rules {
+		if !r.match.MatchString(name) {
+			continue
+		}
+		if r.drop {
+			return "", false
+		}
+		name = r.match.ReplaceAllString(name, r.replacement)
+	}
+	return name, name != ""
+}
+
+func (in *statsdIngester) serveUDP(ctx context.Context, pc net.PacketConn) {
+	go func() { <-ctx.Done(); pc.Close() }()
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("StatsD ingestion: %v", err)
+			}
+			return
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			in.handle(line)
+		}
+	}
+}
+
+func (in *statsdIngester) serveTCP(ctx context.Context, l net.Listener) {
+	go func() { <-ctx.Done(); l.Close() }()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("StatsD ingestion: %v", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			sc := bufio.NewScanner(conn)
+			for sc.Scan() {
+				in.handle(sc.Text())
+			}
+		}()
+	}
+}
+
+// run flushes every interval, or early once a batch is waiting, and once
+// more on the way out.
+func (in *statsdIngester) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			in.flush(flushCtx)
+			cancel()
+			return
+		case <-t.C:
+		case <-in.full:
+		}
+		flushCtx, cancel := context.WithTimeout(ctx, interval+5*time.Second)
+		in.flush(flushCtx)
+		cancel()
+	}
+}
+
+// flush writes the whole part of each pending increment, in pipelines of
+// at most batch counters, so the Redis counters stay integers. Fractions
+// left by sample rates are set aside until more of the same counter
+// arrives, so they neither count towards a batch nor keep triggering
+// flushes; increments that failed wait for the next flush, as do those
+// to a counter the durability guard is refusing writes to.
+func (in *statsdIngester) flush(ctx context.Context) {
+	refusing := counterGuardian != nil && counterGuardian.refusing() != nil
+	in.mu.Lock()
+	whole := make(map[string]int64, len(in.pending))
+	for k, v := range in.pending {
+		if refusing && slices.Contains(durableCounters, k) {
+			counterWritesRefused.with().inc()
+			continue
+		}
+		delete(in.pending, k)
+		v += in.fractions[k]
+		n := math.Trunc(v)
+		if n != 0 {
+			whole[k] = int64(n)
+		}
+		_, held := in.fractions[k]
+		switch {
+		case v == n:
+			delete(in.fractions, k)
+		case held || len(in.fractions) < in.maxKeys:
+			in.fractions[k] = v - n
+		default:
+			statsdIngestFractionsDropped.with().inc()
+		}
+	}
+	in.mu.Unlock()
+
+	keys := sortedKeys(whole)
+	for len(keys) > 0 {
+		n := min(len(keys), in.batch)
+		chunk := make(map[string]int64, n)
+		for _, k := range keys[:n] {
+			chunk[k] = whole[k]
+		}
+		keys = keys[n:]
+		retry := in.sink.increment(ctx, chunk)
+		if len(retry) == 0 {
+			continue
+		}
+		statsdIngestErrors.with().add(float64(len(retry)))
+		in.mu.Lock()
+		for k, v := range retry {
+			in.pending[k] += float64(v)
+		}
+		in.mu.Unlock()
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestParseStatsDLine(t *testing.T) {
+	s, err := parseStatsDLine("legacy.visits:3|c|@0.5|#env:prod,region:eu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "legacy.visits" || s.Value != 3 || s.Type != "c" || s.Rate != 0.5 || s.Tags["region"] != "eu" {
+		t.Errorf("parsed %+v", s)
+	}
+	for _, bad := range []string{"novalue", ":1|c", "x:abc|c", "x:1", "x:1|c|@2", "x:NaN|c"} {
+		if _, err := parseStatsDLine(bad); err == nil {
+			t.Errorf("parseStatsDLine(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestStatsDRules(t *testing.T) {
+	rules, err := parseStatsDRules(`drop ^debug\.; rewrite ^legacy\.(\w+)$ app_$1; rewrite ^app_visits$ go_visit_counter`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newStatsDIngester(nil, rules, 10)
+	in.tagKeys = []string{"region"}
+	for _, c := range []struct {
+		name string
+		tags map[string]string
+		want string
+	}{
+		{"legacy.visits", nil, "go_visit_counter"},
+		{"legacy.logins", nil, "app_logins"},
+		{"legacy.logins", map[string]string{"region": "eu"}, "legacy.logins.eu"},
+		{"debug.noise", nil, ""},
+	} {
+		got, ok := in.counterName(statsdSample{Name: c.name, Tags: c.tags})
+		if c.want == "" && ok || got != c.want {
+			t.Errorf("counterName(%s %v) = %q, %v; want %q", c.name, c.tags, got, ok, c.want)
+		}
+	}
+	if _, err := parseStatsDRules("rename a b"); err == nil {
+		t.Error("unknown rule accepted")
+	}
+}
+
+// fakeSink records increments and fails the first call when asked to.
+type fakeSink struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	calls    []int
+	failOnce bool
+}
+
+func (s *fakeSink) increment(_ context.Context, deltas map[string]int64) map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, len(deltas))
+	if s.failOnce {
+		s.failOnce = false
+		return deltas
+	}
+	for k, v := range deltas {
+		s.counters[k] += v
+	}
+	return nil
+}
+
+func TestStatsDIngestOverUDPAndTCP(t *testing.T) {
+	sink := &fakeSink{counters: make(map[string]int64), failOnce: true}
+	rules, _ := parseStatsDRules(`drop ^debug\.`)
+	in := newStatsDIngester(sink, rules, 2)
+	in.keyPrefix = "statsd:"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go in.serveUDP(ctx, pc)
+	go in.serveTCP(ctx, l)
+
+	u, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	fmt.Fprint(u, "a:1|c\na:2|c\nb:1|c|@0.4\ndebug.x:5|c\nt:12|ms\ngarbage")
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(c, "a:4|c\nc:1|c\n")
+	c.Close()
+
+	// Wait for the listeners to take every line.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		in.mu.Lock()
+		n := len(in.pending)
+		a := in.pending["statsd:a"]
+		in.mu.Unlock()
+		if n == 3 && a == 7 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	in.flush(ctx) // fails, and is kept for the next flush
+	in.flush(ctx)
+	want := map[string]int64{"statsd:a": 7, "statsd:b": 2, "statsd:c": 1}
+	for k, v := range want {
+		if sink.counters[k] != v {
+			t.Errorf("%s = %d; want %d (all: %v)", k, sink.counters[k], v, sink.counters)
+		}
+	}
+	// b:1 at a 0.4 sample rate is 2.5: the half waits for more.
+	if in.fractions["statsd:b"] != 0.5 || len(in.pending) != 0 {
+		t.Errorf("fraction b = %v, pending %v; want 0.5 and nothing", in.fractions["statsd:b"], in.pending)
+	}
+	// Three counters in batches of two take two pipelines; the retry
+	// only carries the failed pipeline's two.
+	if fmt.Sprint(sink.calls) != "[2 1 2]" {
+		t.Errorf("pipeline sizes = %v; want [2 1 2]", sink.calls)
+	}
+}
+
+// With an empty key prefix a rewritten legacy counter adds to the one
+// go-app serves.
+func TestStatsDIngestIntoVisitCounter(t *testing.T) {
+	t.Setenv("STATSD_KEY_PREFIX", "")
+	rules, err := parseStatsDRules(`rewrite ^legacy\.visits$ go_visit_counter`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &fakeSink{counters: map[string]int64{"go_visit_counter": 41}}
+	in := newStatsDIngester(sink, rules, 10)
+	in.keyPrefix = statsdKeyPrefix()
+	in.handle("legacy.visits:2|c")
+	in.flush(context.Background())
+	if got := sink.counters["go_visit_counter"]; got != 43 {
+		t.Errorf("go_visit_counter = %d; want 43 (all: %v)", got, sink.counters)
+	}
+}
+
+// Fractions left by many sampled names must not fill the batch and make
+// every line trigger an empty flush.
+func TestStatsDIngestFractionsDoNotFillBatch(t *testing.T) {
+	sink := &fakeSink{counters: make(map[string]int64)}
+	in := newStatsDIngester(sink, nil, 2)
+	for _, name := range []string{"a", "b", "c"} {
+		in.handle(name + ":1|c|@0.4") // 2.5 each
+	}
+	<-in.full
+	in.flush(context.Background())
+	if len(in.pending) != 0 || len(in.fractions) != 3 {
+		t.Fatalf("pending %v, fractions %v", in.pending, in.fractions)
+	}
+	in.handle("a:1|c|@0.4")
+	select {
+	case <-in.full:
+		t.Error("one pending counter signalled a full batch")
+	default:
+	}
+	in.flush(context.Background())
+	if sink.counters["a"] != 5 || in.fractions["a"] != 0 {
+		t.Errorf("a = %d, fraction %v; want 5 and none", sink.counters["a"], in.fractions["a"])
+	}
+}
+
+// A sender inventing names cannot grow the pending counters or the held
+// fractions past maxKeys.
+func TestStatsDIngestMaxKeys(t *testing.T) {
+	sink := &fakeSink{counters: make(map[string]int64)}
+	in := newStatsDIngester(sink, nil, 10)
+	in.maxKeys = 2
+	for _, line := range []string{"a:1|c|@0.4", "b:1|c|@0.4", "c:1|c", "a:1|c"} {
+		in.handle(line)
+	}
+	if len(in.pending) != 2 || in.pending["a"] != 3.5 {
+		t.Fatalf("pending = %v; want a and b only, a at 3.5", in.pending)
+	}
+	in.flush(context.Background())
+	in.handle("c:1|c|@0.4")
+	in.flush(context.Background())
+	if len(in.fractions) != 2 || in.fractions["c"] != 0 {
+		t.Errorf("fractions = %v; want a and b only", in.fractions)
+	}
+	if sink.counters["c"] != 2 {
+		t.Errorf("c = %d; want its whole part written", sink.counters["c"])
+	}
+}
+
+// Ingested increments to go_visit_counter go through the durability
+// guard like /counter's own.
+func TestStatsDIngestGuardedCounter(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: fakeRedis(t)})
+	defer client.Close()
+	g := newCounterGuard(&fakeCounterStore{values: map[string]int64{}}, "refuse", "")
+	g.lost = &counterLoss{Reason: "epoch_missing"}
+	counterGuardian = g
+	defer func() { counterGuardian = nil }()
+
+	in := newStatsDIngester(redisCounterSink{client}, nil, 10)
+	in.handle("go_visit_counter:3|c")
+	in.handle("other:1|c")
+	ctx := context.Background()
+	in.flush(ctx)
+	if in.pending["go_visit_counter"] != 3 || len(in.pending) != 1 {
+		t.Fatalf("pending = %v; want go_visit_counter held while writes are refused", in.pending)
+	}
+
+	g.lost = nil
+	in.flush(ctx)
+	if len(in.pending) != 0 || g.high["go_visit_counter"] != 3 {
+		t.Errorf("pending %v, high %d; want the increment written and noted", in.pending, g.high["go_visit_counter"])
+	}
+}